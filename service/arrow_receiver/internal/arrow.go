@@ -1,51 +1,92 @@
 package internal
 
 import (
-	"context"
 	"encoding/json"
 	"strconv"
 
-	"database/sql"
-
-	log "github.com/sirupsen/logrus"
+	arrowrecord "github.com/open-telemetry/otel-arrow/pkg/otel/arrow_record"
+	plog "go.opentelemetry.io/collector/pdata/plog"
 	pmetric "go.opentelemetry.io/collector/pdata/pmetric"
+	ptrace "go.opentelemetry.io/collector/pdata/ptrace"
 
 	arrowpb "github.com/open-telemetry/otel-arrow/api/experimental/arrow/v1"
 )
 
-func ProcessTracesBatch(ctx context.Context, db *sql.DB, batch *arrowpb.BatchArrowRecords) error {
-	traces, err := ArrowToOtlpTraces(batch)
-	if err != nil {
-		log.WithError(err).Error("Error converting Arrow to OTLP traces")
-		return err
-	}
-	if err := EnsureTracesTableExists(ctx, db); err != nil {
-		return err
+// RowBatch holds the table rows decoded from one BatchArrowRecords.
+type RowBatch struct {
+	Traces  []TraceRow
+	Logs    []LogRow
+	Metrics []MetricRow
+}
+
+// Len is the total number of rows in the batch.
+func (b RowBatch) Len() int {
+	return len(b.Traces) + len(b.Logs) + len(b.Metrics)
+}
+
+// DecodeBatch converts an Arrow batch of the given signal into table rows
+// owned by tenant, with the processing rules applied. The consumer must be
+// the one of the stream the batch arrived on, since Arrow schemas and
+// dictionaries are shared across batches.
+func DecodeBatch(consumer *arrowrecord.Consumer, signal Signal, batch *arrowpb.BatchArrowRecords, tenant string, processor *Processor) (RowBatch, error) {
+	var rows RowBatch
+	switch signal {
+	case SignalTraces:
+		traces, err := ArrowToOtlpTraces(consumer, batch)
+		if err != nil {
+			return rows, err
+		}
+		for _, t := range traces {
+			processor.Traces(t)
+			rows.Traces = append(rows.Traces, TracesToRows(t, tenant)...)
+		}
+	case SignalLogs:
+		logs, err := ArrowToOtlpLogs(consumer, batch)
+		if err != nil {
+			return rows, err
+		}
+		for _, l := range logs {
+			processor.Logs(l)
+			rows.Logs = append(rows.Logs, LogsToRows(l, tenant)...)
+		}
+	case SignalMetrics:
+		metrics, err := ArrowToOtlpMetrics(consumer, batch)
+		if err != nil {
+			return rows, err
+		}
+		for _, m := range metrics {
+			processor.Metrics(m)
+			rows.Metrics = append(rows.Metrics, MetricsToRows(m, tenant)...)
+		}
 	}
-	// Save each span to DB
+	return rows, nil
+}
+
+// TracesToRows flattens traces into one row per span.
+func TracesToRows(traces ptrace.Traces, tenant string) []TraceRow {
+	rows := make([]TraceRow, 0, traces.SpanCount())
 	rl := traces.ResourceSpans()
 	for i := 0; i < rl.Len(); i++ {
 		rs := rl.At(i)
 		resourceJSON, _ := json.Marshal(rs.Resource().Attributes().AsRaw())
-		scopeJSON, _ := json.Marshal(rs.ScopeSpans().At(0).Scope().Attributes().AsRaw())
 		schemaURL := rs.SchemaUrl()
 		sl := rs.ScopeSpans()
 		for j := 0; j < sl.Len(); j++ {
 			scope := sl.At(j)
+			scopeJSON, _ := json.Marshal(scope.Scope().Attributes().AsRaw())
 			spans := scope.Spans()
 			for k := 0; k < spans.Len(); k++ {
 				span := spans.At(k)
-				attrsBytes, _ := json.Marshal(span.Attributes().AsRaw())
-				attrsJSON := string(attrsBytes)
+				attrsJSON, _ := json.Marshal(span.Attributes().AsRaw())
 
 				// Serialize events
 				events := make([]map[string]interface{}, span.Events().Len())
 				for ei := 0; ei < span.Events().Len(); ei++ {
 					e := span.Events().At(ei)
 					events[ei] = map[string]interface{}{
-						"name": e.Name(),
-						"time_unix_nano": e.Timestamp().String(),
-						"attributes": e.Attributes().AsRaw(),
+						"name":                     e.Name(),
+						"time_unix_nano":           e.Timestamp().String(),
+						"attributes":               e.Attributes().AsRaw(),
 						"dropped_attributes_count": e.DroppedAttributesCount(),
 					}
 				}
@@ -56,170 +97,115 @@ func ProcessTracesBatch(ctx context.Context, db *sql.DB, batch *arrowpb.BatchArr
 				for li := 0; li < span.Links().Len(); li++ {
 					l := span.Links().At(li)
 					links[li] = map[string]interface{}{
-						"trace_id": l.TraceID().String(),
-						"span_id": l.SpanID().String(),
-						"trace_state": l.TraceState().AsRaw(),
-						"attributes": l.Attributes().AsRaw(),
+						"trace_id":                 l.TraceID().String(),
+						"span_id":                  l.SpanID().String(),
+						"trace_state":              l.TraceState().AsRaw(),
+						"attributes":               l.Attributes().AsRaw(),
 						"dropped_attributes_count": l.DroppedAttributesCount(),
 					}
 				}
 				linksJSON, _ := json.Marshal(links)
 
-				parentSpanID := span.ParentSpanID().String()
-				kind := int(span.Kind())
-				traceState := span.TraceState().AsRaw()
 				status := span.Status()
-				statusCode := int(status.Code())
-				statusMessage := status.Message()
-				droppedAttrs := int(span.DroppedAttributesCount())
-				droppedEvents := int(span.DroppedEventsCount())
-				droppedLinks := int(span.DroppedLinksCount())
-				startTime := span.StartTimestamp().String()
-				endTime := span.EndTimestamp().String()
-				if err := InsertTraceRow(ctx, db,
-					span.TraceID().String(),
-					span.SpanID().String(),
-					parentSpanID,
-					span.Name(),
-					kind,
-					traceState,
-					statusCode,
-					statusMessage,
-					string(resourceJSON),
-					attrsJSON,
-					startTime,
-					endTime,
-					droppedAttrs,
-					droppedEvents,
-					droppedLinks,
-					string(eventsJSON),
-					string(linksJSON),
-					string(scopeJSON),
-					schemaURL,
-				); err != nil {
-					log.WithError(err).Error("Error inserting trace row")
-				}
+				rows = append(rows, TraceRow{
+					TraceID:       span.TraceID().String(),
+					SpanID:        span.SpanID().String(),
+					ParentSpanID:  span.ParentSpanID().String(),
+					Name:          span.Name(),
+					Kind:          int(span.Kind()),
+					TraceState:    span.TraceState().AsRaw(),
+					StatusCode:    int(status.Code()),
+					StatusMessage: status.Message(),
+					Resource:      string(resourceJSON),
+					Attributes:    string(attrsJSON),
+					StartTime:     span.StartTimestamp().String(),
+					EndTime:       span.EndTimestamp().String(),
+					DroppedAttrs:  int(span.DroppedAttributesCount()),
+					DroppedEvents: int(span.DroppedEventsCount()),
+					DroppedLinks:  int(span.DroppedLinksCount()),
+					Events:        string(eventsJSON),
+					Links:         string(linksJSON),
+					Scope:         string(scopeJSON),
+					SchemaURL:     schemaURL,
+					TenantID:      tenant,
+				})
 			}
 		}
 	}
-	return nil
+	return rows
 }
 
-func ProcessLogsBatch(ctx context.Context, db *sql.DB, batch *arrowpb.BatchArrowRecords) error {
-	logs, err := ArrowToOtlpLogs(batch)
-	if err != nil {
-		log.WithError(err).Error("Error converting Arrow to OTLP logs")
-		return err
-	}
-	if err := EnsureLogsTableExists(ctx, db); err != nil {
-		return err
-	}
+// LogsToRows flattens logs into one row per log record.
+func LogsToRows(logs plog.Logs, tenant string) []LogRow {
+	rows := make([]LogRow, 0, logs.LogRecordCount())
 	rl := logs.ResourceLogs()
 	for i := 0; i < rl.Len(); i++ {
 		rs := rl.At(i)
 		resourceJSON, _ := json.Marshal(rs.Resource().Attributes().AsRaw())
-		scopeJSON, _ := json.Marshal(rs.ScopeLogs().At(0).Scope().Attributes().AsRaw())
 		schemaURL := rs.SchemaUrl()
 		sl := rs.ScopeLogs()
 		for j := 0; j < sl.Len(); j++ {
 			scope := sl.At(j)
+			scopeJSON, _ := json.Marshal(scope.Scope().Attributes().AsRaw())
 			logRecords := scope.LogRecords()
 			for k := 0; k < logRecords.Len(); k++ {
 				logrec := logRecords.At(k)
-				attrsBytes, _ := json.Marshal(logrec.Attributes().AsRaw())
-				attrsJSON := string(attrsBytes)
-				logID := logrec.TraceID().String() + logrec.SpanID().String()
-				timeUnixNano := logrec.Timestamp().String()
-				observedTimeUnixNano := logrec.ObservedTimestamp().String()
-				severityNumber := int(logrec.SeverityNumber())
-				severityText := logrec.SeverityText()
-				body := logrec.Body().AsString()
-				droppedAttrs := int(logrec.DroppedAttributesCount())
-				flags := int(logrec.Flags())
-				traceID := logrec.TraceID().String()
-				spanID := logrec.SpanID().String()
-				if err := InsertLogRow(ctx, db,
-					logID,
-					string(resourceJSON),
-					timeUnixNano,
-					observedTimeUnixNano,
-					severityNumber,
-					severityText,
-					body,
-					attrsJSON,
-					droppedAttrs,
-					flags,
-					traceID,
-					spanID,
-					string(scopeJSON),
-					schemaURL,
-				); err != nil {
-					log.WithError(err).Error("Error inserting log row")
-				}
+				attrsJSON, _ := json.Marshal(logrec.Attributes().AsRaw())
+				rows = append(rows, LogRow{
+					LogID:                logrec.TraceID().String() + logrec.SpanID().String(),
+					Resource:             string(resourceJSON),
+					TimeUnixNano:         logrec.Timestamp().String(),
+					ObservedTimeUnixNano: logrec.ObservedTimestamp().String(),
+					SeverityNumber:       int(logrec.SeverityNumber()),
+					SeverityText:         logrec.SeverityText(),
+					Body:                 logrec.Body().AsString(),
+					Attributes:           string(attrsJSON),
+					DroppedAttrs:         int(logrec.DroppedAttributesCount()),
+					Flags:                int(logrec.Flags()),
+					TraceID:              logrec.TraceID().String(),
+					SpanID:               logrec.SpanID().String(),
+					Scope:                string(scopeJSON),
+					SchemaURL:            schemaURL,
+					TenantID:             tenant,
+				})
 			}
 		}
 	}
-	return nil
+	return rows
 }
 
-func ProcessMetricsBatch(ctx context.Context, db *sql.DB, batch *arrowpb.BatchArrowRecords) error {
-	metrics, err := ArrowToOtlpMetrics(batch)
-	if err != nil {
-		log.WithError(err).Error("Error converting Arrow to OTLP metrics")
-		return err
-	}
-	if err := EnsureMetricsTableExists(ctx, db); err != nil {
-		return err
-	}
+// MetricsToRows flattens sum and gauge metrics into one row per data point.
+func MetricsToRows(metrics pmetric.Metrics, tenant string) []MetricRow {
+	rows := make([]MetricRow, 0, metrics.DataPointCount())
 	rl := metrics.ResourceMetrics()
 	for i := 0; i < rl.Len(); i++ {
 		rs := rl.At(i)
 		resourceJSON, _ := json.Marshal(rs.Resource().Attributes().AsRaw())
-		scopeJSON, _ := json.Marshal(rs.ScopeMetrics().At(0).Scope().Attributes().AsRaw())
 		schemaURL := rs.SchemaUrl()
-		metricsSlice := rs.ScopeMetrics().At(0).Metrics()
-		for j := 0; j < metricsSlice.Len(); j++ {
-			metric := metricsSlice.At(j)
-			name := metric.Name()
-			unit := metric.Unit()
-			description := metric.Description()
-			aggTemporality := 0
-			isMonotonic := false
-			attrsJSON := "{}"
-			if metric.Type() == pmetric.MetricTypeSum {
-				aggTemporality = int(metric.Sum().AggregationTemporality())
-				isMonotonic = metric.Sum().IsMonotonic()
-				dps := metric.Sum().DataPoints()
-				for l := 0; l < dps.Len(); l++ {
-					dp := dps.At(l)
-					value := ""
-					switch dp.ValueType() {
-					case pmetric.NumberDataPointValueTypeInt:
-						value = strconv.FormatInt(dp.IntValue(), 10)
-					case pmetric.NumberDataPointValueTypeDouble:
-						value = strconv.FormatFloat(dp.DoubleValue(), 'f', -1, 64)
-					}
-					attrsBytes, _ := json.Marshal(dp.Attributes().AsRaw())
-					attrsJSON = string(attrsBytes)
-					if err := InsertMetricRow(ctx, db,
-						string(resourceJSON),
-						name,
-						unit,
-						description,
-						dp.StartTimestamp().String(),
-						dp.Timestamp().String(),
-						value,
-						aggTemporality,
-						isMonotonic,
-						attrsJSON,
-						string(scopeJSON),
-						schemaURL,
-					); err != nil {
-						log.WithError(err).Error("Error inserting metric row")
-					}
+		sl := rs.ScopeMetrics()
+		for j := 0; j < sl.Len(); j++ {
+			scope := sl.At(j)
+			scopeJSON, _ := json.Marshal(scope.Scope().Attributes().AsRaw())
+			metricsSlice := scope.Metrics()
+			for k := 0; k < metricsSlice.Len(); k++ {
+				metric := metricsSlice.At(k)
+				var dps pmetric.NumberDataPointSlice
+				aggTemporality := 0
+				isMonotonic := false
+				switch metric.Type() {
+				case pmetric.MetricTypeSum:
+					aggTemporality = int(metric.Sum().AggregationTemporality())
+					isMonotonic = metric.Sum().IsMonotonic()
+					dps = metric.Sum().DataPoints()
+				case pmetric.MetricTypeGauge:
+					dps = metric.Gauge().DataPoints()
+				case pmetric.MetricTypeHistogram:
+					rows = append(rows, histogramRows(metric, string(resourceJSON), string(scopeJSON), schemaURL, tenant)...)
+					continue
+				default:
+					// Add support for other metric types as needed
+					continue
 				}
-			} else if metric.Type() == pmetric.MetricTypeGauge {
-				dps := metric.Gauge().DataPoints()
 				for l := 0; l < dps.Len(); l++ {
 					dp := dps.At(l)
 					value := ""
@@ -229,28 +215,77 @@ func ProcessMetricsBatch(ctx context.Context, db *sql.DB, batch *arrowpb.BatchAr
 					case pmetric.NumberDataPointValueTypeDouble:
 						value = strconv.FormatFloat(dp.DoubleValue(), 'f', -1, 64)
 					}
-					attrsBytes, _ := json.Marshal(dp.Attributes().AsRaw())
-					attrsJSON = string(attrsBytes)
-					if err := InsertMetricRow(ctx, db,
-						string(resourceJSON),
-						name,
-						unit,
-						description,
-						dp.StartTimestamp().String(),
-						dp.Timestamp().String(),
-						value,
-						aggTemporality,
-						isMonotonic,
-						attrsJSON,
-						string(scopeJSON),
-						schemaURL,
-					); err != nil {
-						log.WithError(err).Error("Error inserting metric row")
-					}
+					attrsJSON, _ := json.Marshal(dp.Attributes().AsRaw())
+					rows = append(rows, MetricRow{
+						Resource:       string(resourceJSON),
+						Name:           metric.Name(),
+						Unit:           metric.Unit(),
+						Description:    metric.Description(),
+						StartTime:      dp.StartTimestamp().String(),
+						Time:           dp.Timestamp().String(),
+						Value:          value,
+						AggTemporality: aggTemporality,
+						IsMonotonic:    isMonotonic,
+						Attributes:     string(attrsJSON),
+						Scope:          string(scopeJSON),
+						SchemaURL:      schemaURL,
+						TenantID:       tenant,
+					})
 				}
 			}
-			// Add support for other metric types as needed
 		}
 	}
-	return nil
-} 
+	return rows
+}
+
+// histogramRows stores histogram data points the way Prometheus exposes
+// them: cumulative _bucket counters labelled with their upper bound le, plus
+// _sum and _count, so histogram_quantile works on them.
+func histogramRows(metric pmetric.Metric, resourceJSON, scopeJSON, schemaURL, tenant string) []MetricRow {
+	hist := metric.Histogram()
+	var rows []MetricRow
+	for i := 0; i < hist.DataPoints().Len(); i++ {
+		dp := hist.DataPoints().At(i)
+		row := func(suffix, value string, attrs map[string]interface{}) MetricRow {
+			attrsJSON, _ := json.Marshal(attrs)
+			return MetricRow{
+				Resource:       resourceJSON,
+				Name:           metric.Name() + suffix,
+				Unit:           metric.Unit(),
+				Description:    metric.Description(),
+				StartTime:      dp.StartTimestamp().String(),
+				Time:           dp.Timestamp().String(),
+				Value:          value,
+				AggTemporality: int(hist.AggregationTemporality()),
+				IsMonotonic:    true,
+				Attributes:     string(attrsJSON),
+				Scope:          scopeJSON,
+				SchemaURL:      schemaURL,
+				TenantID:       tenant,
+			}
+		}
+		var cumulative uint64
+		bounds, counts := dp.ExplicitBounds(), dp.BucketCounts()
+		for b := 0; b < counts.Len(); b++ {
+			cumulative += counts.At(b)
+			le := "+Inf"
+			if b < bounds.Len() {
+				le = strconv.FormatFloat(bounds.At(b), 'f', -1, 64)
+			}
+			attrs := dp.Attributes().AsRaw()
+			attrs["le"] = le
+			rows = append(rows, row("_bucket", strconv.FormatUint(cumulative, 10), attrs))
+		}
+		if counts.Len() == bounds.Len() {
+			// Without the overflow bucket, +Inf is the total count.
+			attrs := dp.Attributes().AsRaw()
+			attrs["le"] = "+Inf"
+			rows = append(rows, row("_bucket", strconv.FormatUint(dp.Count(), 10), attrs))
+		}
+		if dp.HasSum() {
+			rows = append(rows, row("_sum", strconv.FormatFloat(dp.Sum(), 'f', -1, 64), dp.Attributes().AsRaw()))
+		}
+		rows = append(rows, row("_count", strconv.FormatUint(dp.Count(), 10), dp.Attributes().AsRaw()))
+	}
+	return rows
+}
@@ -10,46 +10,19 @@ import (
 )
 
 // ArrowToOtlpLogs converts Arrow BatchArrowRecords to OTLP plog.Logs using the official otel-arrow consumer.
-// Returns the first Logs object in the batch (usually only one is present).
-func ArrowToOtlpLogs(batch *arrowpb.BatchArrowRecords) (plog.Logs, error) {
-	consumer := arrowrecord.NewConsumer()
-	defer consumer.Close()
-	logs, err := consumer.LogsFrom(batch)
-	if err != nil {
-		return plog.Logs{}, err
-	}
-	if len(logs) == 0 {
-		return plog.Logs{}, nil
-	}
-	return logs[0], nil
+// The consumer keeps the Arrow IPC state of the stream and must see its batches in order.
+func ArrowToOtlpLogs(consumer *arrowrecord.Consumer, batch *arrowpb.BatchArrowRecords) ([]plog.Logs, error) {
+	return consumer.LogsFrom(batch)
 }
 
 // ArrowToOtlpMetrics converts Arrow BatchArrowRecords to OTLP pmetric.Metrics using the official otel-arrow consumer.
-// Returns the first Metrics object in the batch (usually only one is present).
-func ArrowToOtlpMetrics(batch *arrowpb.BatchArrowRecords) (pmetric.Metrics, error) {
-	consumer := arrowrecord.NewConsumer()
-	defer consumer.Close()
-	metrics, err := consumer.MetricsFrom(batch)
-	if err != nil {
-		return pmetric.Metrics{}, err
-	}
-	if len(metrics) == 0 {
-		return pmetric.Metrics{}, nil
-	}
-	return metrics[0], nil
+// The consumer keeps the Arrow IPC state of the stream and must see its batches in order.
+func ArrowToOtlpMetrics(consumer *arrowrecord.Consumer, batch *arrowpb.BatchArrowRecords) ([]pmetric.Metrics, error) {
+	return consumer.MetricsFrom(batch)
 }
 
 // ArrowToOtlpTraces converts Arrow BatchArrowRecords to OTLP ptrace.Traces using the official otel-arrow consumer.
-// Returns the first Traces object in the batch (usually only one is present).
-func ArrowToOtlpTraces(batch *arrowpb.BatchArrowRecords) (ptrace.Traces, error) {
-	consumer := arrowrecord.NewConsumer()
-	defer consumer.Close()
-	traces, err := consumer.TracesFrom(batch)
-	if err != nil {
-		return ptrace.Traces{}, err
-	}
-	if len(traces) == 0 {
-		return ptrace.Traces{}, nil
-	}
-	return traces[0], nil
+// The consumer keeps the Arrow IPC state of the stream and must see its batches in order.
+func ArrowToOtlpTraces(consumer *arrowrecord.Consumer, batch *arrowpb.BatchArrowRecords) ([]ptrace.Traces, error) {
+	return consumer.TracesFrom(batch)
 }
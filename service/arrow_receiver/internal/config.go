@@ -1,32 +1,460 @@
 package internal
 
 import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
 	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 type Config struct {
+	// ConfigFile is the file the configuration was read from, if any.
+	ConfigFile string
+	// ConfigWatchInterval is how often the configuration and TLS files are
+	// checked for changes, which reload them like SIGHUP. Zero disables it.
+	ConfigWatchInterval time.Duration
+
 	GRPCPort string
+	// HTTPPort is the listen address of the HTTP query API.
+	HTTPPort string
 	DBPath   string
+	// TLSCertFile and TLSKeyFile enable TLS on the gRPC, Flight SQL and HTTP
+	// listeners. With TLSClientCAFile, clients must present a certificate
+	// signed by one of its CAs.
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
+	// GRPCMaxRecvMsgBytes is the largest gRPC message the server accepts.
+	GRPCMaxRecvMsgBytes int
+	// GRPCMaxConcurrentStreams limits streams per connection. Zero means no limit.
+	GRPCMaxConcurrentStreams int
+	// GRPCKeepaliveMinTime is the shortest client ping interval tolerated;
+	// clients pinging more often are disconnected.
+	GRPCKeepaliveMinTime time.Duration
+	// GRPCKeepalivePermitWithoutStream allows client pings on idle connections.
+	GRPCKeepalivePermitWithoutStream bool
+	// GRPCKeepaliveTime and GRPCKeepaliveTimeout control server pings on idle
+	// connections. Zero uses the gRPC defaults.
+	GRPCKeepaliveTime    time.Duration
+	GRPCKeepaliveTimeout time.Duration
+	// GRPCMaxConnectionIdle closes connections without streams after this long.
+	GRPCMaxConnectionIdle time.Duration
+	// GRPCMaxConnectionAge is the maximum lifetime of a connection. Streams on
+	// it are ended when it is reached and get GRPCMaxConnectionAgeGrace to
+	// finish. Zero means no limit.
+	GRPCMaxConnectionAge      time.Duration
+	GRPCMaxConnectionAgeGrace time.Duration
+	// GRPCReflection registers the gRPC reflection service for tools like grpcurl.
+	GRPCReflection bool
+	// HealthCheckInterval is how often DuckDB and the ingest queues are checked.
+	HealthCheckInterval time.Duration
+	// StreamIdleTimeout ends streams that send no batch for this long. Zero
+	// disables it.
+	StreamIdleTimeout time.Duration
+	// ShutdownTimeout bounds draining streams and flushing storage on
+	// SIGINT or SIGTERM.
+	ShutdownTimeout time.Duration
+
+	// TenantHeader is the gRPC metadata / HTTP header carrying the tenant ID
+	// when no API key is presented.
+	TenantHeader string
+	// TenantKeys maps API keys (sent as "Authorization: Bearer <key>") to tenant IDs.
+	// When non-empty, every caller must present a known key.
+	TenantKeys map[string]string
+	// AdminKeys are API keys whose /query requests see all tenants and may
+	// write when they ask for it.
+	AdminKeys map[string]bool
+
+	// QueryTimeout bounds the run time of a /query request, including the
+	// wait for a free slot.
+	QueryTimeout time.Duration
+	// QueryMaxRows and QueryMaxBytes cap the rows and JSON bytes returned by
+	// /query; larger results are truncated.
+	QueryMaxRows  int
+	QueryMaxBytes int64
+	// QueryMaxConcurrent limits the queries running at once.
+	QueryMaxConcurrent int
+	// CORSAllowedOrigins are the web origins, besides the query API's own,
+	// whose pages may call the query API. "*" allows every origin.
+	CORSAllowedOrigins []string
+	// NamedQueriesFile holds the named query registry as a JSON array.
+	// Empty keeps named queries in memory only.
+	NamedQueriesFile string
+	// FlightSQL serves the Arrow Flight SQL service.
+	FlightSQL bool
+	// FlightSQLPort serves Flight SQL on its own listener. Empty registers it
+	// on the ingestion gRPC server.
+	FlightSQLPort string
+	// TenantQuotaBytesPerSec limits the Arrow payload bytes each tenant may ingest
+	// per second. Zero disables the quota.
+	TenantQuotaBytesPerSec int64
+	// TenantQuotaBurstBytes is the bucket size of the per-tenant quota.
+	TenantQuotaBurstBytes int64
+
+	// QueueSize bounds the batches waiting for decode and for storage.
+	QueueSize int
+	// DecodeWorkers is the number of goroutines converting Arrow to rows.
+	DecodeWorkers int
+	// WriterBatchRows caps the rows the DuckDB writer commits per transaction.
+	WriterBatchRows int
+
+	// WALDir holds the write-ahead log. Empty disables it.
+	WALDir string
+	// WALSegmentBytes is the size at which a new WAL segment is started.
+	WALSegmentBytes int64
+	// WALMaxBytes bounds the uncommitted WAL; batches beyond it are rejected.
+	WALMaxBytes int64
+	// Retention deletes telemetry older than this every RetentionInterval.
+	// Zero keeps everything.
+	Retention         time.Duration
+	RetentionInterval time.Duration
+
+	// MemoryLimitBytes bounds the payload of in-flight batches plus the Arrow
+	// memory of all stream consumers. Zero disables the limit.
+	MemoryLimitBytes int64
+	// MemoryWait is how long a batch waits for memory before it is rejected.
+	MemoryWait time.Duration
+	// StreamMemoryLimitBytes caps the Arrow allocator of a single stream.
+	StreamMemoryLimitBytes int64
+
+	// SearchAttributes are the log attributes indexed for full-text search
+	// along with the body.
+	SearchAttributes []string
+
+	// DropAttributes are attribute keys removed from received telemetry
+	// before it is stored; RedactAttributes are keys whose values are
+	// replaced by "[REDACTED]".
+	DropAttributes   []string
+	RedactAttributes []string
+
+	// LiveTailMaxClients limits the clients of /api/v1/tail. Zero disables it.
+	LiveTailMaxClients int
+	// LiveTailBufferBatches is the number of decoded batches buffered for each
+	// live-tail client; batches arriving while it is full are dropped for it.
+	LiveTailBufferBatches int
+
+	// SelfTracing traces the receiver's own work into its traces table, as
+	// SelfTracingServiceName of SelfTracingTenant. SelfTracingSampleRatio is
+	// the share of batches and requests traced.
+	SelfTracing            bool
+	SelfTracingServiceName string
+	SelfTracingTenant      string
+	SelfTracingSampleRatio float64
+
+	// LogLevel is a logrus level name and LogFormat is text or json.
+	LogLevel  string
+	LogFormat string
+	// LogPayloadSampleRatio is the share of received batches whose Arrow
+	// payload is logged; only at debug level.
+	LogPayloadSampleRatio float64
 }
 
-func LoadConfig() Config {
-	port := os.Getenv("ARROW_RECEIVER_GRPC_PORT")
-	if port == "" {
-		port = ":9002"
+// defaultConfig holds the settings used when neither the configuration file,
+// the environment nor a flag sets them.
+func defaultConfig() Config {
+	return Config{
+		GRPCPort:                         ":9002",
+		HTTPPort:                         ":8080",
+		DBPath:                           "traces.db",
+		TenantHeader:                     "x-tenant-id",
+		TenantKeys:                       map[string]string{},
+		AdminKeys:                        map[string]bool{},
+		QueryTimeout:                     30 * time.Second,
+		QueryMaxRows:                     10000,
+		QueryMaxBytes:                    16 << 20,
+		QueryMaxConcurrent:               4,
+		FlightSQL:                        true,
+		QueueSize:                        64,
+		DecodeWorkers:                    runtime.NumCPU(),
+		WriterBatchRows:                  10000,
+		WALDir:                           "wal",
+		WALSegmentBytes:                  64 << 20,
+		WALMaxBytes:                      1 << 30,
+		RetentionInterval:                time.Hour,
+		GRPCMaxRecvMsgBytes:              4 << 20,
+		GRPCKeepaliveMinTime:             10 * time.Second,
+		GRPCKeepalivePermitWithoutStream: true,
+		GRPCReflection:                   true,
+		HealthCheckInterval:              5 * time.Second,
+		ShutdownTimeout:                  30 * time.Second,
+		SelfTracingServiceName:           "arrow-receiver",
+		SelfTracingTenant:                DefaultTenant,
+		SelfTracingSampleRatio:           1,
+		MemoryLimitBytes:                 512 << 20,
+		MemoryWait:                       5 * time.Second,
+		StreamMemoryLimitBytes:           70 << 20,
+		SearchAttributes:                 []string{"exception.message"},
+		LiveTailMaxClients:               16,
+		LiveTailBufferBatches:            64,
+		LogLevel:                         "info",
+		LogFormat:                        "text",
 	}
-	dbPath := os.Getenv("ARROW_RECEIVER_DB_PATH")
-	if dbPath == "" {
-		dbPath = "traces.db"
+}
+
+// configFlags are the settings that can be given on the command line, by
+// flag name.
+var configFlags = map[string]struct {
+	usage string
+	field func(*Config) *string
+}{
+	"grpc-port":       {"gRPC listen address", func(c *Config) *string { return &c.GRPCPort }},
+	"http-port":       {"HTTP query API listen address", func(c *Config) *string { return &c.HTTPPort }},
+	"flight-sql-port": {"Flight SQL listen address, empty to share the gRPC one", func(c *Config) *string { return &c.FlightSQLPort }},
+	"db-path":         {"DuckDB database file", func(c *Config) *string { return &c.DBPath }},
+	"wal-dir":         {"write-ahead log directory, empty to disable it", func(c *Config) *string { return &c.WALDir }},
+	"log-level":       {"log level: trace, debug, info, warn or error", func(c *Config) *string { return &c.LogLevel }},
+	"log-format":      {"log format: text or json", func(c *Config) *string { return &c.LogFormat }},
+}
+
+// LoadConfig builds the configuration from the command-line arguments. The
+// file named by --config, or ARROW_RECEIVER_CONFIG, overrides the defaults,
+// environment variables override the file and flags override both. The
+// result is validated.
+func LoadConfig(args []string) (Config, error) {
+	fs := flag.NewFlagSet("arrow_receiver", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("ARROW_RECEIVER_CONFIG"), "YAML or JSON configuration file")
+	for name, f := range configFlags {
+		fs.String(name, "", f.usage)
 	}
-	return Config{
-		GRPCPort: port,
-		DBPath:   dbPath,
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+	if fs.NArg() > 0 {
+		return Config{}, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	cfg := defaultConfig()
+	if *path != "" {
+		if err := cfg.loadFile(*path); err != nil {
+			return Config{}, err
+		}
+		cfg.ConfigFile = *path
+	}
+	envErr := cfg.loadEnv()
+	fs.Visit(func(f *flag.Flag) {
+		if cf, ok := configFlags[f.Name]; ok {
+			*cf.field(&cfg) = f.Value.String()
+		}
+	})
+	cfg.TenantHeader = strings.ToLower(cfg.TenantHeader)
+	return cfg, errors.Join(envErr, cfg.Validate())
+}
+
+// loadEnv overrides the settings that have an environment variable set. It
+// reports every malformed variable.
+func (c *Config) loadEnv() error {
+	env := &envReader{}
+	c.GRPCPort = env.string("ARROW_RECEIVER_GRPC_PORT", c.GRPCPort)
+	c.HTTPPort = env.string("ARROW_RECEIVER_HTTP_PORT", c.HTTPPort)
+	c.DBPath = env.string("ARROW_RECEIVER_DB_PATH", c.DBPath)
+	c.TLSCertFile = env.string("ARROW_RECEIVER_TLS_CERT_FILE", c.TLSCertFile)
+	c.TLSKeyFile = env.string("ARROW_RECEIVER_TLS_KEY_FILE", c.TLSKeyFile)
+	c.TLSClientCAFile = env.string("ARROW_RECEIVER_TLS_CLIENT_CA_FILE", c.TLSClientCAFile)
+	c.TenantHeader = env.string("ARROW_RECEIVER_TENANT_HEADER", c.TenantHeader)
+	c.TenantKeys = env.tenantKeys("ARROW_RECEIVER_TENANT_KEYS", c.TenantKeys)
+	c.AdminKeys = env.keySet("ARROW_RECEIVER_ADMIN_KEYS", c.AdminKeys)
+	c.QueryTimeout = env.duration("ARROW_RECEIVER_QUERY_TIMEOUT", c.QueryTimeout)
+	c.QueryMaxRows = env.int("ARROW_RECEIVER_QUERY_MAX_ROWS", c.QueryMaxRows)
+	c.QueryMaxBytes = env.int64("ARROW_RECEIVER_QUERY_MAX_BYTES", c.QueryMaxBytes)
+	c.QueryMaxConcurrent = env.int("ARROW_RECEIVER_QUERY_MAX_CONCURRENT", c.QueryMaxConcurrent)
+	c.CORSAllowedOrigins = env.list("ARROW_RECEIVER_CORS_ALLOWED_ORIGINS", c.CORSAllowedOrigins)
+	c.NamedQueriesFile = env.string("ARROW_RECEIVER_NAMED_QUERIES_FILE", c.NamedQueriesFile)
+	c.FlightSQL = env.bool("ARROW_RECEIVER_FLIGHT_SQL", c.FlightSQL)
+	c.FlightSQLPort = env.string("ARROW_RECEIVER_FLIGHT_SQL_PORT", c.FlightSQLPort)
+	c.TenantQuotaBytesPerSec = env.int64("ARROW_RECEIVER_TENANT_QUOTA_BYTES_PER_SEC", c.TenantQuotaBytesPerSec)
+	c.TenantQuotaBurstBytes = env.int64("ARROW_RECEIVER_TENANT_QUOTA_BURST_BYTES", c.TenantQuotaBurstBytes)
+	c.QueueSize = env.int("ARROW_RECEIVER_QUEUE_SIZE", c.QueueSize)
+	c.DecodeWorkers = env.int("ARROW_RECEIVER_DECODE_WORKERS", c.DecodeWorkers)
+	c.WriterBatchRows = env.int("ARROW_RECEIVER_WRITER_BATCH_ROWS", c.WriterBatchRows)
+	if v, ok := os.LookupEnv("ARROW_RECEIVER_WAL_DIR"); ok {
+		c.WALDir = v
+	}
+	c.WALSegmentBytes = env.int64("ARROW_RECEIVER_WAL_SEGMENT_BYTES", c.WALSegmentBytes)
+	c.WALMaxBytes = env.int64("ARROW_RECEIVER_WAL_MAX_BYTES", c.WALMaxBytes)
+	c.Retention = env.duration("ARROW_RECEIVER_RETENTION", c.Retention)
+	c.RetentionInterval = env.duration("ARROW_RECEIVER_RETENTION_INTERVAL", c.RetentionInterval)
+	c.GRPCMaxRecvMsgBytes = env.int("ARROW_RECEIVER_GRPC_MAX_RECV_MSG_BYTES", c.GRPCMaxRecvMsgBytes)
+	c.GRPCMaxConcurrentStreams = env.int("ARROW_RECEIVER_GRPC_MAX_CONCURRENT_STREAMS", c.GRPCMaxConcurrentStreams)
+	c.GRPCKeepaliveMinTime = env.duration("ARROW_RECEIVER_GRPC_KEEPALIVE_MIN_TIME", c.GRPCKeepaliveMinTime)
+	c.GRPCKeepalivePermitWithoutStream = env.bool("ARROW_RECEIVER_GRPC_KEEPALIVE_PERMIT_WITHOUT_STREAM", c.GRPCKeepalivePermitWithoutStream)
+	c.GRPCKeepaliveTime = env.duration("ARROW_RECEIVER_GRPC_KEEPALIVE_TIME", c.GRPCKeepaliveTime)
+	c.GRPCKeepaliveTimeout = env.duration("ARROW_RECEIVER_GRPC_KEEPALIVE_TIMEOUT", c.GRPCKeepaliveTimeout)
+	c.GRPCMaxConnectionIdle = env.duration("ARROW_RECEIVER_GRPC_MAX_CONNECTION_IDLE", c.GRPCMaxConnectionIdle)
+	c.GRPCMaxConnectionAge = env.duration("ARROW_RECEIVER_GRPC_MAX_CONNECTION_AGE", c.GRPCMaxConnectionAge)
+	c.GRPCMaxConnectionAgeGrace = env.duration("ARROW_RECEIVER_GRPC_MAX_CONNECTION_AGE_GRACE", c.GRPCMaxConnectionAgeGrace)
+	c.GRPCReflection = env.bool("ARROW_RECEIVER_GRPC_REFLECTION", c.GRPCReflection)
+	c.HealthCheckInterval = env.duration("ARROW_RECEIVER_HEALTH_CHECK_INTERVAL", c.HealthCheckInterval)
+	c.StreamIdleTimeout = env.duration("ARROW_RECEIVER_STREAM_IDLE_TIMEOUT", c.StreamIdleTimeout)
+	c.ShutdownTimeout = env.duration("ARROW_RECEIVER_SHUTDOWN_TIMEOUT", c.ShutdownTimeout)
+	c.MemoryLimitBytes = env.int64("ARROW_RECEIVER_MEMORY_LIMIT_BYTES", c.MemoryLimitBytes)
+	c.MemoryWait = env.duration("ARROW_RECEIVER_MEMORY_WAIT", c.MemoryWait)
+	c.StreamMemoryLimitBytes = env.int64("ARROW_RECEIVER_STREAM_MEMORY_LIMIT_BYTES", c.StreamMemoryLimitBytes)
+	c.SearchAttributes = env.list("ARROW_RECEIVER_SEARCH_ATTRIBUTES", c.SearchAttributes)
+	c.DropAttributes = env.list("ARROW_RECEIVER_DROP_ATTRIBUTES", c.DropAttributes)
+	c.RedactAttributes = env.list("ARROW_RECEIVER_REDACT_ATTRIBUTES", c.RedactAttributes)
+	c.LiveTailMaxClients = env.int("ARROW_RECEIVER_LIVE_TAIL_MAX_CLIENTS", c.LiveTailMaxClients)
+	c.LiveTailBufferBatches = env.int("ARROW_RECEIVER_LIVE_TAIL_BUFFER_BATCHES", c.LiveTailBufferBatches)
+	c.LogLevel = env.string("ARROW_RECEIVER_LOG_LEVEL", c.LogLevel)
+	c.LogFormat = env.string("ARROW_RECEIVER_LOG_FORMAT", c.LogFormat)
+	c.LogPayloadSampleRatio = env.float("ARROW_RECEIVER_LOG_PAYLOAD_SAMPLE_RATIO", c.LogPayloadSampleRatio)
+	c.SelfTracing = env.bool("ARROW_RECEIVER_SELF_TRACING", c.SelfTracing)
+	c.SelfTracingServiceName = env.string("ARROW_RECEIVER_SELF_TRACING_SERVICE_NAME", c.SelfTracingServiceName)
+	c.SelfTracingTenant = env.string("ARROW_RECEIVER_SELF_TRACING_TENANT", c.SelfTracingTenant)
+	c.SelfTracingSampleRatio = env.float("ARROW_RECEIVER_SELF_TRACING_SAMPLE_RATIO", c.SelfTracingSampleRatio)
+	c.ConfigWatchInterval = env.duration("ARROW_RECEIVER_CONFIG_WATCH_INTERVAL", c.ConfigWatchInterval)
+	return errors.Join(env.errs...)
+}
+
+// SetupLogger applies the log level, format and payload sample ratio; all
+// were validated.
+func SetupLogger(cfg Config) {
+	payloadSampleRatio.Store(math.Float64bits(cfg.LogPayloadSampleRatio))
+	if cfg.LogFormat == "json" {
+		log.SetFormatter(&log.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+	} else {
+		log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	}
+	level, err := log.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		level = log.InfoLevel
+	}
+	log.SetLevel(level)
+}
+
+// envReader reads settings from environment variables and collects the
+// malformed ones.
+type envReader struct {
+	errs []error
+}
+
+func (e *envReader) fail(key, format string, args ...interface{}) {
+	e.errs = append(e.errs, fmt.Errorf(key+": "+format, args...))
+}
+
+// string reads a string variable, falling back to def when it is unset or
+// empty.
+func (e *envReader) string(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// int is int64 for int settings.
+func (e *envReader) int(key string, def int) int {
+	return int(e.int64(key, int64(def)))
+}
+
+// int64 reads an integer variable, falling back to def when it is unset.
+func (e *envReader) int64(key string, def int64) int64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		e.fail(key, "%q is not an integer", v)
+		return def
+	}
+	return n
+}
+
+// duration reads a duration variable such as "5s", falling back to def when
+// it is unset.
+func (e *envReader) duration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		e.fail(key, "%q is not a duration like 5s", v)
+		return def
+	}
+	return d
+}
+
+// float reads a number variable, falling back to def when it is unset.
+func (e *envReader) float(key string, def float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		e.fail(key, "%q is not a number", v)
+		return def
 	}
+	return f
 }
 
-func SetupLogger() {
-	log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
-	log.SetLevel(log.InfoLevel)
-} 
\ No newline at end of file
+// bool reads a boolean variable, falling back to def when it is unset.
+func (e *envReader) bool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		e.fail(key, "%q is not true or false", v)
+		return def
+	}
+	return b
+}
+
+// list reads a comma-separated variable, falling back to def when it is
+// unset. Set it to "" for an empty list.
+func (e *envReader) list(key string, def []string) []string {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	list := []string{}
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// keySet reads "key1,key2", falling back to def when it is unset.
+func (e *envReader) keySet(key string, def map[string]bool) map[string]bool {
+	if _, ok := os.LookupEnv(key); !ok {
+		return def
+	}
+	keys := map[string]bool{}
+	for _, k := range e.list(key, nil) {
+		keys[k] = true
+	}
+	return keys
+}
+
+// tenantKeys reads "key1=tenantA,key2=tenantB", falling back to def when it
+// is unset. Malformed pairs are reported by position, which keeps the keys
+// out of error messages.
+func (e *envReader) tenantKeys(key string, def map[string]string) map[string]string {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	keys := map[string]string{}
+	for i, pair := range strings.Split(v, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		k, tenant, ok := strings.Cut(pair, "=")
+		if !ok || k == "" || tenant == "" {
+			e.fail(key, "entry %d is not key=tenant", i+1)
+			continue
+		}
+		keys[k] = tenant
+	}
+	return keys
+}
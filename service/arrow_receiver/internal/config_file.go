@@ -0,0 +1,415 @@
+package internal
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig is the schema of the configuration file. JSON files are read
+// as YAML. Its fields point into a Config, so a file only overrides the
+// settings it has.
+type fileConfig struct {
+	Listeners fileListeners `yaml:"listeners"`
+	TLS       fileTLS       `yaml:"tls"`
+	GRPC      fileGRPC      `yaml:"grpc"`
+	Storage   fileStorage   `yaml:"storage"`
+	Pipeline  filePipeline  `yaml:"pipeline"`
+	Memory    fileMemory    `yaml:"memory"`
+	Auth      fileAuth      `yaml:"auth"`
+	Query     fileQuery     `yaml:"query"`
+	Search    fileSearch    `yaml:"search"`
+	Process   fileProcess   `yaml:"processing"`
+	LiveTail  fileLiveTail  `yaml:"live_tail"`
+	SelfTrace fileSelfTrace `yaml:"self_tracing"`
+	Health    fileHealth    `yaml:"health"`
+	Logging   fileLogging   `yaml:"logging"`
+	Reload    fileReload    `yaml:"reload"`
+	Shutdown  fileShutdown  `yaml:"shutdown"`
+}
+
+type fileListeners struct {
+	GRPC      *string `yaml:"grpc"`
+	HTTP      *string `yaml:"http"`
+	FlightSQL *string `yaml:"flight_sql"`
+}
+
+type fileTLS struct {
+	CertFile     *string `yaml:"cert_file"`
+	KeyFile      *string `yaml:"key_file"`
+	ClientCAFile *string `yaml:"client_ca_file"`
+}
+
+type fileGRPC struct {
+	MaxRecvMsgBytes              *int           `yaml:"max_recv_msg_bytes"`
+	MaxConcurrentStreams         *int           `yaml:"max_concurrent_streams"`
+	KeepaliveMinTime             *time.Duration `yaml:"keepalive_min_time"`
+	KeepalivePermitWithoutStream *bool          `yaml:"keepalive_permit_without_stream"`
+	KeepaliveTime                *time.Duration `yaml:"keepalive_time"`
+	KeepaliveTimeout             *time.Duration `yaml:"keepalive_timeout"`
+	MaxConnectionIdle            *time.Duration `yaml:"max_connection_idle"`
+	MaxConnectionAge             *time.Duration `yaml:"max_connection_age"`
+	MaxConnectionAgeGrace        *time.Duration `yaml:"max_connection_age_grace"`
+	StreamIdleTimeout            *time.Duration `yaml:"stream_idle_timeout"`
+	Reflection                   *bool          `yaml:"reflection"`
+	FlightSQL                    *bool          `yaml:"flight_sql"`
+}
+
+type fileStorage struct {
+	DBPath            *string        `yaml:"db_path"`
+	WALDir            *string        `yaml:"wal_dir"`
+	WALSegmentBytes   *int64         `yaml:"wal_segment_bytes"`
+	WALMaxBytes       *int64         `yaml:"wal_max_bytes"`
+	Retention         *time.Duration `yaml:"retention"`
+	RetentionInterval *time.Duration `yaml:"retention_interval"`
+}
+
+type filePipeline struct {
+	QueueSize       *int `yaml:"queue_size"`
+	DecodeWorkers   *int `yaml:"decode_workers"`
+	WriterBatchRows *int `yaml:"writer_batch_rows"`
+}
+
+type fileMemory struct {
+	LimitBytes       *int64         `yaml:"limit_bytes"`
+	Wait             *time.Duration `yaml:"wait"`
+	StreamLimitBytes *int64         `yaml:"stream_limit_bytes"`
+}
+
+type fileAuth struct {
+	TenantHeader     *string            `yaml:"tenant_header"`
+	TenantKeys       *map[string]string `yaml:"tenant_keys"`
+	AdminKeys        *keySet            `yaml:"admin_keys"`
+	QuotaBytesPerSec *int64             `yaml:"quota_bytes_per_sec"`
+	QuotaBurstBytes  *int64             `yaml:"quota_burst_bytes"`
+}
+
+type fileQuery struct {
+	Timeout          *time.Duration `yaml:"timeout"`
+	MaxRows          *int           `yaml:"max_rows"`
+	MaxBytes         *int64         `yaml:"max_bytes"`
+	MaxConcurrent    *int           `yaml:"max_concurrent"`
+	NamedQueriesFile *string        `yaml:"named_queries_file"`
+	CORSOrigins      *[]string      `yaml:"cors_allowed_origins"`
+}
+
+type fileSearch struct {
+	Attributes *[]string `yaml:"attributes"`
+}
+
+type fileProcess struct {
+	DropAttributes   *[]string `yaml:"drop_attributes"`
+	RedactAttributes *[]string `yaml:"redact_attributes"`
+}
+
+type fileLiveTail struct {
+	MaxClients    *int `yaml:"max_clients"`
+	BufferBatches *int `yaml:"buffer_batches"`
+}
+
+type fileHealth struct {
+	CheckInterval *time.Duration `yaml:"check_interval"`
+}
+
+type fileLogging struct {
+	Level              *string  `yaml:"level"`
+	Format             *string  `yaml:"format"`
+	PayloadSampleRatio *float64 `yaml:"payload_sample_ratio"`
+}
+
+type fileSelfTrace struct {
+	Enabled     *bool    `yaml:"enabled"`
+	ServiceName *string  `yaml:"service_name"`
+	Tenant      *string  `yaml:"tenant"`
+	SampleRatio *float64 `yaml:"sample_ratio"`
+}
+
+type fileReload struct {
+	WatchInterval *time.Duration `yaml:"watch_interval"`
+}
+
+type fileShutdown struct {
+	Timeout *time.Duration `yaml:"timeout"`
+}
+
+// keySet is a set of API keys written as a list.
+type keySet map[string]bool
+
+func (s *keySet) UnmarshalYAML(n *yaml.Node) error {
+	var keys []string
+	if err := n.Decode(&keys); err != nil {
+		return err
+	}
+	*s = keySet{}
+	for _, key := range keys {
+		(*s)[key] = true
+	}
+	return nil
+}
+
+// schema returns the file schema pointing at the settings of c.
+func (c *Config) schema() *fileConfig {
+	return &fileConfig{
+		Listeners: fileListeners{GRPC: &c.GRPCPort, HTTP: &c.HTTPPort, FlightSQL: &c.FlightSQLPort},
+		TLS:       fileTLS{CertFile: &c.TLSCertFile, KeyFile: &c.TLSKeyFile, ClientCAFile: &c.TLSClientCAFile},
+		GRPC: fileGRPC{
+			MaxRecvMsgBytes:              &c.GRPCMaxRecvMsgBytes,
+			MaxConcurrentStreams:         &c.GRPCMaxConcurrentStreams,
+			KeepaliveMinTime:             &c.GRPCKeepaliveMinTime,
+			KeepalivePermitWithoutStream: &c.GRPCKeepalivePermitWithoutStream,
+			KeepaliveTime:                &c.GRPCKeepaliveTime,
+			KeepaliveTimeout:             &c.GRPCKeepaliveTimeout,
+			MaxConnectionIdle:            &c.GRPCMaxConnectionIdle,
+			MaxConnectionAge:             &c.GRPCMaxConnectionAge,
+			MaxConnectionAgeGrace:        &c.GRPCMaxConnectionAgeGrace,
+			StreamIdleTimeout:            &c.StreamIdleTimeout,
+			Reflection:                   &c.GRPCReflection,
+			FlightSQL:                    &c.FlightSQL,
+		},
+		Storage: fileStorage{
+			DBPath:            &c.DBPath,
+			WALDir:            &c.WALDir,
+			WALSegmentBytes:   &c.WALSegmentBytes,
+			WALMaxBytes:       &c.WALMaxBytes,
+			Retention:         &c.Retention,
+			RetentionInterval: &c.RetentionInterval,
+		},
+		Pipeline: filePipeline{QueueSize: &c.QueueSize, DecodeWorkers: &c.DecodeWorkers, WriterBatchRows: &c.WriterBatchRows},
+		Memory:   fileMemory{LimitBytes: &c.MemoryLimitBytes, Wait: &c.MemoryWait, StreamLimitBytes: &c.StreamMemoryLimitBytes},
+		Auth: fileAuth{
+			TenantHeader:     &c.TenantHeader,
+			TenantKeys:       &c.TenantKeys,
+			AdminKeys:        (*keySet)(&c.AdminKeys),
+			QuotaBytesPerSec: &c.TenantQuotaBytesPerSec,
+			QuotaBurstBytes:  &c.TenantQuotaBurstBytes,
+		},
+		Query: fileQuery{
+			Timeout:          &c.QueryTimeout,
+			MaxRows:          &c.QueryMaxRows,
+			MaxBytes:         &c.QueryMaxBytes,
+			MaxConcurrent:    &c.QueryMaxConcurrent,
+			NamedQueriesFile: &c.NamedQueriesFile,
+			CORSOrigins:      &c.CORSAllowedOrigins,
+		},
+		Search:   fileSearch{Attributes: &c.SearchAttributes},
+		Process:  fileProcess{DropAttributes: &c.DropAttributes, RedactAttributes: &c.RedactAttributes},
+		LiveTail: fileLiveTail{MaxClients: &c.LiveTailMaxClients, BufferBatches: &c.LiveTailBufferBatches},
+		SelfTrace: fileSelfTrace{
+			Enabled:     &c.SelfTracing,
+			ServiceName: &c.SelfTracingServiceName,
+			Tenant:      &c.SelfTracingTenant,
+			SampleRatio: &c.SelfTracingSampleRatio,
+		},
+		Health:   fileHealth{CheckInterval: &c.HealthCheckInterval},
+		Logging:  fileLogging{Level: &c.LogLevel, Format: &c.LogFormat, PayloadSampleRatio: &c.LogPayloadSampleRatio},
+		Reload:   fileReload{WatchInterval: &c.ConfigWatchInterval},
+		Shutdown: fileShutdown{Timeout: &c.ShutdownTimeout},
+	}
+}
+
+// unknownFieldPattern matches the yaml error for a key missing from the schema.
+var unknownFieldPattern = regexp.MustCompile(`field (\S+) not found in type internal\.(\w+)`)
+
+// loadFile overrides the settings of c with those of the file at path.
+// Unknown keys and values of the wrong type are errors.
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	err = dec.Decode(c.schema())
+	var typeErr *yaml.TypeError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &typeErr):
+		// Name sections by their key rather than by their Go type.
+		sections := map[string]string{"fileConfig": "the top level"}
+		t := reflect.TypeOf(fileConfig{})
+		for i := 0; i < t.NumField(); i++ {
+			sections[t.Field(i).Type.Name()] = "section " + t.Field(i).Tag.Get("yaml")
+		}
+		msgs := make([]string, len(typeErr.Errors))
+		for i, msg := range typeErr.Errors {
+			msgs[i] = unknownFieldPattern.ReplaceAllStringFunc(msg, func(s string) string {
+				m := unknownFieldPattern.FindStringSubmatch(s)
+				return fmt.Sprintf("unknown key %s in %s", m[1], sections[m[2]])
+			})
+		}
+		return fmt.Errorf("%s: %s", path, strings.Join(msgs, "; "))
+	case errors.Is(err, io.EOF):
+		// An empty file keeps the defaults.
+		return nil
+	}
+	return fmt.Errorf("%s: %w", path, err)
+}
+
+// Validate checks the settings and reports every invalid one, named by its
+// key in the configuration file.
+func (c Config) Validate() error {
+	var errs []error
+	fail := func(key, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(key+": "+format, args...))
+	}
+	addrs := map[string]string{}
+	for _, l := range []struct{ key, addr string }{
+		{"listeners.grpc", c.GRPCPort},
+		{"listeners.http", c.HTTPPort},
+		{"listeners.flight_sql", c.FlightSQLPort},
+	} {
+		if l.addr == "" {
+			if l.key != "listeners.flight_sql" {
+				fail(l.key, "is required")
+			}
+			continue
+		}
+		if _, _, err := net.SplitHostPort(l.addr); err != nil {
+			fail(l.key, "%q is not a host:port address", l.addr)
+			continue
+		}
+		if other, ok := addrs[l.addr]; ok {
+			fail(l.key, "%q is already used by %s", l.addr, other)
+		}
+		addrs[l.addr] = l.key
+	}
+	switch {
+	case (c.TLSCertFile == "") != (c.TLSKeyFile == ""):
+		fail("tls", "cert_file and key_file must be set together")
+	case c.TLSCertFile != "":
+		if _, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile); err != nil {
+			fail("tls", "loading the certificate: %v", err)
+		}
+	case c.TLSClientCAFile != "":
+		fail("tls.client_ca_file", "needs cert_file and key_file")
+	}
+	if c.TLSClientCAFile != "" {
+		if _, err := loadCertPool(c.TLSClientCAFile); err != nil {
+			fail("tls.client_ca_file", "%v", err)
+		}
+	}
+	positive := func(key string, n int64) {
+		if n <= 0 {
+			fail(key, "must be positive, got %d", n)
+		}
+	}
+	notNegative := func(key string, n int64) {
+		if n < 0 {
+			fail(key, "must not be negative, got %d", n)
+		}
+	}
+	positive("grpc.max_recv_msg_bytes", int64(c.GRPCMaxRecvMsgBytes))
+	notNegative("grpc.max_concurrent_streams", int64(c.GRPCMaxConcurrentStreams))
+	for _, d := range []struct {
+		key string
+		d   time.Duration
+	}{
+		{"grpc.keepalive_min_time", c.GRPCKeepaliveMinTime},
+		{"grpc.keepalive_time", c.GRPCKeepaliveTime},
+		{"grpc.keepalive_timeout", c.GRPCKeepaliveTimeout},
+		{"grpc.max_connection_idle", c.GRPCMaxConnectionIdle},
+		{"grpc.max_connection_age", c.GRPCMaxConnectionAge},
+		{"grpc.max_connection_age_grace", c.GRPCMaxConnectionAgeGrace},
+		{"grpc.stream_idle_timeout", c.StreamIdleTimeout},
+		{"storage.retention", c.Retention},
+		{"memory.wait", c.MemoryWait},
+		{"reload.watch_interval", c.ConfigWatchInterval},
+	} {
+		if d.d < 0 {
+			fail(d.key, "must not be negative, got %s", d.d)
+		}
+	}
+	if c.DBPath == "" {
+		fail("storage.db_path", "is required")
+	}
+	if c.WALDir != "" {
+		positive("storage.wal_segment_bytes", c.WALSegmentBytes)
+		if c.WALMaxBytes < c.WALSegmentBytes {
+			fail("storage.wal_max_bytes", "must be at least wal_segment_bytes (%d), got %d", c.WALSegmentBytes, c.WALMaxBytes)
+		}
+	}
+	if c.Retention > 0 && c.RetentionInterval <= 0 {
+		fail("storage.retention_interval", "must be positive when retention is set, got %s", c.RetentionInterval)
+	}
+	positive("pipeline.queue_size", int64(c.QueueSize))
+	positive("pipeline.decode_workers", int64(c.DecodeWorkers))
+	positive("pipeline.writer_batch_rows", int64(c.WriterBatchRows))
+	notNegative("memory.limit_bytes", c.MemoryLimitBytes)
+	positive("memory.stream_limit_bytes", c.StreamMemoryLimitBytes)
+	if c.TenantHeader == "" || strings.ContainsAny(c.TenantHeader, " :\t") {
+		fail("auth.tenant_header", "%q is not a header name", c.TenantHeader)
+	}
+	for key, tenant := range c.TenantKeys {
+		if key == "" || !tenantIDPattern.MatchString(tenant) {
+			fail("auth.tenant_keys", "invalid tenant %q, tenant IDs are 1-64 letters, digits, _, . or -", tenant)
+		}
+	}
+	notNegative("auth.quota_bytes_per_sec", c.TenantQuotaBytesPerSec)
+	notNegative("auth.quota_burst_bytes", c.TenantQuotaBurstBytes)
+	if c.QueryTimeout <= 0 {
+		fail("query.timeout", "must be positive, got %s", c.QueryTimeout)
+	}
+	positive("query.max_rows", int64(c.QueryMaxRows))
+	positive("query.max_bytes", c.QueryMaxBytes)
+	positive("query.max_concurrent", int64(c.QueryMaxConcurrent))
+	for _, origin := range c.CORSAllowedOrigins {
+		if u, err := url.Parse(origin); origin != "*" && (err != nil || u.Scheme == "" || u.Host == "" || u.Path != "") {
+			fail("query.cors_allowed_origins", "%q is not an origin like https://grafana.example.com", origin)
+		}
+	}
+	dropped := map[string]bool{}
+	for _, key := range c.DropAttributes {
+		if key == "" {
+			fail("processing.drop_attributes", "keys must not be empty")
+		}
+		dropped[key] = true
+	}
+	for _, key := range c.RedactAttributes {
+		if key == "" {
+			fail("processing.redact_attributes", "keys must not be empty")
+		}
+		if dropped[key] {
+			fail("processing.redact_attributes", "%q is also dropped", key)
+		}
+	}
+	notNegative("live_tail.max_clients", int64(c.LiveTailMaxClients))
+	positive("live_tail.buffer_batches", int64(c.LiveTailBufferBatches))
+	if c.SelfTracingServiceName == "" {
+		fail("self_tracing.service_name", "must not be empty")
+	}
+	if !tenantIDPattern.MatchString(c.SelfTracingTenant) {
+		fail("self_tracing.tenant", "invalid tenant %q, tenant IDs are 1-64 letters, digits, _, . or -", c.SelfTracingTenant)
+	}
+	if c.SelfTracingSampleRatio < 0 || c.SelfTracingSampleRatio > 1 {
+		fail("self_tracing.sample_ratio", "must be between 0 and 1, got %g", c.SelfTracingSampleRatio)
+	}
+	if c.HealthCheckInterval <= 0 {
+		fail("health.check_interval", "must be positive, got %s", c.HealthCheckInterval)
+	}
+	if c.ShutdownTimeout <= 0 {
+		fail("shutdown.timeout", "must be positive, got %s", c.ShutdownTimeout)
+	}
+	if _, err := log.ParseLevel(c.LogLevel); err != nil {
+		fail("logging.level", "%q is not one of trace, debug, info, warn, error, fatal or panic", c.LogLevel)
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		fail("logging.format", "%q is not text or json", c.LogFormat)
+	}
+	if c.LogPayloadSampleRatio < 0 || c.LogPayloadSampleRatio > 1 {
+		fail("logging.payload_sample_ratio", "must be between 0 and 1, got %g", c.LogPayloadSampleRatio)
+	}
+	return errors.Join(errs...)
+}
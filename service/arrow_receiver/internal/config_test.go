@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigRejectsMalformedEnv(t *testing.T) {
+	for _, tc := range []struct {
+		env, value, want string
+	}{
+		{"ARROW_RECEIVER_QUERY_MAX_ROWS", "many", `ARROW_RECEIVER_QUERY_MAX_ROWS: "many" is not an integer`},
+		{"ARROW_RECEIVER_QUERY_TIMEOUT", "30", `ARROW_RECEIVER_QUERY_TIMEOUT: "30" is not a duration`},
+		{"ARROW_RECEIVER_FLIGHT_SQL", "yes please", `ARROW_RECEIVER_FLIGHT_SQL: "yes please" is not true or false`},
+		{"ARROW_RECEIVER_SELF_TRACING_SAMPLE_RATIO", "half", `ARROW_RECEIVER_SELF_TRACING_SAMPLE_RATIO: "half" is not a number`},
+		{"ARROW_RECEIVER_TENANT_KEYS", "k1=acme,secret-key", "ARROW_RECEIVER_TENANT_KEYS: entry 2 is not key=tenant"},
+	} {
+		t.Run(tc.env, func(t *testing.T) {
+			t.Setenv(tc.env, tc.value)
+			_, err := LoadConfig(nil)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("LoadConfig with %s=%q: %v, want %q", tc.env, tc.value, err, tc.want)
+			}
+			if strings.Contains(err.Error(), "secret-key") {
+				t.Errorf("error reveals a key: %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	t.Setenv("ARROW_RECEIVER_TENANT_KEYS", "k1=acme, k2=globex,")
+	t.Setenv("ARROW_RECEIVER_QUERY_TIMEOUT", "5s")
+	cfg, err := LoadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.TenantKeys) != 2 || cfg.TenantKeys["k1"] != "acme" || cfg.TenantKeys["k2"] != "globex" {
+		t.Errorf("tenant keys %v", cfg.TenantKeys)
+	}
+	if cfg.QueryTimeout.String() != "5s" {
+		t.Errorf("query timeout %s", cfg.QueryTimeout)
+	}
+}
+
+func TestLoadConfigProcessing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "receiver.yaml")
+	if err := os.WriteFile(path, []byte("processing:\n  drop_attributes: [http.request.header.cookie]\n  redact_attributes: [user.email]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig([]string{"--config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.DropAttributes) != 1 || cfg.DropAttributes[0] != "http.request.header.cookie" || len(cfg.RedactAttributes) != 1 || cfg.RedactAttributes[0] != "user.email" {
+		t.Errorf("drop %v, redact %v", cfg.DropAttributes, cfg.RedactAttributes)
+	}
+
+	t.Setenv("ARROW_RECEIVER_REDACT_ATTRIBUTES", "user.email,http.request.header.cookie")
+	_, err = LoadConfig([]string{"--config", path})
+	if want := `processing.redact_attributes: "http.request.header.cookie" is also dropped`; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("LoadConfig: %v, want %q", err, want)
+	}
+}
@@ -3,9 +3,15 @@ package internal
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
-	_ "github.com/marcboeker/go-duckdb"
+	"github.com/marcboeker/go-duckdb"
+	log "github.com/sirupsen/logrus"
 )
 
 func InitDB(path string) (*sql.DB, error) {
@@ -13,9 +19,130 @@ func InitDB(path string) (*sql.DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := EnsureSchema(context.Background(), db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := lockDownDB(context.Background(), db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	registerDBMetrics(path, db)
 	return db, nil
 }
 
+// registerDBMetrics exposes the size of the database files, read when
+// scraped, and the row count of each table, which is cached for
+// tableRowsMaxAge.
+func registerDBMetrics(path string, db *sql.DB) {
+	metrics.gaugeFunc("arrow_receiver_db_size_bytes", "Size of the DuckDB database file and its write-ahead log, by file.", []string{"file"},
+		func(emit func(float64, ...string)) {
+			for _, f := range []struct{ file, path string }{{"database", path}, {"wal", path + ".wal"}} {
+				if fi, err := os.Stat(f.path); err == nil {
+					emit(float64(fi.Size()), f.file)
+				}
+			}
+		})
+	rows := &tableRowCounts{db: db}
+	metrics.gaugeFunc("arrow_receiver_table_rows", "Rows stored in each DuckDB table, counted at most once a minute.", []string{"table"},
+		func(emit func(float64, ...string)) {
+			counts := rows.get()
+			for _, table := range countedTables {
+				if n, ok := counts[table]; ok {
+					emit(float64(n), table)
+				}
+			}
+		})
+}
+
+// countedTables are the tables whose rows arrow_receiver_table_rows counts.
+var countedTables = []string{"traces", "logs", "metrics", "log_terms"}
+
+// tableRowsMaxAge is how long row counts are reused. Counting scans the
+// tables, which should not happen on every scrape.
+const tableRowsMaxAge = time.Minute
+
+// tableRowCounts caches the row counts of countedTables.
+type tableRowCounts struct {
+	db *sql.DB
+
+	mu     sync.Mutex
+	read   time.Time
+	counts map[string]int64
+}
+
+// get returns the row counts, counting again when they are older than
+// tableRowsMaxAge. A table that cannot be counted keeps its last count.
+func (c *tableRowCounts) get() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.read) < tableRowsMaxAge {
+		return c.counts
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	counts := map[string]int64{}
+	for _, table := range countedTables {
+		var n int64
+		if err := c.db.QueryRowContext(ctx, "SELECT count(*) FROM "+table).Scan(&n); err != nil {
+			log.WithError(err).WithField("table", table).Warn("Error counting rows for metrics")
+			if prev, ok := c.counts[table]; ok {
+				counts[table] = prev
+			}
+			continue
+		}
+		counts[table] = n
+	}
+	c.counts, c.read = counts, time.Now()
+	return counts
+}
+
+// CloseDB checkpoints DuckDB's write-ahead log into the database file and
+// closes the database.
+func CloseDB(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, "CHECKPOINT"); err != nil {
+		db.Close()
+		return fmt.Errorf("checkpointing DuckDB: %w", err)
+	}
+	return db.Close()
+}
+
+// lockDownDB disables access to files outside the database and extension
+// installation and autoloading for the lifetime of the process, so queries
+// cannot read or write arbitrary files. DuckDB refuses to enable external
+// access again while the database is open.
+func lockDownDB(ctx context.Context, db *sql.DB) error {
+	for _, stmt := range []string{
+		"SET autoinstall_known_extensions = false",
+		"SET autoload_known_extensions = false",
+		"SET enable_external_access = false",
+	} {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EnsureSchema creates the telemetry tables and upgrades databases written
+// before rows were tagged with a tenant. Existing rows belong to DefaultTenant.
+func EnsureSchema(ctx context.Context, db *sql.DB) error {
+	for _, ensure := range []func(context.Context, *sql.DB) error{
+		EnsureTracesTableExists, EnsureLogsTableExists, EnsureMetricsTableExists, EnsureLogTermsTableExists,
+	} {
+		if err := ensure(ctx, db); err != nil {
+			return err
+		}
+	}
+	for _, table := range tenantTables {
+		if _, err := db.ExecContext(ctx, fmt.Sprintf(
+			"ALTER TABLE %s ADD COLUMN IF NOT EXISTS tenant_id TEXT DEFAULT '%s'", table, DefaultTenant)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func EnsureTracesTableExists(ctx context.Context, db *sql.DB) error {
 	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS traces (
 		trace_id TEXT,
@@ -36,22 +163,25 @@ func EnsureTracesTableExists(ctx context.Context, db *sql.DB) error {
 		events JSON,
 		links JSON,
 		scope JSON,
-		schema_url TEXT
+		schema_url TEXT,
+		tenant_id TEXT
 	)`)
 	return err
 }
 
-func InsertTraceRow(ctx context.Context, db *sql.DB,
-	traceID, spanID, parentSpanID, name string,
-	kind int, traceState string, statusCode int, statusMessage string,
-	resourceJSON, attrsJSON, startTime, endTime string,
-	droppedAttrs, droppedEvents, droppedLinks int,
-	eventsJSON, linksJSON, scopeJSON, schemaURL string) error {
-	_, err := db.ExecContext(ctx, `INSERT INTO traces (
-		trace_id, span_id, parent_span_id, name, kind, trace_state, status_code, status_message, resource, attributes, start_time_unix_nano, end_time_unix_nano, dropped_attributes_count, dropped_events_count, dropped_links_count, events, links, scope, schema_url
-	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		traceID, spanID, parentSpanID, name, kind, traceState, statusCode, statusMessage, resourceJSON, attrsJSON, startTime, endTime, droppedAttrs, droppedEvents, droppedLinks, eventsJSON, linksJSON, scopeJSON, schemaURL)
-	return err
+// TraceRow is one span as stored in the traces table.
+type TraceRow struct {
+	TraceID, SpanID, ParentSpanID, Name string
+	Kind                                int
+	TraceState                          string
+	StatusCode                          int
+	StatusMessage                       string
+	Resource, Attributes                string
+	StartTime, EndTime                  string
+	DroppedAttrs, DroppedEvents         int
+	DroppedLinks                        int
+	Events, Links, Scope, SchemaURL     string
+	TenantID                            string
 }
 
 func EnsureLogsTableExists(ctx context.Context, db *sql.DB) error {
@@ -69,20 +199,44 @@ func EnsureLogsTableExists(ctx context.Context, db *sql.DB) error {
 		trace_id TEXT,
 		span_id TEXT,
 		scope JSON,
-		schema_url TEXT
+		schema_url TEXT,
+		tenant_id TEXT
 	)`)
 	return err
 }
 
-func InsertLogRow(ctx context.Context, db *sql.DB,
-	logID, resourceJSON, timeUnixNano, observedTimeUnixNano string,
-	severityNumber int, severityText, body string, attrsJSON string,
-	droppedAttrs, flags int, traceID, spanID, scopeJSON, schemaURL string) error {
-	_, err := db.ExecContext(ctx, `INSERT INTO logs (
-		log_id, resource, time_unix_nano, observed_time_unix_nano, severity_number, severity_text, body, attributes, dropped_attributes_count, flags, trace_id, span_id, scope, schema_url
-	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		logID, resourceJSON, timeUnixNano, observedTimeUnixNano, severityNumber, severityText, body, attrsJSON, droppedAttrs, flags, traceID, spanID, scopeJSON, schemaURL)
-	return err
+// EnsureLogTermsTableExists creates the full-text index of the logs (see
+// LogIndex): the search columns of logs, the sequence numbering them and
+// the log_terms table.
+func EnsureLogTermsTableExists(ctx context.Context, db *sql.DB) error {
+	for _, stmt := range []string{
+		"CREATE SEQUENCE IF NOT EXISTS log_search_seq",
+		"ALTER TABLE logs ADD COLUMN IF NOT EXISTS search_id BIGINT",
+		"ALTER TABLE logs ADD COLUMN IF NOT EXISTS search_length INT",
+		`CREATE TABLE IF NOT EXISTS log_terms (
+			term TEXT,
+			search_id BIGINT,
+			tf INT,
+			tenant_id TEXT
+		)`,
+		"CREATE INDEX IF NOT EXISTS log_terms_term ON log_terms (term)",
+	} {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LogRow is one log record as stored in the logs table.
+type LogRow struct {
+	LogID, Resource                    string
+	TimeUnixNano, ObservedTimeUnixNano string
+	SeverityNumber                     int
+	SeverityText, Body, Attributes     string
+	DroppedAttrs, Flags                int
+	TraceID, SpanID, Scope, SchemaURL  string
+	TenantID                           string
 }
 
 func EnsureMetricsTableExists(ctx context.Context, db *sql.DB) error {
@@ -98,22 +252,166 @@ func EnsureMetricsTableExists(ctx context.Context, db *sql.DB) error {
 		is_monotonic BOOL,
 		attributes JSON,
 		scope JSON,
-		schema_url TEXT
+		schema_url TEXT,
+		tenant_id TEXT
 	)`)
 	if err != nil {
-		fmt.Printf("[DB DEBUG] Error creating metrics table: %v\n", err)
-	} else {
-		fmt.Println("[DB DEBUG] EnsureMetricsTableExists executed successfully.")
+		log.WithError(err).Error("Error creating metrics table")
+		return err
+	}
+	log.Debug("Metrics table ready")
+	return nil
+}
+
+// MetricRow is one data point as stored in the metrics table.
+type MetricRow struct {
+	Resource, Name, Unit, Description string
+	StartTime, Time, Value            string
+	AggTemporality                    int
+	IsMonotonic                       bool
+	Attributes, Scope, SchemaURL      string
+	TenantID                          string
+}
+
+// stageTable describes the columns the writer loads into one telemetry table.
+type stageTable struct {
+	name    string
+	columns []string
+	json    map[string]bool
+}
+
+var (
+	traceStage = stageTable{
+		name: "traces",
+		columns: []string{
+			"trace_id", "span_id", "parent_span_id", "name", "kind", "trace_state", "status_code", "status_message", "resource", "attributes", "start_time_unix_nano", "end_time_unix_nano", "dropped_attributes_count", "dropped_events_count", "dropped_links_count", "events", "links", "scope", "schema_url", "tenant_id",
+		},
+		json: map[string]bool{"resource": true, "attributes": true, "events": true, "links": true, "scope": true},
+	}
+	logStage = stageTable{
+		name: "logs",
+		columns: []string{
+			"log_id", "resource", "time_unix_nano", "observed_time_unix_nano", "severity_number", "severity_text", "body", "attributes", "dropped_attributes_count", "flags", "trace_id", "span_id", "scope", "schema_url", "tenant_id",
+		},
+		json: map[string]bool{"resource": true, "attributes": true, "scope": true},
+	}
+	metricStage = stageTable{
+		name: "metrics",
+		columns: []string{
+			"resource", "name", "unit", "description", "start_time_unix_nano", "time_unix_nano", "value", "aggregation_temporality", "is_monotonic", "attributes", "scope", "schema_url", "tenant_id",
+		},
+		json: map[string]bool{"resource": true, "attributes": true, "scope": true},
+	}
+)
+
+// RowWriter bulk-loads rows with the DuckDB appender. The appender stores Go
+// strings in JSON columns as JSON string values, so rows are appended to
+// staging tables with VARCHAR in place of JSON and copied over with
+// INSERT ... SELECT, which parses them. The staging tables are temporary and
+// live on the writer's own connection; it must not be used concurrently.
+type RowWriter struct {
+	conn  *sql.Conn
+	index *LogIndex
+}
+
+func NewRowWriter(ctx context.Context, db *sql.DB, index *LogIndex) (*RowWriter, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range []stageTable{traceStage, logStage, metricStage} {
+		cols := make([]string, len(t.columns))
+		for i, c := range t.columns {
+			cols[i] = c
+			if t.json[c] {
+				cols[i] = c + "::VARCHAR AS " + c
+			}
+		}
+		if _, err := conn.ExecContext(ctx, fmt.Sprintf(
+			"CREATE TEMP TABLE IF NOT EXISTS stage_%s AS SELECT %s FROM %s LIMIT 0",
+			t.name, strings.Join(cols, ", "), t.name)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return &RowWriter{conn: conn, index: index}, nil
+}
+
+// Write stores all rows of the batch in one transaction.
+func (w *RowWriter) Write(ctx context.Context, rows RowBatch) error {
+	if _, err := w.conn.ExecContext(ctx, "BEGIN TRANSACTION"); err != nil {
+		return err
+	}
+	err := w.load(ctx, traceStage, len(rows.Traces), func(i int) []driver.Value {
+		r := rows.Traces[i]
+		return []driver.Value{r.TraceID, r.SpanID, r.ParentSpanID, r.Name, int32(r.Kind), r.TraceState, int32(r.StatusCode), r.StatusMessage, r.Resource, r.Attributes, r.StartTime, r.EndTime, int32(r.DroppedAttrs), int32(r.DroppedEvents), int32(r.DroppedLinks), r.Events, r.Links, r.Scope, r.SchemaURL, r.TenantID}
+	})
+	if err == nil && len(rows.Logs) > 0 {
+		err = w.index.add(ctx, w.conn, func() error {
+			return w.load(ctx, logStage, len(rows.Logs), func(i int) []driver.Value {
+				r := rows.Logs[i]
+				return []driver.Value{r.LogID, r.Resource, r.TimeUnixNano, r.ObservedTimeUnixNano, int32(r.SeverityNumber), r.SeverityText, r.Body, r.Attributes, int32(r.DroppedAttrs), int32(r.Flags), r.TraceID, r.SpanID, r.Scope, r.SchemaURL, r.TenantID}
+			})
+		})
+	}
+	if err == nil {
+		err = w.load(ctx, metricStage, len(rows.Metrics), func(i int) []driver.Value {
+			r := rows.Metrics[i]
+			return []driver.Value{r.Resource, r.Name, r.Unit, r.Description, r.StartTime, r.Time, r.Value, int32(r.AggTemporality), r.IsMonotonic, r.Attributes, r.Scope, r.SchemaURL, r.TenantID}
+		})
+	}
+	if err == nil {
+		_, err = w.conn.ExecContext(ctx, "COMMIT")
+	}
+	if err != nil {
+		w.conn.ExecContext(ctx, "ROLLBACK")
 	}
 	return err
 }
 
-func InsertMetricRow(ctx context.Context, db *sql.DB,
-	resourceJSON, name, unit, description, startTime, time, value string,
-	aggTemporality int, isMonotonic bool, attrsJSON, scopeJSON, schemaURL string) error {
-	_, err := db.ExecContext(ctx, `INSERT INTO metrics (
-		resource, name, unit, description, start_time_unix_nano, time_unix_nano, value, aggregation_temporality, is_monotonic, attributes, scope, schema_url
-	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		resourceJSON, name, unit, description, startTime, time, value, aggTemporality, isMonotonic, attrsJSON, scopeJSON, schemaURL)
+// load appends n rows to the staging table of t and moves them into t.
+func (w *RowWriter) load(ctx context.Context, t stageTable, n int, row func(int) []driver.Value) error {
+	if n == 0 {
+		return nil
+	}
+	err := w.conn.Raw(func(dc any) error {
+		appender, err := duckdb.NewAppenderFromConn(dc.(driver.Conn), "", "stage_"+t.name)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if err := appender.AppendRow(row(i)...); err != nil {
+				appender.Close()
+				return err
+			}
+		}
+		return appender.Close()
+	})
+	if err != nil {
+		return err
+	}
+	cols := strings.Join(t.columns, ", ")
+	into, values := cols, cols
+	if t.name == logStage.name {
+		searchCols, searchValues := w.index.searchColumns()
+		into, values = cols+", "+searchCols, cols+", "+searchValues
+	}
+	if _, err := w.conn.ExecContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (%s) SELECT %s FROM temp.stage_%s", t.name, into, values, t.name)); err != nil {
+		return err
+	}
+	_, err = w.conn.ExecContext(ctx, "DELETE FROM temp.stage_"+t.name)
 	return err
-} 
\ No newline at end of file
+}
+
+// Close drops the staging tables before the connection returns to the pool,
+// where they would otherwise be visible to queries.
+func (w *RowWriter) Close() error {
+	for _, t := range []stageTable{traceStage, logStage, metricStage} {
+		if _, err := w.conn.ExecContext(context.Background(), "DROP TABLE IF EXISTS temp.stage_"+t.name); err != nil {
+			w.conn.Raw(func(any) error { return driver.ErrBadConn })
+			break
+		}
+	}
+	return w.conn.Close()
+}
@@ -0,0 +1,449 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/flight"
+	"github.com/apache/arrow-go/v18/arrow/flight/flightsql"
+	"github.com/apache/arrow-go/v18/arrow/flight/flightsql/schema_ref"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/marcboeker/go-duckdb"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// flightTableType is the only table type reported; tenants see views, but
+// they stand in for the tables.
+const flightTableType = "TABLE"
+
+// FlightSQLServer serves the traces, logs and metrics tables over Arrow
+// Flight SQL with the tenant, read-only and limit rules of /query.
+// Statements and prepared statements are stateless: their handle is the
+// query text, which is checked again when it is executed.
+type FlightSQLServer struct {
+	flightsql.BaseServer
+	cfg     Config
+	db      *sql.DB
+	tenants *TenantResolver
+	slots   QuerySlots
+	catalog string
+}
+
+func NewFlightSQLServer(cfg Config, db *sql.DB, slots QuerySlots, tenants *TenantResolver) (*FlightSQLServer, error) {
+	s := &FlightSQLServer{
+		cfg:     cfg,
+		db:      db,
+		tenants: tenants,
+		slots:   slots,
+	}
+	s.Alloc = memory.DefaultAllocator
+	var version string
+	if err := db.QueryRow("SELECT current_database(), version()").Scan(&s.catalog, &version); err != nil {
+		return nil, err
+	}
+	info := map[flightsql.SqlInfo]interface{}{
+		flightsql.SqlInfoFlightSqlServerName:         "arrow_receiver",
+		flightsql.SqlInfoFlightSqlServerVersion:      "duckdb " + version,
+		flightsql.SqlInfoFlightSqlServerArrowVersion: arrow.PkgVersion,
+		flightsql.SqlInfoFlightSqlServerReadOnly:     true,
+		flightsql.SqlInfoFlightSqlServerSql:          true,
+		flightsql.SqlInfoFlightSqlServerSubstrait:    false,
+		flightsql.SqlInfoFlightSqlServerTransaction:  int32(flightsql.SqlTransactionNone),
+		flightsql.SqlInfoFlightSqlServerCancel:       false,
+		flightsql.SqlInfoDDLCatalog:                  false,
+		flightsql.SqlInfoDDLSchema:                   false,
+		flightsql.SqlInfoDDLTable:                    false,
+		flightsql.SqlInfoIdentifierQuoteChar:         `"`,
+		flightsql.SqlInfoTransactionsSupported:       false,
+	}
+	for id, value := range info {
+		if err := s.RegisterSqlInfo(id, value); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Register adds the Flight service to g.
+func (s *FlightSQLServer) Register(g *grpc.Server) {
+	flight.RegisterFlightServiceServer(g, flightsql.NewFlightServer(s))
+}
+
+// caller resolves the tenant of an RPC from its metadata. Admin keys see the
+// rows of all tenants.
+func (s *FlightSQLServer) caller(ctx context.Context) (tenant string, admin bool, err error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if s.tenants.IsAdminMetadata(md) {
+		return "", true, nil
+	}
+	tenant, err = s.tenants.FromMetadata(md)
+	if err != nil {
+		return "", false, status.Error(codes.Unauthenticated, err.Error())
+	}
+	return tenant, false, nil
+}
+
+// open returns a connection that sees what the caller may query.
+func (s *FlightSQLServer) open(ctx context.Context) (*TenantConn, *log.Entry, error) {
+	tenant, admin, err := s.caller(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	logger := log.WithFields(log.Fields{"tenant": tenant, "admin": admin, "api": "flightsql"})
+	var conn *TenantConn
+	if admin {
+		conn, err = OpenAdminConn(ctx, s.db)
+	} else {
+		conn, err = OpenTenantConn(ctx, s.db, tenant)
+	}
+	if err != nil {
+		logger.WithError(err).Error("opening query connection failed")
+		return nil, nil, status.Error(codes.Internal, err.Error())
+	}
+	return conn, logger, nil
+}
+
+// check applies the statement rules of /query to query.
+func (s *FlightSQLServer) check(ctx context.Context, conn *TenantConn, logger *log.Entry, query string) error {
+	err := CheckReadOnlyQuery(ctx, conn, query)
+	if err == nil && !conn.admin {
+		err = CheckTenantQuery(ctx, conn, query)
+	}
+	if err != nil {
+		logger.WithError(err).WithField("query", query).Warn("query blocked")
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return conn.BeginReadOnly(ctx)
+}
+
+// validate checks a query without running it so clients see errors when
+// they plan a statement rather than when they fetch it.
+func (s *FlightSQLServer) validate(ctx context.Context, query string) error {
+	conn, logger, err := s.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return s.check(ctx, conn, logger, query)
+}
+
+// runQuery runs query and streams its result. Results beyond the row or byte
+// limit are cut off and flagged with the x-query-truncated trailer.
+func (s *FlightSQLServer) runQuery(ctx context.Context, query string) (*arrow.Schema, <-chan flight.StreamChunk, error) {
+	qctx, cancel := context.WithTimeout(ctx, s.cfg.QueryTimeout)
+	qctx, span := startSpan(qctx, "flightsql.query", trace.WithAttributes(attribute.String("db.query.text", query)))
+	if !s.slots.Acquire(qctx) {
+		err := status.Error(codes.ResourceExhausted, "too many concurrent queries")
+		endSpan(span, err)
+		cancel()
+		log.WithField("api", "flightsql").Warn("query rejected: concurrency limit reached")
+		return nil, nil, err
+	}
+	conn, logger, err := s.open(qctx)
+	if err != nil {
+		endSpan(span, err)
+		s.slots.Release()
+		cancel()
+		return nil, nil, err
+	}
+	done := func(err error) error {
+		endSpan(span, err)
+		conn.Close()
+		s.slots.Release()
+		cancel()
+		return err
+	}
+	if err := s.check(qctx, conn, logger, query); err != nil {
+		return nil, nil, done(err)
+	}
+	if err := materializeResult(qctx, conn, query, s.cfg.QueryMaxRows); err != nil {
+		return nil, nil, done(flightQueryError(qctx, err, logger))
+	}
+	reader, err := queryArrowResult(qctx, conn)
+	if err != nil {
+		return nil, nil, done(flightQueryError(qctx, err, logger))
+	}
+	ch := make(chan flight.StreamChunk)
+	go func() {
+		var err error
+		defer func() { done(err) }()
+		defer close(ch)
+		defer reader.Release()
+		var cut bool
+		_, cut, err = limitRecords(reader, s.cfg.QueryMaxRows, s.cfg.QueryMaxBytes, func(rec arrow.Record) error {
+			rec.Retain()
+			select {
+			case ch <- flight.StreamChunk{Data: rec}:
+				return nil
+			case <-qctx.Done():
+				rec.Release()
+				return qctx.Err()
+			}
+		})
+		if err != nil {
+			select {
+			case ch <- flight.StreamChunk{Err: status.Error(codes.Internal, err.Error())}:
+			case <-qctx.Done():
+			}
+			logger.WithError(err).Warn("streaming query result failed")
+			return
+		}
+		if cut {
+			grpc.SetTrailer(ctx, metadata.Pairs("x-query-truncated", "true"))
+		}
+	}()
+	return reader.Schema(), ch, nil
+}
+
+// flightQueryError maps a failed query to a gRPC status, telling timeouts
+// and cancellations apart from errors in the query itself.
+func flightQueryError(ctx context.Context, err error, logger *log.Entry) error {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		logger.WithError(err).Warn("query timed out")
+		return status.Error(codes.DeadlineExceeded, "query timed out")
+	case ctx.Err() != nil:
+		logger.WithError(err).Info("query cancelled: client disconnected")
+		return status.FromContextError(ctx.Err()).Err()
+	default:
+		logger.WithError(err).Error("query failed")
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+}
+
+func (s *FlightSQLServer) GetFlightInfoStatement(ctx context.Context, cmd flightsql.StatementQuery, desc *flight.FlightDescriptor) (*flight.FlightInfo, error) {
+	if err := s.validate(ctx, cmd.GetQuery()); err != nil {
+		return nil, err
+	}
+	ticket, err := flightsql.CreateStatementQueryTicket([]byte(cmd.GetQuery()))
+	if err != nil {
+		return nil, err
+	}
+	return &flight.FlightInfo{
+		Endpoint:         []*flight.FlightEndpoint{{Ticket: &flight.Ticket{Ticket: ticket}}},
+		FlightDescriptor: desc,
+		TotalRecords:     -1,
+		TotalBytes:       -1,
+	}, nil
+}
+
+func (s *FlightSQLServer) DoGetStatement(ctx context.Context, ticket flightsql.StatementQueryTicket) (*arrow.Schema, <-chan flight.StreamChunk, error) {
+	return s.runQuery(ctx, string(ticket.GetStatementHandle()))
+}
+
+func (s *FlightSQLServer) CreatePreparedStatement(ctx context.Context, req flightsql.ActionCreatePreparedStatementRequest) (flightsql.ActionCreatePreparedStatementResult, error) {
+	if err := s.validate(ctx, req.GetQuery()); err != nil {
+		return flightsql.ActionCreatePreparedStatementResult{}, err
+	}
+	return flightsql.ActionCreatePreparedStatementResult{Handle: []byte(req.GetQuery())}, nil
+}
+
+func (s *FlightSQLServer) ClosePreparedStatement(context.Context, flightsql.ActionClosePreparedStatementRequest) error {
+	return nil
+}
+
+func (s *FlightSQLServer) GetFlightInfoPreparedStatement(ctx context.Context, cmd flightsql.PreparedStatementQuery, desc *flight.FlightDescriptor) (*flight.FlightInfo, error) {
+	return s.flightInfo(desc, nil), nil
+}
+
+func (s *FlightSQLServer) DoGetPreparedStatement(ctx context.Context, cmd flightsql.PreparedStatementQuery) (*arrow.Schema, <-chan flight.StreamChunk, error) {
+	return s.runQuery(ctx, string(cmd.GetPreparedStatementHandle()))
+}
+
+// flightInfo answers a command whose ticket is the command itself.
+func (s *FlightSQLServer) flightInfo(desc *flight.FlightDescriptor, schema *arrow.Schema) *flight.FlightInfo {
+	info := &flight.FlightInfo{
+		Endpoint:         []*flight.FlightEndpoint{{Ticket: &flight.Ticket{Ticket: desc.Cmd}}},
+		FlightDescriptor: desc,
+		TotalRecords:     -1,
+		TotalBytes:       -1,
+	}
+	if schema != nil {
+		info.Schema = flight.SerializeSchema(schema, s.Alloc)
+	}
+	return info
+}
+
+func (s *FlightSQLServer) GetFlightInfoCatalogs(_ context.Context, desc *flight.FlightDescriptor) (*flight.FlightInfo, error) {
+	return s.flightInfo(desc, schema_ref.Catalogs), nil
+}
+
+func (s *FlightSQLServer) DoGetCatalogs(ctx context.Context) (*arrow.Schema, <-chan flight.StreamChunk, error) {
+	if _, _, err := s.caller(ctx); err != nil {
+		return nil, nil, err
+	}
+	b := array.NewRecordBuilder(s.Alloc, schema_ref.Catalogs)
+	defer b.Release()
+	b.Field(0).(*array.StringBuilder).Append(s.catalog)
+	return schema_ref.Catalogs, singleRecord(b.NewRecord()), nil
+}
+
+func (s *FlightSQLServer) GetFlightInfoSchemas(_ context.Context, _ flightsql.GetDBSchemas, desc *flight.FlightDescriptor) (*flight.FlightInfo, error) {
+	return s.flightInfo(desc, schema_ref.DBSchemas), nil
+}
+
+func (s *FlightSQLServer) DoGetDBSchemas(ctx context.Context, cmd flightsql.GetDBSchemas) (*arrow.Schema, <-chan flight.StreamChunk, error) {
+	if _, _, err := s.caller(ctx); err != nil {
+		return nil, nil, err
+	}
+	b := array.NewRecordBuilder(s.Alloc, schema_ref.DBSchemas)
+	defer b.Release()
+	if s.matchesSchema(cmd.GetCatalog(), cmd.GetDBSchemaFilterPattern()) {
+		b.Field(0).(*array.StringBuilder).Append(s.catalog)
+		b.Field(1).(*array.StringBuilder).Append("main")
+	}
+	return schema_ref.DBSchemas, singleRecord(b.NewRecord()), nil
+}
+
+func (s *FlightSQLServer) GetFlightInfoTables(_ context.Context, cmd flightsql.GetTables, desc *flight.FlightDescriptor) (*flight.FlightInfo, error) {
+	if cmd.GetIncludeSchema() {
+		return s.flightInfo(desc, schema_ref.TablesWithIncludedSchema), nil
+	}
+	return s.flightInfo(desc, schema_ref.Tables), nil
+}
+
+// DoGetTables lists the telemetry tables. Their schemas are the ones the
+// caller queries, so tenants do not see the tenant_id column.
+func (s *FlightSQLServer) DoGetTables(ctx context.Context, cmd flightsql.GetTables) (*arrow.Schema, <-chan flight.StreamChunk, error) {
+	schema := schema_ref.Tables
+	if cmd.GetIncludeSchema() {
+		schema = schema_ref.TablesWithIncludedSchema
+	}
+	var tables []string
+	if s.matchesSchema(cmd.GetCatalog(), cmd.GetDBSchemaFilterPattern()) && matchesTableType(cmd.GetTableTypes()) {
+		for _, table := range tenantTables {
+			if pattern := cmd.GetTableNameFilterPattern(); pattern == nil || likePattern(*pattern).MatchString(table) {
+				tables = append(tables, table)
+			}
+		}
+	}
+	var schemas [][]byte
+	if cmd.GetIncludeSchema() && len(tables) > 0 {
+		var err error
+		if schemas, err = s.tableSchemas(ctx, tables); err != nil {
+			return nil, nil, err
+		}
+	} else if _, _, err := s.caller(ctx); err != nil {
+		return nil, nil, err
+	}
+	b := array.NewRecordBuilder(s.Alloc, schema)
+	defer b.Release()
+	for i, table := range tables {
+		b.Field(0).(*array.StringBuilder).Append(s.catalog)
+		b.Field(1).(*array.StringBuilder).Append("main")
+		b.Field(2).(*array.StringBuilder).Append(table)
+		b.Field(3).(*array.StringBuilder).Append(flightTableType)
+		if schemas != nil {
+			b.Field(4).(*array.BinaryBuilder).Append(schemas[i])
+		}
+	}
+	return schema, singleRecord(b.NewRecord()), nil
+}
+
+// tableSchemas returns the serialized Arrow schema of each table as the
+// caller sees it.
+func (s *FlightSQLServer) tableSchemas(ctx context.Context, tables []string) ([][]byte, error) {
+	conn, _, err := s.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	schemas := make([][]byte, len(tables))
+	err = conn.Raw(func(driverConn interface{}) error {
+		dc, ok := driverConn.(driver.Conn)
+		if !ok {
+			return fmt.Errorf("unexpected driver connection %T", driverConn)
+		}
+		ar, err := duckdb.NewArrowFromConn(dc)
+		if err != nil {
+			return err
+		}
+		for i, table := range tables {
+			reader, err := ar.QueryContext(ctx, "SELECT * FROM "+table+" LIMIT 0")
+			if err != nil {
+				return err
+			}
+			schemas[i] = flight.SerializeSchema(reader.Schema(), s.Alloc)
+			reader.Release()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return schemas, nil
+}
+
+func (s *FlightSQLServer) GetFlightInfoTableTypes(_ context.Context, desc *flight.FlightDescriptor) (*flight.FlightInfo, error) {
+	return s.flightInfo(desc, schema_ref.TableTypes), nil
+}
+
+func (s *FlightSQLServer) DoGetTableTypes(ctx context.Context) (*arrow.Schema, <-chan flight.StreamChunk, error) {
+	if _, _, err := s.caller(ctx); err != nil {
+		return nil, nil, err
+	}
+	b := array.NewRecordBuilder(s.Alloc, schema_ref.TableTypes)
+	defer b.Release()
+	b.Field(0).(*array.StringBuilder).Append(flightTableType)
+	return schema_ref.TableTypes, singleRecord(b.NewRecord()), nil
+}
+
+// matchesSchema reports whether the main schema passes the catalog and
+// schema filters of a metadata request.
+func (s *FlightSQLServer) matchesSchema(catalog, schemaPattern *string) bool {
+	if catalog != nil && *catalog != s.catalog {
+		return false
+	}
+	return schemaPattern == nil || likePattern(*schemaPattern).MatchString("main")
+}
+
+func matchesTableType(types []string) bool {
+	if len(types) == 0 {
+		return true
+	}
+	for _, t := range types {
+		if strings.EqualFold(t, flightTableType) {
+			return true
+		}
+	}
+	return false
+}
+
+// likePattern compiles a Flight SQL filter pattern, where % matches any
+// string and _ any character.
+func likePattern(pattern string) *regexp.Regexp {
+	var re strings.Builder
+	re.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			re.WriteString(".*")
+		case '_':
+			re.WriteString(".")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	re.WriteString("$")
+	return regexp.MustCompile(re.String())
+}
+
+func singleRecord(rec arrow.Record) <-chan flight.StreamChunk {
+	ch := make(chan flight.StreamChunk, 1)
+	ch <- flight.StreamChunk{Data: rec}
+	close(ch)
+	return ch
+}
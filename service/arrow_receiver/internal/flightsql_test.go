@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/flight"
+	"github.com/apache/arrow-go/v18/arrow/flight/flightsql"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// startFlightSQLTest serves Flight SQL over newScopeTestDB and returns a
+// client and a context for the tenant acme.
+func startFlightSQLTest(t *testing.T, cfg Config) (*flightsql.Client, context.Context) {
+	t.Helper()
+	s, err := NewFlightSQLServer(cfg, newScopeTestDB(t), NewQuerySlots(cfg.QueryMaxConcurrent), NewTenantResolver(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := grpc.NewServer()
+	s.Register(g)
+	go g.Serve(lis)
+	t.Cleanup(g.Stop)
+	client, err := flightsql.NewClient(lis.Addr().String(), nil, nil, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, metadata.AppendToOutgoingContext(context.Background(), "x-tenant-id", "acme")
+}
+
+// fetch runs query as a statement and returns its rows and the
+// x-query-truncated trailer.
+func fetch(t *testing.T, client *flightsql.Client, ctx context.Context, query string) (rows int64, truncated string) {
+	t.Helper()
+	info, err := client.Execute(ctx, query)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	var trailer metadata.MD
+	reader, err := client.DoGet(ctx, info.Endpoint[0].Ticket, grpc.Trailer(&trailer))
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	defer reader.Release()
+	for reader.Next() {
+		rows += reader.Record().NumRows()
+	}
+	if err := reader.Err(); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	if v := trailer.Get("x-query-truncated"); len(v) > 0 {
+		truncated = v[0]
+	}
+	return rows, truncated
+}
+
+// TestFlightSQLChecksTenantStatements checks that tenant statements are held
+// to the read-only and tenant rules when they are planned, prepared and
+// fetched with a ticket made up by the client.
+func TestFlightSQLChecksTenantStatements(t *testing.T) {
+	client, ctx := startFlightSQLTest(t, defaultConfig())
+	for _, query := range []string{
+		"DELETE FROM traces",
+		"SELECT * FROM scope.main.traces",
+		"SUMMARIZE scope.main.traces",
+		"DESCRIBE scope.main.logs",
+	} {
+		if _, err := client.Execute(ctx, query); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("Execute %s: %v, want PermissionDenied", query, err)
+		}
+		if _, err := client.Prepare(ctx, query); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("Prepare %s: %v, want PermissionDenied", query, err)
+		}
+		ticket, err := flightsql.CreateStatementQueryTicket([]byte(query))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, err := client.DoGet(ctx, &flight.Ticket{Ticket: ticket})
+		if err == nil {
+			reader.Release()
+		}
+		if status.Code(err) != codes.PermissionDenied {
+			t.Errorf("DoGet %s: %v, want PermissionDenied", query, err)
+		}
+	}
+
+	info, err := client.Execute(ctx, "SELECT count(*) AS n FROM traces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := client.DoGet(ctx, info.Endpoint[0].Ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Release()
+	if !reader.Next() {
+		t.Fatal(reader.Err())
+	}
+	if n := reader.Record().Column(0).(*array.Int64).Value(0); n != 3 {
+		t.Errorf("tenant counted %d spans, want its own 3", n)
+	}
+}
+
+func TestFlightSQLSignalsTruncation(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.QueryMaxRows = 2
+	client, ctx := startFlightSQLTest(t, cfg)
+	if rows, truncated := fetch(t, client, ctx, "SELECT span_id FROM traces"); rows != 2 || truncated != "true" {
+		t.Errorf("%d rows, truncated %q; want 2 rows, true", rows, truncated)
+	}
+	if rows, truncated := fetch(t, client, ctx, "SELECT span_id FROM traces LIMIT 2"); rows != 2 || truncated != "" {
+		t.Errorf("%d rows, truncated %q; want 2 rows and no trailer", rows, truncated)
+	}
+}
@@ -1,107 +1,314 @@
 package internal
 
 import (
-	"database/sql"
+	"context"
 	"io"
+	"math"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 
 	arrowpb "github.com/open-telemetry/otel-arrow/api/experimental/arrow/v1"
+	arrowrecord "github.com/open-telemetry/otel-arrow/pkg/otel/arrow_record"
 )
 
 type ArrowHandler struct {
 	arrowpb.UnimplementedArrowTracesServiceServer
 	arrowpb.UnimplementedArrowLogsServiceServer
 	arrowpb.UnimplementedArrowMetricsServiceServer
-	db *sql.DB
+	pipeline          *Pipeline
+	tenants           *TenantResolver
+	quotas            *TenantQuotas
+	memory            *MemoryBudget
+	streamMemoryLimit uint64
+	maxInflight       int
+	maxStreamAge      time.Duration
+	streamIdleTimeout time.Duration
+	// streams numbers the streams for the logs.
+	streams atomic.Uint64
 }
 
-func NewArrowHandler(db *sql.DB) *ArrowHandler {
-	return &ArrowHandler{db: db}
+func NewArrowHandler(cfg Config, pipeline *Pipeline, memory *MemoryBudget, tenants *TenantResolver) *ArrowHandler {
+	return &ArrowHandler{
+		pipeline:          pipeline,
+		tenants:           tenants,
+		quotas:            NewTenantQuotas(cfg.TenantQuotaBytesPerSec, cfg.TenantQuotaBurstBytes),
+		memory:            memory,
+		streamMemoryLimit: uint64(cfg.StreamMemoryLimitBytes),
+		maxInflight:       cfg.QueueSize,
+		maxStreamAge:      cfg.GRPCMaxConnectionAge,
+		streamIdleTimeout: cfg.StreamIdleTimeout,
+	}
 }
 
-func (h *ArrowHandler) ArrowTraces(stream arrowpb.ArrowTracesService_ArrowTracesServer) error {
-	ctx := stream.Context()
-	for {
-		record, err := stream.Recv()
-		if err == io.EOF {
-			log.Info("Stream closed by client.")
-			return nil
-		}
-		if err != nil {
-			log.WithError(err).Error("Error receiving from stream")
-			return err
-		}
-		log.WithField("record", record).Info("Received BatchArrowRecords")
+// payloadSampleRatio holds the math.Float64bits of the share of batches whose
+// payload is logged at debug level. SetupLogger sets it.
+var payloadSampleRatio atomic.Uint64
 
-		if err := ProcessTracesBatch(ctx, h.db, record); err != nil {
-			log.WithError(err).Error("Error processing traces batch")
-		}
+// arrowStream is the part of the three generated stream types the handler uses.
+type arrowStream interface {
+	Context() context.Context
+	Recv() (*arrowpb.BatchArrowRecords, error)
+	Send(*arrowpb.BatchStatus) error
+}
 
-		resp := &arrowpb.BatchStatus{
-			BatchId:     record.BatchId,
-			StatusCode:  arrowpb.StatusCode_OK,
-			StatusMessage: "Received",
-		}
-		if err := stream.Send(resp); err != nil {
-			log.WithError(err).Error("Error sending response")
-			return err
-		}
-	}
+func (h *ArrowHandler) ArrowTraces(stream arrowpb.ArrowTracesService_ArrowTracesServer) error {
+	return h.serve(SignalTraces, stream)
 }
 
 func (h *ArrowHandler) ArrowLogs(stream arrowpb.ArrowLogsService_ArrowLogsServer) error {
-	ctx := stream.Context()
+	return h.serve(SignalLogs, stream)
+}
+
+func (h *ArrowHandler) ArrowMetrics(stream arrowpb.ArrowMetricsService_ArrowMetricsServer) error {
+	return h.serve(SignalMetrics, stream)
+}
+
+// serve receives batches and hands them to the pipeline. Acks are sent by a
+// separate goroutine in the order the batches arrived, once each batch has
+// been stored or rejected. A rejected batch ends the stream: later batches
+// may depend on Arrow schemas it carried, so the exporter has to reconnect.
+// Streams that stay idle, outlive their connection's max age or are drained
+// for shutdown are ended with an OK status once their batches are acked;
+// exporters then reconnect.
+func (h *ArrowHandler) serve(signal Signal, stream arrowStream) error {
+	ctx, err := h.streamContext(stream.Context())
+	if err != nil {
+		return err
+	}
+	tenant := TenantFromContext(ctx)
+	logger := log.WithFields(log.Fields{"stream": h.streams.Add(1), "signal": signal, "tenant": tenant})
+	if p, ok := peer.FromContext(ctx); ok {
+		logger = logger.WithField("peer", p.Addr.String())
+	}
+	logger.Info("Stream opened")
+	metricActiveStreams.Add(1, string(signal))
+	defer metricActiveStreams.Add(-1, string(signal))
+	decoder := newStreamDecoder(
+		arrowrecord.WithMemoryLimit(h.streamMemoryLimit),
+		arrowrecord.WithMeterProvider(h.memory.MeterProvider()),
+	)
+	inflight := make(chan *ingestJob, h.maxInflight)
+	acked := make(chan struct{})
+	go func() {
+		defer close(acked)
+		h.sendAcks(stream, inflight, logger)
+		decoder.close()
+	}()
+	stop := make(chan struct{})
+	finish := func(err error) error {
+		close(stop)
+		close(inflight)
+		<-acked
+		return err
+	}
+	received := receive(stream, stop)
+	idle := newOptionalTimer(h.streamIdleTimeout)
+	defer idle.Stop()
+	expire := newOptionalTimer(h.streamLifetime(ctx))
+	defer expire.Stop()
+
 	for {
-		record, err := stream.Recv()
-		if err == io.EOF {
-			log.Info("Logs stream closed by client.")
-			return nil
-		}
-		if err != nil {
-			log.WithError(err).Error("Error receiving logs from stream")
-			return err
+		var record *arrowpb.BatchArrowRecords
+		select {
+		case r := <-received:
+			if r.err == io.EOF {
+				logger.Info("Stream closed by client")
+				return finish(nil)
+			}
+			if status.Code(r.err) == codes.Canceled {
+				logger.Info("Stream cancelled by client")
+				return finish(r.err)
+			}
+			if r.err != nil {
+				logger.WithError(r.err).Error("Error receiving from stream")
+				return finish(r.err)
+			}
+			record = r.batch
+			idle.Reset(h.streamIdleTimeout)
+		case <-idle.C:
+			logger.Info("Closing idle stream")
+			return finish(nil)
+		case <-expire.C:
+			logger.Info("Closing stream at max connection age")
+			return finish(nil)
+		case <-h.pipeline.Draining():
+			logger.Info("Closing stream for shutdown")
+			return finish(nil)
 		}
-		log.WithField("record", record).Info("Received BatchArrowRecords for logs")
-		if err := ProcessLogsBatch(ctx, h.db, record); err != nil {
-			log.WithError(err).Error("Error processing logs batch")
+		job := newIngestJob(signal, tenant, record)
+		job.decoder = decoder
+		size := batchSize(record)
+		h.logBatch(logger, record, size)
+		metricBatchesReceived.Add(1, string(signal))
+		metricBytesReceived.Add(float64(size), string(signal))
+		job.ctx, job.span = startSpan(ctx, "arrow.receive", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("signal", string(signal)),
+			attribute.String("tenant", tenant),
+			attribute.Int64("batch_id", record.BatchId),
+			attribute.Int("payloads", len(record.ArrowPayloads)),
+			attribute.Int64("bytes", size),
+		))
+		if !h.quotas.Allow(tenant, size) {
+			logger.WithField("batch_id", record.BatchId).Warn("Tenant ingest quota exceeded")
+			return finish(h.reject(inflight, job, "tenant ingest quota exceeded"))
 		}
-		resp := &arrowpb.BatchStatus{
-			BatchId:     record.BatchId,
-			StatusCode:  arrowpb.StatusCode_OK,
-			StatusMessage: "Received",
+		if err := h.memory.Acquire(ctx, size); err != nil {
+			logger.WithError(err).WithField("batch_id", record.BatchId).Warn("Rejecting batch")
+			return finish(h.reject(inflight, job, err.Error()))
 		}
-		if err := stream.Send(resp); err != nil {
-			log.WithError(err).Error("Error sending logs response")
-			return err
+		job.memory, job.reserved = h.memory, size
+		if err := h.pipeline.Submit(job); err != nil {
+			logger.WithError(err).WithField("batch_id", record.BatchId).Warn("Rejecting batch")
+			job.release()
+			return finish(h.reject(inflight, job, err.Error()))
 		}
+		inflight <- job
 	}
 }
 
-func (h *ArrowHandler) ArrowMetrics(stream arrowpb.ArrowMetricsService_ArrowMetricsServer) error {
-	ctx := stream.Context()
-	for {
-		record, err := stream.Recv()
-		if err == io.EOF {
-			log.Info("Metrics stream closed by client.")
-			return nil
+// streamLifetime is the time left until the stream's connection reaches its
+// max age, or zero if there is none.
+func (h *ArrowHandler) streamLifetime(ctx context.Context) time.Duration {
+	if h.maxStreamAge <= 0 {
+		return 0
+	}
+	start, ok := connStart(ctx)
+	if !ok {
+		return h.maxStreamAge
+	}
+	if left := time.Until(start.Add(h.maxStreamAge)); left > 0 {
+		return left
+	}
+	return time.Nanosecond
+}
+
+type received struct {
+	batch *arrowpb.BatchArrowRecords
+	err   error
+}
+
+// receive reads the stream on its own goroutine so serve can also wait on
+// timers. It returns after the first error or once stop is closed.
+func receive(stream arrowStream, stop <-chan struct{}) <-chan received {
+	out := make(chan received)
+	go func() {
+		for {
+			batch, err := stream.Recv()
+			select {
+			case out <- received{batch, err}:
+			case <-stop:
+				return
+			}
+			if err != nil {
+				return
+			}
 		}
-		if err != nil {
-			log.WithError(err).Error("Error receiving metrics from stream")
-			return err
+	}()
+	return out
+}
+
+// optionalTimer is a time.Timer that never fires when created with a zero
+// duration.
+type optionalTimer struct {
+	*time.Timer
+	C <-chan time.Time
+}
+
+func newOptionalTimer(d time.Duration) optionalTimer {
+	if d <= 0 {
+		return optionalTimer{}
+	}
+	t := time.NewTimer(d)
+	return optionalTimer{Timer: t, C: t.C}
+}
+
+func (t optionalTimer) Stop() {
+	if t.Timer != nil {
+		t.Timer.Stop()
+	}
+}
+
+func (t optionalTimer) Reset(d time.Duration) {
+	if t.Timer != nil {
+		t.Timer.Reset(d)
+	}
+}
+
+// reject acks the job with RESOURCE_EXHAUSTED and returns the matching
+// stream error.
+func (h *ArrowHandler) reject(inflight chan<- *ingestJob, job *ingestJob, msg string) error {
+	job.finish(arrowpb.StatusCode_RESOURCE_EXHAUSTED, msg)
+	inflight <- job
+	return status.Error(codes.ResourceExhausted, msg)
+}
+
+// logBatch logs a received batch at debug level, with its payload for a
+// sample of them.
+func (h *ArrowHandler) logBatch(logger *log.Entry, record *arrowpb.BatchArrowRecords, size int64) {
+	if !logger.Logger.IsLevelEnabled(log.DebugLevel) {
+		return
+	}
+	logger = logger.WithFields(log.Fields{"batch_id": record.BatchId, "payloads": len(record.ArrowPayloads), "bytes": size})
+	if ratio := math.Float64frombits(payloadSampleRatio.Load()); ratio > 0 && rand.Float64() < ratio {
+		logger = logger.WithField("payload", record)
+	}
+	logger.Debug("Received batch")
+}
+
+// sendAcks sends the status of every in-flight job in order. After a failed
+// Send it keeps draining so the pipeline never blocks on a dead stream.
+func (h *ArrowHandler) sendAcks(stream arrowStream, inflight <-chan *ingestJob, logger *log.Entry) {
+	var sendErr error
+	for job := range inflight {
+		resp := <-job.done
+		if logger.Logger.IsLevelEnabled(log.DebugLevel) {
+			logger.WithFields(log.Fields{
+				"batch_id":    resp.BatchId,
+				"status":      resp.StatusCode.String(),
+				"items":       job.rows.Len(),
+				"duration_ms": float64(time.Since(job.received).Microseconds()) / 1000,
+			}).Debug("Acked batch")
 		}
-		log.WithField("record", record).Info("Received BatchArrowRecords for metrics")
-		if err := ProcessMetricsBatch(ctx, h.db, record); err != nil {
-			log.WithError(err).Error("Error processing metrics batch")
+		job.span.SetAttributes(attribute.String("status", resp.StatusCode.String()))
+		if resp.StatusCode != arrowpb.StatusCode_OK {
+			job.span.SetStatus(otelcodes.Error, resp.StatusMessage)
 		}
-		resp := &arrowpb.BatchStatus{
-			BatchId:     record.BatchId,
-			StatusCode:  arrowpb.StatusCode_OK,
-			StatusMessage: "Received",
+		if sendErr != nil {
+			job.span.End()
+			continue
 		}
-		if err := stream.Send(resp); err != nil {
-			log.WithError(err).Error("Error sending metrics response")
-			return err
+		if sendErr = stream.Send(resp); sendErr != nil {
+			logger.WithError(sendErr).Error("Error sending response")
 		}
+		endSpan(job.span, sendErr)
 	}
-}
\ No newline at end of file
+}
+
+// streamContext tags the stream context with the caller's tenant.
+func (h *ArrowHandler) streamContext(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	tenant, err := h.tenants.FromMetadata(md)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	return WithTenant(ctx, tenant), nil
+}
+
+// batchSize is the number of Arrow payload bytes in the batch.
+func batchSize(record *arrowpb.BatchArrowRecords) int64 {
+	var n int64
+	for _, payload := range record.ArrowPayloads {
+		n += int64(len(payload.Record))
+	}
+	return n
+}
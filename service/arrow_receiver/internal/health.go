@@ -0,0 +1,181 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	arrowpb "github.com/open-telemetry/otel-arrow/api/experimental/arrow/v1"
+)
+
+// arrowServices maps each signal to the gRPC service that ingests it.
+var arrowServices = map[Signal]string{
+	SignalTraces:  arrowpb.ArrowTracesService_ServiceDesc.ServiceName,
+	SignalLogs:    arrowpb.ArrowLogsService_ServiceDesc.ServiceName,
+	SignalMetrics: arrowpb.ArrowMetricsService_ServiceDesc.ServiceName,
+}
+
+// healthSignals fixes the order signals are checked and reported in.
+var healthSignals = []Signal{SignalTraces, SignalLogs, SignalMetrics}
+
+// Health periodically checks that DuckDB answers, that the table of each
+// signal can be read and that the ingest queues have room. It reports each
+// Arrow service through grpc.health.v1, the overall status "" as SERVING only
+// while all of them are, and the problems through /readyz.
+type Health struct {
+	db       *sql.DB
+	pipeline *Pipeline
+	server   *health.Server
+	interval time.Duration
+
+	mu sync.RWMutex
+	// problems lists why each signal cannot be ingested; those of the whole
+	// receiver are listed under every signal.
+	problems map[Signal][]string
+	stop     chan struct{}
+	stopped  bool
+}
+
+func NewHealth(db *sql.DB, pipeline *Pipeline, interval time.Duration) *Health {
+	h := &Health{
+		db:       db,
+		pipeline: pipeline,
+		server:   health.NewServer(),
+		interval: interval,
+		problems: map[Signal][]string{},
+		stop:     make(chan struct{}),
+	}
+	for _, signal := range healthSignals {
+		h.problems[signal] = []string{"not checked yet"}
+	}
+	h.publish()
+	return h
+}
+
+// Register adds the grpc.health.v1 service to s.
+func (h *Health) Register(s *grpc.Server) {
+	healthpb.RegisterHealthServer(s, h.server)
+}
+
+// Start runs the first check and then checks every interval until Shutdown.
+func (h *Health) Start() {
+	h.check()
+	go func() {
+		ticker := time.NewTicker(h.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				h.check()
+			case <-h.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Shutdown stops checking and reports every service as NOT_SERVING.
+func (h *Health) Shutdown() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stopped {
+		return
+	}
+	h.stopped = true
+	close(h.stop)
+	for _, signal := range healthSignals {
+		h.problems[signal] = []string{"shutting down"}
+	}
+	h.server.Shutdown()
+}
+
+// Problems lists why the receiver is not ready. It is empty when ready.
+func (h *Health) Problems() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.allProblems()
+}
+
+// allProblems lists the problems of every signal once. Callers hold h.mu.
+func (h *Health) allProblems() []string {
+	var all []string
+	seen := map[string]bool{}
+	for _, signal := range healthSignals {
+		for _, p := range h.problems[signal] {
+			if !seen[p] {
+				seen[p] = true
+				all = append(all, p)
+			}
+		}
+	}
+	return all
+}
+
+func (h *Health) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), h.interval)
+	defer cancel()
+	var shared []string
+	_, dbErr := h.db.ExecContext(ctx, "SELECT 1")
+	if dbErr != nil {
+		shared = append(shared, "duckdb unavailable: "+dbErr.Error())
+	}
+	if h.pipeline.Saturated() {
+		shared = append(shared, "ingest queue saturated")
+	}
+	if err := h.pipeline.InsertError(); err != nil {
+		shared = append(shared, "retrying insert of acked batch: "+err.Error())
+	}
+	problems := map[Signal][]string{}
+	for _, signal := range healthSignals {
+		problems[signal] = shared
+		if dbErr != nil {
+			continue
+		}
+		if _, err := h.db.ExecContext(ctx, "SELECT * FROM "+string(signal)+" LIMIT 0"); err != nil {
+			problems[signal] = append(append([]string(nil), shared...), string(signal)+" table unavailable: "+err.Error())
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stopped {
+		return
+	}
+	wasReady := len(h.allProblems()) == 0
+	for _, signal := range healthSignals {
+		was, now := h.problems[signal], problems[signal]
+		if len(now) > 0 && len(was) == 0 {
+			log.WithFields(log.Fields{"service": arrowServices[signal], "problems": now}).Warn("Service not serving")
+		} else if len(now) == 0 && len(was) > 0 {
+			log.WithField("service", arrowServices[signal]).Info("Service serving")
+		}
+	}
+	h.problems = problems
+	if all := h.allProblems(); len(all) > 0 && wasReady {
+		log.WithField("problems", all).Warn("Receiver not ready")
+	} else if len(all) == 0 && !wasReady {
+		log.Info("Receiver ready")
+	}
+	h.publish()
+}
+
+// publish sets the status of each service from its problems and the overall
+// status from all of them. Callers hold h.mu or own h.
+func (h *Health) publish() {
+	overall := healthpb.HealthCheckResponse_SERVING
+	for _, signal := range healthSignals {
+		status := healthpb.HealthCheckResponse_SERVING
+		if len(h.problems[signal]) > 0 {
+			status = healthpb.HealthCheckResponse_NOT_SERVING
+			overall = status
+		}
+		h.server.SetServingStatus(arrowServices[signal], status)
+	}
+	h.server.SetServingStatus("", overall)
+}
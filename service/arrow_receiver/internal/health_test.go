@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// TestHealthPerService checks that a signal whose table cannot be read is
+// NOT_SERVING on its own while the other services keep serving.
+func TestHealthPerService(t *testing.T) {
+	db, err := InitDB(filepath.Join(t.TempDir(), "health.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	pipeline := &Pipeline{queue: make(chan *ingestJob, 1), writes: make(chan *ingestJob, 1)}
+	h := NewHealth(db, pipeline, time.Second)
+	status := func(service string) healthpb.HealthCheckResponse_ServingStatus {
+		t.Helper()
+		resp, err := h.server.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Status
+	}
+	want := func(service string, s healthpb.HealthCheckResponse_ServingStatus) {
+		t.Helper()
+		if got := status(service); got != s {
+			t.Errorf("service %q: %s, want %s", service, got, s)
+		}
+	}
+
+	h.check()
+	want("", healthpb.HealthCheckResponse_SERVING)
+	for _, service := range arrowServices {
+		want(service, healthpb.HealthCheckResponse_SERVING)
+	}
+
+	if _, err := db.Exec("ALTER TABLE logs RENAME TO logs_moved"); err != nil {
+		t.Fatal(err)
+	}
+	h.check()
+	want("", healthpb.HealthCheckResponse_NOT_SERVING)
+	want(arrowServices[SignalLogs], healthpb.HealthCheckResponse_NOT_SERVING)
+	want(arrowServices[SignalTraces], healthpb.HealthCheckResponse_SERVING)
+	want(arrowServices[SignalMetrics], healthpb.HealthCheckResponse_SERVING)
+	if p := h.Problems(); len(p) != 1 {
+		t.Errorf("problems %q, want the logs table only", p)
+	}
+
+	if _, err := db.Exec("ALTER TABLE logs_moved RENAME TO logs"); err != nil {
+		t.Fatal(err)
+	}
+	h.check()
+	want("", healthpb.HealthCheckResponse_SERVING)
+	want(arrowServices[SignalLogs], healthpb.HealthCheckResponse_SERVING)
+}
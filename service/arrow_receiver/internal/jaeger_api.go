@@ -0,0 +1,539 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	ptrace "go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+// jaegerNoService names the process and service of spans without a
+// service.name, as the OpenTelemetry Jaeger translator does.
+const jaegerNoService = "OTLP_ResourceNoServiceName"
+
+// jaegerServiceSQL is the Jaeger service name of a traces row.
+var jaegerServiceSQL = `coalesce(json_extract_string(resource, '$."service.name"'), '` + jaegerNoService + `')`
+
+// jaegerResponse is the envelope of every Jaeger query API response.
+type jaegerResponse struct {
+	Data   interface{}   `json:"data"`
+	Total  int           `json:"total"`
+	Limit  int           `json:"limit"`
+	Offset int           `json:"offset"`
+	Errors []jaegerError `json:"errors"`
+}
+
+type jaegerError struct {
+	Code int    `json:"code,omitempty"`
+	Msg  string `json:"msg"`
+}
+
+type jaegerTrace struct {
+	TraceID   string                   `json:"traceID"`
+	Spans     []jaegerSpan             `json:"spans"`
+	Processes map[string]jaegerProcess `json:"processes"`
+	Warnings  []string                 `json:"warnings"`
+}
+
+type jaegerSpan struct {
+	TraceID       string            `json:"traceID"`
+	SpanID        string            `json:"spanID"`
+	Flags         uint32            `json:"flags,omitempty"`
+	OperationName string            `json:"operationName"`
+	References    []jaegerReference `json:"references"`
+	StartTime     int64             `json:"startTime"`
+	Duration      int64             `json:"duration"`
+	Tags          []jaegerKeyValue  `json:"tags"`
+	Logs          []jaegerLog       `json:"logs"`
+	ProcessID     string            `json:"processID"`
+	Warnings      []string          `json:"warnings"`
+}
+
+type jaegerReference struct {
+	RefType string `json:"refType"`
+	TraceID string `json:"traceID"`
+	SpanID  string `json:"spanID"`
+}
+
+type jaegerKeyValue struct {
+	Key   string      `json:"key"`
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+type jaegerLog struct {
+	Timestamp int64            `json:"timestamp"`
+	Fields    []jaegerKeyValue `json:"fields"`
+}
+
+type jaegerProcess struct {
+	ServiceName string           `json:"serviceName"`
+	Tags        []jaegerKeyValue `json:"tags"`
+}
+
+func writeJaeger(w http.ResponseWriter, data interface{}, total int) {
+	json.NewEncoder(w).Encode(jaegerResponse{Data: data, Total: total})
+}
+
+func writeJaegerError(w http.ResponseWriter, status int, msg string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(jaegerResponse{Errors: []jaegerError{{Code: status, Msg: msg}}})
+}
+
+// jaegerCaller checks the method of a Jaeger API call and resolves the
+// caller; ok is false when a response was already written.
+func (a *queryAPI) jaegerCaller(w http.ResponseWriter, r *http.Request) (tenant string, admin bool, ok bool) {
+	if a.cors(w, r, "GET") {
+		return "", false, false
+	}
+	if r.Method != "GET" {
+		writeJaegerError(w, http.StatusMethodNotAllowed, "GET only")
+		return "", false, false
+	}
+	return a.caller(w, r)
+}
+
+// handleJaegerServices lists the service names found in the traces.
+func (a *queryAPI) handleJaegerServices(w http.ResponseWriter, r *http.Request) {
+	tenant, admin, ok := a.jaegerCaller(w, r)
+	if !ok {
+		return
+	}
+	ctx, conn, logger, done := a.readRequest(w, r, tenant, admin)
+	if conn == nil {
+		return
+	}
+	defer done()
+	services, err := queryStrings(ctx, conn, `
+		SELECT DISTINCT `+jaegerServiceSQL+` AS service FROM traces ORDER BY service`)
+	if err != nil {
+		writeQueryError(ctx, w, r, err, logger)
+		return
+	}
+	writeJaeger(w, services, len(services))
+}
+
+// handleJaegerOperations lists the span names of a service.
+func (a *queryAPI) handleJaegerOperations(w http.ResponseWriter, r *http.Request) {
+	tenant, admin, ok := a.jaegerCaller(w, r)
+	if !ok {
+		return
+	}
+	ctx, conn, logger, done := a.readRequest(w, r, tenant, admin)
+	if conn == nil {
+		return
+	}
+	defer done()
+	operations, err := queryStrings(ctx, conn, `
+		SELECT DISTINCT name FROM traces
+		WHERE `+jaegerServiceSQL+` = ? ORDER BY name`, r.PathValue("service"))
+	if err != nil {
+		writeQueryError(ctx, w, r, err, logger)
+		return
+	}
+	writeJaeger(w, operations, len(operations))
+}
+
+func queryStrings(ctx context.Context, conn *TenantConn, query string, args ...interface{}) ([]string, error) {
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []string{}
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+// handleJaegerTrace returns one trace in the Jaeger model.
+func (a *queryAPI) handleJaegerTrace(w http.ResponseWriter, r *http.Request) {
+	tenant, admin, ok := a.jaegerCaller(w, r)
+	if !ok {
+		return
+	}
+	traceID, err := jaegerTraceID(r.PathValue("traceId"))
+	if err != nil {
+		writeJaegerError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ctx, conn, logger, done := a.readRequest(w, r, tenant, admin)
+	if conn == nil {
+		return
+	}
+	defer done()
+	traces, err := loadJaegerTraces(ctx, conn, []string{traceID}, a.cfg.QueryMaxRows)
+	if err != nil {
+		writeQueryError(ctx, w, r, err, logger)
+		return
+	}
+	if len(traces) == 0 {
+		writeJaegerError(w, http.StatusNotFound, "trace not found")
+		return
+	}
+	writeJaeger(w, traces, len(traces))
+}
+
+// jaegerTraceID parses a trace ID as Jaeger does, up to 32 hex digits with
+// leading zeros dropped, into the 32 digits stored in the traces table.
+func jaegerTraceID(id string) (string, error) {
+	var hi, lo uint64
+	var err error
+	switch {
+	case len(id) > 32:
+		return "", fmt.Errorf("TraceID cannot be longer than 32 hex characters: %s", id)
+	case len(id) > 16:
+		if hi, err = strconv.ParseUint(id[:len(id)-16], 16, 64); err == nil {
+			lo, err = strconv.ParseUint(id[len(id)-16:], 16, 64)
+		}
+	default:
+		lo, err = strconv.ParseUint(id, 16, 64)
+	}
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%016x%016x", hi, lo), nil
+}
+
+// jaegerID formats a stored trace ID as Jaeger does, without the high 64
+// bits when they are zero.
+func jaegerID(id string) string {
+	if len(id) == 32 && strings.HasPrefix(id, "0000000000000000") {
+		return id[16:]
+	}
+	return id
+}
+
+// handleJaegerSearch finds traces like Jaeger's /api/traces: by service,
+// operation, tags, duration and a start window in microseconds, or by a list
+// of traceID parameters.
+func (a *queryAPI) handleJaegerSearch(w http.ResponseWriter, r *http.Request) {
+	tenant, admin, ok := a.jaegerCaller(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	var traceIDs []string
+	for _, v := range q["traceID"] {
+		id, err := jaegerTraceID(v)
+		if err != nil {
+			writeJaegerError(w, http.StatusBadRequest, fmt.Sprintf("invalid trace ID %q: %v", v, err))
+			return
+		}
+		traceIDs = append(traceIDs, id)
+	}
+	var search *traceSearch
+	if len(traceIDs) == 0 {
+		var err error
+		if search, err = parseJaegerSearch(q, a.cfg.QueryMaxRows); err != nil {
+			writeJaegerError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	ctx, conn, logger, done := a.readRequest(w, r, tenant, admin)
+	if conn == nil {
+		return
+	}
+	defer done()
+	if search != nil {
+		summaries, _, err := searchTraces(ctx, conn, search)
+		if err != nil {
+			writeQueryError(ctx, w, r, err, logger)
+			return
+		}
+		for _, s := range summaries {
+			traceIDs = append(traceIDs, s.TraceID)
+		}
+	}
+	traces, err := loadJaegerTraces(ctx, conn, traceIDs, a.cfg.QueryMaxRows)
+	if err != nil {
+		writeQueryError(ctx, w, r, err, logger)
+		return
+	}
+	writeJaeger(w, traces, len(traces))
+}
+
+// parseJaegerSearch translates the parameters of a Jaeger search. Tags match
+// span attributes, except error=true, which matches error status, and
+// span.kind.
+func parseJaegerSearch(q url.Values, maxRows int) (*traceSearch, error) {
+	service := q.Get("service")
+	if service == "" {
+		return nil, fmt.Errorf("parameter 'service' is required")
+	}
+	s := &traceSearch{}
+	if service == jaegerNoService {
+		s.filter("service IS NULL")
+	} else {
+		s.filter("service = ?", service)
+	}
+	if op := q.Get("operation"); op != "" {
+		s.filter("name = ?", op)
+	}
+	tags := map[string]string{}
+	if raw := q.Get("tags"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &tags); err != nil {
+			return nil, fmt.Errorf("malformed 'tags' parameter: %w", err)
+		}
+	}
+	for _, tag := range q["tag"] {
+		key, value, ok := strings.Cut(tag, ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed 'tag' parameter %q, expected key:value", tag)
+		}
+		tags[key] = value
+	}
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := tags[key]
+		switch key {
+		case "error":
+			if value == "true" {
+				s.filter("status_code = ?", int(ptrace.StatusCodeError))
+			} else {
+				s.filter("status_code <> ?", int(ptrace.StatusCodeError))
+			}
+		case "span.kind":
+			kind, ok := jaegerSpanKinds[value]
+			if !ok {
+				return nil, fmt.Errorf("unknown span.kind %q", value)
+			}
+			s.filter("kind = ?", int(kind))
+		default:
+			if err := s.attribute(key, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, bound := range []struct{ param, op string }{{"minDuration", ">="}, {"maxDuration", "<="}} {
+		v := q.Get(bound.param)
+		if v == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", bound.param, err)
+		}
+		s.filter("end_ns - start_ns "+bound.op+" ?", d.Nanoseconds())
+	}
+	for _, bound := range []struct{ param, op string }{{"start", ">="}, {"end", "<="}} {
+		v := q.Get(bound.param)
+		if v == "" {
+			continue
+		}
+		micros, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be Unix microseconds", bound.param)
+		}
+		s.filter("start_ns "+bound.op+" ?", micros*1000)
+	}
+	limit := defaultTraceSearchLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("limit must be a non-negative integer")
+		}
+		if n > 0 {
+			limit = n
+		}
+	}
+	s.page = &queryPage{Size: min(limit, maxRows)}
+	return s, nil
+}
+
+// jaegerSpanKinds maps the span.kind tag to ptrace.SpanKind.
+var jaegerSpanKinds = map[string]ptrace.SpanKind{
+	"internal": ptrace.SpanKindInternal,
+	"server":   ptrace.SpanKindServer,
+	"client":   ptrace.SpanKindClient,
+	"producer": ptrace.SpanKindProducer,
+	"consumer": ptrace.SpanKindConsumer,
+}
+
+// loadJaegerTraces reads the traces in the order of traceIDs, skipping those
+// that do not exist. At most limit spans are read in all; traces that may
+// have lost spans to the limit carry a warning.
+func loadJaegerTraces(ctx context.Context, conn *TenantConn, traceIDs []string, limit int) ([]jaegerTrace, error) {
+	spans, truncated, err := loadTraceSpans(ctx, conn, traceIDs, limit)
+	if err != nil {
+		return nil, err
+	}
+	byTrace := map[string][]*traceSpan{}
+	for _, s := range spans {
+		byTrace[s.TraceID] = append(byTrace[s.TraceID], s)
+	}
+	traces := []jaegerTrace{}
+	for _, id := range traceIDs {
+		if len(byTrace[id]) == 0 {
+			continue
+		}
+		trace, err := toJaegerTrace(id, byTrace[id])
+		if err != nil {
+			return nil, err
+		}
+		if truncated {
+			trace.Warnings = append(trace.Warnings, fmt.Sprintf("result limited to %d spans; this trace may be incomplete", limit))
+		}
+		traces = append(traces, trace)
+		delete(byTrace, id)
+	}
+	return traces, nil
+}
+
+// toJaegerTrace maps spans to the Jaeger model the way the OpenTelemetry
+// Jaeger translator does: the resource becomes the process, events become
+// logs, the parent and links become references and kind and status become
+// tags. Tags are sorted by key and log fields start with the event name, as
+// jaeger-query's adjusters leave them.
+func toJaegerTrace(traceID string, spans []*traceSpan) (jaegerTrace, error) {
+	trace := jaegerTrace{TraceID: jaegerID(traceID), Spans: make([]jaegerSpan, 0, len(spans)), Processes: map[string]jaegerProcess{}}
+	processIDs := map[string]string{}
+	for _, s := range spans {
+		processID, ok := processIDs[string(s.Resource)]
+		if !ok {
+			processID = fmt.Sprintf("p%d", len(processIDs)+1)
+			processIDs[string(s.Resource)] = processID
+			process, err := toJaegerProcess(s.Resource)
+			if err != nil {
+				return trace, fmt.Errorf("span %s: resource: %w", s.SpanID, err)
+			}
+			trace.Processes[processID] = process
+		}
+		span := jaegerSpan{
+			TraceID:       jaegerID(s.TraceID),
+			SpanID:        s.SpanID,
+			OperationName: s.Name,
+			References:    []jaegerReference{},
+			StartTime:     s.StartTime.UnixMicro(),
+			Duration:      s.DurationNanos / 1000,
+			Logs:          make([]jaegerLog, 0, len(s.Events)),
+			ProcessID:     processID,
+		}
+		if s.ParentSpanID != "" {
+			span.References = append(span.References, jaegerReference{RefType: "CHILD_OF", TraceID: jaegerID(s.TraceID), SpanID: s.ParentSpanID})
+		}
+		for _, l := range s.Links {
+			span.References = append(span.References, jaegerReference{RefType: "FOLLOWS_FROM", TraceID: jaegerID(l.TraceID), SpanID: l.SpanID})
+		}
+		attrs, err := decodeAttributes(s.Attributes)
+		if err != nil {
+			return trace, fmt.Errorf("span %s: attributes: %w", s.SpanID, err)
+		}
+		span.Tags = jaegerTags(attrs)
+		if s.kind != ptrace.SpanKindUnspecified {
+			span.Tags = append(span.Tags, jaegerKeyValue{Key: "span.kind", Type: "string", Value: strings.ToLower(s.kind.String())})
+		}
+		switch s.statusCode {
+		case ptrace.StatusCodeError:
+			span.Tags = append(span.Tags,
+				jaegerKeyValue{Key: "error", Type: "bool", Value: true},
+				jaegerKeyValue{Key: "otel.status_code", Type: "string", Value: "ERROR"})
+		case ptrace.StatusCodeOk:
+			span.Tags = append(span.Tags, jaegerKeyValue{Key: "otel.status_code", Type: "string", Value: "OK"})
+		}
+		if s.Status.Message != "" {
+			span.Tags = append(span.Tags, jaegerKeyValue{Key: "otel.status_description", Type: "string", Value: s.Status.Message})
+		}
+		if s.TraceState != "" {
+			span.Tags = append(span.Tags, jaegerKeyValue{Key: "w3c.tracestate", Type: "string", Value: s.TraceState})
+		}
+		sortJaegerTags(span.Tags)
+		for _, e := range s.Events {
+			fields := jaegerTags(e.Attributes)
+			if _, ok := e.Attributes["event"]; !ok && e.Name != "" {
+				fields = append([]jaegerKeyValue{{Key: "event", Type: "string", Value: e.Name}}, fields...)
+			}
+			span.Logs = append(span.Logs, jaegerLog{Timestamp: e.Time.UnixMicro(), Fields: fields})
+		}
+		trace.Spans = append(trace.Spans, span)
+	}
+	return trace, nil
+}
+
+func toJaegerProcess(resource json.RawMessage) (jaegerProcess, error) {
+	attrs, err := decodeAttributes(resource)
+	if err != nil {
+		return jaegerProcess{}, err
+	}
+	process := jaegerProcess{ServiceName: jaegerNoService}
+	if name, ok := attrs["service.name"].(string); ok {
+		process.ServiceName = name
+	}
+	delete(attrs, "service.name")
+	process.Tags = jaegerTags(attrs)
+	return process, nil
+}
+
+// decodeAttributes decodes a stored attribute map, keeping integers exact.
+func decodeAttributes(raw json.RawMessage) (map[string]interface{}, error) {
+	attrs := map[string]interface{}{}
+	if err := decodeJSONNumbers(string(raw), &attrs); err != nil {
+		return nil, err
+	}
+	return attrs, nil
+}
+
+// jaegerTags converts attributes to typed Jaeger tags sorted by key. Maps and
+// arrays become their JSON text.
+func jaegerTags(attrs map[string]interface{}) []jaegerKeyValue {
+	tags := make([]jaegerKeyValue, 0, len(attrs))
+	for key, value := range attrs {
+		tag := jaegerKeyValue{Key: key, Type: "string", Value: value}
+		switch v := value.(type) {
+		case string:
+		case bool:
+			tag.Type = "bool"
+		case json.Number:
+			if n, err := v.Int64(); err == nil {
+				tag.Type, tag.Value = "int64", n
+			} else {
+				f, _ := v.Float64()
+				tag.Type, tag.Value = "float64", f
+			}
+		case float64:
+			if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+				tag.Type, tag.Value = "int64", int64(v)
+			} else {
+				tag.Type = "float64"
+			}
+		case nil:
+			tag.Value = ""
+		default:
+			text, _ := json.Marshal(v)
+			tag.Value = string(text)
+		}
+		tags = append(tags, tag)
+	}
+	sortJaegerTags(tags)
+	return tags
+}
+
+// jaegerTypeOrder ranks tag types as Jaeger's ValueType enum does.
+var jaegerTypeOrder = map[string]int{"string": 0, "bool": 1, "int64": 2, "float64": 3, "binary": 4}
+
+// sortJaegerTags sorts tags by key, then type, as Jaeger sorts key-values.
+func sortJaegerTags(tags []jaegerKeyValue) {
+	sort.SliceStable(tags, func(i, j int) bool {
+		if tags[i].Key != tags[j].Key {
+			return tags[i].Key < tags[j].Key
+		}
+		return jaegerTypeOrder[tags[i].Type] < jaegerTypeOrder[tags[j].Type]
+	})
+}
@@ -0,0 +1,258 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+// jaegerTestTraces is one trace of two services: a server span with an
+// event, a failed client span that links to another trace, and an internal
+// span of a resource without service.name.
+func jaegerTestTraces() ptrace.Traces {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(ms int) pcommon.Timestamp {
+		return pcommon.NewTimestampFromTime(start.Add(time.Duration(ms) * time.Millisecond))
+	}
+	traceID := pcommon.TraceID{0, 0, 0, 0, 0, 0, 0, 0, 0x13, 0xc9, 0x96, 0x20, 0xc7, 0xc0, 0x4b, 0xda}
+	traces := ptrace.NewTraces()
+
+	rs := traces.ResourceSpans().AppendEmpty()
+	rs.Resource().Attributes().PutStr("service.name", "frontend")
+	rs.Resource().Attributes().PutStr("host.name", "web-1")
+	spans := rs.ScopeSpans().AppendEmpty().Spans()
+
+	server := spans.AppendEmpty()
+	server.SetTraceID(traceID)
+	server.SetSpanID(pcommon.SpanID{1, 1, 1, 1, 1, 1, 1, 1})
+	server.SetName("GET /checkout")
+	server.SetKind(ptrace.SpanKindServer)
+	server.SetStartTimestamp(at(0))
+	server.SetEndTimestamp(at(120))
+	server.Status().SetCode(ptrace.StatusCodeOk)
+	server.TraceState().FromRaw("vendor=a")
+	server.Attributes().PutStr("http.method", "GET")
+	server.Attributes().PutInt("http.status_code", 200)
+	server.Attributes().PutDouble("sample.rate", 0.5)
+	server.Attributes().PutBool("cache.hit", false)
+	server.Attributes().PutEmptySlice("tags").AppendEmpty().SetStr("a")
+	event := server.Events().AppendEmpty()
+	event.SetName("request.received")
+	event.SetTimestamp(at(1))
+	event.Attributes().PutInt("bytes", 512)
+
+	client := spans.AppendEmpty()
+	client.SetTraceID(traceID)
+	client.SetSpanID(pcommon.SpanID{2, 2, 2, 2, 2, 2, 2, 2})
+	client.SetParentSpanID(server.SpanID())
+	client.SetName("charge")
+	client.SetKind(ptrace.SpanKindClient)
+	client.SetStartTimestamp(at(10))
+	client.SetEndTimestamp(at(110))
+	client.Status().SetCode(ptrace.StatusCodeError)
+	client.Status().SetMessage("card declined")
+	link := client.Links().AppendEmpty()
+	link.SetTraceID(pcommon.TraceID{0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa})
+	link.SetSpanID(pcommon.SpanID{0xbb, 0xbb, 0xbb, 0xbb, 0xbb, 0xbb, 0xbb, 0xbb})
+
+	rs = traces.ResourceSpans().AppendEmpty()
+	rs.Resource().Attributes().PutStr("k8s.pod.name", "worker-0")
+	internal := rs.ScopeSpans().AppendEmpty().Spans().AppendEmpty()
+	internal.SetTraceID(traceID)
+	internal.SetSpanID(pcommon.SpanID{3, 3, 3, 3, 3, 3, 3, 3})
+	internal.SetParentSpanID(client.SpanID())
+	internal.SetName("score")
+	internal.SetKind(ptrace.SpanKindInternal)
+	internal.SetStartTimestamp(at(20))
+	internal.SetEndTimestamp(at(30))
+	return traces
+}
+
+func newJaegerTestServer(t *testing.T) http.Handler {
+	t.Helper()
+	cfg := defaultConfig()
+	db, err := InitDB(filepath.Join(t.TempDir(), "jaeger.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	ctx := context.Background()
+	rows, err := NewRowWriter(ctx, db, NewLogIndex(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rows.Write(ctx, RowBatch{Traces: TracesToRows(jaegerTestTraces(), DefaultTenant)}); err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+
+	api := &queryAPI{cfg: cfg, db: db, tenants: NewTenantResolver(cfg), slots: NewQuerySlots(cfg.QueryMaxConcurrent), logIndex: NewLogIndex(cfg)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/services", api.handleJaegerServices)
+	mux.HandleFunc("/api/services/{service}/operations", api.handleJaegerOperations)
+	mux.HandleFunc("/api/traces", api.handleJaegerSearch)
+	mux.HandleFunc("/api/traces/{traceId}", api.handleJaegerTrace)
+	return mux
+}
+
+// TestJaegerAPIResponses compares the responses with what jaeger-query
+// returns for the same spans, kept in testdata/jaeger; see its README.
+func TestJaegerAPIResponses(t *testing.T) {
+	server := newJaegerTestServer(t)
+	for _, tc := range []struct {
+		fixture, url string
+		status       int
+	}{
+		{"services.json", "/api/services", http.StatusOK},
+		{"operations.json", "/api/services/frontend/operations", http.StatusOK},
+		{"operations_no_service.json", "/api/services/OTLP_ResourceNoServiceName/operations", http.StatusOK},
+		{"search.json", "/api/traces?service=frontend&start=1714564800000000&end=1714564801000000", http.StatusOK},
+		{"search_error.json", "/api/traces?service=frontend&tags=%7B%22error%22%3A%22true%22%7D", http.StatusOK},
+		{"search_none.json", "/api/traces?service=frontend&operation=charge&tags=%7B%22error%22%3A%22false%22%7D", http.StatusOK},
+		{"trace.json", "/api/traces/13c99620c7c04bda", http.StatusOK},
+		{"trace.json", "/api/traces/000000000000000013C99620C7C04BDA", http.StatusOK},
+		{"trace_not_found.json", "/api/traces/ffff", http.StatusNotFound},
+		{"trace_invalid.json", "/api/traces/xyz", http.StatusBadRequest},
+	} {
+		t.Run(tc.url, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, httptest.NewRequest("GET", tc.url, nil))
+			if rec.Code != tc.status {
+				t.Fatalf("GET %s: status %d, want %d: %s", tc.url, rec.Code, tc.status, rec.Body)
+			}
+			path := filepath.Join("testdata", "jaeger", tc.fixture)
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := canonicalJSON(rec.Body.Bytes())
+			if err != nil {
+				t.Fatalf("GET %s: invalid JSON: %v", tc.url, err)
+			}
+			if want, err = canonicalJSON(want); err != nil {
+				t.Fatalf("%s: %v", path, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("GET %s differs from %s:\ngot  %s\nwant %s", tc.url, path, got, want)
+			}
+		})
+	}
+}
+
+// canonicalJSON re-encodes a JSON document so that formatting and the order
+// of object keys do not matter.
+func canonicalJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// TestJaegerTraceMapping checks the OpenTelemetry to Jaeger mapping of the
+// test trace field by field.
+func TestJaegerTraceMapping(t *testing.T) {
+	server := newJaegerTestServer(t)
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("GET", "/api/traces/13c99620c7c04bda", nil))
+	var resp struct {
+		Data []jaegerTrace `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Data) != 1 {
+		t.Fatalf("got %d traces, want 1", len(resp.Data))
+	}
+	trace := resp.Data[0]
+	if trace.TraceID != "13c99620c7c04bda" {
+		t.Errorf("traceID = %q", trace.TraceID)
+	}
+	spans := map[string]jaegerSpan{}
+	for _, s := range trace.Spans {
+		spans[s.OperationName] = s
+	}
+	tags := func(s jaegerSpan) map[string]jaegerKeyValue {
+		m := map[string]jaegerKeyValue{}
+		for _, kv := range s.Tags {
+			m[kv.Key] = kv
+		}
+		return m
+	}
+	wantTag := func(span, key, typ string, value interface{}) {
+		t.Helper()
+		kv, ok := tags(spans[span])[key]
+		if !ok {
+			t.Errorf("%s: no %s tag", span, key)
+			return
+		}
+		if kv.Type != typ || kv.Value != value {
+			t.Errorf("%s: tag %s = %s %v, want %s %v", span, key, kv.Type, kv.Value, typ, value)
+		}
+	}
+
+	// Kind and status become tags.
+	wantTag("GET /checkout", "span.kind", "string", "server")
+	wantTag("GET /checkout", "otel.status_code", "string", "OK")
+	wantTag("charge", "span.kind", "string", "client")
+	wantTag("charge", "error", "bool", true)
+	wantTag("charge", "otel.status_code", "string", "ERROR")
+	wantTag("charge", "otel.status_description", "string", "card declined")
+	wantTag("score", "span.kind", "string", "internal")
+	if _, ok := tags(spans["score"])["otel.status_code"]; ok {
+		t.Error("score: unset status must not become a tag")
+	}
+	wantTag("GET /checkout", "w3c.tracestate", "string", "vendor=a")
+
+	// Attributes keep their types; arrays become JSON text.
+	wantTag("GET /checkout", "http.method", "string", "GET")
+	wantTag("GET /checkout", "http.status_code", "int64", float64(200))
+	wantTag("GET /checkout", "sample.rate", "float64", 0.5)
+	wantTag("GET /checkout", "cache.hit", "bool", false)
+	wantTag("GET /checkout", "tags", "string", `["a"]`)
+
+	// Events become logs.
+	logs := spans["GET /checkout"].Logs
+	if len(logs) != 1 || logs[0].Timestamp != 1714564800001000 {
+		t.Fatalf("logs = %+v", logs)
+	}
+	if f := logs[0].Fields; len(f) != 2 || f[0].Key != "event" || f[0].Value != "request.received" || f[1].Key != "bytes" || f[1].Type != "int64" {
+		t.Errorf("log fields = %+v", f)
+	}
+
+	// The parent and links become references.
+	refs := spans["charge"].References
+	want := []jaegerReference{
+		{RefType: "CHILD_OF", TraceID: trace.TraceID, SpanID: "0101010101010101"},
+		{RefType: "FOLLOWS_FROM", TraceID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", SpanID: "bbbbbbbbbbbbbbbb"},
+	}
+	if len(refs) != len(want) || refs[0] != want[0] || refs[1] != want[1] {
+		t.Errorf("references = %+v, want %+v", refs, want)
+	}
+	if refs := spans["GET /checkout"].References; len(refs) != 0 {
+		t.Errorf("root references = %+v", refs)
+	}
+
+	// Times are microseconds.
+	if s := spans["charge"]; s.StartTime != 1714564800010000 || s.Duration != 100000 {
+		t.Errorf("charge: startTime %d, duration %d", s.StartTime, s.Duration)
+	}
+
+	// Resources become processes; service.name moves out of the tags.
+	frontend := trace.Processes[spans["charge"].ProcessID]
+	if frontend.ServiceName != "frontend" || len(frontend.Tags) != 1 || frontend.Tags[0].Key != "host.name" {
+		t.Errorf("frontend process = %+v", frontend)
+	}
+	if p := trace.Processes[spans["score"].ProcessID]; p.ServiceName != jaegerNoService {
+		t.Errorf("process without service.name = %+v", p)
+	}
+}
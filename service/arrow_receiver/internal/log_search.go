@@ -0,0 +1,351 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// searchTermPattern defines the terms of the full-text index: runs of
+// letters, digits and underscores, lower-cased. DuckDB and Go both use RE2,
+// so documents and queries split the same way.
+const searchTermPattern = `[\p{L}\p{N}_]+`
+
+var searchTermRE = regexp.MustCompile(searchTermPattern)
+
+// defaultLogSearchLimit is the page size of a log search without limit.
+const defaultLogSearchLimit = 20
+
+// BM25 parameters.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// LogIndex maintains the full-text index of the logs. Every log record gets
+// a search_id from log_search_seq when it is inserted, and log_terms holds
+// how often each term of its body and of the selected attributes occurs in
+// it. The index is written in the transaction that inserts the records, so
+// searches never see records without their terms or the other way round.
+type LogIndex struct {
+	attributes []string
+}
+
+func NewLogIndex(cfg Config) *LogIndex {
+	x := &LogIndex{}
+	for _, key := range cfg.SearchAttributes {
+		if strings.ContainsAny(key, `"\'`) {
+			log.WithField("attribute", key).Warn("attribute name cannot be indexed, skipping")
+			continue
+		}
+		x.attributes = append(x.attributes, key)
+	}
+	return x
+}
+
+// documentSQL is the lower-cased text indexed for the log record in scope.
+func (x *LogIndex) documentSQL() string {
+	parts := []string{"body"}
+	for _, key := range x.attributes {
+		parts = append(parts, fmt.Sprintf("json_extract_string(attributes, '%s')", attributePath(key)))
+	}
+	return "lower(concat_ws(' ', " + strings.Join(parts, ", ") + "))"
+}
+
+// termsSQL lists the terms of the log record in scope.
+func (x *LogIndex) termsSQL() string {
+	return "regexp_extract_all(" + x.documentSQL() + ", '" + searchTermPattern + "')"
+}
+
+// searchColumns returns the search columns of logs and their values for the
+// record in scope, for inserts.
+func (x *LogIndex) searchColumns() (cols, exprs string) {
+	return "search_id, search_length", "nextval('log_search_seq'), len(" + x.termsSQL() + ")"
+}
+
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// add runs insert, which must number the log records it inserts from
+// log_search_seq, and indexes them. conn must be in a transaction that no
+// other writer of logs shares.
+func (x *LogIndex) add(ctx context.Context, conn sqlExecer, insert func() error) error {
+	// Every search_id taken after floor belongs to the records of insert.
+	var floor int64
+	if err := conn.QueryRowContext(ctx, "SELECT nextval('log_search_seq')").Scan(&floor); err != nil {
+		return err
+	}
+	if err := insert(); err != nil {
+		return err
+	}
+	_, err := conn.ExecContext(ctx, `
+		INSERT INTO log_terms (term, search_id, tf, tenant_id)
+		SELECT term, search_id, count(*), tenant_id
+		FROM (SELECT unnest(`+x.termsSQL()+`) AS term, search_id, tenant_id FROM logs WHERE search_id > ?)
+		GROUP BY ALL`, floor)
+	return err
+}
+
+// Backfill indexes the log records that have no search_id, such as those
+// stored before the index existed. It must run before ingestion starts.
+func (x *LogIndex) Backfill(ctx context.Context, db *sql.DB) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var n int64
+	err = x.add(ctx, tx, func() error {
+		res, err := tx.ExecContext(ctx, `
+			UPDATE logs SET search_id = nextval('log_search_seq'), search_length = len(`+x.termsSQL()+`)
+			WHERE search_id IS NULL`)
+		if err == nil {
+			n, err = res.RowsAffected()
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// logSearch is a parsed /api/v1/logs/search request. Terms must all occur
+// in a record, phrases must occur as consecutive terms, and excluded terms
+// and phrases must not occur.
+type logSearch struct {
+	terms           []string
+	phrases         []string
+	excludedTerms   []string
+	excludedPhrases []string
+	conds           []string
+	args            []interface{}
+	page            *queryPage
+}
+
+// parseLogSearch reads a search query such as `timeout "connection reset"
+// -healthcheck` and the time bounds of the request. A word that splits into
+// several terms, like user-42, is a phrase.
+func parseLogSearch(q url.Values, maxRows int) (*logSearch, error) {
+	s := &logSearch{}
+	query := q.Get("q")
+	for query = strings.TrimSpace(query); query != ""; query = strings.TrimSpace(query) {
+		exclude := strings.HasPrefix(query, "-")
+		query = strings.TrimPrefix(query, "-")
+		var clause string
+		if strings.HasPrefix(query, `"`) {
+			end := strings.Index(query[1:], `"`)
+			if end < 0 {
+				return nil, errors.New("unterminated phrase")
+			}
+			clause, query = query[1:end+1], query[end+2:]
+		} else {
+			end := strings.IndexAny(query, " \t\n")
+			if end < 0 {
+				end = len(query)
+			}
+			clause, query = query[:end], query[end:]
+		}
+		terms := searchTermRE.FindAllString(strings.ToLower(clause), -1)
+		switch {
+		case len(terms) == 0:
+		case len(terms) == 1 && exclude:
+			s.excludedTerms = append(s.excludedTerms, terms[0])
+		case len(terms) == 1:
+			s.terms = append(s.terms, terms[0])
+		case exclude:
+			s.excludedPhrases = append(s.excludedPhrases, phrasePattern(terms))
+		default:
+			s.terms = append(s.terms, terms...)
+			s.phrases = append(s.phrases, phrasePattern(terms))
+		}
+	}
+	if len(s.terms) == 0 {
+		return nil, errors.New("q needs at least one term to search for")
+	}
+	for _, bound := range []struct{ param, op string }{{"start", ">="}, {"end", "<"}} {
+		v := q.Get(bound.param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be an RFC 3339 time", bound.param)
+		}
+		s.conds = append(s.conds, "t "+bound.op+" ?")
+		s.args = append(s.args, t.UnixNano())
+	}
+	limit := defaultLogSearchLimit
+	if v := q.Get("limit"); v != "" {
+		if _, err := fmt.Sscan(v, &limit); err != nil || limit <= 0 {
+			return nil, errors.New("limit must be a positive integer")
+		}
+	}
+	filters := url.Values{}
+	for key, vals := range q {
+		if key != "limit" && key != "cursor" {
+			filters[key] = vals
+		}
+	}
+	page, err := parsePage(filters.Encode(), limit, q.Get("cursor"), maxRows)
+	if err != nil {
+		return nil, err
+	}
+	s.page = page
+	return s, nil
+}
+
+// phrasePattern matches the terms as consecutive terms of a document.
+func phrasePattern(terms []string) string {
+	const sep = `[^\p{L}\p{N}_]`
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = regexp.QuoteMeta(term)
+	}
+	return `(^|` + sep + `)` + strings.Join(quoted, sep+`+`) + `(` + sep + `|$)`
+}
+
+// query returns the SQL of the search, best matches first, and its
+// arguments. It selects one more record than the page holds, telling
+// whether another page follows.
+func (s *logSearch) query(x *LogIndex) (string, []interface{}) {
+	var hits []string
+	var args []interface{}
+	terms := map[string]bool{}
+	for _, term := range s.terms {
+		if !terms[term] {
+			terms[term] = true
+			hits = append(hits, "SELECT term, search_id, tf FROM log_terms WHERE term = ?")
+			args = append(args, term)
+		}
+	}
+	conds := append([]string{}, s.conds...)
+	condArgs := append([]interface{}{}, s.args...)
+	for _, pattern := range s.phrases {
+		conds = append(conds, "regexp_matches(document, ?)")
+		condArgs = append(condArgs, pattern)
+	}
+	for _, pattern := range s.excludedPhrases {
+		conds = append(conds, "NOT regexp_matches(document, ?)")
+		condArgs = append(condArgs, pattern)
+	}
+	for _, term := range s.excludedTerms {
+		conds = append(conds, "search_id NOT IN (SELECT search_id FROM log_terms WHERE term = ?)")
+		condArgs = append(condArgs, term)
+	}
+	where := "true"
+	if len(conds) > 0 {
+		where = strings.Join(conds, " AND ")
+	}
+	query := `
+		WITH stats AS (
+			SELECT count(*) AS docs, coalesce(avg(search_length), 1) AS avg_length FROM logs WHERE search_id IS NOT NULL
+		), hits AS (
+			` + strings.Join(hits, " UNION ALL ") + `
+		), df AS (
+			SELECT term, count(*) AS df FROM hits GROUP BY term
+		), matched AS (
+			SELECT search_id FROM hits GROUP BY search_id HAVING count(*) = ?
+		), candidates AS (
+			SELECT *, ` + logTimeSQL + ` AS t, ` + x.documentSQL() + ` AS document FROM logs
+			WHERE search_id BETWEEN (SELECT min(search_id) FROM matched) AND (SELECT max(search_id) FROM matched)
+				AND search_id IN (SELECT search_id FROM matched)
+		), scores AS (
+			SELECT search_id, sum(ln(1 + (stats.docs - df.df + 0.5) / (df.df + 0.5))
+				* tf * (? + 1) / (tf + ? * (1 - ? + ? * search_length / greatest(stats.avg_length, 1)))) AS score
+			FROM hits JOIN df USING (term) JOIN (SELECT search_id, search_length FROM candidates) USING (search_id), stats
+			GROUP BY search_id
+		)
+		SELECT score, t, severity_number, coalesce(severity_text, ''), coalesce(body, ''),
+			coalesce(json_extract_string(resource, '$."service.name"'), ''),
+			coalesce(trace_id, ''), coalesce(span_id, ''),
+			coalesce(CAST(attributes AS VARCHAR), '{}'), coalesce(CAST(resource AS VARCHAR), '{}')
+		FROM candidates JOIN scores USING (search_id)
+		WHERE ` + where + `
+		ORDER BY score DESC, t DESC, search_id
+		LIMIT ? OFFSET ?`
+	args = append(args, len(terms), bm25K1, bm25K1, bm25B, bm25B)
+	args = append(args, condArgs...)
+	args = append(args, s.page.Size+1, s.page.Offset)
+	return query, args
+}
+
+// logHit is a log record found by a search.
+type logHit struct {
+	Score          float64         `json:"score"`
+	Time           time.Time       `json:"time"`
+	SeverityNumber int             `json:"severity_number"`
+	SeverityText   string          `json:"severity_text,omitempty"`
+	Body           string          `json:"body"`
+	Service        string          `json:"service,omitempty"`
+	TraceID        string          `json:"trace_id,omitempty"`
+	SpanID         string          `json:"span_id,omitempty"`
+	Attributes     json.RawMessage `json:"attributes"`
+	Resource       json.RawMessage `json:"resource"`
+}
+
+// handleLogSearch finds log records by the terms and phrases of their body
+// and selected attributes, ranked by BM25.
+func (a *queryAPI) handleLogSearch(w http.ResponseWriter, r *http.Request) {
+	tenant, admin, ok := a.getCaller(w, r)
+	if !ok {
+		return
+	}
+	search, err := parseLogSearch(r.URL.Query(), a.cfg.QueryMaxRows)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ctx, conn, logger, done := a.readRequest(w, r, tenant, admin)
+	if conn == nil {
+		return
+	}
+	defer done()
+	query, args := search.query(a.logIndex)
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		writeQueryError(ctx, w, r, err, logger)
+		return
+	}
+	defer rows.Close()
+	hits := []logHit{}
+	more := false
+	for rows.Next() {
+		if len(hits) == search.page.Size {
+			more = true
+			break
+		}
+		var h logHit
+		var t int64
+		var severity sql.NullInt64
+		var attributes, resource string
+		if err := rows.Scan(&h.Score, &t, &severity, &h.SeverityText, &h.Body, &h.Service, &h.TraceID, &h.SpanID, &attributes, &resource); err != nil {
+			writeQueryError(ctx, w, r, err, logger)
+			return
+		}
+		h.Time = time.Unix(0, t).UTC()
+		h.SeverityNumber = int(severity.Int64)
+		h.Attributes, h.Resource = json.RawMessage(attributes), json.RawMessage(resource)
+		hits = append(hits, h)
+	}
+	if err := rows.Err(); err != nil {
+		writeQueryError(ctx, w, r, err, logger)
+		return
+	}
+	resp := map[string]interface{}{"logs": hits}
+	if more {
+		resp["next_cursor"] = search.page.next(len(hits))
+	}
+	json.NewEncoder(w).Encode(resp)
+}
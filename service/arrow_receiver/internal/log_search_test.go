@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestParseLogSearch(t *testing.T) {
+	s, err := parseLogSearch(url.Values{"q": {`Timeout "connection reset" -healthcheck -"GET /health" user-42`}}, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.terms; len(got) != 5 || got[0] != "timeout" || got[1] != "connection" || got[3] != "user" || got[4] != "42" {
+		t.Errorf("terms %q, want timeout, connection, reset, user and 42", got)
+	}
+	if len(s.phrases) != 2 || len(s.excludedTerms) != 1 || s.excludedTerms[0] != "healthcheck" || len(s.excludedPhrases) != 1 {
+		t.Errorf("phrases %q, excluded %q and %q", s.phrases, s.excludedTerms, s.excludedPhrases)
+	}
+	if s.page.Size != defaultLogSearchLimit {
+		t.Errorf("page size %d, want %d", s.page.Size, defaultLogSearchLimit)
+	}
+
+	phrase := regexp.MustCompile(phrasePattern([]string{"connection", "reset"}))
+	for doc, want := range map[string]bool{
+		"connection reset":             true,
+		"error: connection  reset":     true,
+		"connection reset by peer":     true,
+		"connection was reset":         false,
+		"reconnection reset":           false,
+		"connection resetting":         false,
+		"connection_reset by the peer": false,
+	} {
+		if phrase.MatchString(doc) != want {
+			t.Errorf("phrase matches %q: %v, want %v", doc, !want, want)
+		}
+	}
+
+	for _, q := range []url.Values{
+		{"q": {`"connection reset`}},
+		{"q": {"-healthcheck"}},
+		{"q": {"--- ..."}},
+		{"q": {"timeout"}, "start": {"yesterday"}},
+		{"q": {"timeout"}, "limit": {"0"}},
+		{"q": {"timeout"}, "cursor": {"bogus"}},
+	} {
+		if _, err := parseLogSearch(q, 1000); err == nil {
+			t.Errorf("parseLogSearch(%v) succeeded, want an error", q)
+		}
+	}
+}
+
+type logSearchResponse struct {
+	Logs       []logHit `json:"logs"`
+	NextCursor string   `json:"next_cursor"`
+}
+
+func TestLogSearchAPI(t *testing.T) {
+	t0 := time.Unix(1700000000, 0)
+	rows := LogsToRows(lokiTestLogs(t0), "acme")
+	rows = append(rows, LogsToRows(lokiTestLogs(t0), "globex")...)
+	a := newTestQueryAPI(t, defaultConfig(), RowBatch{Logs: rows})
+
+	search := func(q url.Values) logSearchResponse {
+		t.Helper()
+		var resp logSearchResponse
+		getJSON(t, a.handleLogSearch, "/api/v1/logs/search?"+q.Encode(), &resp)
+		return resp
+	}
+	if resp := search(url.Values{"q": {"error"}}); len(resp.Logs) != 3 || resp.NextCursor != "" {
+		t.Errorf("error: %d hits, cursor %q; want the tenant's 3 and no cursor", len(resp.Logs), resp.NextCursor)
+	}
+	if resp := search(url.Values{"q": {`"error b"`}}); len(resp.Logs) != 1 || resp.Logs[0].Service != "api" {
+		t.Errorf(`"error b": %+v, want the one api line`, resp.Logs)
+	}
+	resp := search(url.Values{"q": {"error -plain"}})
+	for _, h := range resp.Logs {
+		if h.Service != "api" || h.Score <= 0 {
+			t.Errorf("error -plain: hit %+v, want api lines with a score", h)
+		}
+	}
+	if len(resp.Logs) != 2 {
+		t.Errorf("error -plain: %d hits, want 2", len(resp.Logs))
+	}
+	end := t0.Add(time.Second).Format(time.RFC3339Nano)
+	if resp := search(url.Values{"q": {"error"}, "end": {end}}); len(resp.Logs) != 2 {
+		t.Errorf("error before %s: %d hits, want the 2 first lines", end, len(resp.Logs))
+	}
+
+	first := search(url.Values{"q": {"error"}, "limit": {"2"}})
+	if len(first.Logs) != 2 || first.NextCursor == "" {
+		t.Fatalf("first page: %d hits, cursor %q; want 2 and a cursor", len(first.Logs), first.NextCursor)
+	}
+	second := search(url.Values{"q": {"error"}, "limit": {"2"}, "cursor": {first.NextCursor}})
+	if len(second.Logs) != 1 || second.NextCursor != "" {
+		t.Fatalf("second page: %d hits, cursor %q; want the last one", len(second.Logs), second.NextCursor)
+	}
+	for _, h := range first.Logs {
+		if h.Body == second.Logs[0].Body {
+			t.Errorf("%q is on both pages", h.Body)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The LogQL subset: a stream selector on resource attributes, line filters
+// (|=, !=, |~, !~), | json and label filters on what it extracts, and
+// count_over_time and rate, which may be aggregated and combined like PromQL.
+// Metric queries are parsed into a PromQL expression whose range selectors
+// stand for log queries and evaluated by promEvaluator: every log line is a
+// delta sample of 1, so increase counts the lines and rate divides by the range.
+type logQL struct {
+	// logs is set for log queries and metric for metric queries.
+	logs      *logQuery
+	metric    promExpr
+	selectors map[*promSelector]*logQuery
+}
+
+type logQuery struct {
+	matchers    []*promMatcher
+	lineFilters []lineFilter
+	// stages run in order on every line read.
+	stages []pipelineStage
+}
+
+type lineFilter struct {
+	op, value string
+}
+
+// pipelineStage is | json when json is set and a label filter otherwise.
+type pipelineStage struct {
+	json    bool
+	matcher *promMatcher
+	// For numeric label filters op is one of == != > >= < <=.
+	label, op string
+	number    float64
+}
+
+// logQLFunctions maps the supported range aggregations to the promEvaluator
+// functions computing them.
+var logQLFunctions = map[string]string{
+	"count_over_time": "increase",
+	"rate":            "rate",
+}
+
+type logQLParser struct {
+	*promParser
+	query *logQL
+}
+
+func parseLogQL(q string) (*logQL, error) {
+	tokens, err := lexPromQL(q)
+	if err != nil {
+		return nil, err
+	}
+	p := &logQLParser{promParser: &promParser{tokens: tokens}, query: &logQL{selectors: map[*promSelector]*logQuery{}}}
+	p.functions = p.call
+	if t := p.peek(); t.kind == 'p' && t.text == "{" {
+		logs, rng, err := p.logQuery()
+		if err == nil && rng > 0 {
+			err = errors.New("a log query cannot have a range, use count_over_time or rate")
+		}
+		if err == nil && p.peek().kind != 0 {
+			err = p.unexpected()
+		}
+		p.query.logs = logs
+		return p.query, err
+	}
+	expr, err := p.additive()
+	if err == nil && p.peek().kind != 0 {
+		err = p.unexpected()
+	}
+	p.query.metric = expr
+	return p.query, err
+}
+
+// call parses a range aggregation such as count_over_time({app="x"}[5m]).
+func (p *logQLParser) call(fn string) (promExpr, error) {
+	if fn == "vector" {
+		return p.promParser.call(fn)
+	}
+	evalFn, ok := logQLFunctions[fn]
+	if !ok {
+		return nil, fmt.Errorf("unsupported function %s", fn)
+	}
+	p.next()
+	logs, rng, err := p.logQuery()
+	if err != nil {
+		return nil, err
+	}
+	if rng == 0 {
+		return nil, fmt.Errorf("%s needs a range such as {app=\"x\"}[5m]", fn)
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	sel := &promSelector{matchers: logs.matchers, rng: rng}
+	p.query.selectors[sel] = logs
+	return &promCall{fn: evalFn, args: []promExpr{sel}}, nil
+}
+
+// logQuery parses a stream selector, its pipeline and an optional range.
+func (p *logQLParser) logQuery() (*logQuery, time.Duration, error) {
+	if t := p.peek(); t.kind != 'p' || t.text != "{" {
+		return nil, 0, p.unexpected()
+	}
+	expr, err := p.selector("")
+	if err != nil {
+		return nil, 0, err
+	}
+	sel := expr.(*promSelector)
+	logs := &logQuery{matchers: sel.matchers}
+	if sel.rng > 0 {
+		return logs, sel.rng, nil
+	}
+	for {
+		t := p.peek()
+		if t.kind != 'p' {
+			break
+		}
+		switch t.text {
+		case "|=", "!=", "|~", "!~":
+			p.next()
+			value := p.next()
+			if value.kind != 's' {
+				return nil, 0, fmt.Errorf("line filter %s needs a string at %d", t.text, value.pos)
+			}
+			if t.text == "|~" || t.text == "!~" {
+				if _, err := newPromMatcher("", "=~", value.text); err != nil {
+					return nil, 0, err
+				}
+			}
+			logs.lineFilters = append(logs.lineFilters, lineFilter{t.text, value.text})
+			continue
+		case "|":
+			p.next()
+			stage, err := p.stage()
+			if err != nil {
+				return nil, 0, err
+			}
+			logs.stages = append(logs.stages, stage)
+			continue
+		case "[":
+			p.next()
+			d, err := parsePromDuration(p.next().text)
+			if err != nil || d <= 0 {
+				return nil, 0, errors.New("invalid range")
+			}
+			return logs, d, p.expect("]")
+		}
+		break
+	}
+	return logs, 0, nil
+}
+
+func (p *logQLParser) stage() (pipelineStage, error) {
+	label := p.next()
+	if label.kind != 'i' {
+		p.pos--
+		return pipelineStage{}, p.unexpected()
+	}
+	if label.text == "json" {
+		if t := p.peek(); t.kind == 'i' {
+			return pipelineStage{}, errors.New("| json with parameters is not supported")
+		}
+		return pipelineStage{json: true}, nil
+	}
+	op, value := p.next(), p.next()
+	if op.kind != 'p' {
+		return pipelineStage{}, fmt.Errorf("unsupported stage %q, only | json and label filters are", label.text)
+	}
+	switch {
+	case value.kind == 's' && (op.text == "=" || op.text == "!=" || op.text == "=~" || op.text == "!~"):
+		m, err := newPromMatcher(label.text, op.text, value.text)
+		return pipelineStage{matcher: m}, err
+	case value.kind == 'n':
+		n, err := strconv.ParseFloat(value.text, 64)
+		if err != nil {
+			return pipelineStage{}, fmt.Errorf("invalid number %q", value.text)
+		}
+		switch op.text {
+		case "=", "==", "!=", ">", ">=", "<", "<=":
+			return pipelineStage{label: label.text, op: op.text, number: n}, nil
+		}
+	}
+	return pipelineStage{}, fmt.Errorf("invalid label filter at %d", label.pos)
+}
+
+// apply runs the stages on a line with the given stream labels and returns
+// the labels of the line, or false when a filter drops it.
+func (q *logQuery) apply(stream promLabels, line string) (promLabels, bool) {
+	labels := stream
+	for _, stage := range q.stages {
+		switch {
+		case stage.json:
+			labels = extractJSON(labels, line)
+		case stage.matcher != nil:
+			if !stage.matcher.matches(labels[stage.matcher.label]) {
+				return nil, false
+			}
+		default:
+			v, err := strconv.ParseFloat(labels[stage.label], 64)
+			if err != nil || !compareNumbers(v, stage.op, stage.number) {
+				return nil, false
+			}
+		}
+	}
+	return labels, true
+}
+
+func compareNumbers(x float64, op string, y float64) bool {
+	switch op {
+	case "=", "==":
+		return x == y
+	case "!=":
+		return x != y
+	case ">":
+		return x > y
+	case ">=":
+		return x >= y
+	case "<":
+		return x < y
+	}
+	return x <= y
+}
+
+// extractJSON adds the fields of a JSON object line to labels, like Loki's
+// json parser: nested keys are joined with _, arrays are skipped, names
+// taken by stream labels get an _extracted suffix, and lines that are not
+// JSON objects get __error__="JSONParserErr".
+func extractJSON(labels promLabels, line string) promLabels {
+	out := labels.without()
+	var fields map[string]interface{}
+	if err := decodeJSONNumbers(line, &fields); err != nil || fields == nil {
+		out["__error__"] = "JSONParserErr"
+		return out
+	}
+	var add func(prefix string, fields map[string]interface{})
+	add = func(prefix string, fields map[string]interface{}) {
+		for key, v := range fields {
+			name := promLabelName(prefix + key)
+			switch v := v.(type) {
+			case map[string]interface{}:
+				add(name+"_", v)
+				continue
+			case []interface{}:
+				continue
+			}
+			if _, ok := labels[name]; ok {
+				name += "_extracted"
+			}
+			out[name] = promLabelValue(v)
+		}
+	}
+	add("", fields)
+	return out
+}
+
+// lineFilterSQL turns the line filters into SQL conditions on body.
+func (q *logQuery) lineFilterSQL() (conds []string, args []interface{}) {
+	for _, f := range q.lineFilters {
+		switch f.op {
+		case "|=":
+			conds = append(conds, "contains(body, ?)")
+		case "!=":
+			conds = append(conds, "NOT contains(body, ?)")
+		case "|~":
+			conds = append(conds, "regexp_matches(body, ?)")
+		case "!~":
+			conds = append(conds, "NOT regexp_matches(body, ?)")
+		}
+		args = append(args, f.value)
+	}
+	return conds, args
+}
+
+// streamLabels returns the labels of a stream, its sanitized resource
+// attributes, from the JSON text of the resource.
+func streamLabels(resource string) (promLabels, error) {
+	attrs, err := decodeAttributes(json.RawMessage(resource))
+	if err != nil {
+		return nil, err
+	}
+	labels := promLabels{}
+	for key, v := range attrs {
+		if s := promLabelValue(v); s != "" {
+			labels[promLabelName(key)] = s
+		}
+	}
+	return labels, nil
+}
+
+// lokiTime parses a time like Loki: Unix nanoseconds, Unix seconds when it
+// has up to 10 digits or a fraction, or RFC 3339; an empty s yields def.
+func lokiTime(s string, def int64) (int64, error) {
+	if s == "" {
+		return def, nil
+	}
+	if strings.Contains(s, ".") {
+		return parsePromTime(s, def)
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return parsePromTime(s, def)
+	}
+	if len(strings.TrimPrefix(s, "-")) <= 10 {
+		return n * int64(time.Second), nil
+	}
+	return n, nil
+}
@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/plog"
+)
+
+func TestParseLogQL(t *testing.T) {
+	q, err := parseLogQL(`{service_name="api", env!="dev"} |= "error" !~ "timeout|retry" | json | status >= 500 | method = "GET"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.logs == nil || q.metric != nil {
+		t.Fatalf("parsed %+v, want a log query", q)
+	}
+	if len(q.logs.matchers) != 2 || len(q.logs.lineFilters) != 2 || len(q.logs.stages) != 3 {
+		t.Errorf("%d matchers, %d line filters, %d stages; want 2, 2 and 3", len(q.logs.matchers), len(q.logs.lineFilters), len(q.logs.stages))
+	}
+	labels, ok := q.logs.apply(promLabels{"service_name": "api"}, `{"status": 503, "method": "GET"}`)
+	if !ok || labels["status"] != "503" || labels["service_name"] != "api" {
+		t.Errorf("apply kept %v, %v; want the line with status 503", labels, ok)
+	}
+	if _, ok := q.logs.apply(promLabels{"service_name": "api"}, `{"status": 404, "method": "GET"}`); ok {
+		t.Error("apply kept a line with status 404")
+	}
+
+	q, err = parseLogQL(`sum by (service_name) (count_over_time({service_name=~".+"} |= "error" [5m])) / 300`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.logs != nil || len(q.selectors) != 1 {
+		t.Fatalf("parsed %+v, want a metric query with one log selector", q)
+	}
+	for sel, logs := range q.selectors {
+		if sel.rng != 5*time.Minute || len(logs.lineFilters) != 1 {
+			t.Errorf("selector range %s with %d line filters, want 5m and 1", sel.rng, len(logs.lineFilters))
+		}
+	}
+
+	for _, s := range []string{
+		`{app="x"}[5m]`,
+		`count_over_time({app="x"})`,
+		`{app="x"} | logfmt`,
+		`{app="x"} | json level`,
+		`{app="x"} |= 5`,
+		`{app="x"} |~ "("`,
+		`avg_over_time({app="x"}[1m])`,
+		`{app="x"`,
+		`{app="x"} extra`,
+	} {
+		if _, err := parseLogQL(s); err == nil {
+			t.Errorf("parseLogQL(%q) succeeded, want an error", s)
+		}
+	}
+}
+
+func TestExtractJSON(t *testing.T) {
+	labels := extractJSON(promLabels{"level": "info"}, `{"level": "error", "http": {"status": 500}, "tags": ["a"], "ok": false}`)
+	want := promLabels{"level": "info", "level_extracted": "error", "http_status": "500", "ok": "false"}
+	if labels.key() != want.key() {
+		t.Errorf("extracted %v, want %v", labels, want)
+	}
+	if labels := extractJSON(promLabels{}, "not json"); labels["__error__"] != "JSONParserErr" {
+		t.Errorf("extracted %v from a plain line, want __error__", labels)
+	}
+}
+
+// lokiTestLogs returns three JSON lines of the service api and a plain line
+// of the service worker, a second apart from t0.
+func lokiTestLogs(t0 time.Time) plog.Logs {
+	logs := plog.NewLogs()
+	for service, lines := range map[string][]string{
+		"api": {
+			`{"status": 500, "msg": "error a"}`,
+			`{"status": 200, "msg": "ok"}`,
+			`{"status": 503, "msg": "error b"}`,
+		},
+		"worker": {"plain error line"},
+	} {
+		rl := logs.ResourceLogs().AppendEmpty()
+		rl.Resource().Attributes().PutStr("service.name", service)
+		records := rl.ScopeLogs().AppendEmpty().LogRecords()
+		for i, line := range lines {
+			record := records.AppendEmpty()
+			record.SetTimestamp(pcommon.NewTimestampFromTime(t0.Add(time.Duration(i) * time.Second)))
+			record.Body().SetStr(line)
+		}
+	}
+	return logs
+}
+
+func TestLokiQueryAPI(t *testing.T) {
+	t0 := time.Unix(1700000000, 0)
+	a := newTestQueryAPI(t, defaultConfig(), RowBatch{Logs: LogsToRows(lokiTestLogs(t0), "acme")})
+	start, end := fmt.Sprint(t0.Unix()), fmt.Sprint(t0.Add(10*time.Second).Unix())
+
+	var streams struct {
+		Data struct {
+			ResultType string `json:"resultType"`
+			Result     []struct {
+				Stream map[string]string `json:"stream"`
+				Values [][2]string       `json:"values"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	q := `{service_name="api"} |= "error" | json | status >= 500`
+	getJSON(t, a.handleLokiQueryRange, "/loki/api/v1/query_range?"+url.Values{"query": {q}, "start": {start}, "end": {end}}.Encode(), &streams)
+	lines := 0
+	for _, s := range streams.Data.Result {
+		if s.Stream["service_name"] != "api" {
+			t.Errorf("stream %v, want service_name api", s.Stream)
+		}
+		lines += len(s.Values)
+	}
+	if streams.Data.ResultType != "streams" || lines != 2 {
+		t.Errorf("log query: %+v, want the 2 error lines", streams.Data)
+	}
+
+	var resp promTestResponse
+	q = `sum(count_over_time({service_name=~".+"} |= "error" [1m]))`
+	getJSON(t, a.handleLokiQuery, "/loki/api/v1/query?"+url.Values{"query": {q}, "time": {end}}.Encode(), &resp)
+	if resp.Data.ResultType != "vector" || len(resp.Data.Result) != 1 || resp.Data.Result[0].Value[1] != "3" {
+		t.Errorf("metric query: %+v, want 3 error lines", resp.Data)
+	}
+
+	var values struct {
+		Data []string `json:"data"`
+	}
+	getJSON(t, a.handleLokiLabelValues, "/loki/api/v1/label/service_name/values?"+url.Values{"start": {start}, "end": {end}}.Encode(), &values, "name", "service_name")
+	if fmt.Sprint(values.Data) != "[api worker]" {
+		t.Errorf("service_name values %v, want [api worker]", values.Data)
+	}
+}
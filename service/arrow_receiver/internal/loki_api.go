@@ -0,0 +1,377 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// lokiPrefix is where the Loki API is served; Grafana's Loki data source
+// takes http://<host>:8080/loki as its URL.
+const lokiPrefix = "/loki"
+
+// defaultLokiLimit is the number of lines a log query returns without limit.
+const defaultLokiLimit = 100
+
+// logTimeSQL is the time of a log record in Unix nanoseconds; records
+// without a timestamp use the time they were observed.
+var logTimeSQL = unixNanosSQL(`(CASE WHEN starts_with(time_unix_nano, '1970-01-01 00:00:00 ') THEN observed_time_unix_nano ELSE time_unix_nano END)`)
+
+type lokiStream struct {
+	Stream promLabels  `json:"stream"`
+	Values [][2]string `json:"values"`
+}
+
+type lokiQueryData struct {
+	ResultType string      `json:"resultType"`
+	Result     interface{} `json:"result"`
+	Stats      struct{}    `json:"stats"`
+}
+
+// writeLokiError answers with a plain text error, as Loki does.
+func writeLokiError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(msg))
+}
+
+// writeLokiQueryError is writeQueryError for the Loki API.
+func writeLokiQueryError(ctx context.Context, w http.ResponseWriter, r *http.Request, err error, logger *log.Entry) {
+	switch {
+	case r.Context().Err() != nil:
+		logger.WithError(err).Info("query cancelled: client disconnected")
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		writeLokiError(w, http.StatusGatewayTimeout, "query timed out")
+		logger.WithError(err).Warn("query timed out")
+	default:
+		writeLokiError(w, http.StatusBadRequest, err.Error())
+		logger.WithError(err).Error("query failed")
+	}
+}
+
+// lokiCaller accepts GET and form POST requests, parses the parameters into
+// r.Form and resolves the caller; ok is false when a response was already
+// written.
+func (a *queryAPI) lokiCaller(w http.ResponseWriter, r *http.Request) (tenant string, admin bool, ok bool) {
+	if a.cors(w, r, "GET, POST") {
+		return "", false, false
+	}
+	if r.Method != "GET" && r.Method != "POST" {
+		writeLokiError(w, http.StatusMethodNotAllowed, "GET or POST only")
+		return "", false, false
+	}
+	if err := r.ParseForm(); err != nil {
+		writeLokiError(w, http.StatusBadRequest, err.Error())
+		return "", false, false
+	}
+	return a.caller(w, r)
+}
+
+// lokiRequest holds the parameters of a query or query_range request.
+type lokiRequest struct {
+	query      *logQL
+	start, end int64
+	step       time.Duration
+	limit      int
+	forward    bool
+	instant    bool
+}
+
+func parseLokiRequest(r *http.Request, instant bool, maxRows int) (*lokiRequest, error) {
+	query, err := parseLogQL(r.Form.Get("query"))
+	if err != nil {
+		return nil, fmt.Errorf("parse error: %w", err)
+	}
+	req := &lokiRequest{query: query, instant: instant, limit: defaultLokiLimit}
+	now := time.Now().UnixNano()
+	if instant {
+		if req.end, err = lokiTime(r.Form.Get("time"), now); err != nil {
+			return nil, err
+		}
+		req.start = req.end
+	} else {
+		if req.end, err = lokiTime(r.Form.Get("end"), now); err != nil {
+			return nil, err
+		}
+		if req.start, err = lokiTime(r.Form.Get("start"), req.end-int64(time.Hour)); err != nil {
+			return nil, err
+		}
+		if req.end < req.start {
+			return nil, errors.New("end is before start")
+		}
+		// Loki's default step yields about 250 points.
+		req.step = time.Duration((req.end-req.start)/250).Truncate(time.Second) + time.Second
+		if s := r.Form.Get("step"); s != "" {
+			if req.step, err = parsePromStep(s); err != nil || req.step <= 0 {
+				return nil, fmt.Errorf("invalid step %q", s)
+			}
+		}
+		if (req.end-req.start)/int64(req.step) >= promMaxSteps {
+			return nil, fmt.Errorf("more than %d steps, increase the step", promMaxSteps)
+		}
+	}
+	if s := r.Form.Get("limit"); s != "" {
+		if req.limit, err = strconv.Atoi(s); err != nil || req.limit <= 0 {
+			return nil, fmt.Errorf("invalid limit %q", s)
+		}
+	}
+	if req.limit > maxRows {
+		req.limit = maxRows
+	}
+	switch r.Form.Get("direction") {
+	case "", "backward", "BACKWARD":
+	case "forward", "FORWARD":
+		req.forward = true
+	default:
+		return nil, errors.New("direction must be forward or backward")
+	}
+	return req, nil
+}
+
+func (a *queryAPI) handleLokiQueryRange(w http.ResponseWriter, r *http.Request) {
+	a.lokiQuery(w, r, false)
+}
+
+func (a *queryAPI) handleLokiQuery(w http.ResponseWriter, r *http.Request) {
+	a.lokiQuery(w, r, true)
+}
+
+// lokiQuery runs a log query, which returns streams of lines, or a metric
+// query, which returns a matrix (or a vector for instant queries).
+func (a *queryAPI) lokiQuery(w http.ResponseWriter, r *http.Request, instant bool) {
+	tenant, admin, ok := a.lokiCaller(w, r)
+	if !ok {
+		return
+	}
+	req, err := parseLokiRequest(r, instant, a.cfg.QueryMaxRows)
+	if err != nil {
+		writeLokiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ctx, conn, logger, done := a.readRequest(w, r, tenant, admin)
+	if conn == nil {
+		return
+	}
+	defer done()
+	if req.query.logs != nil {
+		// Instant log queries read the lines before time, as Loki does.
+		start, end := req.start, req.end
+		if instant {
+			start = end - int64(time.Hour)
+		}
+		streams, err := loadLokiStreams(ctx, conn, req.query.logs, start, end, req.limit, req.forward, a.cfg.QueryMaxRows)
+		if err != nil {
+			writeLokiQueryError(ctx, w, r, err, logger)
+			return
+		}
+		writeProm(w, lokiQueryData{ResultType: "streams", Result: streams})
+		return
+	}
+	eval := &promEvaluator{series: map[*promSelector][]*promSeries{}}
+	maxSamples := a.cfg.QueryMaxRows
+	for sel, logs := range req.query.selectors {
+		series, n, err := loadLokiSeries(ctx, conn, logs, req.start-int64(sel.rng), req.end, maxSamples, a.cfg.QueryMaxRows)
+		if err != nil {
+			writeLokiQueryError(ctx, w, r, err, logger)
+			return
+		}
+		eval.series[sel] = series
+		maxSamples -= n
+	}
+	var data promQueryData
+	if instant {
+		data, err = evalInstant(eval, req.query.metric, req.end)
+	} else {
+		data, err = evalRange(eval, req.query.metric, req.start, req.end, req.step)
+	}
+	if err != nil {
+		writeLokiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeProm(w, lokiQueryData{ResultType: data.ResultType, Result: data.Result})
+}
+
+// matchingStreams returns the JSON text of the resources with lines in
+// [start, end] whose labels match the stream selector.
+func matchingStreams(ctx context.Context, conn *TenantConn, matchers []*promMatcher, start, end int64, maxStreams int) ([]interface{}, map[string]promLabels, error) {
+	resources, err := queryStrings(ctx, conn, `
+		SELECT DISTINCT coalesce(CAST(resource AS VARCHAR), '{}') FROM logs
+		WHERE `+logTimeSQL+` BETWEEN ? AND ? LIMIT ?`, start, end, maxStreams+1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(resources) > maxStreams {
+		return nil, nil, fmt.Errorf("more than %d streams, narrow the time range", maxStreams)
+	}
+	var matched []interface{}
+	labels := map[string]promLabels{}
+	for _, resource := range resources {
+		stream, err := streamLabels(resource)
+		if err != nil {
+			return nil, nil, err
+		}
+		if stream.matches(matchers) {
+			matched = append(matched, resource)
+			labels[resource] = stream
+		}
+	}
+	return matched, labels, nil
+}
+
+// lokiLines reads the lines of the streams matching logs in [start, end],
+// in time order, and calls fn with the labels, time and body of each line
+// that passes the pipeline until it returns false.
+func lokiLines(ctx context.Context, conn *TenantConn, logs *logQuery, start, end int64, limit int, forward bool, maxStreams int, fn func(labels promLabels, t int64, line string) bool) error {
+	resources, streams, err := matchingStreams(ctx, conn, logs.matchers, start, end, maxStreams)
+	if err != nil || len(resources) == 0 {
+		return err
+	}
+	conds, args := logs.lineFilterSQL()
+	conds = append([]string{"t BETWEEN ? AND ?", "res IN (?" + strings.Repeat(", ?", len(resources)-1) + ")"}, conds...)
+	args = append(append([]interface{}{start, end}, resources...), args...)
+	query := `
+		SELECT res, t, coalesce(body, '')
+		FROM (SELECT coalesce(CAST(resource AS VARCHAR), '{}') AS res, ` + logTimeSQL + ` AS t, body FROM logs)
+		WHERE ` + strings.Join(conds, " AND ")
+	if forward {
+		query += " ORDER BY t"
+	} else {
+		query += " ORDER BY t DESC"
+	}
+	// Without stages every line read is returned.
+	if len(logs.stages) == 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var res, line string
+		var t int64
+		if err := rows.Scan(&res, &t, &line); err != nil {
+			return err
+		}
+		labels, ok := logs.apply(streams[res], line)
+		if ok && !fn(labels, t, line) {
+			break
+		}
+	}
+	return rows.Err()
+}
+
+// loadLokiStreams returns up to limit lines of a log query grouped by
+// stream.
+func loadLokiStreams(ctx context.Context, conn *TenantConn, logs *logQuery, start, end int64, limit int, forward bool, maxStreams int) ([]*lokiStream, error) {
+	streams := []*lokiStream{}
+	byKey := map[string]*lokiStream{}
+	n := 0
+	err := lokiLines(ctx, conn, logs, start, end, limit, forward, maxStreams, func(labels promLabels, t int64, line string) bool {
+		key := labels.key()
+		s, ok := byKey[key]
+		if !ok {
+			s = &lokiStream{Stream: labels}
+			byKey[key] = s
+			streams = append(streams, s)
+		}
+		s.Values = append(s.Values, [2]string{strconv.FormatInt(t, 10), line})
+		n++
+		return n < limit
+	})
+	return streams, err
+}
+
+// loadLokiSeries turns the lines of logs in (start, end] into delta series
+// with a sample of 1 per line, and returns them with the number of lines
+// read, at most maxSamples.
+func loadLokiSeries(ctx context.Context, conn *TenantConn, logs *logQuery, start, end int64, maxSamples, maxStreams int) ([]*promSeries, int, error) {
+	var out []*promSeries
+	series := map[string]*promSeries{}
+	n := 0
+	err := lokiLines(ctx, conn, logs, start+1, end, maxSamples+1, true, maxStreams, func(labels promLabels, t int64, line string) bool {
+		if n++; n > maxSamples {
+			return false
+		}
+		key := labels.key()
+		s, ok := series[key]
+		if !ok {
+			s = &promSeries{labels: labels, delta: true}
+			series[key] = s
+			out = append(out, s)
+		}
+		s.points = append(s.points, promPoint{t, 1})
+		return true
+	})
+	if err == nil && n > maxSamples {
+		err = errTooManySamples
+	}
+	return out, n, err
+}
+
+// lokiLabelSets returns the label sets of the streams with lines in the
+// requested time range, the last 6 hours by default.
+func (a *queryAPI) lokiLabelSets(w http.ResponseWriter, r *http.Request, fn func([]promLabels)) {
+	tenant, admin, ok := a.lokiCaller(w, r)
+	if !ok {
+		return
+	}
+	end, err := lokiTime(r.Form.Get("end"), time.Now().UnixNano())
+	var start int64
+	if err == nil {
+		start, err = lokiTime(r.Form.Get("start"), end-int64(6*time.Hour))
+	}
+	if err != nil {
+		writeLokiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ctx, conn, logger, done := a.readRequest(w, r, tenant, admin)
+	if conn == nil {
+		return
+	}
+	defer done()
+	_, streams, err := matchingStreams(ctx, conn, nil, start, end, a.cfg.QueryMaxRows)
+	if err != nil {
+		writeLokiQueryError(ctx, w, r, err, logger)
+		return
+	}
+	sets := make([]promLabels, 0, len(streams))
+	for _, labels := range streams {
+		sets = append(sets, labels)
+	}
+	fn(sets)
+}
+
+// handleLokiLabels lists the stream label names.
+func (a *queryAPI) handleLokiLabels(w http.ResponseWriter, r *http.Request) {
+	a.lokiLabelSets(w, r, func(sets []promLabels) {
+		names := map[string]bool{}
+		for _, labels := range sets {
+			for name := range labels {
+				names[name] = true
+			}
+		}
+		writeProm(w, sortedKeys(names))
+	})
+}
+
+// handleLokiLabelValues lists the values of a stream label.
+func (a *queryAPI) handleLokiLabelValues(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	a.lokiLabelSets(w, r, func(sets []promLabels) {
+		values := map[string]bool{}
+		for _, labels := range sets {
+			if v, ok := labels[name]; ok {
+				values[v] = true
+			}
+		}
+		writeProm(w, sortedKeys(values))
+	})
+}
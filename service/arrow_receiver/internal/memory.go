@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+var ErrMemoryLimit = errors.New("ingest memory limit exceeded")
+
+// MemoryBudget bounds the memory held by ingest: the payload of every batch
+// between receipt and storage plus what the Arrow allocators of the stream
+// consumers have in use. Batches wait for room; allocator usage is charged
+// after the fact, so it can push the budget over its limit until released.
+type MemoryBudget struct {
+	limit int64
+	wait  time.Duration
+
+	mu      sync.Mutex
+	inUse   int64
+	arrow   int64
+	changed chan struct{}
+}
+
+// NewMemoryBudget creates a budget of limit bytes. A limit of zero only
+// tracks usage.
+func NewMemoryBudget(limit int64, wait time.Duration) *MemoryBudget {
+	b := &MemoryBudget{limit: limit, wait: wait, changed: make(chan struct{})}
+	metrics.gaugeFunc("arrow_receiver_ingest_memory_bytes", "Ingest memory in use, Arrow allocators included.", nil,
+		func(emit func(float64, ...string)) { emit(float64(b.usage(&b.inUse))) })
+	metrics.gaugeFunc("arrow_receiver_arrow_memory_bytes", "Memory in use by the Arrow allocators of the stream consumers.", nil,
+		func(emit func(float64, ...string)) { emit(float64(b.usage(&b.arrow))) })
+	metrics.gaugeFunc("arrow_receiver_ingest_memory_limit_bytes", "Ingest memory limit, 0 if unlimited.", nil,
+		func(emit func(float64, ...string)) { emit(float64(limit)) })
+	return b
+}
+
+// Acquire reserves n bytes, waiting up to the configured time for other
+// batches to release theirs. It fails with ErrMemoryLimit.
+func (b *MemoryBudget) Acquire(ctx context.Context, n int64) error {
+	if b.limit > 0 && n > b.limit {
+		return ErrMemoryLimit
+	}
+	timer := time.NewTimer(b.wait)
+	defer timer.Stop()
+	for {
+		b.mu.Lock()
+		if b.limit == 0 || b.inUse+n <= b.limit {
+			b.add(n)
+			b.mu.Unlock()
+			return nil
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return ErrMemoryLimit
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Release returns n bytes to the budget.
+func (b *MemoryBudget) Release(n int64) {
+	b.mu.Lock()
+	b.add(-n)
+	b.mu.Unlock()
+}
+
+// chargeArrow records a change in Arrow allocator usage.
+func (b *MemoryBudget) chargeArrow(n int64) {
+	b.mu.Lock()
+	b.arrow += n
+	b.add(n)
+	b.mu.Unlock()
+}
+
+// usage reads a counter of b under its lock.
+func (b *MemoryBudget) usage(counter *int64) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return *counter
+}
+
+// add must be called with b.mu held.
+func (b *MemoryBudget) add(n int64) {
+	b.inUse += n
+	if n < 0 {
+		close(b.changed)
+		b.changed = make(chan struct{})
+	}
+}
+
+// MeterProvider returns a meter provider for arrowrecord.NewConsumer that
+// charges the consumer's allocator usage to the budget. The consumer reports
+// it as the arrow_memory_inuse counter after every batch and on Close.
+func (b *MemoryBudget) MeterProvider() metric.MeterProvider {
+	return arrowMeterProvider{budget: b}
+}
+
+type arrowMeterProvider struct {
+	noop.MeterProvider
+	budget *MemoryBudget
+}
+
+func (p arrowMeterProvider) Meter(string, ...metric.MeterOption) metric.Meter {
+	return arrowMeter{budget: p.budget}
+}
+
+type arrowMeter struct {
+	noop.Meter
+	budget *MemoryBudget
+}
+
+func (m arrowMeter) Int64UpDownCounter(name string, _ ...metric.Int64UpDownCounterOption) (metric.Int64UpDownCounter, error) {
+	if name != "arrow_memory_inuse" {
+		return noop.Int64UpDownCounter{}, nil
+	}
+	return arrowMemoryCounter{budget: m.budget}, nil
+}
+
+type arrowMemoryCounter struct {
+	noop.Int64UpDownCounter
+	budget *MemoryBudget
+}
+
+func (c arrowMemoryCounter) Add(_ context.Context, n int64, _ ...metric.AddOption) {
+	c.budget.chargeArrow(n)
+}
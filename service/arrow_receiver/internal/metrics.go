@@ -0,0 +1,294 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The receiver's own metrics, served at /metrics in the Prometheus text
+// format. Gauges of other components are registered by their constructors.
+var (
+	metrics = &metricRegistry{}
+
+	metricBatchesReceived = metrics.counter("arrow_receiver_batches_received_total",
+		"Arrow batches received, by signal.", "signal")
+	metricBytesReceived = metrics.counter("arrow_receiver_received_bytes_total",
+		"Arrow payload bytes received, by signal.", "signal")
+	metricBatches = metrics.counter("arrow_receiver_batches_total",
+		"Arrow batches acked, by signal and status code.", "signal", "status")
+	metricItems = metrics.counter("arrow_receiver_items_total",
+		"Spans, log records and metric points of decoded batches acked, by signal and status code.", "signal", "status")
+	metricActiveStreams = metrics.gauge("arrow_receiver_active_streams",
+		"Open Arrow streams, by signal.", "signal")
+	metricDecodeSeconds = metrics.histogram("arrow_receiver_decode_duration_seconds",
+		"Time to decode an Arrow batch into rows, by signal.", "signal")
+	metricInsertSeconds = metrics.histogram("arrow_receiver_insert_duration_seconds",
+		"Time to insert the rows of one writer transaction into DuckDB.")
+	metricInsertRetries = metrics.counter("arrow_receiver_insert_retries_total",
+		"Failed inserts of batches acked from the WAL that are retried, by signal.", "signal")
+	metricHTTPRequests = metrics.counter("arrow_receiver_http_requests_total",
+		"Query API requests, by route and status code.", "handler", "code")
+	metricHTTPSeconds = metrics.histogram("arrow_receiver_http_request_duration_seconds",
+		"Query API request latency, by route.", "handler")
+)
+
+// metricBuckets are the histogram bucket bounds in seconds.
+var metricBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metricRegistry holds the metric families in the order they are exposed.
+type metricRegistry struct {
+	mu       sync.Mutex
+	families []metricFamily
+	funcs    map[string]*gaugeFunc
+}
+
+type metricFamily interface {
+	write(w *bufio.Writer)
+}
+
+func (r *metricRegistry) counter(name, help string, labels ...string) *metricVec {
+	return r.add(&metricVec{name: name, help: help, kind: "counter", labels: labels, values: map[string]*metricValue{}})
+}
+
+func (r *metricRegistry) gauge(name, help string, labels ...string) *metricVec {
+	return r.add(&metricVec{name: name, help: help, kind: "gauge", labels: labels, values: map[string]*metricValue{}})
+}
+
+func (r *metricRegistry) histogram(name, help string, labels ...string) *metricVec {
+	return r.add(&metricVec{name: name, help: help, kind: "histogram", labels: labels, values: map[string]*metricValue{}})
+}
+
+func (r *metricRegistry) add(v *metricVec) *metricVec {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.families = append(r.families, v)
+	return v
+}
+
+// gaugeFunc registers a gauge read when scraped. collect reports one sample
+// per label set. Registering a name again replaces the earlier function.
+func (r *metricRegistry) gaugeFunc(name, help string, labels []string, collect func(emit func(value float64, labelValues ...string))) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if g, ok := r.funcs[name]; ok {
+		g.collect = collect
+		return
+	}
+	if r.funcs == nil {
+		r.funcs = map[string]*gaugeFunc{}
+	}
+	g := &gaugeFunc{name: name, help: help, labels: labels, collect: collect}
+	r.funcs[name] = g
+	r.families = append(r.families, g)
+}
+
+// ServeHTTP writes every metric in the Prometheus text format.
+func (r *metricRegistry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	r.mu.Lock()
+	families := append([]metricFamily(nil), r.families...)
+	r.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(out)
+	}
+	out.Flush()
+}
+
+// metricVec is a counter, gauge or histogram with a value per label set.
+type metricVec struct {
+	name, help, kind string
+	labels           []string
+
+	mu     sync.Mutex
+	values map[string]*metricValue
+}
+
+type metricValue struct {
+	labelValues []string
+	value       float64
+	// buckets, sum and value as count are used by histograms.
+	buckets []uint64
+	sum     float64
+}
+
+func (v *metricVec) get(labelValues []string) *metricValue {
+	key := strings.Join(labelValues, "\xff")
+	m, ok := v.values[key]
+	if !ok {
+		m = &metricValue{labelValues: labelValues}
+		if v.kind == "histogram" {
+			m.buckets = make([]uint64, len(metricBuckets))
+		}
+		v.values[key] = m
+	}
+	return m
+}
+
+// Add adds delta to the counter or gauge of the label values.
+func (v *metricVec) Add(delta float64, labelValues ...string) {
+	v.mu.Lock()
+	v.get(labelValues).value += delta
+	v.mu.Unlock()
+}
+
+// Observe records a histogram sample.
+func (v *metricVec) Observe(value float64, labelValues ...string) {
+	v.mu.Lock()
+	m := v.get(labelValues)
+	for i, bound := range metricBuckets {
+		if value <= bound {
+			m.buckets[i]++
+		}
+	}
+	m.value++
+	m.sum += value
+	v.mu.Unlock()
+}
+
+// ObserveSince records the seconds elapsed since start.
+func (v *metricVec) ObserveSince(start time.Time, labelValues ...string) {
+	v.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (v *metricVec) write(w *bufio.Writer) {
+	v.mu.Lock()
+	values := make([]*metricValue, 0, len(v.values))
+	for _, m := range v.values {
+		values = append(values, m)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return strings.Join(values[i].labelValues, "\xff") < strings.Join(values[j].labelValues, "\xff")
+	})
+	writeMetricHeader(w, v.name, v.help, v.kind)
+	for _, m := range values {
+		if v.kind != "histogram" {
+			writeSample(w, v.name, v.labels, m.labelValues, m.value)
+			continue
+		}
+		labels := append(append([]string(nil), v.labels...), "le")
+		for i, bound := range metricBuckets {
+			writeSample(w, v.name+"_bucket", labels, append(append([]string(nil), m.labelValues...), formatMetricValue(bound)), float64(m.buckets[i]))
+		}
+		writeSample(w, v.name+"_bucket", labels, append(append([]string(nil), m.labelValues...), "+Inf"), m.value)
+		writeSample(w, v.name+"_sum", v.labels, m.labelValues, m.sum)
+		writeSample(w, v.name+"_count", v.labels, m.labelValues, m.value)
+	}
+	v.mu.Unlock()
+}
+
+type gaugeFunc struct {
+	name, help string
+	labels     []string
+	collect    func(emit func(value float64, labelValues ...string))
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	writeMetricHeader(w, g.name, g.help, "gauge")
+	g.collect(func(value float64, labelValues ...string) {
+		writeSample(w, g.name, g.labels, labelValues, value)
+	})
+}
+
+func writeMetricHeader(w *bufio.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeSample(w *bufio.Writer, name string, labels, labelValues []string, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, label, labelEscaper.Replace(labelValues[i]))
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatMetricValue(value))
+	w.WriteByte('\n')
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// untracedRoutes are polled by probes and not worth a span per request.
+var untracedRoutes = map[string]bool{"/healthz": true, "/readyz": true}
+
+// instrumentHTTP counts the requests of a query API route and their latency,
+// and traces them when self-tracing is on.
+func instrumentHTTP(route string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		if untracedRoutes[route] {
+			handler(rec, r)
+		} else {
+			ctx, span := startSpan(r.Context(), r.Method+" "+route, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", route),
+			))
+			handler(rec, r.WithContext(ctx))
+			span.SetAttributes(attribute.Int("http.response.status_code", rec.status))
+			if rec.status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(rec.status))
+			}
+			span.End()
+		}
+		metricHTTPRequests.Add(1, route, strconv.Itoa(rec.status))
+		metricHTTPSeconds.ObserveSince(start, route)
+	}
+}
+
+// statusRecorder remembers the status code of a response. Unwrap and
+// Hijack keep flushing and WebSocket upgrades working.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if !s.wroteHeader {
+		s.status, s.wroteHeader = code, true
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	s.wroteHeader = true
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func (s *statusRecorder) Flush() {
+	http.NewResponseController(s.ResponseWriter).Flush()
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	s.status = http.StatusSwitchingProtocols
+	return http.NewResponseController(s.ResponseWriter).Hijack()
+}
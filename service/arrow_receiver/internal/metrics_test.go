@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	metricNameRe = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRe  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// parseExposition checks text against the Prometheus text format 0.0.4 and
+// returns the samples by series. Each family needs a TYPE line before its
+// samples, which must be contiguous; histograms only have _bucket samples
+// with le, _sum and _count.
+func parseExposition(text string) (map[string]float64, error) {
+	types := map[string]string{}
+	done := map[string]bool{}
+	samples := map[string]float64{}
+	current := ""
+	for i, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		fail := func(format string, args ...interface{}) error {
+			return fmt.Errorf("line %d %q: %s", i+1, line, fmt.Sprintf(format, args...))
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.SplitN(line, " ", 4)
+			if len(fields) < 3 || (fields[1] != "HELP" && fields[1] != "TYPE") {
+				continue
+			}
+			name := fields[2]
+			if !metricNameRe.MatchString(name) {
+				return nil, fail("invalid metric name")
+			}
+			if name != current {
+				if done[name] {
+					return nil, fail("family %s is split", name)
+				}
+				done[current], current = true, name
+			}
+			if fields[1] == "TYPE" {
+				if len(fields) != 4 || !strings.Contains(" counter gauge histogram summary untyped ", " "+fields[3]+" ") {
+					return nil, fail("invalid type")
+				}
+				if _, ok := types[name]; ok {
+					return nil, fail("second TYPE line")
+				}
+				types[name] = fields[3]
+			} else if len(fields) == 4 && strings.Contains(strings.NewReplacer(`\\`, "", `\n`, "").Replace(fields[3]), `\`) {
+				return nil, fail("invalid escape in HELP")
+			}
+			continue
+		}
+		name, rest, labels := line, "", map[string]string{}
+		if j := strings.IndexAny(line, "{ "); j >= 0 {
+			name, rest = line[:j], line[j:]
+		}
+		if strings.HasPrefix(rest, "{") {
+			var err error
+			if labels, rest, err = parseLabels(rest[1:]); err != nil {
+				return nil, fail("%v", err)
+			}
+		}
+		family, suffix := name, ""
+		for _, s := range []string{"_bucket", "_sum", "_count"} {
+			if base := strings.TrimSuffix(name, s); base != name && types[base] == "histogram" {
+				family, suffix = base, s
+			}
+		}
+		if family != current || types[family] == "" {
+			return nil, fail("sample outside the %s family or before its TYPE", family)
+		}
+		if types[family] == "histogram" && (suffix == "" || (suffix == "_bucket") != (labels["le"] != "")) {
+			return nil, fail("invalid histogram sample")
+		}
+		fields := strings.Fields(rest)
+		if len(fields) < 1 || len(fields) > 2 {
+			return nil, fail("want a value and an optional timestamp")
+		}
+		value, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, fail("invalid value")
+		}
+		pairs := make([]string, 0, len(labels))
+		for k, v := range labels {
+			pairs = append(pairs, k+"="+strconv.Quote(v))
+		}
+		sort.Strings(pairs)
+		series := name + "{" + strings.Join(pairs, ",") + "}"
+		if _, ok := samples[series]; ok {
+			return nil, fail("duplicate series")
+		}
+		samples[series] = value
+	}
+	return samples, nil
+}
+
+// parseLabels parses the label pairs after "{" and returns the text after
+// the closing "}".
+func parseLabels(s string) (map[string]string, string, error) {
+	labels := map[string]string{}
+	for {
+		if strings.HasPrefix(s, "}") {
+			return labels, s[1:], nil
+		}
+		eq := strings.Index(s, `="`)
+		if eq < 0 || !labelNameRe.MatchString(s[:eq]) {
+			return nil, "", fmt.Errorf("invalid label in %q", s)
+		}
+		name := s[:eq]
+		s = s[eq+2:]
+		var value strings.Builder
+		for {
+			if s == "" {
+				return nil, "", fmt.Errorf("unterminated value of %s", name)
+			}
+			c := s[0]
+			s = s[1:]
+			if c == '"' {
+				break
+			}
+			if c == '\n' {
+				return nil, "", fmt.Errorf("raw newline in %s", name)
+			}
+			if c == '\\' {
+				if s == "" || !strings.ContainsRune(`\"n`, rune(s[0])) {
+					return nil, "", fmt.Errorf("invalid escape in %s", name)
+				}
+				c, s = map[byte]byte{'\\': '\\', '"': '"', 'n': '\n'}[s[0]], s[1:]
+			}
+			value.WriteByte(c)
+		}
+		if _, ok := labels[name]; ok {
+			return nil, "", fmt.Errorf("repeated label %s", name)
+		}
+		labels[name] = value.String()
+		s = strings.TrimPrefix(s, ",")
+	}
+}
+
+func TestMetricsExposition(t *testing.T) {
+	newScopeTestDB(t)
+	metricHTTPRequests.Add(1, `/query "quoted" \ path`+"\n", "200")
+	metricHTTPSeconds.Observe(0.2, "/query")
+	metricBatches.Add(1, "traces", "OK")
+	w := httptest.NewRecorder()
+	metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	samples, err := parseExposition(w.Body.String())
+	if err != nil {
+		t.Fatalf("%v\n%s", err, w.Body)
+	}
+	for _, series := range []string{
+		`arrow_receiver_http_request_duration_seconds_bucket{handler="/query",le="0.25"}`,
+		`arrow_receiver_http_request_duration_seconds_count{handler="/query"}`,
+		`arrow_receiver_table_rows{table="traces"}`,
+		`arrow_receiver_http_requests_total{code="200",handler="/query \"quoted\" \\ path\n"}`,
+	} {
+		if _, ok := samples[series]; !ok {
+			t.Errorf("no sample %s", series)
+		}
+	}
+	if n := samples[`arrow_receiver_table_rows{table="traces"}`]; n != 6 {
+		t.Errorf("traces rows %v, want 6", n)
+	}
+}
+
+func TestParseExpositionRejects(t *testing.T) {
+	for _, text := range []string{
+		"# TYPE a counter\na{x=\"1\"} one\n",
+		"a 1\n",
+		"# TYPE a counter\na{x=\"\\q\"} 1\n",
+		"# TYPE a counter\n# TYPE b gauge\nb 1\na 1\n",
+		"# TYPE h histogram\nh 1\n",
+		"# TYPE a counter\na{x=\"1\"} 1\na{x=\"1\"} 2\n",
+	} {
+		if _, err := parseExposition(text); err == nil {
+			t.Errorf("parsed %q", text)
+		}
+	}
+}
+
+func TestTableRowCountsCached(t *testing.T) {
+	db := newScopeTestDB(t)
+	counts := &tableRowCounts{db: db}
+	if n := counts.get()["traces"]; n != 6 {
+		t.Fatalf("traces rows %d, want 6", n)
+	}
+	ctx := context.Background()
+	rows, err := NewRowWriter(ctx, db, NewLogIndex(defaultConfig()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	if err := rows.Write(ctx, RowBatch{Traces: TracesToRows(jaegerTestTraces(), "initech")}); err != nil {
+		t.Fatal(err)
+	}
+	if n := counts.get()["traces"]; n != 6 {
+		t.Errorf("traces rows %d within tableRowsMaxAge, want the cached 6", n)
+	}
+	counts.read = time.Now().Add(-tableRowsMaxAge)
+	if n := counts.get()["traces"]; n != 9 {
+		t.Errorf("traces rows %d after tableRowsMaxAge, want 9", n)
+	}
+}
@@ -0,0 +1,358 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrNamedQueryNotFound = errors.New("named query not found")
+
+var namedQueryPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// NamedQuery is a stored query run by name. Its $name placeholders are
+// filled from the request, converted to the declared types.
+type NamedQuery struct {
+	Name        string `json:"name"`
+	Query       string `json:"query"`
+	Description string `json:"description,omitempty"`
+	// Params maps each placeholder to string, int, float, bool or
+	// timestamp (RFC 3339). All of them are required.
+	Params map[string]string `json:"params,omitempty"`
+}
+
+func (q NamedQuery) validate() error {
+	if !namedQueryPattern.MatchString(q.Name) {
+		return fmt.Errorf("invalid named query name %q", q.Name)
+	}
+	if q.Query == "" {
+		return fmt.Errorf("named query %q has no query", q.Name)
+	}
+	for param, typ := range q.Params {
+		if _, ok := paramTypes[typ]; !ok {
+			return fmt.Errorf("named query %q: parameter %q has unknown type %q", q.Name, param, typ)
+		}
+	}
+	return nil
+}
+
+// checkPlaceholders verifies that the placeholders of the query are exactly
+// the declared parameters.
+func (q NamedQuery) checkPlaceholders(ctx context.Context, conn *TenantConn) error {
+	names, err := queryParamNames(ctx, conn, q.Query)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, name := range names {
+		if _, ok := q.Params[name]; !ok {
+			return fmt.Errorf("placeholder $%s is not a declared parameter", name)
+		}
+		seen[name] = true
+	}
+	for name := range q.Params {
+		if !seen[name] {
+			return fmt.Errorf("parameter %q is not used by the query", name)
+		}
+	}
+	return nil
+}
+
+// args converts the request values to the declared parameter types.
+func (q NamedQuery) args(values map[string]string) ([]interface{}, error) {
+	names := make([]string, 0, len(q.Params))
+	for name := range q.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	args := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		raw, ok := values[name]
+		if !ok {
+			return nil, fmt.Errorf("missing parameter %q", name)
+		}
+		v, err := paramTypes[q.Params[name]](raw)
+		if err != nil {
+			return nil, fmt.Errorf("parameter %q: expected %s", name, q.Params[name])
+		}
+		args = append(args, sql.Named(name, v))
+	}
+	return args, nil
+}
+
+// NamedQueries is the registry of named queries. When it has a file,
+// queries are loaded from it and changes made through the API are saved
+// back to it.
+type NamedQueries struct {
+	path string
+
+	mu      sync.RWMutex
+	queries map[string]NamedQuery
+}
+
+// LoadNamedQueries reads the JSON array of named queries at path. An empty
+// path keeps the registry in memory; a missing file starts it empty.
+func LoadNamedQueries(path string) (*NamedQueries, error) {
+	n := &NamedQueries{path: path, queries: map[string]NamedQuery{}}
+	if path == "" {
+		return n, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return n, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var queries []NamedQuery
+	if err := json.Unmarshal(data, &queries); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for _, q := range queries {
+		if err := q.validate(); err != nil {
+			return nil, err
+		}
+		n.queries[q.Name] = q
+	}
+	return n, nil
+}
+
+func (n *NamedQueries) Get(name string) (NamedQuery, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	q, ok := n.queries[name]
+	return q, ok
+}
+
+// List returns the named queries sorted by name.
+func (n *NamedQueries) List() []NamedQuery {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	list := make([]NamedQuery, 0, len(n.queries))
+	for _, q := range n.queries {
+		list = append(list, q)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Put adds or replaces a named query.
+func (n *NamedQueries) Put(q NamedQuery) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	prev, existed := n.queries[q.Name]
+	n.queries[q.Name] = q
+	if err := n.save(); err != nil {
+		if existed {
+			n.queries[q.Name] = prev
+		} else {
+			delete(n.queries, q.Name)
+		}
+		return err
+	}
+	return nil
+}
+
+func (n *NamedQueries) Delete(name string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	prev, ok := n.queries[name]
+	if !ok {
+		return ErrNamedQueryNotFound
+	}
+	delete(n.queries, name)
+	if err := n.save(); err != nil {
+		n.queries[name] = prev
+		return err
+	}
+	return nil
+}
+
+// save writes the registry to its file through a temporary file, so a
+// crash leaves either the old or the new version.
+func (n *NamedQueries) save() error {
+	if n.path == "" {
+		return nil
+	}
+	list := make([]NamedQuery, 0, len(n.queries))
+	for _, q := range n.queries {
+		list = append(list, q)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(n.path), ".named-queries-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), n.path)
+}
+
+// handleNamedList lists the named queries.
+func (a *queryAPI) handleNamedList(w http.ResponseWriter, r *http.Request) {
+	if a.cors(w, r, "GET") {
+		return
+	}
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(`{"error": "GET only"}`))
+		return
+	}
+	if _, _, ok := a.caller(w, r); !ok {
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"queries": a.named.List()})
+}
+
+// handleNamed runs a named query with GET (parameters in the URL) or POST
+// (a JSON body with params, page_size, cursor and format), and lets admins
+// create it with PUT and remove it with DELETE.
+func (a *queryAPI) handleNamed(w http.ResponseWriter, r *http.Request) {
+	if a.cors(w, r, "GET, POST, PUT, DELETE") {
+		return
+	}
+	name := r.PathValue("name")
+	switch r.Method {
+	case "GET", "POST":
+		a.runNamed(w, r, name)
+	case "PUT":
+		a.putNamed(w, r, name)
+	case "DELETE":
+		a.deleteNamed(w, r, name)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(`{"error": "GET, POST, PUT or DELETE only"}`))
+	}
+}
+
+func (a *queryAPI) runNamed(w http.ResponseWriter, r *http.Request, name string) {
+	tenant, admin, ok := a.caller(w, r)
+	if !ok {
+		return
+	}
+	q, found := a.named.Get(name)
+	if !found {
+		writeJSONError(w, http.StatusNotFound, ErrNamedQueryNotFound.Error())
+		return
+	}
+	var body struct {
+		Params   map[string]string `json:"params"`
+		PageSize int               `json:"page_size"`
+		Cursor   string            `json:"cursor"`
+		Format   string            `json:"format"`
+	}
+	values := map[string]string{}
+	if r.Method == "POST" {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid json"}`))
+			return
+		}
+		values = body.Params
+	} else {
+		for key, vals := range r.URL.Query() {
+			values[key] = vals[0]
+		}
+	}
+	args, err := q.args(values)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	used := map[string]string{}
+	for param := range q.Params {
+		used[param] = values[param]
+	}
+	params, _ := json.Marshal(used)
+	a.execute(w, r, tenant, admin, queryRequest{
+		Query:    q.Query,
+		Params:   params,
+		PageSize: body.PageSize,
+		Cursor:   body.Cursor,
+		Format:   body.Format,
+	}, args)
+}
+
+func (a *queryAPI) putNamed(w http.ResponseWriter, r *http.Request, name string) {
+	if !a.tenants.IsAdmin(r) {
+		writeJSONError(w, http.StatusForbidden, "managing named queries requires an admin key")
+		return
+	}
+	var q NamedQuery
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "invalid json"}`))
+		return
+	}
+	q.Name = name
+	if err := q.validate(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.QueryTimeout)
+	defer cancel()
+	conn, err := OpenAdminConn(ctx, a.db)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer conn.Close()
+	err = CheckReadOnlyQuery(ctx, conn, q.Query)
+	if err == nil {
+		err = q.checkPlaceholders(ctx, conn)
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := a.named.Put(q); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		log.WithError(err).Error("saving named queries failed")
+		return
+	}
+	log.WithField("name", name).Info("named query saved")
+	json.NewEncoder(w).Encode(q)
+}
+
+func (a *queryAPI) deleteNamed(w http.ResponseWriter, r *http.Request, name string) {
+	if !a.tenants.IsAdmin(r) {
+		writeJSONError(w, http.StatusForbidden, "managing named queries requires an admin key")
+		return
+	}
+	err := a.named.Delete(name)
+	if errors.Is(err, ErrNamedQueryNotFound) {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		log.WithError(err).Error("saving named queries failed")
+		return
+	}
+	log.WithField("name", name).Info("named query deleted")
+	w.WriteHeader(http.StatusNoContent)
+}
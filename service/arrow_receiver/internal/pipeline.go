@@ -0,0 +1,470 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	arrowpb "github.com/open-telemetry/otel-arrow/api/experimental/arrow/v1"
+	arrowrecord "github.com/open-telemetry/otel-arrow/pkg/otel/arrow_record"
+)
+
+// Signal names the telemetry type carried by a stream.
+type Signal string
+
+const (
+	SignalTraces  Signal = "traces"
+	SignalLogs    Signal = "logs"
+	SignalMetrics Signal = "metrics"
+)
+
+var (
+	ErrQueueFull      = errors.New("ingest queue full")
+	ErrPipelineClosed = errors.New("ingest pipeline closed")
+)
+
+// ingestJob is one received batch on its way to storage. Its final status is
+// delivered exactly once on done.
+type ingestJob struct {
+	signal  Signal
+	tenant  string
+	batch   *arrowpb.BatchArrowRecords
+	decoder *streamDecoder
+	seq     uint64
+	rows    RowBatch
+	// received is when the batch arrived.
+	received time.Time
+	done     chan *arrowpb.BatchStatus
+	// acked is set once the status was sent early because the rows are in
+	// the WAL; walSegment is the segment to commit after the insert.
+	acked      bool
+	walSegment uint64
+	// memory holds the reserved bytes until the job leaves the pipeline.
+	memory   *MemoryBudget
+	reserved int64
+	// ctx carries span, the self-tracing span of the batch, which ends when
+	// it is acked; queued spans the wait for a decode worker.
+	ctx    context.Context
+	span   trace.Span
+	queued trace.Span
+}
+
+func newIngestJob(signal Signal, tenant string, batch *arrowpb.BatchArrowRecords) *ingestJob {
+	return &ingestJob{
+		signal:   signal,
+		tenant:   tenant,
+		batch:    batch,
+		done:     make(chan *arrowpb.BatchStatus, 1),
+		received: time.Now(),
+		ctx:      context.Background(),
+		span:     noop.Span{},
+		queued:   noop.Span{},
+	}
+}
+
+func (j *ingestJob) finish(code arrowpb.StatusCode, msg string) {
+	metricBatches.Add(1, string(j.signal), code.String())
+	metricItems.Add(float64(j.rows.Len()), string(j.signal), code.String())
+	j.done <- &arrowpb.BatchStatus{BatchId: j.batch.BatchId, StatusCode: code, StatusMessage: msg}
+}
+
+// release returns the job's memory reservation.
+func (j *ingestJob) release() {
+	if j.memory != nil {
+		j.memory.Release(j.reserved)
+		j.memory = nil
+	}
+}
+
+// streamDecoder owns the otel-arrow consumer of one stream. Batches carry
+// Arrow schemas and dictionary deltas for the batches after them, so decode
+// workers take turns in the order the batches were received.
+type streamDecoder struct {
+	consumer *arrowrecord.Consumer
+	next     uint64 // next sequence number, only touched by the receive loop
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	turn uint64
+}
+
+func newStreamDecoder(opts ...arrowrecord.Option) *streamDecoder {
+	d := &streamDecoder{consumer: arrowrecord.NewConsumer(opts...)}
+	d.cond = sync.NewCond(&d.mu)
+	return d
+}
+
+// decode runs fn once every batch received before seq has been decoded.
+func (d *streamDecoder) decode(seq uint64, fn func(*arrowrecord.Consumer)) {
+	d.mu.Lock()
+	for d.turn != seq {
+		d.cond.Wait()
+	}
+	d.mu.Unlock()
+
+	fn(d.consumer)
+
+	d.mu.Lock()
+	d.turn++
+	d.cond.Broadcast()
+	d.mu.Unlock()
+}
+
+func (d *streamDecoder) close() {
+	if err := d.consumer.Close(); err != nil {
+		log.WithError(err).Warn("Error closing Arrow consumer")
+	}
+}
+
+// Pipeline decouples receiving from storage: streams submit batches to a
+// bounded queue, decode workers turn them into rows and a single writer
+// commits rows from all streams to DuckDB in shared transactions. With a WAL
+// the rows are logged by the decode worker and acked before the insert.
+// Decoded batches are also published to live-tail clients.
+type Pipeline struct {
+	rows         *RowWriter
+	processor    atomic.Pointer[Processor]
+	wal          *WAL
+	tail         *LiveTail
+	queue        chan *ingestJob
+	writes       chan *ingestJob
+	maxBatchRows int
+
+	draining  chan struct{}
+	drainOnce sync.Once
+	// abort is closed when Close stops waiting for the writer.
+	abort     chan struct{}
+	insertErr atomic.Pointer[error]
+	// unstored counts batches acked from the WAL but not yet in DuckDB.
+	unstored atomic.Int64
+
+	mu      sync.RWMutex
+	closed  bool
+	workers sync.WaitGroup
+	writer  sync.WaitGroup
+}
+
+// NewPipeline starts the decode workers and the writer. wal may be nil.
+func NewPipeline(cfg Config, db *sql.DB, wal *WAL, tail *LiveTail) (*Pipeline, error) {
+	rows, err := NewRowWriter(context.Background(), db, NewLogIndex(cfg))
+	if err != nil {
+		return nil, err
+	}
+	p := &Pipeline{
+		rows:         rows,
+		wal:          wal,
+		tail:         tail,
+		queue:        make(chan *ingestJob, cfg.QueueSize),
+		writes:       make(chan *ingestJob, cfg.QueueSize),
+		maxBatchRows: cfg.WriterBatchRows,
+		draining:     make(chan struct{}),
+		abort:        make(chan struct{}),
+	}
+	p.processor.Store(NewProcessor(cfg))
+	for i := 0; i < cfg.DecodeWorkers; i++ {
+		p.workers.Add(1)
+		go p.decodeLoop()
+	}
+	p.writer.Add(1)
+	go p.writeLoop()
+	metrics.gaugeFunc("arrow_receiver_queue_depth", "Batches waiting in the ingest queues, by queue.", []string{"queue"},
+		func(emit func(float64, ...string)) {
+			emit(float64(len(p.queue)), "decode")
+			emit(float64(len(p.writes)), "write")
+		})
+	metrics.gaugeFunc("arrow_receiver_queue_capacity", "Capacity of the ingest queues, by queue.", []string{"queue"},
+		func(emit func(float64, ...string)) {
+			emit(float64(cap(p.queue)), "decode")
+			emit(float64(cap(p.writes)), "write")
+		})
+	return p, nil
+}
+
+// Submit enqueues the job without blocking. It fails with ErrQueueFull when
+// the queue is at capacity.
+func (p *Pipeline) Submit(job *ingestJob) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return ErrPipelineClosed
+	}
+	job.seq = job.decoder.next
+	_, job.queued = startSpan(job.ctx, "arrow.queue")
+	select {
+	case p.queue <- job:
+		job.decoder.next++
+		return nil
+	default:
+		job.queued.End()
+		return ErrQueueFull
+	}
+}
+
+// SetProcessor replaces the processing rules applied to decoded batches.
+func (p *Pipeline) SetProcessor(processor *Processor) {
+	p.processor.Store(processor)
+}
+
+// Saturated reports whether the decode or write queue is full.
+func (p *Pipeline) Saturated() bool {
+	return len(p.queue) == cap(p.queue) || len(p.writes) == cap(p.writes)
+}
+
+// Drain asks the streams to end once their batches are acked, so exporters
+// stop sending before the pipeline closes.
+func (p *Pipeline) Drain() {
+	p.drainOnce.Do(func() { close(p.draining) })
+}
+
+// Draining is closed once Drain has been called.
+func (p *Pipeline) Draining() <-chan struct{} {
+	return p.draining
+}
+
+// Close stops accepting batches and returns once every queued batch has been
+// written and the WAL is closed. If ctx ends first the writer stops retrying
+// failed inserts. Close fails if an acked batch was not stored, and says how
+// many; those are in the WAL and replayed on the next start. Batches queued
+// but not acked are resent by the exporters.
+func (p *Pipeline) Close(ctx context.Context) error {
+	p.Drain()
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.queue)
+	p.mu.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		p.workers.Wait()
+		close(p.writes)
+		p.writer.Wait()
+		var errs []error
+		if n := p.unstored.Load(); n > 0 {
+			errs = append(errs, fmt.Errorf("%d acked batches not stored, left in the WAL for replay", n))
+		}
+		if err := p.rows.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing DuckDB writer connection: %w", err))
+		}
+		if p.wal != nil {
+			if err := p.wal.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("closing WAL: %w", err))
+			}
+		}
+		done <- errors.Join(errs...)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		close(p.abort)
+		return fmt.Errorf("%w with %d batches still queued and %d acked batches not stored", ctx.Err(), len(p.queue)+len(p.writes), p.unstored.Load())
+	}
+}
+
+func (p *Pipeline) decodeLoop() {
+	defer p.workers.Done()
+	for job := range p.queue {
+		var err error
+		job.decoder.decode(job.seq, func(consumer *arrowrecord.Consumer) {
+			job.queued.End()
+			_, span := startSpan(job.ctx, "arrow.decode")
+			start := time.Now()
+			job.rows, err = DecodeBatch(consumer, job.signal, job.batch, job.tenant, p.processor.Load())
+			metricDecodeSeconds.ObserveSince(start, string(job.signal))
+			span.SetAttributes(attribute.Int("items", job.rows.Len()))
+			endSpan(span, err)
+		})
+		if err != nil {
+			log.WithError(err).WithField("signal", job.signal).Error("Error converting Arrow to OTLP")
+			code := arrowpb.StatusCode_INVALID_ARGUMENT
+			if errors.Is(err, arrowrecord.ErrConsumerMemoryLimit) {
+				code = arrowpb.StatusCode_RESOURCE_EXHAUSTED
+			}
+			job.finish(code, err.Error())
+			job.release()
+			continue
+		}
+		p.tail.Publish(job.signal, job.tenant, job.rows)
+		if p.wal != nil && !p.logToWAL(job) {
+			job.release()
+			continue
+		}
+		p.writes <- job
+	}
+}
+
+// logToWAL appends the decoded rows to the WAL and acks the job. It reports
+// false if the job was rejected instead.
+func (p *Pipeline) logToWAL(job *ingestJob) bool {
+	_, span := startSpan(job.ctx, "wal.append")
+	seg, err := p.wal.Append(walEntry{Signal: job.signal, Tenant: job.tenant, Rows: job.rows})
+	endSpan(span, err)
+	if err != nil {
+		log.WithError(err).WithField("signal", job.signal).Error("Error appending to WAL")
+		code := arrowpb.StatusCode_UNAVAILABLE
+		if errors.Is(err, ErrWALFull) {
+			code = arrowpb.StatusCode_RESOURCE_EXHAUSTED
+		}
+		job.finish(code, err.Error())
+		return false
+	}
+	job.walSegment = seg
+	job.acked = true
+	p.unstored.Add(1)
+	job.finish(arrowpb.StatusCode_OK, "Received")
+	return true
+}
+
+func (p *Pipeline) writeLoop() {
+	defer p.writer.Done()
+	for job := range p.writes {
+		jobs := []*ingestJob{job}
+		rows := job.rows.Len()
+	drain:
+		for rows < p.maxBatchRows {
+			select {
+			case next, ok := <-p.writes:
+				if !ok {
+					break drain
+				}
+				jobs = append(jobs, next)
+				rows += next.rows.Len()
+			default:
+				break drain
+			}
+		}
+		p.commit(jobs)
+	}
+}
+
+// Backoff between inserts of a batch acked from the WAL.
+const (
+	insertRetryMin = 100 * time.Millisecond
+	insertRetryMax = 5 * time.Second
+)
+
+// commit writes the jobs in one transaction. If that fails the jobs are
+// retried one by one so a single bad batch does not fail its neighbours.
+// Batches not yet acked are failed so the exporter resends them; acked ones
+// are retried until they are stored, holding up the writer so the queues
+// fill and new batches are rejected.
+func (p *Pipeline) commit(jobs []*ingestJob) {
+	start := time.Now()
+	err := p.insert(context.Background(), jobs)
+	traceInsert(jobs, start, err)
+	if err != nil && len(jobs) > 1 {
+		for _, job := range jobs {
+			p.commit([]*ingestJob{job})
+		}
+		return
+	}
+	if err != nil && jobs[0].acked {
+		err = p.retryInsert(jobs[0], err)
+	}
+	for _, job := range jobs {
+		job.release()
+		if err != nil && !job.acked {
+			log.WithError(err).WithField("signal", job.signal).Error("Error inserting batch")
+			job.finish(arrowpb.StatusCode_UNAVAILABLE, err.Error())
+			continue
+		}
+		if err != nil {
+			log.WithError(err).WithField("signal", job.signal).Error("Acked batch not stored, leaving it in the WAL for replay")
+			continue
+		}
+		if p.wal != nil {
+			p.wal.Commit(job.walSegment)
+		}
+		if job.acked {
+			p.unstored.Add(-1)
+		} else {
+			job.finish(arrowpb.StatusCode_OK, "Received")
+		}
+	}
+}
+
+// retryInsert inserts a batch acked from the WAL again after err, backing
+// off between attempts, until it is stored or Close gives up waiting. While
+// it retries the error is reported by InsertError.
+func (p *Pipeline) retryInsert(job *ingestJob, err error) error {
+	defer p.insertErr.Store(nil)
+	backoff := insertRetryMin
+	for attempt := 1; err != nil; attempt++ {
+		p.insertErr.Store(&err)
+		metricInsertRetries.Add(1, string(job.signal))
+		log.WithError(err).WithFields(log.Fields{"signal": job.signal, "attempt": attempt}).Warn("Retrying insert of acked batch")
+		select {
+		case <-time.After(backoff):
+		case <-p.abort:
+			return err
+		}
+		backoff = min(2*backoff, insertRetryMax)
+		start := time.Now()
+		err = p.insert(context.Background(), []*ingestJob{job})
+		traceInsert([]*ingestJob{job}, start, err)
+	}
+	return nil
+}
+
+// InsertError returns the last insert error while an acked batch is being
+// retried, or nil.
+func (p *Pipeline) InsertError() error {
+	if err := p.insertErr.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// traceInsert adds a span for a transaction that inserted jobs to the trace
+// of each of them.
+func traceInsert(jobs []*ingestJob, start time.Time, err error) {
+	end := time.Now()
+	for _, job := range jobs {
+		_, span := startSpan(job.ctx, "duckdb.insert", trace.WithTimestamp(start),
+			trace.WithAttributes(attribute.Int("batches", len(jobs)), attribute.Int("items", job.rows.Len())))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End(trace.WithTimestamp(end))
+	}
+}
+
+// ReplayWAL inserts the entries a previous run logged but may not have
+// stored. Entries committed just before a crash are inserted again.
+func ReplayWAL(cfg Config, db *sql.DB, wal *WAL) (int, error) {
+	ctx := context.Background()
+	rows, err := NewRowWriter(ctx, db, NewLogIndex(cfg))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	return wal.Replay(func(entry walEntry) error {
+		return rows.Write(ctx, entry.Rows)
+	})
+}
+
+func (p *Pipeline) insert(ctx context.Context, jobs []*ingestJob) error {
+	var rows RowBatch
+	for _, job := range jobs {
+		rows.Traces = append(rows.Traces, job.rows.Traces...)
+		rows.Logs = append(rows.Logs, job.rows.Logs...)
+		rows.Metrics = append(rows.Metrics, job.rows.Metrics...)
+	}
+	defer metricInsertSeconds.ObserveSince(time.Now())
+	return p.rows.Write(ctx, rows)
+}
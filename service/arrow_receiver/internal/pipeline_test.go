@@ -0,0 +1,322 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	arrowpb "github.com/open-telemetry/otel-arrow/api/experimental/arrow/v1"
+	arrowrecord "github.com/open-telemetry/otel-arrow/pkg/otel/arrow_record"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// newPipelineTestDB returns an empty database for a pipeline test.
+func newPipelineTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := InitDB(filepath.Join(t.TempDir(), "pipeline.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// decodedJob returns a job as a decode worker hands it on, with the spans of
+// jaegerTestTraces for tenant.
+func decodedJob(id int64, tenant string) *ingestJob {
+	job := newIngestJob(SignalTraces, tenant, &arrowpb.BatchArrowRecords{BatchId: id})
+	job.rows = RowBatch{Traces: TracesToRows(jaegerTestTraces(), tenant)}
+	return job
+}
+
+// waitFor polls cond until it holds or the test times out.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func countRows(t *testing.T, db *sql.DB, table string) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM " + table).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// TestPipelineRetriesAckedInsert checks that a batch acked from the WAL
+// survives inserts failing for a while: it stays in the WAL, the failure is
+// reported, and it is stored once DuckDB recovers.
+func TestPipelineRetriesAckedInsert(t *testing.T) {
+	db := newPipelineTestDB(t)
+	walDir := t.TempDir()
+	wal, err := OpenWAL(walDir, 1<<20, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultConfig()
+	cfg.DecodeWorkers = 1
+	p, err := NewPipeline(cfg, db, wal, NewLiveTail(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec("ALTER TABLE traces RENAME TO traces_moved"); err != nil {
+		t.Fatal(err)
+	}
+	job := decodedJob(1, "acme")
+	if !p.logToWAL(job) {
+		t.Fatal("logToWAL rejected the batch")
+	}
+	if s := <-job.done; s.StatusCode != arrowpb.StatusCode_OK {
+		t.Fatalf("batch acked with %s", s.StatusCode)
+	}
+	p.writes <- job
+	waitFor(t, "the insert to fail", func() bool { return p.InsertError() != nil })
+	// Long enough for several attempts.
+	time.Sleep(3 * insertRetryMin)
+	if ids, err := wal.segmentIDs(); err != nil || len(ids) == 0 {
+		t.Fatalf("WAL segments %v, %v while the insert fails", ids, err)
+	}
+	h := NewHealth(db, p, time.Second)
+	h.check()
+	if len(h.Problems()) == 0 {
+		t.Error("health reports no problem while the insert fails")
+	}
+
+	if _, err := db.Exec("ALTER TABLE traces_moved RENAME TO traces"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the retry to succeed", func() bool { return p.InsertError() == nil })
+	if n := countRows(t, db, "traces"); n != 3 {
+		t.Errorf("stored %d spans, want 3", n)
+	}
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err = OpenWAL(walDir, 1<<20, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	if n, err := wal.Replay(func(walEntry) error { return nil }); err != nil || n != 0 {
+		t.Errorf("replayed %d entries (%v), want the stored batch committed", n, err)
+	}
+}
+
+// testStream is an Arrow stream of a tenant that delivers batches until they
+// run out and collects the acks.
+type testStream struct {
+	ctx     context.Context
+	batches chan *arrowpb.BatchArrowRecords
+
+	mu   sync.Mutex
+	acks []*arrowpb.BatchStatus
+}
+
+func newTestStream(tenant string, batches []*arrowpb.BatchArrowRecords) *testStream {
+	s := &testStream{
+		ctx:     metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-tenant-id", tenant)),
+		batches: make(chan *arrowpb.BatchArrowRecords, len(batches)),
+	}
+	for _, b := range batches {
+		s.batches <- b
+	}
+	close(s.batches)
+	return s
+}
+
+func (s *testStream) Context() context.Context { return s.ctx }
+
+func (s *testStream) Recv() (*arrowpb.BatchArrowRecords, error) {
+	if b, ok := <-s.batches; ok {
+		return b, nil
+	}
+	return nil, io.EOF
+}
+
+func (s *testStream) Send(status *arrowpb.BatchStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acks = append(s.acks, status)
+	return nil
+}
+
+// arrowTraceBatches encodes n batches of spans spans each with one
+// producer, so later batches depend on the schemas of the first.
+func arrowTraceBatches(t *testing.T, n, spans int) []*arrowpb.BatchArrowRecords {
+	t.Helper()
+	producer := arrowrecord.NewProducer()
+	defer producer.Close()
+	now := time.Now()
+	var batches []*arrowpb.BatchArrowRecords
+	for i := 0; i < n; i++ {
+		traces := ptrace.NewTraces()
+		ss := traces.ResourceSpans().AppendEmpty().ScopeSpans().AppendEmpty().Spans()
+		for j := 0; j < spans; j++ {
+			span := ss.AppendEmpty()
+			span.SetTraceID(pcommon.TraceID([16]byte{byte(i + 1)}))
+			span.SetSpanID(pcommon.SpanID([8]byte{byte(j + 1)}))
+			span.SetName(fmt.Sprintf("op-%d", j))
+			span.SetStartTimestamp(pcommon.NewTimestampFromTime(now))
+			span.SetEndTimestamp(pcommon.NewTimestampFromTime(now.Add(time.Millisecond)))
+		}
+		batch, err := producer.BatchArrowRecordsFromTraces(traces)
+		if err != nil {
+			t.Fatal(err)
+		}
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// TestArrowHandlerAcksInOrder runs concurrent streams through several decode
+// workers and the writer: every batch is acked OK, in the order it was sent
+// on its stream, and stored.
+func TestArrowHandlerAcksInOrder(t *testing.T) {
+	db := newPipelineTestDB(t)
+	cfg := defaultConfig()
+	cfg.DecodeWorkers = 4
+	p, err := NewPipeline(cfg, db, nil, NewLiveTail(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewArrowHandler(cfg, p, NewMemoryBudget(cfg.MemoryLimitBytes, cfg.MemoryWait), NewTenantResolver(cfg))
+	const streams, batches, spans = 4, 10, 5
+	var wg sync.WaitGroup
+	sent := make([][]*arrowpb.BatchArrowRecords, streams)
+	received := make([]*testStream, streams)
+	for i := range received {
+		sent[i] = arrowTraceBatches(t, batches, spans)
+		received[i] = newTestStream(fmt.Sprintf("tenant-%d", i), sent[i])
+		wg.Add(1)
+		go func(stream *testStream) {
+			defer wg.Done()
+			if err := h.serve(SignalTraces, stream); err != nil {
+				t.Errorf("serve: %v", err)
+			}
+		}(received[i])
+	}
+	wg.Wait()
+	for i, stream := range received {
+		if len(stream.acks) != batches {
+			t.Fatalf("stream %d: %d acks, want %d", i, len(stream.acks), batches)
+		}
+		for j, ack := range stream.acks {
+			if ack.BatchId != sent[i][j].BatchId || ack.StatusCode != arrowpb.StatusCode_OK {
+				t.Errorf("stream %d ack %d: batch %d %s, want batch %d OK", i, j, ack.BatchId, ack.StatusCode, sent[i][j].BatchId)
+			}
+		}
+	}
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, db, "traces"); n != streams*batches*spans {
+		t.Errorf("stored %d spans, want %d", n, streams*batches*spans)
+	}
+}
+
+// TestPipelineQueueFull checks that a full queue rejects batches without
+// blocking, and that the stream acks the batch RESOURCE_EXHAUSTED.
+func TestPipelineQueueFull(t *testing.T) {
+	p := &Pipeline{queue: make(chan *ingestJob, 1), writes: make(chan *ingestJob, 1), draining: make(chan struct{})}
+	decoder := newStreamDecoder()
+	defer decoder.close()
+	first := newIngestJob(SignalTraces, "acme", &arrowpb.BatchArrowRecords{BatchId: 1})
+	first.decoder = decoder
+	if err := p.Submit(first); err != nil {
+		t.Fatal(err)
+	}
+	if !p.Saturated() {
+		t.Error("Saturated is false with a full queue")
+	}
+	second := newIngestJob(SignalTraces, "acme", &arrowpb.BatchArrowRecords{BatchId: 2})
+	second.decoder = decoder
+	if err := p.Submit(second); err != ErrQueueFull {
+		t.Fatalf("Submit to a full queue: %v, want ErrQueueFull", err)
+	}
+	if decoder.next != 1 {
+		t.Errorf("rejected batch took decode turn %d", decoder.next)
+	}
+
+	cfg := defaultConfig()
+	h := NewArrowHandler(cfg, p, NewMemoryBudget(cfg.MemoryLimitBytes, cfg.MemoryWait), NewTenantResolver(cfg))
+	stream := newTestStream("acme", arrowTraceBatches(t, 1, 1))
+	if err := h.serve(SignalTraces, stream); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("serve: %v, want ResourceExhausted", err)
+	}
+	if len(stream.acks) != 1 || stream.acks[0].StatusCode != arrowpb.StatusCode_RESOURCE_EXHAUSTED {
+		t.Errorf("acks %v, want one RESOURCE_EXHAUSTED", stream.acks)
+	}
+}
+
+// insertTransactions is the number of writer transactions so far.
+func insertTransactions() float64 {
+	metricInsertSeconds.mu.Lock()
+	defer metricInsertSeconds.mu.Unlock()
+	var n float64
+	for _, m := range metricInsertSeconds.values {
+		n += m.value
+	}
+	return n
+}
+
+// TestWriterBatchesAcrossStreams checks that the writer commits the queued
+// batches of different streams and tenants in shared transactions of up to
+// maxBatchRows rows.
+func TestWriterBatchesAcrossStreams(t *testing.T) {
+	for _, tc := range []struct {
+		maxBatchRows int
+		transactions float64
+	}{
+		{1000, 1},
+		{3, 3},
+	} {
+		t.Run(fmt.Sprint(tc.maxBatchRows), func(t *testing.T) {
+			db := newPipelineTestDB(t)
+			rows, err := NewRowWriter(context.Background(), db, NewLogIndex(defaultConfig()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+			p := &Pipeline{rows: rows, writes: make(chan *ingestJob, 3), maxBatchRows: tc.maxBatchRows}
+			var jobs []*ingestJob
+			for i, tenant := range []string{"acme", "globex", "initech"} {
+				job := decodedJob(int64(i), tenant)
+				jobs = append(jobs, job)
+				p.writes <- job
+			}
+			close(p.writes)
+			before := insertTransactions()
+			p.writer.Add(1)
+			p.writeLoop()
+			if n := insertTransactions() - before; n != tc.transactions {
+				t.Errorf("%v transactions, want %v", n, tc.transactions)
+			}
+			for _, job := range jobs {
+				if s := <-job.done; s.StatusCode != arrowpb.StatusCode_OK {
+					t.Errorf("batch %d: %s", s.BatchId, s.StatusCode)
+				}
+			}
+			if n := countRows(t, db, "traces"); n != 9 {
+				t.Errorf("stored %d spans, want 9", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/plog"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+// redactedValue replaces the value of a redacted attribute.
+const redactedValue = "[REDACTED]"
+
+// Processor applies the processing rules of the configuration to decoded
+// telemetry before it is stored or published to live tails. Rules apply to
+// the attributes of resources, scopes, spans, span events and links, log
+// records and metric data points.
+type Processor struct {
+	drop   map[string]bool
+	redact map[string]bool
+}
+
+func NewProcessor(cfg Config) *Processor {
+	p := &Processor{drop: map[string]bool{}, redact: map[string]bool{}}
+	for _, key := range cfg.DropAttributes {
+		p.drop[key] = true
+	}
+	for _, key := range cfg.RedactAttributes {
+		p.redact[key] = true
+	}
+	return p
+}
+
+func (p *Processor) empty() bool {
+	return p == nil || len(p.drop) == 0 && len(p.redact) == 0
+}
+
+func (p *Processor) attributes(attrs pcommon.Map) {
+	attrs.RemoveIf(func(key string, _ pcommon.Value) bool { return p.drop[key] })
+	attrs.Range(func(key string, v pcommon.Value) bool {
+		if p.redact[key] {
+			v.SetStr(redactedValue)
+		}
+		return true
+	})
+}
+
+// Traces applies the rules to traces in place.
+func (p *Processor) Traces(traces ptrace.Traces) {
+	if p.empty() {
+		return
+	}
+	rs := traces.ResourceSpans()
+	for i := 0; i < rs.Len(); i++ {
+		p.attributes(rs.At(i).Resource().Attributes())
+		ss := rs.At(i).ScopeSpans()
+		for j := 0; j < ss.Len(); j++ {
+			p.attributes(ss.At(j).Scope().Attributes())
+			spans := ss.At(j).Spans()
+			for k := 0; k < spans.Len(); k++ {
+				span := spans.At(k)
+				p.attributes(span.Attributes())
+				for e := 0; e < span.Events().Len(); e++ {
+					p.attributes(span.Events().At(e).Attributes())
+				}
+				for l := 0; l < span.Links().Len(); l++ {
+					p.attributes(span.Links().At(l).Attributes())
+				}
+			}
+		}
+	}
+}
+
+// Logs applies the rules to logs in place.
+func (p *Processor) Logs(logs plog.Logs) {
+	if p.empty() {
+		return
+	}
+	rl := logs.ResourceLogs()
+	for i := 0; i < rl.Len(); i++ {
+		p.attributes(rl.At(i).Resource().Attributes())
+		sl := rl.At(i).ScopeLogs()
+		for j := 0; j < sl.Len(); j++ {
+			p.attributes(sl.At(j).Scope().Attributes())
+			records := sl.At(j).LogRecords()
+			for k := 0; k < records.Len(); k++ {
+				p.attributes(records.At(k).Attributes())
+			}
+		}
+	}
+}
+
+// Metrics applies the rules to metrics in place.
+func (p *Processor) Metrics(metrics pmetric.Metrics) {
+	if p.empty() {
+		return
+	}
+	rm := metrics.ResourceMetrics()
+	for i := 0; i < rm.Len(); i++ {
+		p.attributes(rm.At(i).Resource().Attributes())
+		sm := rm.At(i).ScopeMetrics()
+		for j := 0; j < sm.Len(); j++ {
+			p.attributes(sm.At(j).Scope().Attributes())
+			ms := sm.At(j).Metrics()
+			for k := 0; k < ms.Len(); k++ {
+				p.dataPoints(ms.At(k))
+			}
+		}
+	}
+}
+
+// dataPoints applies the rules to the data points of every metric type.
+func (p *Processor) dataPoints(m pmetric.Metric) {
+	switch m.Type() {
+	case pmetric.MetricTypeGauge:
+		for i := 0; i < m.Gauge().DataPoints().Len(); i++ {
+			p.attributes(m.Gauge().DataPoints().At(i).Attributes())
+		}
+	case pmetric.MetricTypeSum:
+		for i := 0; i < m.Sum().DataPoints().Len(); i++ {
+			p.attributes(m.Sum().DataPoints().At(i).Attributes())
+		}
+	case pmetric.MetricTypeHistogram:
+		for i := 0; i < m.Histogram().DataPoints().Len(); i++ {
+			p.attributes(m.Histogram().DataPoints().At(i).Attributes())
+		}
+	case pmetric.MetricTypeExponentialHistogram:
+		for i := 0; i < m.ExponentialHistogram().DataPoints().Len(); i++ {
+			p.attributes(m.ExponentialHistogram().DataPoints().At(i).Attributes())
+		}
+	case pmetric.MetricTypeSummary:
+		for i := 0; i < m.Summary().DataPoints().Len(); i++ {
+			p.attributes(m.Summary().DataPoints().At(i).Attributes())
+		}
+	}
+}
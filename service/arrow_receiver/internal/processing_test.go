@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+
+	"go.opentelemetry.io/collector/pdata/plog"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+)
+
+func testProcessor() *Processor {
+	cfg := defaultConfig()
+	cfg.DropAttributes = []string{"host.name", "cache.hit", "bytes"}
+	cfg.RedactAttributes = []string{"http.method", "user.email"}
+	return NewProcessor(cfg)
+}
+
+// wantAttrs checks a stored attribute map.
+func wantAttrs(t *testing.T, what, stored string, want map[string]interface{}) {
+	t.Helper()
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(stored), &got); err != nil {
+		t.Fatalf("%s: %v", what, err)
+	}
+	gotJSON, _ := json.Marshal(got)
+	wantJSON, _ := json.Marshal(want)
+	if string(gotJSON) != string(wantJSON) {
+		t.Errorf("%s: %s, want %s", what, gotJSON, wantJSON)
+	}
+}
+
+func TestProcessorTraces(t *testing.T) {
+	traces := jaegerTestTraces()
+	testProcessor().Traces(traces)
+	rows := TracesToRows(traces, DefaultTenant)
+	wantAttrs(t, "resource", rows[0].Resource, map[string]interface{}{"service.name": "frontend"})
+	wantAttrs(t, "span", rows[0].Attributes, map[string]interface{}{
+		"http.method": redactedValue, "http.status_code": 200, "sample.rate": 0.5, "tags": []string{"a"},
+	})
+	var events []struct {
+		Attributes map[string]interface{} `json:"attributes"`
+	}
+	if err := json.Unmarshal([]byte(rows[0].Events), &events); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || len(events[0].Attributes) != 0 {
+		t.Errorf("events %s, want the bytes attribute dropped", rows[0].Events)
+	}
+}
+
+func TestProcessorLogsAndMetrics(t *testing.T) {
+	logs := plog.NewLogs()
+	rl := logs.ResourceLogs().AppendEmpty()
+	rl.Resource().Attributes().PutStr("host.name", "web-1")
+	record := rl.ScopeLogs().AppendEmpty().LogRecords().AppendEmpty()
+	record.Attributes().PutStr("user.email", "a@example.com")
+	record.Attributes().PutStr("action", "login")
+	testProcessor().Logs(logs)
+	logRows := LogsToRows(logs, DefaultTenant)
+	wantAttrs(t, "log resource", logRows[0].Resource, map[string]interface{}{})
+	wantAttrs(t, "log record", logRows[0].Attributes, map[string]interface{}{"action": "login", "user.email": redactedValue})
+
+	metrics := pmetric.NewMetrics()
+	rm := metrics.ResourceMetrics().AppendEmpty()
+	rm.Resource().Attributes().PutStr("service.name", "api")
+	sum := rm.ScopeMetrics().AppendEmpty().Metrics().AppendEmpty()
+	sum.SetName("requests")
+	dp := sum.SetEmptySum().DataPoints().AppendEmpty()
+	dp.SetIntValue(1)
+	dp.Attributes().PutBool("cache.hit", true)
+	dp.Attributes().PutStr("http.method", "GET")
+	testProcessor().Metrics(metrics)
+	metricRows := MetricsToRows(metrics, DefaultTenant)
+	wantAttrs(t, "data point", metricRows[0].Attributes, map[string]interface{}{"http.method": redactedValue})
+}
+
+func TestProcessorWithoutRules(t *testing.T) {
+	traces := jaegerTestTraces()
+	NewProcessor(defaultConfig()).Traces(traces)
+	var nilProcessor *Processor
+	nilProcessor.Traces(traces)
+	rows := TracesToRows(traces, DefaultTenant)
+	wantAttrs(t, "resource", rows[0].Resource, map[string]interface{}{"service.name": "frontend", "host.name": "web-1"})
+}
@@ -0,0 +1,553 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The Prometheus HTTP API over the metrics table. Metric names and
+// attribute keys are sanitized to Prometheus names, histograms are stored as
+// _bucket, _sum and _count series, and every series carries job and
+// instance labels from the service.namespace, service.name and
+// service.instance.id resource attributes.
+
+var errTooManySamples = errors.New("query loads too many samples, narrow the selectors or the time range")
+
+var promInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+// promNameSQL is the SQL equivalent of promName.
+const promNameSQL = `regexp_replace(name, '[^a-zA-Z0-9_:]', '_', 'g')`
+
+// promName sanitizes a metric name.
+func promName(name string) string {
+	return promInvalidChars.ReplaceAllString(name, "_")
+}
+
+// promLabelName sanitizes an attribute key; colons are reserved for
+// metric names.
+func promLabelName(key string) string {
+	name := strings.ReplaceAll(promName(key), ":", "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "key_" + name
+	}
+	return name
+}
+
+type promResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+type promQueryData struct {
+	ResultType string      `json:"resultType"`
+	Result     interface{} `json:"result"`
+}
+
+type promResultSeries struct {
+	Metric promLabels      `json:"metric"`
+	Value  []interface{}   `json:"value,omitempty"`
+	Values [][]interface{} `json:"values,omitempty"`
+}
+
+func writeProm(w http.ResponseWriter, data interface{}) {
+	json.NewEncoder(w).Encode(promResponse{Status: "success", Data: data})
+}
+
+func writePromError(w http.ResponseWriter, status int, errorType, msg string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(promResponse{Status: "error", ErrorType: errorType, Error: msg})
+}
+
+// writePromQueryError is writeQueryError in the Prometheus error format.
+func writePromQueryError(ctx context.Context, w http.ResponseWriter, r *http.Request, err error, logger *log.Entry) {
+	switch {
+	case r.Context().Err() != nil:
+		logger.WithError(err).Info("query cancelled: client disconnected")
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		writePromError(w, http.StatusServiceUnavailable, "timeout", "query timed out")
+		logger.WithError(err).Warn("query timed out")
+	default:
+		writePromError(w, http.StatusUnprocessableEntity, "execution", err.Error())
+		logger.WithError(err).Error("query failed")
+	}
+}
+
+// promCaller accepts GET and form POST requests, as Prometheus does, parses
+// the parameters into r.Form and resolves the caller; ok is false when a
+// response was already written.
+func (a *queryAPI) promCaller(w http.ResponseWriter, r *http.Request) (tenant string, admin bool, ok bool) {
+	if a.cors(w, r, "GET, POST") {
+		return "", false, false
+	}
+	if r.Method != "GET" && r.Method != "POST" {
+		writePromError(w, http.StatusMethodNotAllowed, "bad_data", "GET or POST only")
+		return "", false, false
+	}
+	if err := r.ParseForm(); err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return "", false, false
+	}
+	return a.caller(w, r)
+}
+
+// parsePromTime parses Unix seconds or an RFC 3339 time to Unix
+// nanoseconds; an empty s yields def.
+func parsePromTime(s string, def int64) (int64, error) {
+	if s == "" {
+		return def, nil
+	}
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		return int64(math.Round(secs * 1e9)), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.UnixNano(), nil
+}
+
+// parsePromStep parses a duration such as 15s or a number of seconds.
+func parsePromStep(s string) (time.Duration, error) {
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(secs * float64(time.Second)), nil
+	}
+	return parsePromDuration(s)
+}
+
+func formatPromValue(t int64, v float64) []interface{} {
+	return []interface{}{float64(t) / 1e9, strconv.FormatFloat(v, 'f', -1, 64)}
+}
+
+// handlePromQuery evaluates an instant query.
+func (a *queryAPI) handlePromQuery(w http.ResponseWriter, r *http.Request) {
+	tenant, admin, ok := a.promCaller(w, r)
+	if !ok {
+		return
+	}
+	expr, err := parsePromQL(r.Form.Get("query"))
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+	t, err := parsePromTime(r.Form.Get("time"), time.Now().UnixNano())
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+	ctx, conn, logger, done := a.readRequest(w, r, tenant, admin)
+	if conn == nil {
+		return
+	}
+	defer done()
+	eval, err := loadPromEvaluator(ctx, conn, expr, t, t, a.cfg.QueryMaxRows)
+	if err != nil {
+		writePromQueryError(ctx, w, r, err, logger)
+		return
+	}
+	data, err := evalInstant(eval, expr, t)
+	if err != nil {
+		writePromError(w, http.StatusUnprocessableEntity, "execution", err.Error())
+		return
+	}
+	writeProm(w, data)
+}
+
+// evalInstant evaluates expr at t.
+func evalInstant(eval *promEvaluator, expr promExpr, t int64) (promQueryData, error) {
+	v, err := eval.eval(expr, t)
+	if err != nil {
+		return promQueryData{}, err
+	}
+	switch v := v.(type) {
+	case float64:
+		return promQueryData{"scalar", formatPromValue(t, v)}, nil
+	case promVector:
+		result := make([]promResultSeries, len(v))
+		for i, s := range v {
+			result[i] = promResultSeries{Metric: s.labels, Value: formatPromValue(t, s.v)}
+		}
+		return promQueryData{"vector", result}, nil
+	}
+	m := v.(promMatrix)
+	result := make([]promResultSeries, len(m))
+	for i, s := range m {
+		result[i] = promResultSeries{Metric: s.labels}
+		for _, p := range s.points {
+			result[i].Values = append(result[i].Values, formatPromValue(p.t, p.v))
+		}
+	}
+	return promQueryData{"matrix", result}, nil
+}
+
+// handlePromQueryRange evaluates a query at every step from start to end.
+func (a *queryAPI) handlePromQueryRange(w http.ResponseWriter, r *http.Request) {
+	tenant, admin, ok := a.promCaller(w, r)
+	if !ok {
+		return
+	}
+	expr, err := parsePromQL(r.Form.Get("query"))
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+	start, err := parsePromTime(r.Form.Get("start"), 0)
+	if err == nil && r.Form.Get("start") == "" {
+		err = errors.New("start is required")
+	}
+	var end int64
+	if err == nil {
+		if end, err = parsePromTime(r.Form.Get("end"), 0); err == nil && r.Form.Get("end") == "" {
+			err = errors.New("end is required")
+		}
+	}
+	var step time.Duration
+	if err == nil {
+		step, err = parsePromStep(r.Form.Get("step"))
+	}
+	switch {
+	case err != nil:
+	case step <= 0:
+		err = errors.New("step must be positive")
+	case end < start:
+		err = errors.New("end is before start")
+	case (end-start)/int64(step) >= promMaxSteps:
+		err = fmt.Errorf("more than %d steps, increase the step", promMaxSteps)
+	}
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+	if sel, ok := expr.(*promSelector); ok && sel.rng > 0 {
+		writePromError(w, http.StatusBadRequest, "bad_data", "range queries need an instant vector or scalar expression")
+		return
+	}
+	ctx, conn, logger, done := a.readRequest(w, r, tenant, admin)
+	if conn == nil {
+		return
+	}
+	defer done()
+	eval, err := loadPromEvaluator(ctx, conn, expr, start, end, a.cfg.QueryMaxRows)
+	if err != nil {
+		writePromQueryError(ctx, w, r, err, logger)
+		return
+	}
+	data, err := evalRange(eval, expr, start, end, step)
+	if err != nil {
+		writePromError(w, http.StatusUnprocessableEntity, "execution", err.Error())
+		return
+	}
+	writeProm(w, data)
+}
+
+// evalRange evaluates expr at every step from start to end.
+func evalRange(eval *promEvaluator, expr promExpr, start, end int64, step time.Duration) (promQueryData, error) {
+	series := map[string]*promResultSeries{}
+	var order []string
+	for t := start; t <= end; t += int64(step) {
+		v, err := eval.eval(expr, t)
+		if err != nil {
+			return promQueryData{}, err
+		}
+		vec, ok := v.(promVector)
+		if f, isScalar := v.(float64); isScalar {
+			vec, ok = promVector{{promLabels{}, f}}, true
+		}
+		if !ok {
+			return promQueryData{}, errors.New("range queries need an instant vector or scalar expression")
+		}
+		for _, s := range vec {
+			key := s.labels.key()
+			out, seen := series[key]
+			if !seen {
+				out = &promResultSeries{Metric: s.labels}
+				series[key] = out
+				order = append(order, key)
+			}
+			out.Values = append(out.Values, formatPromValue(t, s.v))
+		}
+	}
+	result := make([]*promResultSeries, len(order))
+	for i, key := range order {
+		result[i] = series[key]
+	}
+	return promQueryData{"matrix", result}, nil
+}
+
+// loadPromEvaluator loads the samples the selectors of expr need to be
+// evaluated from start to end, at most maxSamples in all.
+func loadPromEvaluator(ctx context.Context, conn *TenantConn, expr promExpr, start, end int64, maxSamples int) (*promEvaluator, error) {
+	eval := &promEvaluator{series: map[*promSelector][]*promSeries{}}
+	for _, sel := range promSelectors(expr) {
+		lookback := int64(promLookback)
+		if sel.rng > 0 {
+			lookback = int64(sel.rng)
+		}
+		series, n, err := loadPromSeries(ctx, conn, sel, start-lookback, end, maxSamples)
+		if err != nil {
+			return nil, err
+		}
+		eval.series[sel] = series
+		maxSamples -= n
+	}
+	return eval, nil
+}
+
+// promNameFilter turns the __name__ matchers of sel into SQL conditions.
+func promNameFilter(sel *promSelector) (conds []string, args []interface{}) {
+	for _, m := range sel.matchers {
+		if m.label != "__name__" {
+			continue
+		}
+		switch m.op {
+		case "=", "!=":
+			conds = append(conds, promNameSQL+" "+m.op+" ?")
+		case "=~":
+			conds = append(conds, "regexp_full_match("+promNameSQL+", ?)")
+		case "!~":
+			conds = append(conds, "NOT regexp_full_match("+promNameSQL+", ?)")
+		}
+		args = append(args, m.value)
+	}
+	return conds, args
+}
+
+// loadPromSeries loads the samples of sel in (from, to] and returns the
+// matching series and the number of samples read.
+func loadPromSeries(ctx context.Context, conn *TenantConn, sel *promSelector, from, to int64, maxSamples int) ([]*promSeries, int, error) {
+	conds, args := promNameFilter(sel)
+	conds = append([]string{"t > ?", "t <= ?", "v IS NOT NULL"}, conds...)
+	args = append([]interface{}{from, to}, args...)
+	rows, err := conn.QueryContext(ctx, `
+		SELECT name, coalesce(CAST(attributes AS VARCHAR), '{}'), coalesce(CAST(resource AS VARCHAR), '{}'),
+			aggregation_temporality, t, v
+		FROM (SELECT *, `+unixNanosSQL("time_unix_nano")+` AS t, TRY_CAST(value AS DOUBLE) AS v FROM metrics)
+		WHERE `+strings.Join(conds, " AND ")+`
+		ORDER BY t LIMIT ?`, append(args, maxSamples+1)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var out []*promSeries
+	series := map[string]*promSeries{}
+	n := 0
+	for rows.Next() {
+		var name, attributes, resource string
+		var temporality int
+		var p promPoint
+		if err := rows.Scan(&name, &attributes, &resource, &temporality, &p.t, &p.v); err != nil {
+			return nil, 0, err
+		}
+		if n++; n > maxSamples {
+			return nil, 0, errTooManySamples
+		}
+		labels, err := promSeriesLabels(name, attributes, resource)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !labels.matches(sel.matchers) {
+			continue
+		}
+		key := labels.key()
+		s, ok := series[key]
+		if !ok {
+			s = &promSeries{labels: labels, delta: temporality == 1}
+			series[key] = s
+			out = append(out, s)
+		}
+		s.points = append(s.points, p)
+	}
+	return out, n, rows.Err()
+}
+
+// promSeriesLabels builds the labels of a sample from its metric name and
+// the JSON text of its attributes and resource.
+func promSeriesLabels(name, attributes, resource string) (promLabels, error) {
+	attrs, err := decodeAttributes(json.RawMessage(attributes))
+	if err != nil {
+		return nil, err
+	}
+	res, err := decodeAttributes(json.RawMessage(resource))
+	if err != nil {
+		return nil, err
+	}
+	labels := promLabels{}
+	for key, v := range attrs {
+		if s := promLabelValue(v); s != "" {
+			labels[promLabelName(key)] = s
+		}
+	}
+	job := promLabelValue(res["service.name"])
+	if ns := promLabelValue(res["service.namespace"]); ns != "" && job != "" {
+		job = ns + "/" + job
+	}
+	if job != "" {
+		labels["job"] = job
+	}
+	if instance := promLabelValue(res["service.instance.id"]); instance != "" {
+		labels["instance"] = instance
+	}
+	labels["__name__"] = promName(name)
+	return labels, nil
+}
+
+func promLabelValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	raw, _ := json.Marshal(v)
+	return string(raw)
+}
+
+// promLabelSets loads the distinct label sets of the series with samples
+// in [start, end] that match any of the match[] selectors of r.
+func (a *queryAPI) promLabelSets(w http.ResponseWriter, r *http.Request, requireMatch bool, fn func([]promLabels)) {
+	tenant, admin, ok := a.promCaller(w, r)
+	if !ok {
+		return
+	}
+	var selectors []*promSelector
+	for _, m := range r.Form["match[]"] {
+		sel, err := parsePromSelector(m)
+		if err != nil {
+			writePromError(w, http.StatusBadRequest, "bad_data", err.Error())
+			return
+		}
+		selectors = append(selectors, sel)
+	}
+	if requireMatch && len(selectors) == 0 {
+		writePromError(w, http.StatusBadRequest, "bad_data", "no match[] parameter provided")
+		return
+	}
+	start, err := parsePromTime(r.Form.Get("start"), math.MinInt64)
+	var end int64
+	if err == nil {
+		end, err = parsePromTime(r.Form.Get("end"), math.MaxInt64)
+	}
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+	ctx, conn, logger, done := a.readRequest(w, r, tenant, admin)
+	if conn == nil {
+		return
+	}
+	defer done()
+	conds := []string{"t >= ?", "t <= ?"}
+	args := []interface{}{start, end}
+	if len(selectors) > 0 {
+		var alts []string
+		for _, sel := range selectors {
+			selConds, selArgs := promNameFilter(sel)
+			alts = append(alts, "("+strings.Join(append(selConds, "true"), " AND ")+")")
+			args = append(args, selArgs...)
+		}
+		conds = append(conds, "("+strings.Join(alts, " OR ")+")")
+	}
+	rows, err := conn.QueryContext(ctx, `
+		SELECT DISTINCT name, coalesce(CAST(attributes AS VARCHAR), '{}'), coalesce(CAST(resource AS VARCHAR), '{}')
+		FROM (SELECT *, `+unixNanosSQL("time_unix_nano")+` AS t FROM metrics)
+		WHERE `+strings.Join(conds, " AND ")+`
+		LIMIT ?`, append(args, a.cfg.QueryMaxRows+1)...)
+	if err != nil {
+		writePromQueryError(ctx, w, r, err, logger)
+		return
+	}
+	defer rows.Close()
+	var sets []promLabels
+	seen := map[string]bool{}
+	for n := 0; rows.Next(); n++ {
+		if n >= a.cfg.QueryMaxRows {
+			writePromQueryError(ctx, w, r, errTooManySamples, logger)
+			return
+		}
+		var name, attributes, resource string
+		if err := rows.Scan(&name, &attributes, &resource); err != nil {
+			writePromQueryError(ctx, w, r, err, logger)
+			return
+		}
+		labels, err := promSeriesLabels(name, attributes, resource)
+		if err != nil {
+			writePromQueryError(ctx, w, r, err, logger)
+			return
+		}
+		matched := len(selectors) == 0
+		for _, sel := range selectors {
+			matched = matched || labels.matches(sel.matchers)
+		}
+		if key := labels.key(); matched && !seen[key] {
+			seen[key] = true
+			sets = append(sets, labels)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		writePromQueryError(ctx, w, r, err, logger)
+		return
+	}
+	fn(sets)
+}
+
+// handlePromLabels lists the label names.
+func (a *queryAPI) handlePromLabels(w http.ResponseWriter, r *http.Request) {
+	a.promLabelSets(w, r, false, func(sets []promLabels) {
+		names := map[string]bool{}
+		for _, labels := range sets {
+			for name := range labels {
+				names[name] = true
+			}
+		}
+		writeProm(w, sortedKeys(names))
+	})
+}
+
+// handlePromLabelValues lists the values of a label.
+func (a *queryAPI) handlePromLabelValues(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	a.promLabelSets(w, r, false, func(sets []promLabels) {
+		values := map[string]bool{}
+		for _, labels := range sets {
+			if v, ok := labels[name]; ok {
+				values[v] = true
+			}
+		}
+		writeProm(w, sortedKeys(values))
+	})
+}
+
+// handlePromSeries lists the label sets of the series matching match[].
+func (a *queryAPI) handlePromSeries(w http.ResponseWriter, r *http.Request) {
+	a.promLabelSets(w, r, true, func(sets []promLabels) {
+		if sets == nil {
+			sets = []promLabels{}
+		}
+		writeProm(w, sets)
+	})
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
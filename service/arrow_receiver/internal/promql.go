@@ -0,0 +1,879 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// promLookback is how far back an instant selector looks for a sample, as
+// in Prometheus.
+const promLookback = 5 * time.Minute
+
+// promMaxSteps bounds the points per series of a range query.
+const promMaxSteps = 11000
+
+// The PromQL subset: selectors with label matchers and an optional range,
+// rate and increase, sum/avg/max/min/count with by or without,
+// histogram_quantile, vector and arithmetic between scalars and vectors
+// whose labels match one-to-one.
+type promExpr interface{}
+
+type promSelector struct {
+	matchers []*promMatcher
+	// rng is the range of a range selector and zero for an instant one.
+	rng time.Duration
+}
+
+type promMatcher struct {
+	label, op, value string
+	re               *regexp.Regexp
+}
+
+type promCall struct {
+	fn   string
+	args []promExpr
+}
+
+type promAggregate struct {
+	op       string
+	grouping []string
+	without  bool
+	expr     promExpr
+}
+
+type promBinary struct {
+	op       string
+	lhs, rhs promExpr
+}
+
+var promAggregations = map[string]bool{"sum": true, "avg": true, "max": true, "min": true, "count": true}
+
+// promFunctions maps the supported functions to their argument kinds:
+// 'r' for a range selector, 'v' for an instant vector and 's' for a scalar.
+var promFunctions = map[string]string{
+	"rate":               "r",
+	"increase":           "r",
+	"histogram_quantile": "sv",
+	"vector":             "s",
+}
+
+func newPromMatcher(label, op, value string) (*promMatcher, error) {
+	m := &promMatcher{label: label, op: op, value: value}
+	if op == "=~" || op == "!~" {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %w", value, err)
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+// matches reports whether a label value matches; a missing label has the
+// value "".
+func (m *promMatcher) matches(v string) bool {
+	switch m.op {
+	case "=":
+		return v == m.value
+	case "!=":
+		return v != m.value
+	case "=~":
+		return m.re.MatchString(v)
+	default:
+		return !m.re.MatchString(v)
+	}
+}
+
+type promLabels map[string]string
+
+// key identifies a label set.
+func (l promLabels) key() string {
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(l[name])
+		b.WriteByte(0xff)
+	}
+	return b.String()
+}
+
+func (l promLabels) without(names ...string) promLabels {
+	out := make(promLabels, len(l))
+	for k, v := range l {
+		out[k] = v
+	}
+	for _, name := range names {
+		delete(out, name)
+	}
+	return out
+}
+
+func (l promLabels) matches(matchers []*promMatcher) bool {
+	for _, m := range matchers {
+		if !m.matches(l[m.label]) {
+			return false
+		}
+	}
+	return true
+}
+
+type promPoint struct {
+	t int64 // Unix nanoseconds
+	v float64
+}
+
+// promSeries is a stored series. Points are in time order; delta series
+// hold increments rather than running totals.
+type promSeries struct {
+	labels promLabels
+	points []promPoint
+	delta  bool
+}
+
+type promSample struct {
+	labels promLabels
+	v      float64
+}
+
+type promVector []promSample
+
+// promMatrix is the result of a range selector in an instant query.
+type promMatrix []*promSeries
+
+// --- Parsing ---
+
+type promToken struct {
+	kind byte // 'i'dent, 'n'umber, 's'tring, 'p'unct or 0 at the end
+	text string
+	pos  int
+}
+
+func lexPromQL(q string) ([]promToken, error) {
+	var tokens []promToken
+	for i := 0; i < len(q); {
+		c := q[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'' || c == '`':
+			j := i + 1
+			for j < len(q) && q[j] != c {
+				if q[j] == '\\' && c != '`' {
+					j++
+				}
+				j++
+			}
+			if j >= len(q) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			text := q[i+1 : j]
+			if c != '`' {
+				unquoted, err := strconv.Unquote(`"` + strings.ReplaceAll(text, `"`, `\"`) + `"`)
+				if c == '"' {
+					unquoted, err = strconv.Unquote(q[i : j+1])
+				}
+				if err != nil {
+					return nil, fmt.Errorf("invalid string at %d", i)
+				}
+				text = unquoted
+			}
+			tokens = append(tokens, promToken{'s', text, i})
+			i = j + 1
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(q) && q[i+1] >= '0' && q[i+1] <= '9':
+			j := i
+			for j < len(q) && (isPromNameChar(q[j]) && q[j] != ':' || q[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, promToken{'n', q[i:j], i})
+			i = j
+		case isPromNameChar(c):
+			j := i
+			for j < len(q) && isPromNameChar(q[j]) {
+				j++
+			}
+			tokens = append(tokens, promToken{'i', q[i:j], i})
+			i = j
+		default:
+			punct := ""
+			for _, p := range []string{"!=", "=~", "!~", "|=", "|~", "==", ">=", "<=", "(", ")", "{", "}", "[", "]", ",", "|", "=", ">", "<", "+", "-", "*", "/"} {
+				if strings.HasPrefix(q[i:], p) {
+					punct = p
+					break
+				}
+			}
+			if punct == "" {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+			tokens = append(tokens, promToken{'p', punct, i})
+			i += len(punct)
+		}
+	}
+	return append(tokens, promToken{pos: len(q)}), nil
+}
+
+func isPromNameChar(c byte) bool {
+	return c == '_' || c == ':' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+type promParser struct {
+	tokens []promToken
+	pos    int
+	// functions, when set, parses function calls instead of call; LogQL
+	// uses it for its range aggregations.
+	functions func(fn string) (promExpr, error)
+}
+
+// parsePromQL parses q into an expression of the supported subset.
+func parsePromQL(q string) (promExpr, error) {
+	tokens, err := lexPromQL(q)
+	if err != nil {
+		return nil, err
+	}
+	p := &promParser{tokens: tokens}
+	expr, err := p.additive()
+	if err == nil && p.peek().kind != 0 {
+		err = p.unexpected()
+	}
+	return expr, err
+}
+
+// parsePromSelector parses a match[] parameter, which must be a selector.
+func parsePromSelector(q string) (*promSelector, error) {
+	expr, err := parsePromQL(q)
+	if err != nil {
+		return nil, err
+	}
+	sel, ok := expr.(*promSelector)
+	if !ok || sel.rng != 0 {
+		return nil, fmt.Errorf("%q is not an instant vector selector", q)
+	}
+	return sel, nil
+}
+
+func (p *promParser) peek() promToken { return p.tokens[p.pos] }
+
+func (p *promParser) next() promToken {
+	t := p.tokens[p.pos]
+	if t.kind != 0 {
+		p.pos++
+	}
+	return t
+}
+
+func (p *promParser) accept(punct string) bool {
+	if t := p.peek(); t.kind == 'p' && t.text == punct {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *promParser) expect(punct string) error {
+	if !p.accept(punct) {
+		return p.unexpected()
+	}
+	return nil
+}
+
+func (p *promParser) unexpected() error {
+	t := p.peek()
+	if t.kind == 0 {
+		return errors.New("unexpected end of query")
+	}
+	return fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+}
+
+func (p *promParser) additive() (promExpr, error) {
+	lhs, err := p.multiplicative()
+	for err == nil && (p.peek().text == "+" || p.peek().text == "-") && p.peek().kind == 'p' {
+		op := p.next().text
+		var rhs promExpr
+		if rhs, err = p.multiplicative(); err == nil {
+			lhs = &promBinary{op, lhs, rhs}
+		}
+	}
+	return lhs, err
+}
+
+func (p *promParser) multiplicative() (promExpr, error) {
+	lhs, err := p.unary()
+	for err == nil && (p.peek().text == "*" || p.peek().text == "/") && p.peek().kind == 'p' {
+		op := p.next().text
+		var rhs promExpr
+		if rhs, err = p.unary(); err == nil {
+			lhs = &promBinary{op, lhs, rhs}
+		}
+	}
+	return lhs, err
+}
+
+func (p *promParser) unary() (promExpr, error) {
+	if p.accept("-") {
+		expr, err := p.unary()
+		return &promBinary{"*", -1.0, expr}, err
+	}
+	if p.accept("+") {
+		return p.unary()
+	}
+	return p.primary()
+}
+
+func (p *promParser) primary() (promExpr, error) {
+	t := p.peek()
+	switch {
+	case t.kind == 'n':
+		p.next()
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", t.text)
+		}
+		return v, nil
+	case t.kind == 'p' && t.text == "(":
+		p.next()
+		expr, err := p.additive()
+		if err != nil {
+			return nil, err
+		}
+		return expr, p.expect(")")
+	case t.kind == 'p' && t.text == "{":
+		return p.selector("")
+	case t.kind != 'i':
+		return nil, p.unexpected()
+	}
+	p.next()
+	switch lower := strings.ToLower(t.text); {
+	case lower == "inf" || lower == "nan":
+		v, _ := strconv.ParseFloat(lower, 64)
+		return v, nil
+	case promAggregations[lower] && (p.peek().text == "(" || p.peek().text == "by" || p.peek().text == "without"):
+		return p.aggregate(lower)
+	case p.peek().kind == 'p' && p.peek().text == "(":
+		if p.functions != nil {
+			return p.functions(t.text)
+		}
+		return p.call(t.text)
+	}
+	return p.selector(t.text)
+}
+
+func (p *promParser) aggregate(op string) (promExpr, error) {
+	agg := &promAggregate{op: op}
+	grouping := func() error {
+		t := p.peek()
+		if t.kind != 'i' || (t.text != "by" && t.text != "without") {
+			return nil
+		}
+		if agg.grouping != nil {
+			return p.unexpected()
+		}
+		p.next()
+		agg.without = t.text == "without"
+		agg.grouping = []string{}
+		if err := p.expect("("); err != nil {
+			return err
+		}
+		for !p.accept(")") {
+			if len(agg.grouping) > 0 {
+				if err := p.expect(","); err != nil {
+					return err
+				}
+			}
+			label := p.next()
+			if label.kind != 'i' {
+				p.pos--
+				return p.unexpected()
+			}
+			agg.grouping = append(agg.grouping, label.text)
+		}
+		return nil
+	}
+	if err := grouping(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	expr, err := p.additive()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	agg.expr = expr
+	return agg, grouping()
+}
+
+func (p *promParser) call(fn string) (promExpr, error) {
+	kinds, ok := promFunctions[fn]
+	if !ok {
+		return nil, fmt.Errorf("unsupported function %s", fn)
+	}
+	p.next()
+	call := &promCall{fn: fn}
+	for !p.accept(")") {
+		if len(call.args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.additive()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+	}
+	if len(call.args) != len(kinds) {
+		return nil, fmt.Errorf("%s takes %d arguments", fn, len(kinds))
+	}
+	for i, kind := range kinds {
+		sel, isSel := call.args[i].(*promSelector)
+		switch {
+		case kind == 'r' && (!isSel || sel.rng == 0):
+			return nil, fmt.Errorf("%s needs a range selector such as metric[5m]", fn)
+		case kind != 'r' && isSel && sel.rng != 0:
+			return nil, fmt.Errorf("%s does not take a range selector", fn)
+		}
+	}
+	return call, nil
+}
+
+func (p *promParser) selector(name string) (promExpr, error) {
+	sel := &promSelector{}
+	if name != "" {
+		sel.matchers = append(sel.matchers, &promMatcher{label: "__name__", op: "=", value: name})
+	}
+	if p.accept("{") {
+		for n := 0; !p.accept("}"); n++ {
+			if n > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+				if p.accept("}") {
+					break
+				}
+			}
+			label, op, value := p.next(), p.next(), p.next()
+			if label.kind != 'i' || op.kind != 'p' || value.kind != 's' {
+				return nil, fmt.Errorf("invalid label matcher at %d", label.pos)
+			}
+			if op.text != "=" && op.text != "!=" && op.text != "=~" && op.text != "!~" {
+				return nil, fmt.Errorf("invalid label matcher operator %q", op.text)
+			}
+			m, err := newPromMatcher(label.text, op.text, value.text)
+			if err != nil {
+				return nil, err
+			}
+			sel.matchers = append(sel.matchers, m)
+		}
+	}
+	if len(sel.matchers) == 0 {
+		return nil, errors.New("a selector needs a metric name or a label matcher")
+	}
+	if p.accept("[") {
+		t := p.next()
+		d, err := parsePromDuration(t.text)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid range %q", t.text)
+		}
+		sel.rng = d
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+	}
+	return sel, nil
+}
+
+// parsePromDuration parses durations such as 5m, 1h30m, 2d and 1w.
+func parsePromDuration(s string) (time.Duration, error) {
+	var total time.Duration
+	for rest := s; rest != ""; {
+		i := strings.IndexFunc(rest, func(r rune) bool { return r < '0' || r > '9' })
+		if i <= 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		n, _ := strconv.ParseInt(rest[:i], 10, 64)
+		j := i
+		for j < len(rest) && (rest[j] < '0' || rest[j] > '9') {
+			j++
+		}
+		unit := map[string]time.Duration{
+			"ms": time.Millisecond, "s": time.Second, "m": time.Minute, "h": time.Hour,
+			"d": 24 * time.Hour, "w": 7 * 24 * time.Hour, "y": 365 * 24 * time.Hour,
+		}[rest[i:j]]
+		if unit == 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		total += time.Duration(n) * unit
+		rest = rest[j:]
+	}
+	return total, nil
+}
+
+// promSelectors lists the selectors of expr.
+func promSelectors(expr promExpr) []*promSelector {
+	switch e := expr.(type) {
+	case *promSelector:
+		return []*promSelector{e}
+	case *promCall:
+		var out []*promSelector
+		for _, arg := range e.args {
+			out = append(out, promSelectors(arg)...)
+		}
+		return out
+	case *promAggregate:
+		return promSelectors(e.expr)
+	case *promBinary:
+		return append(promSelectors(e.lhs), promSelectors(e.rhs)...)
+	}
+	return nil
+}
+
+// --- Evaluation ---
+
+// promEvaluator evaluates an expression over series loaded beforehand.
+type promEvaluator struct {
+	series map[*promSelector][]*promSeries
+}
+
+// eval evaluates expr at t and returns a float64, a promVector or, for a
+// range selector, a promMatrix.
+func (e *promEvaluator) eval(expr promExpr, t int64) (interface{}, error) {
+	switch x := expr.(type) {
+	case float64:
+		return x, nil
+	case *promSelector:
+		if x.rng > 0 {
+			var m promMatrix
+			for _, s := range e.series[x] {
+				if points := window(s.points, t-int64(x.rng), t); len(points) > 0 {
+					m = append(m, &promSeries{labels: s.labels, points: points, delta: s.delta})
+				}
+			}
+			return m, nil
+		}
+		var v promVector
+		for _, s := range e.series[x] {
+			if points := window(s.points, t-int64(promLookback), t); len(points) > 0 {
+				v = append(v, promSample{s.labels, points[len(points)-1].v})
+			}
+		}
+		return v, nil
+	case *promCall:
+		return e.call(x, t)
+	case *promAggregate:
+		in, err := e.vector(x.expr, t)
+		if err != nil {
+			return nil, err
+		}
+		return aggregate(x, in), nil
+	case *promBinary:
+		return e.binary(x, t)
+	}
+	return nil, fmt.Errorf("unsupported expression %T", expr)
+}
+
+func (e *promEvaluator) vector(expr promExpr, t int64) (promVector, error) {
+	v, err := e.eval(expr, t)
+	if err != nil {
+		return nil, err
+	}
+	vec, ok := v.(promVector)
+	if !ok {
+		return nil, errors.New("expected an instant vector")
+	}
+	return vec, nil
+}
+
+// window returns the points in (from, to].
+func window(points []promPoint, from, to int64) []promPoint {
+	lo := sort.Search(len(points), func(i int) bool { return points[i].t > from })
+	hi := sort.Search(len(points), func(i int) bool { return points[i].t > to })
+	return points[lo:hi]
+}
+
+func (e *promEvaluator) call(c *promCall, t int64) (interface{}, error) {
+	switch c.fn {
+	case "rate", "increase":
+		sel := c.args[0].(*promSelector)
+		var out promVector
+		for _, s := range e.series[sel] {
+			points := window(s.points, t-int64(sel.rng), t)
+			v, ok := increase(points, s.delta, t-int64(sel.rng), t)
+			if !ok {
+				continue
+			}
+			if c.fn == "rate" {
+				v /= sel.rng.Seconds()
+			}
+			out = append(out, promSample{s.labels.without("__name__"), v})
+		}
+		return out, nil
+	case "vector":
+		v, err := e.eval(c.args[0], t)
+		if err != nil {
+			return nil, err
+		}
+		f, ok := v.(float64)
+		if !ok {
+			return nil, errors.New("vector needs a scalar")
+		}
+		return promVector{{promLabels{}, f}}, nil
+	case "histogram_quantile":
+		q, err := e.eval(c.args[0], t)
+		if err != nil {
+			return nil, err
+		}
+		phi, ok := q.(float64)
+		if !ok {
+			return nil, errors.New("histogram_quantile needs a scalar quantile")
+		}
+		in, err := e.vector(c.args[1], t)
+		if err != nil {
+			return nil, err
+		}
+		return histogramQuantile(phi, in), nil
+	}
+	return nil, fmt.Errorf("unsupported function %s", c.fn)
+}
+
+// increase returns how much a counter grew within (from, to]. For
+// cumulative series it follows Prometheus: counter resets are added back and
+// the result is extrapolated to the window edges. Delta points are summed.
+func increase(points []promPoint, delta bool, from, to int64) (float64, bool) {
+	if delta {
+		if len(points) == 0 {
+			return 0, false
+		}
+		var sum float64
+		for _, p := range points {
+			sum += p.v
+		}
+		return sum, true
+	}
+	if len(points) < 2 {
+		return 0, false
+	}
+	first, last := points[0], points[len(points)-1]
+	result := last.v - first.v
+	for i := 1; i < len(points); i++ {
+		if points[i].v < points[i-1].v {
+			result += points[i-1].v
+		}
+	}
+	sampled := float64(last.t-first.t) / 1e9
+	toStart := float64(first.t-from) / 1e9
+	toEnd := float64(to-last.t) / 1e9
+	avg := sampled / float64(len(points)-1)
+	if result > 0 && first.v >= 0 {
+		if toZero := sampled * (first.v / result); toZero < toStart {
+			toStart = toZero
+		}
+	}
+	threshold := avg * 1.1
+	interval := sampled
+	if toStart < threshold {
+		interval += toStart
+	} else {
+		interval += avg / 2
+	}
+	if toEnd < threshold {
+		interval += toEnd
+	} else {
+		interval += avg / 2
+	}
+	return result * (interval / sampled), true
+}
+
+func aggregate(agg *promAggregate, in promVector) promVector {
+	type group struct {
+		labels promLabels
+		v      float64
+		n      int
+	}
+	groups := map[string]*group{}
+	var order []string
+	for _, s := range in {
+		var labels promLabels
+		if agg.without {
+			labels = s.labels.without(append(agg.grouping, "__name__")...)
+		} else {
+			labels = promLabels{}
+			for _, name := range agg.grouping {
+				if v, ok := s.labels[name]; ok {
+					labels[name] = v
+				}
+			}
+		}
+		key := labels.key()
+		g, ok := groups[key]
+		if !ok {
+			g = &group{labels: labels, v: s.v}
+			groups[key] = g
+			order = append(order, key)
+			if agg.op == "count" {
+				g.v = 0
+			}
+		} else {
+			switch agg.op {
+			case "sum", "avg":
+				g.v += s.v
+			case "max":
+				g.v = math.Max(g.v, s.v)
+			case "min":
+				g.v = math.Min(g.v, s.v)
+			}
+		}
+		g.n++
+	}
+	out := make(promVector, 0, len(groups))
+	for _, key := range order {
+		g := groups[key]
+		switch agg.op {
+		case "avg":
+			g.v /= float64(g.n)
+		case "count":
+			g.v = float64(g.n)
+		}
+		out = append(out, promSample{g.labels, g.v})
+	}
+	return out
+}
+
+// histogramQuantile estimates the phi quantile of each histogram in the
+// vector, whose series are its le buckets, like Prometheus does.
+func histogramQuantile(phi float64, in promVector) promVector {
+	type bucket struct{ le, count float64 }
+	type histogram struct {
+		labels  promLabels
+		buckets []bucket
+	}
+	histograms := map[string]*histogram{}
+	var order []string
+	for _, s := range in {
+		le, err := strconv.ParseFloat(s.labels["le"], 64)
+		if err != nil {
+			continue
+		}
+		labels := s.labels.without("le", "__name__")
+		key := labels.key()
+		h, ok := histograms[key]
+		if !ok {
+			h = &histogram{labels: labels}
+			histograms[key] = h
+			order = append(order, key)
+		}
+		h.buckets = append(h.buckets, bucket{le, s.v})
+	}
+	out := make(promVector, 0, len(histograms))
+	for _, key := range order {
+		h := histograms[key]
+		b := h.buckets
+		sort.Slice(b, func(i, j int) bool { return b[i].le < b[j].le })
+		v := math.NaN()
+		switch {
+		case phi < 0:
+			v = math.Inf(-1)
+		case phi > 1:
+			v = math.Inf(1)
+		case len(b) >= 2 && math.IsInf(b[len(b)-1].le, 1):
+			for i := 1; i < len(b); i++ {
+				b[i].count = math.Max(b[i].count, b[i-1].count)
+			}
+			total := b[len(b)-1].count
+			if total == 0 {
+				break
+			}
+			rank := phi * total
+			i := sort.Search(len(b)-1, func(i int) bool { return b[i].count >= rank })
+			switch {
+			case i == len(b)-1:
+				v = b[len(b)-2].le
+			case i == 0 && b[0].le <= 0:
+				v = b[0].le
+			default:
+				start, count := 0.0, b[i].count
+				if i > 0 {
+					start = b[i-1].le
+					count -= b[i-1].count
+					rank -= b[i-1].count
+				}
+				v = start + (b[i].le-start)*(rank/count)
+			}
+		}
+		out = append(out, promSample{h.labels, v})
+	}
+	return out
+}
+
+func (e *promEvaluator) binary(b *promBinary, t int64) (interface{}, error) {
+	lhs, err := e.eval(b.lhs, t)
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := e.eval(b.rhs, t)
+	if err != nil {
+		return nil, err
+	}
+	apply := func(x, y float64) float64 {
+		switch b.op {
+		case "+":
+			return x + y
+		case "-":
+			return x - y
+		case "*":
+			return x * y
+		}
+		return x / y
+	}
+	switch l := lhs.(type) {
+	case float64:
+		switch r := rhs.(type) {
+		case float64:
+			return apply(l, r), nil
+		case promVector:
+			out := make(promVector, len(r))
+			for i, s := range r {
+				out[i] = promSample{s.labels.without("__name__"), apply(l, s.v)}
+			}
+			return out, nil
+		}
+	case promVector:
+		if r, ok := rhs.(float64); ok {
+			out := make(promVector, len(l))
+			for i, s := range l {
+				out[i] = promSample{s.labels.without("__name__"), apply(s.v, r)}
+			}
+			return out, nil
+		}
+		if r, ok := rhs.(promVector); ok {
+			// Samples pair up when their labels other than __name__ are
+			// equal; the rest are dropped.
+			byLabels := make(map[string]float64, len(r))
+			for _, s := range r {
+				byLabels[s.labels.without("__name__").key()] = s.v
+			}
+			var out promVector
+			for _, s := range l {
+				labels := s.labels.without("__name__")
+				if v, ok := byLabels[labels.key()]; ok {
+					out = append(out, promSample{labels, apply(s.v, v)})
+				}
+			}
+			return out, nil
+		}
+	}
+	return nil, errors.New("binary operations need scalars or instant vectors")
+}
@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+)
+
+func TestParsePromQL(t *testing.T) {
+	expr, err := parsePromQL(`sum by (job) (rate(http_requests{code=~"5..", method!="GET"}[5m])) * 2`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin, ok := expr.(*promBinary)
+	if !ok || bin.op != "*" {
+		t.Fatalf("parsed %#v, want a product", expr)
+	}
+	agg, ok := bin.lhs.(*promAggregate)
+	if !ok || agg.op != "sum" || agg.without || len(agg.grouping) != 1 || agg.grouping[0] != "job" {
+		t.Fatalf("parsed %#v, want sum by (job)", bin.lhs)
+	}
+	call, ok := agg.expr.(*promCall)
+	if !ok || call.fn != "rate" {
+		t.Fatalf("parsed %#v, want rate", agg.expr)
+	}
+	sel := call.args[0].(*promSelector)
+	if sel.rng != 5*time.Minute || len(sel.matchers) != 3 {
+		t.Errorf("selector range %s, %d matchers; want 5m and 3", sel.rng, len(sel.matchers))
+	}
+	if !sel.matchers[1].matches("503") || sel.matchers[1].matches("5030") {
+		t.Error("regular expression matcher is not anchored")
+	}
+
+	for _, q := range []string{
+		`up`,
+		`{__name__="up", job="api"}`,
+		`increase(requests_total[1h30m])`,
+		`histogram_quantile(0.9, sum by (le) (rate(latency_bucket[5m])))`,
+		`count without (instance) (up)`,
+		`-vector(1) + 2 / 4`,
+		`max(queue_depth) - min(queue_depth)`,
+	} {
+		if _, err := parsePromQL(q); err != nil {
+			t.Errorf("parsePromQL(%q): %v", q, err)
+		}
+	}
+	for _, q := range []string{
+		``,
+		`rate(up)`,
+		`up[5m`,
+		`up{job=~"("}`,
+		`sum(`,
+		`topk(3, up)`,
+		`up[5x]`,
+		`up offset 5m`,
+		`up{job="api"`,
+	} {
+		if _, err := parsePromQL(q); err == nil {
+			t.Errorf("parsePromQL(%q) succeeded, want an error", q)
+		}
+	}
+}
+
+// promTestMetrics returns an http.requests counter for codes 200 and 500,
+// sampled every minute for two minutes from t0, and a queue.depth gauge.
+func promTestMetrics(t0 time.Time) pmetric.Metrics {
+	metrics := pmetric.NewMetrics()
+	rm := metrics.ResourceMetrics().AppendEmpty()
+	rm.Resource().Attributes().PutStr("service.name", "api")
+	ms := rm.ScopeMetrics().AppendEmpty().Metrics()
+	requests := ms.AppendEmpty()
+	requests.SetName("http.requests")
+	sum := requests.SetEmptySum()
+	sum.SetIsMonotonic(true)
+	sum.SetAggregationTemporality(pmetric.AggregationTemporalityCumulative)
+	for i := 0; i < 3; i++ {
+		for code, perMinute := range map[string]int64{"200": 60, "500": 6} {
+			dp := sum.DataPoints().AppendEmpty()
+			dp.SetTimestamp(pcommon.NewTimestampFromTime(t0.Add(time.Duration(i) * time.Minute)))
+			dp.SetIntValue(int64(i) * perMinute)
+			dp.Attributes().PutStr("code", code)
+		}
+	}
+	depth := ms.AppendEmpty()
+	depth.SetName("queue.depth")
+	dp := depth.SetEmptyGauge().DataPoints().AppendEmpty()
+	dp.SetTimestamp(pcommon.NewTimestampFromTime(t0.Add(2 * time.Minute)))
+	dp.SetDoubleValue(5)
+	return metrics
+}
+
+type promTestResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Metric map[string]string `json:"metric"`
+			Value  []interface{}     `json:"value"`
+			Values [][]interface{}   `json:"values"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+func TestPromQueryAPI(t *testing.T) {
+	t0 := time.Unix(1700000000, 0)
+	a := newTestQueryAPI(t, defaultConfig(), RowBatch{Metrics: MetricsToRows(promTestMetrics(t0), "acme")})
+	at := fmt.Sprint(t0.Add(2 * time.Minute).Unix())
+
+	var resp promTestResponse
+	getJSON(t, a.handlePromQuery, "/api/v1/query?"+url.Values{"query": {`http_requests{code="200"}`}, "time": {at}}.Encode(), &resp)
+	if resp.Data.ResultType != "vector" || len(resp.Data.Result) != 1 {
+		t.Fatalf("instant selector: %+v", resp.Data)
+	}
+	if got := resp.Data.Result[0]; got.Metric["job"] != "api" || got.Metric["__name__"] != "http_requests" || got.Value[1] != "120" {
+		t.Errorf("instant selector: %+v, want http_requests{job=api} 120", got)
+	}
+
+	resp = promTestResponse{}
+	q := `sum(rate(http_requests{code="500"}[2m])) / sum(rate(http_requests{code="200"}[2m]))`
+	getJSON(t, a.handlePromQuery, "/api/v1/query?"+url.Values{"query": {q}, "time": {at}}.Encode(), &resp)
+	if len(resp.Data.Result) != 1 {
+		t.Fatalf("error ratio: %+v", resp.Data)
+	}
+	if v, _ := strconv.ParseFloat(resp.Data.Result[0].Value[1].(string), 64); math.Abs(v-0.1) > 1e-9 {
+		t.Errorf("error ratio %v, want 0.1", v)
+	}
+
+	resp = promTestResponse{}
+	end := fmt.Sprint(t0.Add(3 * time.Minute).Unix())
+	getJSON(t, a.handlePromQueryRange, "/api/v1/query_range?"+url.Values{"query": {"queue_depth"}, "start": {at}, "end": {end}, "step": {"60"}}.Encode(), &resp)
+	if resp.Data.ResultType != "matrix" || len(resp.Data.Result) != 1 || len(resp.Data.Result[0].Values) != 2 {
+		t.Fatalf("range query: %+v, want one series of 2 points", resp.Data)
+	}
+
+	var values struct {
+		Data []string `json:"data"`
+	}
+	getJSON(t, a.handlePromLabelValues, "/api/v1/label/code/values", &values, "name", "code")
+	if fmt.Sprint(values.Data) != "[200 500]" {
+		t.Errorf("code values %v, want [200 500]", values.Data)
+	}
+	getJSON(t, a.handlePromLabels, "/api/v1/labels", &values)
+	if fmt.Sprint(values.Data) != "[__name__ code job]" {
+		t.Errorf("labels %v, want [__name__ code job]", values.Data)
+	}
+}
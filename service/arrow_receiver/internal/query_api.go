@@ -1,69 +1,359 @@
 package internal
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// StartQueryAPIServer starts the HTTP server for DuckDB queries
-func StartQueryAPIServer(db *sql.DB) {
-	http.HandleFunc("/query", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+// QuerySlots bounds the queries running at once across /query and Flight SQL.
+type QuerySlots chan struct{}
+
+func NewQuerySlots(n int) QuerySlots {
+	return make(QuerySlots, n)
+}
+
+// Acquire waits for a free slot and reports false if ctx ends first.
+func (s QuerySlots) Acquire(ctx context.Context) bool {
+	select {
+	case s <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s QuerySlots) Release() { <-s }
+
+// StartQueryAPIServer starts the HTTP server for DuckDB queries in the
+// background. Each caller only sees the rows of its own tenant. Shutting
+// the server down also ends the live-tail streams.
+func StartQueryAPIServer(cfg Config, db *sql.DB, health *Health, slots QuerySlots, named *NamedQueries, tail *LiveTail, tenants *TenantResolver, serverTLS *ServerTLS) *http.Server {
+	api := &queryAPI{cfg: cfg, db: db, tenants: tenants, slots: slots, named: named, logIndex: NewLogIndex(cfg), tail: tail}
+	// handle registers a route counted in arrow_receiver_http_requests_total.
+	handle := func(pattern string, handler http.HandlerFunc) {
+		http.HandleFunc(pattern, instrumentHTTP(pattern, handler))
+	}
+	http.Handle("/metrics", metrics)
+	handle("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "ok"}`))
+	})
+	handle("/readyz", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		if r.Method == "OPTIONS" {
-			w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-			w.WriteHeader(http.StatusNoContent)
+		problems := health.Problems()
+		if len(problems) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]interface{}{"status": "not ready", "problems": problems})
 			return
 		}
-		if r.Method != "POST" {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			w.Write([]byte(`{"error": "POST only"}`))
+		w.Write([]byte(`{"status": "ready"}`))
+	})
+	handle("/query", api.handleQuery)
+	handle("/query/named", api.handleNamedList)
+	handle("/query/named/{name}", api.handleNamed)
+	handle("/api/v1/traces", api.handleTraceSearch)
+	handle("/api/v1/traces/{traceId}", api.handleTrace)
+	handle("/api/v1/logs/search", api.handleLogSearch)
+	handle("/api/v1/tail", api.handleTail)
+	handle("/api/services", api.handleJaegerServices)
+	handle("/api/services/{service}/operations", api.handleJaegerOperations)
+	handle("/api/traces", api.handleJaegerSearch)
+	handle("/api/traces/{traceId}", api.handleJaegerTrace)
+	handle(tempoPrefix+"/api/echo", api.handleTempoEcho)
+	handle(tempoPrefix+"/api/traces/{traceId}", api.handleTempoTrace)
+	handle(tempoPrefix+"/api/v2/traces/{traceId}", api.handleTempoTrace)
+	handle(tempoPrefix+"/api/search", api.handleTempoSearch)
+	handle(tempoPrefix+"/api/search/tags", api.handleTempoTags)
+	handle(tempoPrefix+"/api/v2/search/tags", api.handleTempoTags)
+	handle(tempoPrefix+"/api/search/tag/{tag}/values", api.handleTempoTagValues)
+	handle(tempoPrefix+"/api/v2/search/tag/{tag}/values", api.handleTempoTagValues)
+	handle("/api/v1/query", api.handlePromQuery)
+	handle("/api/v1/query_range", api.handlePromQueryRange)
+	handle("/api/v1/labels", api.handlePromLabels)
+	handle("/api/v1/label/{name}/values", api.handlePromLabelValues)
+	handle("/api/v1/series", api.handlePromSeries)
+	handle(lokiPrefix+"/api/v1/query", api.handleLokiQuery)
+	handle(lokiPrefix+"/api/v1/query_range", api.handleLokiQueryRange)
+	handle(lokiPrefix+"/api/v1/labels", api.handleLokiLabels)
+	handle(lokiPrefix+"/api/v1/label/{name}/values", api.handleLokiLabelValues)
+	server := &http.Server{Addr: cfg.HTTPPort}
+	server.RegisterOnShutdown(tail.Close)
+	go func() {
+		log.WithFields(log.Fields{"port": cfg.HTTPPort, "tls": serverTLS != nil}).Info("HTTP query server listening")
+		var err error
+		if serverTLS != nil {
+			server.TLSConfig = serverTLS.Config()
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.WithError(err).Fatal("HTTP server failed")
+		}
+	}()
+	return server
+}
+
+type queryAPI struct {
+	cfg     Config
+	db      *sql.DB
+	tenants *TenantResolver
+	slots   QuerySlots
+	named   *NamedQueries
+	// logIndex describes the full-text index searched by /api/v1/logs/search.
+	logIndex *LogIndex
+	// tail feeds /api/v1/tail.
+	tail *LiveTail
+}
+
+// queryRequest is the body of /query.
+type queryRequest struct {
+	Query string `json:"query"`
+	// Params binds ? and $1 placeholders when it is an array and $name
+	// placeholders when it is an object.
+	Params json.RawMessage `json:"params"`
+	// Write lets admins run statements that modify the database.
+	Write bool `json:"write"`
+	// PageSize and Cursor page through the result of a SELECT.
+	PageSize int    `json:"page_size"`
+	Cursor   string `json:"cursor"`
+	// Format overrides the Accept header: json, ndjson, csv,
+	// arrow or parquet.
+	Format string `json:"format"`
+}
+
+// cors refuses requests from web pages of origins that are not allowed and
+// answers preflight requests. It reports whether a response was written.
+func (a *queryAPI) cors(w http.ResponseWriter, r *http.Request, methods string) bool {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("Vary", "Origin")
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if !a.originAllowed(r) {
+			writeJSONError(w, http.StatusForbidden, fmt.Sprintf("origin %q is not allowed", origin))
+			return true
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	if r.Method != "OPTIONS" {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Methods", methods+", OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Accept, Authorization, "+a.cfg.TenantHeader)
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// originAllowed reports whether r comes from a page of the query API itself,
+// of an origin in cfg.CORSAllowedOrigins, or not from a browser at all.
+func (a *queryAPI) originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+		return true
+	}
+	for _, allowed := range a.cfg.CORSAllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// caller resolves who sent r. Admins see all tenants and have no tenant.
+func (a *queryAPI) caller(w http.ResponseWriter, r *http.Request) (tenant string, admin bool, ok bool) {
+	if a.tenants.IsAdmin(r) {
+		return "", true, true
+	}
+	tenant, err := a.tenants.FromHTTP(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, err.Error())
+		return "", false, false
+	}
+	return tenant, false, true
+}
+
+func (a *queryAPI) handleQuery(w http.ResponseWriter, r *http.Request) {
+	if a.cors(w, r, "POST") {
+		return
+	}
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(`{"error": "POST only"}`))
+		return
+	}
+	tenant, admin, ok := a.caller(w, r)
+	if !ok {
+		return
+	}
+	var req queryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "invalid json"}`))
+		return
+	}
+	args, err := parseQueryParams(req.Params)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	a.execute(w, r, tenant, admin, req, args)
+}
+
+// execute runs req for the caller and streams the result in the negotiated
+// format. args are bound to the placeholders of req.Query.
+func (a *queryAPI) execute(w http.ResponseWriter, r *http.Request, tenant string, admin bool, req queryRequest, args []interface{}) {
+	cfg := a.cfg
+	logger := log.WithFields(log.Fields{"tenant": tenant, "admin": admin, "remote_addr": r.RemoteAddr})
+	format, err := negotiateFormat(r, req.Format)
+	if err != nil {
+		writeJSONError(w, http.StatusNotAcceptable, err.Error())
+		return
+	}
+	// A cursor is only valid for the query and parameters it was issued for.
+	pageKey := req.Query
+	if len(req.Params) > 0 {
+		pageKey += "\x00" + string(req.Params)
+	}
+	page, err := parsePage(pageKey, req.PageSize, req.Cursor, cfg.QueryMaxRows)
+	if err == nil && page != nil && req.Write {
+		err = errors.New("write queries cannot be paged")
+	}
+	if err == nil && format.columnar() && req.Write {
+		err = fmt.Errorf("write queries cannot return %s", format)
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Write && !admin {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"error": "write access requires an admin key"}`))
+		logger.WithField("query", req.Query).Warn("blocked write query from non-admin")
+		return
+	}
+	// The deadline also covers waiting for a slot. r.Context() is
+	// cancelled when the client goes away, which interrupts the query.
+	ctx, cancel := context.WithTimeout(r.Context(), cfg.QueryTimeout)
+	defer cancel()
+	_, wait := startSpan(ctx, "query.slot_wait")
+	acquired := a.slots.Acquire(ctx)
+	wait.End()
+	if !acquired {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error": "too many concurrent queries"}`))
+		logger.Warn("query rejected: concurrency limit reached")
+		return
+	}
+	defer a.slots.Release()
+	ctx, span := startSpan(ctx, "query.execute", trace.WithAttributes(
+		attribute.String("db.query.text", req.Query),
+		attribute.String("tenant", tenant),
+		attribute.Bool("admin", admin),
+	))
+	defer span.End()
+	var conn *TenantConn
+	if admin {
+		conn, err = OpenAdminConn(ctx, a.db)
+	} else {
+		conn, err = OpenTenantConn(ctx, a.db, tenant)
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		log.WithError(err).Error("opening query connection failed")
+		return
+	}
+	defer conn.Close()
+	query := req.Query
+	if page != nil {
+		query = page.wrap(query)
+	}
+	if req.Write {
+		logger.WithField("query", req.Query).Info("running admin write query")
+	} else {
+		err := CheckReadOnlyQuery(ctx, conn, query)
+		if err == nil && !admin {
+			err = CheckTenantQuery(ctx, conn, query)
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusForbidden, err.Error())
+			logger.WithError(err).WithField("query", req.Query).Warn("query blocked")
 			return
 		}
-		var req struct {
-			Query string `json:"query"`
+		if err := conn.BeginReadOnly(ctx); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			log.WithError(err).Error("starting read-only transaction failed")
+			return
+		}
+	}
+	counter := &countingWriter{w: w}
+	if format.columnar() {
+		limit := cfg.QueryMaxRows
+		if page != nil {
+			limit = page.Size
 		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(`{"error": "invalid json"}`))
+		if err := materializeResult(ctx, conn, query, limit, args...); err != nil {
+			writeQueryError(ctx, w, r, err, logger)
 			return
 		}
-		rows, err := db.Query(req.Query)
+		result, err := readArrowResult(ctx, conn, page, cfg.QueryMaxRows, cfg.QueryMaxBytes)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
-			log.WithError(err).Error("query failed")
+			writeQueryError(ctx, w, r, err, logger)
 			return
 		}
-		defer rows.Close()
-		cols, _ := rows.Columns()
-		results := []map[string]interface{}{}
-		for rows.Next() {
-			vals := make([]interface{}, len(cols))
-			ptrs := make([]interface{}, len(cols))
-			for i := range vals {
-				ptrs[i] = &vals[i]
-			}
-			if err := rows.Scan(ptrs...); err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte(`{"error": "scan failed"}`))
-				log.WithError(err).Error("scan failed")
-				return
-			}
-			rowMap := map[string]interface{}{}
-			for i, col := range cols {
-				rowMap[col] = vals[i]
-			}
-			results = append(results, rowMap)
+		defer result.Release()
+		w.Header().Set("Content-Type", format.ContentType())
+		setTrailers(w.Header(), result.trailer)
+		if err := result.write(counter, format); err != nil {
+			logger.WithError(err).Warn("writing query result failed")
 		}
-		json.NewEncoder(w).Encode(map[string]interface{}{"columns": cols, "rows": results})
-	})
-	log.Info("HTTP query server listening on :8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		log.WithError(err).Fatal("HTTP server failed")
+		return
+	}
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		writeQueryError(ctx, w, r, err, logger)
+		return
+	}
+	defer rows.Close()
+	out := newResultWriter(counter, format)
+	w.Header().Set("Content-Type", out.ContentType())
+	announceTrailers(w.Header())
+	trailer, err := streamRows(ctx, rows, out, counter, page, cfg.QueryMaxRows, cfg.QueryMaxBytes)
+	if err != nil {
+		logger.WithError(err).Warn("writing query result failed")
+	}
+	setTrailers(w.Header(), trailer)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// writeQueryError reports a failed query, telling timeouts and client
+// disconnects apart from errors in the query itself.
+func writeQueryError(ctx context.Context, w http.ResponseWriter, r *http.Request, err error, logger *log.Entry) {
+	switch {
+	case r.Context().Err() != nil:
+		logger.WithError(err).Info("query cancelled: client disconnected")
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		w.WriteHeader(http.StatusGatewayTimeout)
+		w.Write([]byte(`{"error": "query timed out"}`))
+		logger.WithError(err).Warn("query timed out")
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		logger.WithError(err).Error("query failed")
 	}
-} 
\ No newline at end of file
+}
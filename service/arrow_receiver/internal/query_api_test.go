@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/apache/arrow-go/v18/parquet/file"
+)
+
+func TestQueryAPIOrigins(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.CORSAllowedOrigins = []string{"https://grafana.example.com"}
+	a := &queryAPI{cfg: cfg}
+	for _, tc := range []struct {
+		method, origin string
+		written        bool
+		status         int
+		allowOrigin    string
+	}{
+		{"GET", "", false, http.StatusOK, ""},
+		{"GET", "http://receiver:8080", false, http.StatusOK, "http://receiver:8080"},
+		{"GET", "https://grafana.example.com", false, http.StatusOK, "https://grafana.example.com"},
+		{"GET", "https://evil.example.com", true, http.StatusForbidden, ""},
+		{"OPTIONS", "https://grafana.example.com", true, http.StatusNoContent, "https://grafana.example.com"},
+		{"OPTIONS", "https://evil.example.com", true, http.StatusForbidden, ""},
+	} {
+		r := httptest.NewRequest(tc.method, "http://receiver:8080/api/v1/traces", nil)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		w := httptest.NewRecorder()
+		if written := a.cors(w, r, "GET"); written != tc.written {
+			t.Errorf("%s from %q: cors returned %v, want %v", tc.method, tc.origin, written, tc.written)
+		}
+		if w.Code != tc.status {
+			t.Errorf("%s from %q: status %d, want %d", tc.method, tc.origin, w.Code, tc.status)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tc.allowOrigin {
+			t.Errorf("%s from %q: Access-Control-Allow-Origin %q, want %q", tc.method, tc.origin, got, tc.allowOrigin)
+		}
+	}
+}
+
+// postQuery runs body against /query as the tenant acme of newScopeTestDB.
+func postQuery(t *testing.T, a *queryAPI, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/query", strings.NewReader(body))
+	r.Header.Set("X-Tenant-ID", "acme")
+	w := httptest.NewRecorder()
+	a.handleQuery(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: status %d: %s", body, w.Code, w.Body)
+	}
+	return w
+}
+
+// TestQueryTruncationVisible checks that a cut-off result says so in the
+// body or headers, where clients that ignore HTTP trailers see it.
+func TestQueryTruncationVisible(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.QueryMaxRows = 2
+	a := &queryAPI{cfg: cfg, db: newScopeTestDB(t), tenants: NewTenantResolver(cfg), slots: NewQuerySlots(1)}
+	const query = `"query": "SELECT span_id, start_time_unix_nano FROM traces ORDER BY span_id"`
+
+	w := postQuery(t, a, `{`+query+`, "format": "csv"}`)
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 4 || lines[3] != "#truncated=true" {
+		t.Errorf("csv body %q, want a header, 2 rows and #truncated=true", w.Body)
+	}
+
+	w = postQuery(t, a, `{`+query+`, "format": "arrow"}`)
+	if got := w.Header().Get(trailerTruncated); got != "true" {
+		t.Errorf("arrow %s header %q, want true", trailerTruncated, got)
+	}
+	reader, err := ipc.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := reader.Schema().Metadata().GetValue("truncated"); v != "true" {
+		t.Errorf("arrow schema metadata truncated %q, want true", v)
+	}
+	rows := 0
+	for reader.Next() {
+		rows += int(reader.Record().NumRows())
+	}
+	reader.Release()
+	if rows != 2 {
+		t.Errorf("arrow rows %d, want 2", rows)
+	}
+
+	w = postQuery(t, a, `{`+query+`, "format": "parquet"}`)
+	if got := w.Header().Get(trailerTruncated); got != "true" {
+		t.Errorf("parquet %s header %q, want true", trailerTruncated, got)
+	}
+	pf, err := file.NewParquetReader(bytes.NewReader(w.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := pf.MetaData().KeyValueMetadata().FindValue("truncated"); v == nil || *v != "true" {
+		t.Errorf("parquet metadata truncated %v, want true", v)
+	}
+
+	w = postQuery(t, a, `{`+query+`, "format": "arrow", "page_size": 2}`)
+	if w.Header().Get(trailerNextCursor) == "" || w.Header().Get(trailerTruncated) != "false" {
+		t.Errorf("paged arrow headers %v, want a next cursor", w.Header())
+	}
+
+	w = postQuery(t, a, `{"query": "SELECT span_id FROM traces LIMIT 2", "format": "arrow"}`)
+	if got := w.Header().Get(trailerTruncated); got != "false" {
+		t.Errorf("complete arrow %s header %q, want false", trailerTruncated, got)
+	}
+}
+
+func TestCSVResultMarksErrors(t *testing.T) {
+	var buf bytes.Buffer
+	out := newResultWriter(&buf, formatCSV)
+	if err := out.Begin([]string{"n"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Row([]interface{}{int64(1)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.End(resultTrailer{Error: "query timed out"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "n\n1\n#error=query timed out\n"; buf.String() != want {
+		t.Errorf("csv %q, want %q", buf.String(), want)
+	}
+}
+
+// newTestQueryAPI returns a query API over a database holding batch for
+// the tenant acme.
+func newTestQueryAPI(t *testing.T, cfg Config, batch RowBatch) *queryAPI {
+	t.Helper()
+	db, err := InitDB(filepath.Join(t.TempDir(), "api.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	ctx := context.Background()
+	rows, err := NewRowWriter(ctx, db, NewLogIndex(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	if err := rows.Write(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+	return &queryAPI{cfg: cfg, db: db, tenants: NewTenantResolver(cfg), slots: NewQuerySlots(cfg.QueryMaxConcurrent), logIndex: NewLogIndex(cfg), tail: NewLiveTail(cfg)}
+}
+
+// getJSON calls handler with a GET of target as the tenant acme and decodes
+// the JSON response into out. pathValues are name, value pairs.
+func getJSON(t *testing.T, handler http.HandlerFunc, target string, out interface{}, pathValues ...string) {
+	t.Helper()
+	r := httptest.NewRequest("GET", target, nil)
+	r.Header.Set("X-Tenant-ID", "acme")
+	for i := 0; i+1 < len(pathValues); i += 2 {
+		r.SetPathValue(pathValues[i], pathValues[i+1])
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s: status %d: %s", target, w.Code, w.Body)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+		t.Fatalf("GET %s: %v: %s", target, err, w.Body)
+	}
+}
@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/apache/arrow-go/v18/arrow/util"
+	"github.com/apache/arrow-go/v18/parquet"
+	"github.com/apache/arrow-go/v18/parquet/compress"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+	"github.com/marcboeker/go-duckdb"
+)
+
+// arrowResultTable holds a columnar result inside the read-only transaction
+// of a query; it disappears with the rollback that ends the transaction.
+const arrowResultTable = "query_result"
+
+// materializeResult runs query into a temp table limited to limit+1 rows, the
+// extra row telling whether the result was cut off. DuckDB's Arrow interface
+// cannot be interrupted, so the query itself runs here where the deadline
+// and client disconnects apply.
+func materializeResult(ctx context.Context, conn *TenantConn, query string, limit int, args ...interface{}) error {
+	query = strings.TrimRight(strings.TrimSpace(query), "; \t\n")
+	_, err := conn.ExecContext(ctx, fmt.Sprintf("CREATE TEMP TABLE %s AS SELECT * FROM (\n%s\n) LIMIT %d", arrowResultTable, query, limit+1), args...)
+	return err
+}
+
+// arrowRecordWriter writes Arrow records in one columnar format.
+type arrowRecordWriter interface {
+	Write(rec arrow.Record) error
+	Close() error
+}
+
+type ipcRecordWriter struct {
+	w *ipc.Writer
+}
+
+func (i *ipcRecordWriter) Write(rec arrow.Record) error { return i.w.Write(rec) }
+
+func (i *ipcRecordWriter) Close() error { return i.w.Close() }
+
+// parquetRecordWriter writes one row group per record and keeps the Arrow
+// schema in the file so readers get the original types back. The schema
+// metadata becomes the file's key-value metadata.
+type parquetRecordWriter struct {
+	w *pqarrow.FileWriter
+}
+
+func (p *parquetRecordWriter) Write(rec arrow.Record) error { return p.w.Write(rec) }
+
+func (p *parquetRecordWriter) Close() error { return p.w.Close() }
+
+func newArrowRecordWriter(counter *countingWriter, format queryFormat, schema *arrow.Schema) (arrowRecordWriter, error) {
+	if format == formatParquet {
+		props := parquet.NewWriterProperties(parquet.WithCompression(compress.Codecs.Zstd))
+		w, err := pqarrow.NewFileWriter(schema, counter, props, pqarrow.NewArrowWriterProperties(pqarrow.WithStoreSchema()))
+		if err != nil {
+			return nil, err
+		}
+		return &parquetRecordWriter{w: w}, nil
+	}
+	return &ipcRecordWriter{w: ipc.NewWriter(counter, ipc.WithSchema(schema))}, nil
+}
+
+// queryArrowResult reads the table filled by materializeResult as Arrow
+// records. The reader holds the whole result, which the limit keeps small.
+func queryArrowResult(ctx context.Context, conn *TenantConn) (array.RecordReader, error) {
+	var reader array.RecordReader
+	err := conn.Raw(func(driverConn interface{}) error {
+		dc, ok := driverConn.(driver.Conn)
+		if !ok {
+			return fmt.Errorf("unexpected driver connection %T", driverConn)
+		}
+		ar, err := duckdb.NewArrowFromConn(dc)
+		if err != nil {
+			return err
+		}
+		reader, err = ar.QueryContext(ctx, "SELECT * FROM temp."+arrowResultTable)
+		return err
+	})
+	return reader, err
+}
+
+// limitRecords passes the records of reader to emit until maxRows rows or
+// maxBytes of Arrow buffers have been emitted. It returns the rows emitted
+// and whether rows were left over.
+func limitRecords(reader array.RecordReader, maxRows int, maxBytes int64, emit func(arrow.Record) error) (read int, cut bool, err error) {
+	var size int64
+	for reader.Next() {
+		rec := reader.Record()
+		if read >= maxRows || size >= maxBytes {
+			return read, true, nil
+		}
+		total := int(rec.NumRows())
+		n := min(total, maxRows-read)
+		if n < total {
+			rec = rec.NewSlice(0, int64(n))
+			defer rec.Release()
+		}
+		if err := emit(rec); err != nil {
+			return read, false, err
+		}
+		read += n
+		size += util.TotalRecordSize(rec)
+		if n < total {
+			return read, true, nil
+		}
+	}
+	return read, false, reader.Err()
+}
+
+// arrowResult is a columnar result read in full before any of it is
+// written, so its trailer can go out in the response headers and the
+// schema metadata ahead of the rows.
+type arrowResult struct {
+	schema  *arrow.Schema
+	records []arrow.Record
+	trailer resultTrailer
+}
+
+// readArrowResult reads the table filled by materializeResult, applying the
+// same row and byte limits as streamRows.
+func readArrowResult(ctx context.Context, conn *TenantConn, page *queryPage, maxRows int, maxBytes int64) (*arrowResult, error) {
+	if page != nil {
+		maxRows = page.Size
+	}
+	reader, err := queryArrowResult(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Release()
+	result := &arrowResult{}
+	read, cut, err := limitRecords(reader, maxRows, maxBytes, func(rec arrow.Record) error {
+		rec.Retain()
+		result.records = append(result.records, rec)
+		return nil
+	})
+	if err != nil {
+		result.Release()
+		return nil, err
+	}
+	if cut {
+		result.trailer.Truncated = page == nil
+		if page != nil {
+			result.trailer.NextCursor = page.next(read)
+		}
+	}
+	metadata := map[string]string{"truncated": strconv.FormatBool(result.trailer.Truncated)}
+	if result.trailer.NextCursor != "" {
+		metadata["next_cursor"] = result.trailer.NextCursor
+	}
+	md := arrow.MetadataFrom(metadata)
+	result.schema = arrow.NewSchema(reader.Schema().Fields(), &md)
+	return result, nil
+}
+
+// Release frees the records of the result.
+func (r *arrowResult) Release() {
+	for _, rec := range r.records {
+		rec.Release()
+	}
+	r.records = nil
+}
+
+// write writes the result as Arrow IPC or Parquet.
+func (r *arrowResult) write(counter *countingWriter, format queryFormat) error {
+	out, err := newArrowRecordWriter(counter, format, r.schema)
+	if err != nil {
+		return err
+	}
+	for _, rec := range r.records {
+		if err := out.Write(rec); err != nil {
+			return err
+		}
+	}
+	return out.Close()
+}
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+var ErrInvalidParams = errors.New("params must be an array or an object of strings, numbers, booleans or null")
+
+// parseQueryParams decodes the params of a /query request into arguments for
+// database/sql: an array binds ? and $1 placeholders in order, an object
+// binds $name placeholders. JSON types are kept, so compare strings to
+// timestamps with an explicit cast such as $since::TIMESTAMP.
+func parseQueryParams(raw json.RawMessage) ([]interface{}, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return nil, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var params interface{}
+	if err := dec.Decode(&params); err != nil {
+		return nil, ErrInvalidParams
+	}
+	var args []interface{}
+	switch p := params.(type) {
+	case []interface{}:
+		for _, v := range p {
+			arg, err := paramValue(v)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+		}
+	case map[string]interface{}:
+		names := make([]string, 0, len(p))
+		for name := range p {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			arg, err := paramValue(p[name])
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, sql.Named(name, arg))
+		}
+	default:
+		return nil, ErrInvalidParams
+	}
+	return args, nil
+}
+
+func paramValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case nil, string, bool:
+		return v, nil
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, nil
+		}
+		return v.Float64()
+	}
+	return nil, ErrInvalidParams
+}
+
+// paramTypes are the types a named query may declare for its parameters.
+var paramTypes = map[string]func(string) (interface{}, error){
+	"string": func(s string) (interface{}, error) { return s, nil },
+	"int": func(s string) (interface{}, error) {
+		return strconv.ParseInt(s, 10, 64)
+	},
+	"float": func(s string) (interface{}, error) {
+		return strconv.ParseFloat(s, 64)
+	},
+	"bool": func(s string) (interface{}, error) {
+		return strconv.ParseBool(s)
+	},
+	"timestamp": func(s string) (interface{}, error) {
+		return time.Parse(time.RFC3339Nano, s)
+	},
+}
+
+// queryParamNames returns the placeholder names of query in order; positional
+// placeholders are named by their position.
+func queryParamNames(ctx context.Context, conn *TenantConn, query string) ([]string, error) {
+	var names []string
+	err := conn.Raw(func(dc interface{}) error {
+		stmt, err := dc.(*duckdb.Conn).Prepare(query)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		s := stmt.(*duckdb.Stmt)
+		for i := 1; i <= s.NumInput(); i++ {
+			name, err := s.ParamName(i)
+			if err != nil {
+				return err
+			}
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrQueryBlocked, err)
+	}
+	return names, nil
+}
@@ -0,0 +1,369 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidCursor     = errors.New("invalid or mismatched cursor")
+	ErrUnsupportedFormat = errors.New("unsupported result format; use json, ndjson, csv, arrow or parquet")
+)
+
+// queryFormat is an output format of /query results.
+type queryFormat string
+
+const (
+	formatJSON    queryFormat = "json"
+	formatNDJSON  queryFormat = "ndjson"
+	formatCSV     queryFormat = "csv"
+	formatArrow   queryFormat = "arrow"
+	formatParquet queryFormat = "parquet"
+)
+
+var formatMediaTypes = map[queryFormat][]string{
+	formatJSON:    {"application/json"},
+	formatNDJSON:  {"application/x-ndjson"},
+	formatCSV:     {"text/csv"},
+	formatArrow:   {"application/vnd.apache.arrow.stream"},
+	formatParquet: {"application/vnd.apache.parquet", "application/x-parquet"},
+}
+
+func (f queryFormat) ContentType() string { return formatMediaTypes[f][0] }
+
+// columnar reports whether the format is written from Arrow records, which
+// keeps column types, instead of row by row.
+func (f queryFormat) columnar() bool { return f == formatArrow || f == formatParquet }
+
+// negotiateFormat picks the output format from the format parameter or, when
+// it is empty, from the first supported type in the Accept header.
+func negotiateFormat(r *http.Request, param string) (queryFormat, error) {
+	if param != "" {
+		if _, ok := formatMediaTypes[queryFormat(param)]; ok {
+			return queryFormat(param), nil
+		}
+		return "", ErrUnsupportedFormat
+	}
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return formatJSON, nil
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+		switch mediaType {
+		case "*/*", "application/*":
+			return formatJSON, nil
+		case "text/*":
+			return formatCSV, nil
+		}
+		for format, types := range formatMediaTypes {
+			for _, t := range types {
+				if strings.EqualFold(mediaType, t) {
+					return format, nil
+				}
+			}
+		}
+	}
+	return "", ErrUnsupportedFormat
+}
+
+// resultTrailer ends every result. NextCursor is set when a paged query has
+// more rows.
+type resultTrailer struct {
+	Truncated  bool   `json:"truncated"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// resultWriter streams a query result in one output format: the columns
+// once, then one call per row, then the trailer.
+type resultWriter interface {
+	ContentType() string
+	Begin(cols []string) error
+	Row(vals []interface{}) error
+	End(trailer resultTrailer) error
+}
+
+// newResultWriter returns the row writer of a row-based format.
+func newResultWriter(w io.Writer, format queryFormat) resultWriter {
+	switch format {
+	case formatNDJSON:
+		return &ndjsonResultWriter{enc: json.NewEncoder(w)}
+	case formatCSV:
+		return &csvResultWriter{w: csv.NewWriter(w)}
+	}
+	return &jsonResultWriter{w: w}
+}
+
+// Trailer headers carry the result trailer for formats that have no room
+// for it in the body. Columnar results know their trailer before the body
+// and send them as ordinary headers.
+const (
+	trailerTruncated  = "X-Query-Truncated"
+	trailerNextCursor = "X-Next-Cursor"
+	trailerError      = "X-Query-Error"
+)
+
+// announceTrailers declares the trailer headers; it must be called before
+// the body is written.
+func announceTrailers(h http.Header) {
+	h.Set("Trailer", strings.Join([]string{trailerTruncated, trailerNextCursor, trailerError}, ", "))
+}
+
+// setTrailers sets the trailer headers. Before the body is written they go
+// out as ordinary headers, after it as HTTP trailers.
+func setTrailers(h http.Header, trailer resultTrailer) {
+	h.Set(trailerTruncated, strconv.FormatBool(trailer.Truncated))
+	if trailer.NextCursor != "" {
+		h.Set(trailerNextCursor, trailer.NextCursor)
+	}
+	if trailer.Error != "" {
+		h.Set(trailerError, trailer.Error)
+	}
+}
+
+// jsonResultWriter writes {"columns": [...], "rows": [[...], ...], ...} with
+// each row as an array in column order.
+type jsonResultWriter struct {
+	w    io.Writer
+	rows int
+}
+
+func (j *jsonResultWriter) ContentType() string { return "application/json" }
+
+func (j *jsonResultWriter) Begin(cols []string) error {
+	encoded, err := json.Marshal(cols)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(j.w, `{"columns":%s,"rows":[`, encoded)
+	return err
+}
+
+func (j *jsonResultWriter) Row(vals []interface{}) error {
+	encoded, err := json.Marshal(vals)
+	if err != nil {
+		return err
+	}
+	if j.rows > 0 {
+		encoded = append([]byte{','}, encoded...)
+	}
+	j.rows++
+	_, err = j.w.Write(encoded)
+	return err
+}
+
+func (j *jsonResultWriter) End(trailer resultTrailer) error {
+	encoded, err := json.Marshal(trailer)
+	if err != nil {
+		return err
+	}
+	// Splice the trailer fields into the enclosing object.
+	_, err = fmt.Fprintf(j.w, "],%s\n", encoded[1:])
+	return err
+}
+
+// ndjsonResultWriter writes {"columns": [...]} on the first line, one array
+// per row and the trailer object on the last line.
+type ndjsonResultWriter struct {
+	enc *json.Encoder
+}
+
+func (n *ndjsonResultWriter) ContentType() string { return "application/x-ndjson" }
+
+func (n *ndjsonResultWriter) Begin(cols []string) error {
+	return n.enc.Encode(map[string][]string{"columns": cols})
+}
+
+func (n *ndjsonResultWriter) Row(vals []interface{}) error {
+	return n.enc.Encode(vals)
+}
+
+func (n *ndjsonResultWriter) End(trailer resultTrailer) error {
+	return n.enc.Encode(trailer)
+}
+
+// csvResultWriter writes a header row and one record per row. NULL is an
+// empty field, timestamps are RFC 3339 and nested values are JSON.
+type csvResultWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvResultWriter) ContentType() string { return "text/csv" }
+
+func (c *csvResultWriter) Begin(cols []string) error {
+	return c.w.Write(cols)
+}
+
+func (c *csvResultWriter) Row(vals []interface{}) error {
+	record := make([]string, len(vals))
+	for i, v := range vals {
+		switch v := v.(type) {
+		case nil:
+		case string:
+			record[i] = v
+		case []byte:
+			record[i] = string(v)
+		case time.Time:
+			record[i] = v.UTC().Format(time.RFC3339Nano)
+		case bool, int8, int16, int32, int64, uint8, uint16, uint32, uint64, float32, float64:
+			record[i] = fmt.Sprint(v)
+		default:
+			encoded, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			record[i] = string(encoded)
+		}
+	}
+	return c.w.Write(record)
+}
+
+// End marks an incomplete result with one record per trailer field, such as
+// "#truncated=true" or "#error=...", which CSV readers that skip "#" comment
+// lines ignore. The trailer also goes out as HTTP trailers.
+func (c *csvResultWriter) End(trailer resultTrailer) error {
+	var marks []string
+	if trailer.Truncated {
+		marks = append(marks, "#truncated=true")
+	}
+	if trailer.NextCursor != "" {
+		marks = append(marks, "#next_cursor="+trailer.NextCursor)
+	}
+	if trailer.Error != "" {
+		marks = append(marks, "#error="+trailer.Error)
+	}
+	for _, mark := range marks {
+		if err := c.w.Write([]string{mark}); err != nil {
+			return err
+		}
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// queryPage is the window of a paged query.
+type queryPage struct {
+	Offset int    `json:"o"`
+	Size   int    `json:"n"`
+	Hash   string `json:"h"`
+}
+
+// parsePage returns the page requested by pageSize and cursor, or nil when
+// the query is not paged. A cursor only applies to the key (the query and
+// its parameters) it was issued for.
+func parsePage(key string, pageSize int, cursor string, maxRows int) (*queryPage, error) {
+	if pageSize <= 0 && cursor == "" {
+		return nil, nil
+	}
+	page := &queryPage{Size: pageSize, Hash: queryHash(key)}
+	if cursor != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+		var prev queryPage
+		if err := json.Unmarshal(raw, &prev); err != nil || prev.Hash != page.Hash || prev.Offset < 0 {
+			return nil, ErrInvalidCursor
+		}
+		page.Offset = prev.Offset
+		if page.Size <= 0 {
+			page.Size = prev.Size
+		}
+	}
+	if page.Size <= 0 || page.Size > maxRows {
+		page.Size = maxRows
+	}
+	return page, nil
+}
+
+// wrap limits the query to the page plus one row, which tells whether
+// another page follows.
+func (p *queryPage) wrap(query string) string {
+	query = strings.TrimRight(strings.TrimSpace(query), "; \t\n")
+	return fmt.Sprintf("SELECT * FROM (\n%s\n) LIMIT %d OFFSET %d", query, p.Size+1, p.Offset)
+}
+
+// next returns the cursor of the page starting after read rows.
+func (p *queryPage) next(read int) string {
+	encoded, _ := json.Marshal(queryPage{Offset: p.Offset + read, Size: p.Size, Hash: p.Hash})
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+func queryHash(query string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(query)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// streamRows writes rows to out until they run out or a limit is reached.
+// Without a page, hitting maxRows or maxBytes marks the result truncated; with
+// one, the result ends early and next_cursor continues after the last row.
+// Errors after the first row are reported in the trailer.
+func streamRows(ctx context.Context, rows *sql.Rows, out resultWriter, counter *countingWriter, page *queryPage, maxRows int, maxBytes int64) (resultTrailer, error) {
+	var trailer resultTrailer
+	cols, err := rows.Columns()
+	if err != nil {
+		return trailer, err
+	}
+	if page != nil {
+		maxRows = page.Size
+	}
+	if err := out.Begin(cols); err != nil {
+		return trailer, err
+	}
+	start := counter.n
+	read := 0
+	for rows.Next() {
+		if read >= maxRows || counter.n-start >= maxBytes {
+			trailer.Truncated = page == nil
+			if page != nil {
+				trailer.NextCursor = page.next(read)
+			}
+			break
+		}
+		vals := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			trailer.Error = err.Error()
+			break
+		}
+		if err := out.Row(vals); err != nil {
+			return trailer, err
+		}
+		read++
+	}
+	if err := rows.Err(); err != nil && trailer.Error == "" {
+		trailer.Error = err.Error()
+		if ctx.Err() != nil {
+			trailer.Error = "query timed out"
+		}
+	}
+	return trailer, out.End(trailer)
+}
@@ -0,0 +1,250 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+// ErrQueryBlocked is wrapped by errors for statements a read-only query may
+// not run.
+var ErrQueryBlocked = errors.New("query blocked")
+
+// readOnlyStatements are the statement types /query runs without the admin
+// write flag. DuckDB reports WITH, DESCRIBE, SHOW and SUMMARIZE as SELECT.
+var readOnlyStatements = map[duckdb.StmtType]bool{
+	duckdb.STATEMENT_TYPE_SELECT:  true,
+	duckdb.STATEMENT_TYPE_EXPLAIN: true,
+}
+
+var statementTypeNames = map[duckdb.StmtType]string{
+	duckdb.STATEMENT_TYPE_INSERT:      "INSERT",
+	duckdb.STATEMENT_TYPE_UPDATE:      "UPDATE",
+	duckdb.STATEMENT_TYPE_DELETE:      "DELETE",
+	duckdb.STATEMENT_TYPE_CREATE:      "CREATE",
+	duckdb.STATEMENT_TYPE_ALTER:       "ALTER",
+	duckdb.STATEMENT_TYPE_DROP:        "DROP",
+	duckdb.STATEMENT_TYPE_COPY:        "COPY",
+	duckdb.STATEMENT_TYPE_EXPORT:      "EXPORT",
+	duckdb.STATEMENT_TYPE_TRANSACTION: "TRANSACTION",
+	duckdb.STATEMENT_TYPE_SET:         "SET",
+	duckdb.STATEMENT_TYPE_PRAGMA:      "PRAGMA",
+	duckdb.STATEMENT_TYPE_CALL:        "CALL",
+	duckdb.STATEMENT_TYPE_LOAD:        "LOAD",
+	duckdb.STATEMENT_TYPE_EXTENSION:   "INSTALL/LOAD",
+	duckdb.STATEMENT_TYPE_ATTACH:      "ATTACH",
+	duckdb.STATEMENT_TYPE_DETACH:      "DETACH",
+}
+
+// explainPrefix matches the EXPLAIN keyword in front of the explained statement.
+var explainPrefix = regexp.MustCompile(`(?i)^\s*EXPLAIN(\s+ANALYZE)?\s+`)
+
+// tenantTables are the telemetry tables shadowed by per-tenant views,
+// including the full-text index of the logs.
+var tenantTables = []string{"traces", "logs", "metrics", "log_terms"}
+
+// scopeTableFunctions are the table functions a tenant query may call; all
+// others (query_table, read_csv, ...) could reach data outside the tenant views.
+var scopeTableFunctions = map[string]bool{
+	"range":           true,
+	"generate_series": true,
+	"unnest":          true,
+}
+
+// TenantConn is a pooled connection on which traces, logs and metrics are
+// temporary views restricted to one tenant's rows.
+type TenantConn struct {
+	*sql.Conn
+	admin    bool
+	readOnly bool
+}
+
+// OpenAdminConn returns a connection that sees the tables of all tenants.
+func OpenAdminConn(ctx context.Context, db *sql.DB) (*TenantConn, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &TenantConn{Conn: conn, admin: true}, nil
+}
+
+// OpenTenantConn returns a TenantConn for the tenant. Callers must Close it so
+// the views are dropped before the connection goes back to the pool.
+func OpenTenantConn(ctx context.Context, db *sql.DB, tenant string) (*TenantConn, error) {
+	if !tenantIDPattern.MatchString(tenant) {
+		return nil, ErrInvalidTenant
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c := &TenantConn{Conn: conn}
+	var catalog string
+	if err := conn.QueryRowContext(ctx, "SELECT current_database()").Scan(&catalog); err != nil {
+		c.Close()
+		return nil, err
+	}
+	for _, table := range tenantTables {
+		// Views cannot take parameters; the tenant ID was validated above.
+		stmt := fmt.Sprintf(`CREATE OR REPLACE TEMP VIEW %s AS SELECT * EXCLUDE (tenant_id) FROM "%s".main.%s WHERE tenant_id = '%s'`,
+			table, strings.ReplaceAll(catalog, `"`, `""`), table, tenant)
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// BeginReadOnly starts a read-only transaction that lasts until Close, so
+// no statement run on c can write.
+func (c *TenantConn) BeginReadOnly(ctx context.Context) error {
+	if _, err := c.Conn.ExecContext(ctx, "BEGIN TRANSACTION READ ONLY"); err != nil {
+		return err
+	}
+	c.readOnly = true
+	return nil
+}
+
+// Close ends the read-only transaction, drops the tenant views and releases
+// the connection. A connection whose views cannot be dropped is discarded
+// instead of reused, since the views would shadow the tables for the next
+// user of the pool.
+func (c *TenantConn) Close() error {
+	if c.readOnly {
+		c.Conn.ExecContext(context.Background(), "ROLLBACK")
+	}
+	for _, table := range tenantTables {
+		if _, err := c.Conn.ExecContext(context.Background(), "DROP VIEW IF EXISTS temp.main."+table); err != nil {
+			c.Conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+			break
+		}
+	}
+	return c.Conn.Close()
+}
+
+// CheckReadOnlyQuery rejects anything but a single SELECT (including WITH,
+// DESCRIBE and friends) or EXPLAIN statement. The statement is prepared to
+// learn its type, so it must also bind on conn.
+func CheckReadOnlyQuery(ctx context.Context, conn *TenantConn, query string) error {
+	var stmtType duckdb.StmtType
+	err := conn.Raw(func(dc interface{}) error {
+		stmt, err := dc.(*duckdb.Conn).Prepare(query)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		stmtType, err = stmt.(*duckdb.Stmt).StatementType()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrQueryBlocked, err)
+	}
+	if !readOnlyStatements[stmtType] {
+		name, ok := statementTypeNames[stmtType]
+		if !ok {
+			name = fmt.Sprintf("type %d", stmtType)
+		}
+		return fmt.Errorf("%w: %s statements are not allowed", ErrQueryBlocked, name)
+	}
+	if stmtType == duckdb.STATEMENT_TYPE_EXPLAIN {
+		if loc := explainPrefix.FindStringIndex(query); loc != nil {
+			return CheckReadOnlyQuery(ctx, conn, query[loc[1]:])
+		}
+	}
+	return nil
+}
+
+// CheckTenantQuery rejects queries that could escape the tenant views: anything
+// but a single SELECT, catalog- or schema-qualified table references and table
+// functions outside scopeTableFunctions. For EXPLAIN the explained statement
+// is checked.
+func CheckTenantQuery(ctx context.Context, conn *TenantConn, query string) error {
+	if loc := explainPrefix.FindStringIndex(query); loc != nil {
+		query = query[loc[1]:]
+	}
+	var serialized string
+	if err := conn.QueryRowContext(ctx, "SELECT json_serialize_sql(?::VARCHAR)::VARCHAR", query).Scan(&serialized); err != nil {
+		return err
+	}
+	var parsed struct {
+		Error        bool              `json:"error"`
+		ErrorMessage string            `json:"error_message"`
+		Statements   []json.RawMessage `json:"statements"`
+	}
+	if err := json.Unmarshal([]byte(serialized), &parsed); err != nil {
+		return err
+	}
+	if parsed.Error {
+		return fmt.Errorf("query rejected: %s", parsed.ErrorMessage)
+	}
+	if len(parsed.Statements) != 1 {
+		return fmt.Errorf("query rejected: expected exactly one statement, got %d", len(parsed.Statements))
+	}
+	var tree interface{}
+	if err := json.Unmarshal(parsed.Statements[0], &tree); err != nil {
+		return err
+	}
+	return checkScopeNode(tree)
+}
+
+func checkScopeNode(node interface{}) error {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		switch n["type"] {
+		case "BASE_TABLE":
+			catalog, _ := n["catalog_name"].(string)
+			schema, _ := n["schema_name"].(string)
+			if catalog != "" || (schema != "" && schema != "main") {
+				return fmt.Errorf("query rejected: qualified table reference %q is not allowed", n["table_name"])
+			}
+		case "SHOW_REF":
+			// DESCRIBE, SHOW and SUMMARIZE name their table as SQL text, or
+			// wrap a query whose nodes are checked below.
+			name, _ := n["table_name"].(string)
+			if n["query"] == nil && qualifiedName(name) {
+				return fmt.Errorf("query rejected: qualified table reference %s is not allowed", name)
+			}
+		case "TABLE_FUNCTION":
+			fn, _ := n["function"].(map[string]interface{})
+			name, _ := fn["function_name"].(string)
+			if !scopeTableFunctions[strings.ToLower(name)] {
+				return fmt.Errorf("query rejected: table function %q is not allowed", name)
+			}
+		}
+		for _, child := range n {
+			if err := checkScopeNode(child); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, child := range n {
+			if err := checkScopeNode(child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// qualifiedName reports whether the SQL name has a catalog or schema, that is
+// a dot outside double quotes.
+func qualifiedName(name string) bool {
+	quoted := false
+	for _, c := range name {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == '.' && !quoted:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newScopeTestDB returns a database named "scope" holding the spans of
+// jaegerTestTraces for the tenants acme and globex.
+func newScopeTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := InitDB(filepath.Join(t.TempDir(), "scope.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	ctx := context.Background()
+	rows, err := NewRowWriter(ctx, db, NewLogIndex(defaultConfig()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for _, tenant := range []string{"acme", "globex"} {
+		if err := rows.Write(ctx, RowBatch{Traces: TracesToRows(jaegerTestTraces(), tenant)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestCheckTenantQueryRejectsQualifiedShow(t *testing.T) {
+	db := newScopeTestDB(t)
+	ctx := context.Background()
+	conn, err := OpenTenantConn(ctx, db, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, q := range []string{
+		"SUMMARIZE scope.traces",
+		"SUMMARIZE scope.main.traces",
+		`SUMMARIZE "scope"."main"."logs"`,
+		"DESCRIBE scope.main.logs",
+		"SHOW scope.main.metrics",
+		"SELECT * FROM (SUMMARIZE scope.traces)",
+		"SUMMARIZE SELECT * FROM scope.main.traces",
+		"EXPLAIN SUMMARIZE scope.traces",
+		"SELECT * FROM scope.main.traces",
+	} {
+		err := CheckReadOnlyQuery(ctx, conn, q)
+		if err == nil {
+			err = CheckTenantQuery(ctx, conn, q)
+		}
+		if err == nil || !strings.Contains(err.Error(), "rejected") {
+			t.Errorf("%s: %v, want it rejected", q, err)
+		}
+	}
+	for _, q := range []string{
+		"SUMMARIZE traces",
+		"DESCRIBE logs",
+		`SHOW "metrics"`,
+		"SHOW TABLES",
+		"SUMMARIZE SELECT name FROM traces",
+	} {
+		if err := CheckTenantQuery(ctx, conn, q); err != nil {
+			t.Errorf("%s: %v", q, err)
+		}
+	}
+}
+
+// TestTenantSummarizeSeesOwnRows checks that an allowed SUMMARIZE reads the
+// tenant view rather than the shared table.
+func TestTenantSummarizeSeesOwnRows(t *testing.T) {
+	db := newScopeTestDB(t)
+	ctx := context.Background()
+	conn, err := OpenTenantConn(ctx, db, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.BeginReadOnly(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := conn.QueryRowContext(ctx, `SELECT count FROM (SUMMARIZE traces) WHERE column_name = 'span_id'`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("SUMMARIZE traces counted %d spans, want the tenant's 3", count)
+	}
+	var n int
+	if err := conn.QueryRowContext(ctx, `SELECT count(*) FROM (DESCRIBE traces) WHERE column_name = 'tenant_id'`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Error("DESCRIBE traces shows the tenant_id column")
+	}
+}
@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// reloadableKeys are the configuration file keys applied without a restart.
+// The TLS files are as long as TLS is neither turned on nor off.
+var reloadableKeys = map[string]bool{
+	"tls.cert_file":                true,
+	"tls.key_file":                 true,
+	"tls.client_ca_file":           true,
+	"storage.retention":            true,
+	"storage.retention_interval":   true,
+	"auth.tenant_keys":             true,
+	"auth.admin_keys":              true,
+	"logging.level":                true,
+	"logging.format":               true,
+	"logging.payload_sample_ratio": true,
+	"self_tracing.sample_ratio":    true,
+	"processing.drop_attributes":   true,
+	"processing.redact_attributes": true,
+}
+
+// Reloader reloads the configuration on request and applies the settings
+// that can change while running: the log level, format and payload sampling,
+// API keys, retention, the self-tracing sample ratio, the processing rules
+// and the TLS certificate and client CAs. Other changes are reported and
+// wait for a restart.
+type Reloader struct {
+	args        []string
+	pipeline    *Pipeline
+	tenants     *TenantResolver
+	serverTLS   *ServerTLS
+	retention   *Retention
+	selfTracing *SelfTracing
+
+	mu  sync.Mutex
+	cfg Config
+}
+
+// NewReloader returns a Reloader for the configuration cfg that was loaded
+// from args. serverTLS is nil when TLS is off and selfTracing when
+// self-tracing is.
+func NewReloader(cfg Config, args []string, pipeline *Pipeline, tenants *TenantResolver, serverTLS *ServerTLS, retention *Retention, selfTracing *SelfTracing) *Reloader {
+	return &Reloader{args: args, pipeline: pipeline, tenants: tenants, serverTLS: serverTLS, retention: retention, selfTracing: selfTracing, cfg: cfg}
+}
+
+// Reload loads the configuration again from the file, the environment and
+// the flags. When it is invalid, or the TLS files cannot be read, nothing
+// changes.
+func (r *Reloader) Reload() {
+	applied, restart, err := r.reload()
+	if err != nil {
+		log.WithError(err).Error("Configuration reload failed, keeping the running configuration")
+		return
+	}
+	log.WithField("applied", applied).Info("Configuration reloaded")
+	if len(restart) > 0 {
+		log.WithField("keys", restart).Warn("Configuration changes need a restart to take effect")
+	}
+}
+
+// reload applies the new configuration and returns the changed keys that
+// were applied and those that need a restart.
+func (r *Reloader) reload() (applied, restart []string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	next, err := LoadConfig(r.args)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsToggled := (r.cfg.TLSCertFile == "") != (next.TLSCertFile == "")
+	if r.serverTLS != nil && !tlsToggled {
+		// Reread even unchanged paths so rotated certificates are picked up.
+		if err := r.serverTLS.Load(next); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, key := range changedKeys(&r.cfg, &next) {
+		if reloadableKeys[key] && !(tlsToggled && strings.HasPrefix(key, "tls.")) {
+			applied = append(applied, key)
+		} else {
+			restart = append(restart, key)
+		}
+	}
+	running := r.cfg
+	if !tlsToggled {
+		running.TLSCertFile, running.TLSKeyFile, running.TLSClientCAFile = next.TLSCertFile, next.TLSKeyFile, next.TLSClientCAFile
+	}
+	running.Retention, running.RetentionInterval = next.Retention, next.RetentionInterval
+	running.TenantKeys, running.AdminKeys = next.TenantKeys, next.AdminKeys
+	running.LogLevel, running.LogFormat, running.LogPayloadSampleRatio = next.LogLevel, next.LogFormat, next.LogPayloadSampleRatio
+	running.SelfTracingSampleRatio = next.SelfTracingSampleRatio
+	running.DropAttributes, running.RedactAttributes = next.DropAttributes, next.RedactAttributes
+	SetupLogger(running)
+	r.tenants.SetKeys(running.TenantKeys, running.AdminKeys)
+	r.retention.Set(running.Retention, running.RetentionInterval)
+	r.selfTracing.SetSampleRatio(running.SelfTracingSampleRatio)
+	r.pipeline.SetProcessor(NewProcessor(running))
+	r.cfg = running
+	return applied, restart, nil
+}
+
+// Watch reloads the configuration whenever the configuration file or a TLS
+// file changes, checking every interval. It never returns.
+func (r *Reloader) Watch(interval time.Duration) {
+	last := r.fileStamps()
+	for range time.Tick(interval) {
+		if stamps := r.fileStamps(); !reflect.DeepEqual(stamps, last) {
+			last = stamps
+			log.Info("Configuration files changed, reloading")
+			r.Reload()
+		}
+	}
+}
+
+// fileStamps returns the modification time and size of the files the
+// running configuration was read from.
+func (r *Reloader) fileStamps() map[string][2]int64 {
+	r.mu.Lock()
+	files := []string{r.cfg.ConfigFile, r.cfg.TLSCertFile, r.cfg.TLSKeyFile, r.cfg.TLSClientCAFile}
+	r.mu.Unlock()
+	stamps := map[string][2]int64{}
+	for _, path := range files {
+		if path == "" {
+			continue
+		}
+		if fi, err := os.Stat(path); err == nil {
+			stamps[path] = [2]int64{fi.ModTime().UnixNano(), fi.Size()}
+		}
+	}
+	return stamps
+}
+
+// changedKeys lists the configuration file keys whose settings differ
+// between a and b.
+func changedKeys(a, b *Config) []string {
+	va, vb := reflect.ValueOf(a.schema()).Elem(), reflect.ValueOf(b.schema()).Elem()
+	var keys []string
+	for i := 0; i < va.NumField(); i++ {
+		section := va.Type().Field(i)
+		sa, sb := va.Field(i), vb.Field(i)
+		for j := 0; j < sa.NumField(); j++ {
+			if !reflect.DeepEqual(sa.Field(j).Interface(), sb.Field(j).Interface()) {
+				keys = append(keys, section.Tag.Get("yaml")+"."+section.Type.Field(j).Tag.Get("yaml"))
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/plog"
+)
+
+// writeTestCert writes a self-signed certificate and its key to dir.
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestReload(t *testing.T) {
+	t.Cleanup(func() { SetupLogger(defaultConfig()) })
+	for _, tc := range []struct {
+		name string
+		// file is the new configuration file; {tls} is replaced by the
+		// running TLS section.
+		file             string
+		corruptCert      bool
+		wantErr          string
+		applied, restart []string
+		check            func(t *testing.T, cfg Config, p *Pipeline)
+	}{
+		{
+			name:    "applied",
+			file:    "{tls}storage:\n  db_path: /tmp/reload.db\nlogging:\n  level: debug\nprocessing:\n  redact_attributes: [user.email]\n",
+			applied: []string{"logging.level", "processing.redact_attributes"},
+			check: func(t *testing.T, cfg Config, p *Pipeline) {
+				if cfg.LogLevel != "debug" {
+					t.Errorf("log level %q, want debug", cfg.LogLevel)
+				}
+				logs := plog.NewLogs()
+				record := logs.ResourceLogs().AppendEmpty().ScopeLogs().AppendEmpty().LogRecords().AppendEmpty()
+				record.Attributes().PutStr("user.email", "a@example.com")
+				p.processor.Load().Logs(logs)
+				if v, _ := record.Attributes().Get("user.email"); v.Str() != redactedValue {
+					t.Errorf("user.email %q, want it redacted", v.Str())
+				}
+			},
+		},
+		{
+			name:    "restart only",
+			file:    "{tls}storage:\n  db_path: /tmp/other.db\n",
+			restart: []string{"storage.db_path"},
+			check: func(t *testing.T, cfg Config, p *Pipeline) {
+				if cfg.DBPath != "/tmp/reload.db" {
+					t.Errorf("db path %q, want the running one", cfg.DBPath)
+				}
+			},
+		},
+		{
+			name:    "TLS turned off",
+			file:    "storage:\n  db_path: /tmp/reload.db\n",
+			restart: []string{"tls.cert_file", "tls.key_file"},
+			check: func(t *testing.T, cfg Config, p *Pipeline) {
+				if cfg.TLSCertFile == "" {
+					t.Error("TLS files dropped from the running configuration")
+				}
+			},
+		},
+		{
+			name:    "invalid file",
+			file:    "{tls}storage:\n  db_path: /tmp/reload.db\nlogging:\n  level: debug\n  colour: true\n",
+			wantErr: "colour",
+		},
+		{
+			name:        "unreadable certificate",
+			file:        "{tls}storage:\n  db_path: /tmp/reload.db\nlogging:\n  level: debug\n",
+			corruptCert: true,
+			wantErr:     "certificate",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			certFile, keyFile := writeTestCert(t, dir)
+			tlsSection := "tls:\n  cert_file: " + certFile + "\n  key_file: " + keyFile + "\n"
+			path := filepath.Join(dir, "receiver.yaml")
+			args := []string{"--config", path}
+			if err := os.WriteFile(path, []byte(tlsSection+"storage:\n  db_path: /tmp/reload.db\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := LoadConfig(args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			serverTLS, err := NewServerTLS(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			runningCert := serverTLS.current.Load().Certificates[0].Certificate[0]
+			pipeline := &Pipeline{}
+			pipeline.SetProcessor(NewProcessor(cfg))
+			r := NewReloader(cfg, args, pipeline, NewTenantResolver(cfg), serverTLS, NewRetention(nil, cfg.Retention, cfg.RetentionInterval), nil)
+
+			if err := os.WriteFile(path, []byte(strings.ReplaceAll(tc.file, "{tls}", tlsSection)), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if tc.corruptCert {
+				if err := os.WriteFile(certFile, []byte("not a certificate"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			applied, restart, err := r.reload()
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("reload: %v, want an error about %s", err, tc.wantErr)
+				}
+				if !reflect.DeepEqual(r.cfg, cfg) {
+					t.Errorf("running configuration changed after a failed reload")
+				}
+				if got := serverTLS.current.Load().Certificates[0].Certificate[0]; string(got) != string(runningCert) {
+					t.Errorf("TLS certificate replaced after a failed reload")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(applied, tc.applied) || !reflect.DeepEqual(restart, tc.restart) {
+				t.Errorf("applied %v, restart %v; want %v, %v", applied, restart, tc.applied, tc.restart)
+			}
+			tc.check(t, r.cfg, pipeline)
+		})
+	}
+}
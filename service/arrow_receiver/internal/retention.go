@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Retention periodically deletes telemetry older than the retention period:
+// spans by end time, log records by time and metric points by time. The
+// search terms of deleted log records go with them.
+type Retention struct {
+	db *sql.DB
+
+	mu       sync.Mutex
+	age      time.Duration
+	interval time.Duration
+	changed  chan struct{}
+
+	stop chan struct{}
+	once sync.Once
+}
+
+func NewRetention(db *sql.DB, age, interval time.Duration) *Retention {
+	return &Retention{db: db, age: age, interval: interval, changed: make(chan struct{}, 1), stop: make(chan struct{})}
+}
+
+// Start expires rows now and then every interval until Shutdown. Nothing
+// is deleted while the retention period is zero.
+func (r *Retention) Start() {
+	go func() {
+		for {
+			age, interval := r.settings()
+			var tick <-chan time.Time
+			if age > 0 {
+				if err := r.expire(context.Background(), age); err != nil {
+					log.WithError(err).Error("Error deleting expired telemetry")
+				}
+				tick = time.After(interval)
+			}
+			select {
+			case <-tick:
+			case <-r.changed:
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Set changes the retention period and interval; expired rows are deleted
+// right away.
+func (r *Retention) Set(age, interval time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if age == r.age && interval == r.interval {
+		return
+	}
+	r.age, r.interval = age, interval
+	select {
+	case r.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Retention) settings() (age, interval time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.age, r.interval
+}
+
+func (r *Retention) Shutdown() {
+	r.once.Do(func() { close(r.stop) })
+}
+
+// expire deletes the rows older than the retention period in one
+// transaction.
+func (r *Retention) expire(ctx context.Context, age time.Duration) error {
+	cutoff := time.Now().Add(-age)
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(`DELETE FROM log_terms WHERE search_id IN (SELECT search_id FROM logs WHERE %s < ?)`, logTimeSQL), cutoff.UnixNano()); err != nil {
+		return err
+	}
+	deleted, total := log.Fields{}, int64(0)
+	for _, t := range []struct{ table, time string }{
+		{"traces", unixNanosSQL("end_time_unix_nano")},
+		{"logs", logTimeSQL},
+		{"metrics", unixNanosSQL("time_unix_nano")},
+	} {
+		res, err := tx.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s WHERE %s < ?`, t.table, t.time), cutoff.UnixNano())
+		if err != nil {
+			return err
+		}
+		n, _ := res.RowsAffected()
+		deleted[t.table] = n
+		total += n
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if total > 0 {
+		log.WithFields(deleted).WithField("before", cutoff.UTC().Format(time.RFC3339)).Info("Deleted expired telemetry")
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"sync/atomic"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// tracer records the receiver's own spans. It is a no-op unless
+// StartSelfTracing enabled self-tracing.
+var tracer trace.Tracer = noop.NewTracerProvider().Tracer("")
+
+// selfTraceGuard marks the contexts of the self-trace exporter. Spans are
+// never started under it, so storing self-spans cannot create more.
+type selfTraceGuard struct{}
+
+// startSpan starts a self-tracing span unless ctx belongs to the exporter.
+func startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if ctx.Value(selfTraceGuard{}) != nil {
+		return ctx, noop.Span{}
+	}
+	return tracer.Start(ctx, name, opts...)
+}
+
+// endSpan records err, if any, on the span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// SelfTracing traces stream receive, Arrow decode, storage insert and query
+// execution into the receiver's own traces table.
+type SelfTracing struct {
+	provider *sdktrace.TracerProvider
+	sampler  *ratioSampler
+}
+
+// StartSelfTracing installs the tracer when cfg enables self-tracing. The
+// spans are batched and written to the traces table of cfg's self-tracing
+// tenant under the configured service name. It returns nil when disabled.
+func StartSelfTracing(cfg Config, db *sql.DB) (*SelfTracing, error) {
+	if !cfg.SelfTracing {
+		return nil, nil
+	}
+	ctx := context.WithValue(context.Background(), selfTraceGuard{}, true)
+	rows, err := NewRowWriter(ctx, db, NewLogIndex(cfg))
+	if err != nil {
+		return nil, err
+	}
+	attrs := []attribute.KeyValue{attribute.String("service.name", cfg.SelfTracingServiceName)}
+	if host, err := os.Hostname(); err == nil {
+		attrs = append(attrs, attribute.String("host.name", host))
+	}
+	sampler := &ratioSampler{}
+	sampler.set(cfg.SelfTracingSampleRatio)
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(&selfTraceExporter{rows: rows, tenant: cfg.SelfTracingTenant}),
+		sdktrace.WithResource(resource.NewSchemaless(attrs...)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+	)
+	tracer = provider.Tracer("tonbo/arrow_receiver")
+	return &SelfTracing{provider: provider, sampler: sampler}, nil
+}
+
+// SetSampleRatio changes the share of batches and requests traced. It is a
+// no-op on a nil SelfTracing.
+func (s *SelfTracing) SetSampleRatio(ratio float64) {
+	if s != nil {
+		s.sampler.set(ratio)
+	}
+}
+
+// Shutdown writes the buffered spans and stops tracing. It is a no-op on a
+// nil SelfTracing.
+func (s *SelfTracing) Shutdown(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	return s.provider.Shutdown(context.WithValue(ctx, selfTraceGuard{}, true))
+}
+
+// ratioSampler samples root spans by trace ID at a ratio that can change
+// while running.
+type ratioSampler struct {
+	current atomic.Pointer[sdktrace.Sampler]
+}
+
+func (s *ratioSampler) set(ratio float64) {
+	sampler := sdktrace.TraceIDRatioBased(ratio)
+	s.current.Store(&sampler)
+}
+
+func (s *ratioSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	return (*s.current.Load()).ShouldSample(p)
+}
+
+func (s *ratioSampler) Description() string {
+	return (*s.current.Load()).Description()
+}
+
+// selfTraceExporter writes finished spans to the traces table.
+type selfTraceExporter struct {
+	rows   *RowWriter
+	tenant string
+}
+
+func (e *selfTraceExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	ctx = context.WithValue(ctx, selfTraceGuard{}, true)
+	return e.rows.Write(ctx, RowBatch{Traces: TracesToRows(spansToTraces(spans), e.tenant)})
+}
+
+func (e *selfTraceExporter) Shutdown(context.Context) error {
+	return e.rows.Close()
+}
+
+// spansToTraces converts SDK spans to pdata so they are stored exactly like
+// received ones.
+func spansToTraces(spans []sdktrace.ReadOnlySpan) ptrace.Traces {
+	traces := ptrace.NewTraces()
+	scopes := map[*resource.Resource]ptrace.ScopeSpans{}
+	for _, s := range spans {
+		ss, ok := scopes[s.Resource()]
+		if !ok {
+			rs := traces.ResourceSpans().AppendEmpty()
+			putAttributes(rs.Resource().Attributes(), s.Resource().Attributes())
+			ss = rs.ScopeSpans().AppendEmpty()
+			ss.Scope().SetName(s.InstrumentationScope().Name)
+			ss.Scope().SetVersion(s.InstrumentationScope().Version)
+			scopes[s.Resource()] = ss
+		}
+		span := ss.Spans().AppendEmpty()
+		span.SetTraceID(pcommon.TraceID(s.SpanContext().TraceID()))
+		span.SetSpanID(pcommon.SpanID(s.SpanContext().SpanID()))
+		if s.Parent().IsValid() {
+			span.SetParentSpanID(pcommon.SpanID(s.Parent().SpanID()))
+		}
+		span.SetName(s.Name())
+		// The SDK and OTLP number span kinds the same way.
+		span.SetKind(ptrace.SpanKind(s.SpanKind()))
+		span.SetStartTimestamp(pcommon.NewTimestampFromTime(s.StartTime()))
+		span.SetEndTimestamp(pcommon.NewTimestampFromTime(s.EndTime()))
+		putAttributes(span.Attributes(), s.Attributes())
+		span.SetDroppedAttributesCount(uint32(s.DroppedAttributes()))
+		switch s.Status().Code {
+		case codes.Ok:
+			span.Status().SetCode(ptrace.StatusCodeOk)
+		case codes.Error:
+			span.Status().SetCode(ptrace.StatusCodeError)
+			span.Status().SetMessage(s.Status().Description)
+		}
+		for _, e := range s.Events() {
+			event := span.Events().AppendEmpty()
+			event.SetName(e.Name)
+			event.SetTimestamp(pcommon.NewTimestampFromTime(e.Time))
+			putAttributes(event.Attributes(), e.Attributes)
+		}
+		span.SetDroppedEventsCount(uint32(s.DroppedEvents()))
+		for _, l := range s.Links() {
+			link := span.Links().AppendEmpty()
+			link.SetTraceID(pcommon.TraceID(l.SpanContext.TraceID()))
+			link.SetSpanID(pcommon.SpanID(l.SpanContext.SpanID()))
+			putAttributes(link.Attributes(), l.Attributes)
+		}
+		span.SetDroppedLinksCount(uint32(s.DroppedLinks()))
+	}
+	return traces
+}
+
+func putAttributes(m pcommon.Map, attrs []attribute.KeyValue) {
+	for _, kv := range attrs {
+		key := string(kv.Key)
+		switch kv.Value.Type() {
+		case attribute.BOOL:
+			m.PutBool(key, kv.Value.AsBool())
+		case attribute.INT64:
+			m.PutInt(key, kv.Value.AsInt64())
+		case attribute.FLOAT64:
+			m.PutDouble(key, kv.Value.AsFloat64())
+		case attribute.STRING:
+			m.PutStr(key, kv.Value.AsString())
+		default:
+			m.PutStr(key, kv.Value.Emit())
+		}
+	}
+}
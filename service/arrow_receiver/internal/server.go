@@ -1,24 +1,167 @@
 package internal
 
 import (
-	"database/sql"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"net"
+	"os"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/stats"
 
 	arrowpb "github.com/open-telemetry/otel-arrow/api/experimental/arrow/v1"
 )
 
-func NewGRPCServer(cfg Config, db *sql.DB) (*grpc.Server, net.Listener) {
+// NewGRPCServer serves the Arrow ingestion services, health and, unless it
+// has its own port, Flight SQL. flightSQL may be nil.
+func NewGRPCServer(cfg Config, pipeline *Pipeline, memory *MemoryBudget, health *Health, flightSQL *FlightSQLServer, tenants *TenantResolver, serverTLS *ServerTLS) (*grpc.Server, net.Listener) {
 	lis, err := net.Listen("tcp", cfg.GRPCPort)
 	if err != nil {
 		log.WithError(err).Fatal("failed to listen")
 	}
-	grpcServer := grpc.NewServer()
-	handler := NewArrowHandler(db)
+	grpcServer := grpc.NewServer(grpcServerOptions(cfg, serverTLS)...)
+	handler := NewArrowHandler(cfg, pipeline, memory, tenants)
 	arrowpb.RegisterArrowTracesServiceServer(grpcServer, handler)
 	arrowpb.RegisterArrowLogsServiceServer(grpcServer, handler)
 	arrowpb.RegisterArrowMetricsServiceServer(grpcServer, handler)
+	health.Register(grpcServer)
+	if flightSQL != nil && cfg.FlightSQLPort == "" {
+		flightSQL.Register(grpcServer)
+	}
+	if cfg.GRPCReflection {
+		reflection.Register(grpcServer)
+	}
+	return grpcServer, lis
+}
+
+// NewFlightSQLGRPCServer serves Flight SQL on cfg.FlightSQLPort.
+func NewFlightSQLGRPCServer(cfg Config, flightSQL *FlightSQLServer, serverTLS *ServerTLS) (*grpc.Server, net.Listener) {
+	lis, err := net.Listen("tcp", cfg.FlightSQLPort)
+	if err != nil {
+		log.WithError(err).Fatal("failed to listen for Flight SQL")
+	}
+	grpcServer := grpc.NewServer(grpcServerOptions(cfg, serverTLS)...)
+	flightSQL.Register(grpcServer)
+	if cfg.GRPCReflection {
+		reflection.Register(grpcServer)
+	}
 	return grpcServer, lis
-} 
\ No newline at end of file
+}
+
+func grpcServerOptions(cfg Config, serverTLS *ServerTLS) []grpc.ServerOption {
+	opts := []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(cfg.GRPCMaxRecvMsgBytes),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             cfg.GRPCKeepaliveMinTime,
+			PermitWithoutStream: cfg.GRPCKeepalivePermitWithoutStream,
+		}),
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			MaxConnectionIdle:     cfg.GRPCMaxConnectionIdle,
+			MaxConnectionAge:      cfg.GRPCMaxConnectionAge,
+			MaxConnectionAgeGrace: cfg.GRPCMaxConnectionAgeGrace,
+			Time:                  cfg.GRPCKeepaliveTime,
+			Timeout:               cfg.GRPCKeepaliveTimeout,
+		}),
+		grpc.StatsHandler(connStartHandler{}),
+	}
+	if cfg.GRPCMaxConcurrentStreams > 0 {
+		opts = append(opts, grpc.MaxConcurrentStreams(uint32(cfg.GRPCMaxConcurrentStreams)))
+	}
+	if serverTLS != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(serverTLS.Config())))
+	}
+	return opts
+}
+
+// ServerTLS holds the certificate and client CAs of the gRPC and HTTP
+// listeners. Load swaps them for the connections accepted afterwards.
+type ServerTLS struct {
+	current atomic.Pointer[tls.Config]
+}
+
+// NewServerTLS loads the TLS files of cfg. It returns nil when TLS is off.
+func NewServerTLS(cfg Config) (*ServerTLS, error) {
+	if cfg.TLSCertFile == "" {
+		return nil, nil
+	}
+	t := &ServerTLS{}
+	return t, t.Load(cfg)
+}
+
+// Load reads the certificate, key and client CAs of cfg. On error the
+// previous ones stay in use.
+func (t *ServerTLS) Load(cfg Config) error {
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if cfg.TLSClientCAFile != "" {
+		tlsConfig.ClientCAs, err = loadCertPool(cfg.TLSClientCAFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	t.current.Store(tlsConfig)
+	return nil
+}
+
+// Config returns a TLS configuration that uses the files last loaded.
+func (t *ServerTLS) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return t.current.Load(), nil
+		},
+	}
+}
+
+// loadCertPool reads the PEM certificates of a CA bundle.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New(path + " holds no PEM certificate")
+	}
+	return pool, nil
+}
+
+type connStartKey struct{}
+
+// connStartHandler records when each connection was accepted so streams can
+// end themselves when their connection reaches its max age.
+type connStartHandler struct{}
+
+func (connStartHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return context.WithValue(ctx, connStartKey{}, time.Now())
+}
+
+func (connStartHandler) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (connStartHandler) HandleConn(context.Context, stats.ConnStats) {}
+
+func (connStartHandler) HandleRPC(context.Context, stats.RPCStats) {}
+
+// connStart returns when the connection of a stream was accepted.
+func connStart(ctx context.Context) (time.Time, bool) {
+	t, ok := ctx.Value(connStartKey{}).(time.Time)
+	return t, ok
+}
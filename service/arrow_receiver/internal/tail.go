@@ -0,0 +1,478 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	ptrace "go.opentelemetry.io/collector/pdata/ptrace"
+	"golang.org/x/net/websocket"
+)
+
+// tailKeepalive is how often an idle Server-Sent Events stream gets a
+// comment, so proxies do not time it out.
+const tailKeepalive = 15 * time.Second
+
+// tailWriteTimeout bounds a write to a live-tail client; a client that
+// stops reading is disconnected.
+const tailWriteTimeout = 10 * time.Second
+
+var (
+	ErrTooManyTailClients = errors.New("too many live-tail clients")
+	ErrLiveTailClosed     = errors.New("live tail is shutting down")
+)
+
+// severityNumbers maps severity names to the lowest OTLP severity number of
+// their range.
+var severityNumbers = map[string]int{
+	"trace": 1,
+	"debug": 5,
+	"info":  9,
+	"warn":  13,
+	"error": 17,
+	"fatal": 21,
+}
+
+// LiveTail hands decoded batches to live-tail clients. Publishing never
+// blocks: every client has a bounded buffer of batches, and batches that
+// arrive while it is full are dropped for that client and counted.
+type LiveTail struct {
+	buffer     int
+	maxClients int
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu      sync.RWMutex
+	clients map[*tailClient]struct{}
+}
+
+func NewLiveTail(cfg Config) *LiveTail {
+	t := &LiveTail{
+		buffer:     cfg.LiveTailBufferBatches,
+		maxClients: cfg.LiveTailMaxClients,
+		closed:     make(chan struct{}),
+		clients:    map[*tailClient]struct{}{},
+	}
+	metrics.gaugeFunc("arrow_receiver_live_tail_clients", "Connected live-tail clients.", nil,
+		func(emit func(float64, ...string)) {
+			t.mu.RLock()
+			defer t.mu.RUnlock()
+			emit(float64(len(t.clients)))
+		})
+	return t
+}
+
+// tailBatch is a decoded batch of one tenant.
+type tailBatch struct {
+	tenant string
+	rows   RowBatch
+}
+
+type tailClient struct {
+	tenant  string
+	admin   bool
+	filter  *tailFilter
+	batches chan tailBatch
+	closed  <-chan struct{}
+	// dropped counts the records dropped since the client was last told;
+	// lost counts all of them.
+	dropped atomic.Int64
+	lost    atomic.Int64
+}
+
+// Subscribe registers a client seeing the batches of tenant, or of all
+// tenants for admins, that pass filter.
+func (t *LiveTail) Subscribe(tenant string, admin bool, filter *tailFilter) (*tailClient, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	select {
+	case <-t.closed:
+		return nil, ErrLiveTailClosed
+	default:
+	}
+	if len(t.clients) >= t.maxClients {
+		return nil, ErrTooManyTailClients
+	}
+	c := &tailClient{tenant: tenant, admin: admin, filter: filter, batches: make(chan tailBatch, t.buffer), closed: t.closed}
+	t.clients[c] = struct{}{}
+	return c, nil
+}
+
+func (t *LiveTail) Unsubscribe(c *tailClient) {
+	t.mu.Lock()
+	delete(t.clients, c)
+	t.mu.Unlock()
+}
+
+// Close ends every live-tail stream and refuses new clients.
+func (t *LiveTail) Close() {
+	t.closeOnce.Do(func() { close(t.closed) })
+}
+
+// Publish offers the rows of a decoded batch to every interested client.
+func (t *LiveTail) Publish(signal Signal, tenant string, rows RowBatch) {
+	if rows.Len() == 0 {
+		return
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for c := range t.clients {
+		if (!c.admin && c.tenant != tenant) || !c.filter.signals[signal] {
+			continue
+		}
+		select {
+		case c.batches <- tailBatch{tenant, rows}:
+		default:
+			c.dropped.Add(int64(rows.Len()))
+			c.lost.Add(int64(rows.Len()))
+		}
+	}
+}
+
+// tailFilter selects the records a live-tail client receives.
+type tailFilter struct {
+	signals map[Signal]bool
+	service string
+	// minSeverity applies to log records only.
+	minSeverity int
+	attributes  map[string]string
+}
+
+// parseTailFilter reads the signal, service, severity and attr parameters.
+func parseTailFilter(q url.Values) (*tailFilter, error) {
+	f := &tailFilter{signals: map[Signal]bool{}, service: q.Get("service"), attributes: map[string]string{}}
+	for _, s := range strings.Split(q.Get("signal"), ",") {
+		switch signal := Signal(strings.TrimSpace(s)); signal {
+		case SignalTraces, SignalLogs, SignalMetrics:
+			f.signals[signal] = true
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown signal %q, use traces, logs or metrics", s)
+		}
+	}
+	if len(f.signals) == 0 {
+		f.signals = map[Signal]bool{SignalTraces: true, SignalLogs: true, SignalMetrics: true}
+	}
+	if s := q.Get("severity"); s != "" {
+		n, ok := severityNumbers[strings.ToLower(s)]
+		if !ok {
+			var err error
+			n, err = strconv.Atoi(s)
+			if err != nil || n < 1 || n > 24 {
+				return nil, fmt.Errorf("invalid severity %q, use a name such as warn or a number from 1 to 24", s)
+			}
+		}
+		f.minSeverity = n
+	}
+	for _, attr := range q["attr"] {
+		key, value, ok := strings.Cut(attr, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid attr %q, use key=value", attr)
+		}
+		f.attributes[key] = value
+	}
+	return f, nil
+}
+
+// matches applies the service and attribute filters. Attributes are looked
+// up on the record first and on its resource second.
+func (f *tailFilter) matches(resource map[string]interface{}, attributes string) bool {
+	if f.service != "" && promLabelValue(resource["service.name"]) != f.service {
+		return false
+	}
+	if len(f.attributes) == 0 {
+		return true
+	}
+	attrs, err := decodeAttributes(json.RawMessage(attributes))
+	if err != nil {
+		return false
+	}
+	for key, want := range f.attributes {
+		v, ok := attrs[key]
+		if !ok {
+			v, ok = resource[key]
+		}
+		if !ok || promLabelValue(v) != want {
+			return false
+		}
+	}
+	return true
+}
+
+// tailRecord is a message to a client. Its type is also the Server-Sent
+// Events event name.
+type tailRecord interface {
+	eventType() string
+}
+
+// tailSpan, tailLog and tailPoint are the records sent to clients.
+type tailSpan struct {
+	Type          string          `json:"type"`
+	Tenant        string          `json:"tenant"`
+	TraceID       string          `json:"trace_id"`
+	SpanID        string          `json:"span_id"`
+	ParentSpanID  string          `json:"parent_span_id,omitempty"`
+	Name          string          `json:"name"`
+	Kind          string          `json:"kind"`
+	Service       string          `json:"service,omitempty"`
+	Status        spanStatus      `json:"status"`
+	StartTime     time.Time       `json:"start_time"`
+	EndTime       time.Time       `json:"end_time"`
+	DurationNanos int64           `json:"duration_ns"`
+	Attributes    json.RawMessage `json:"attributes"`
+	Resource      json.RawMessage `json:"resource"`
+}
+
+type tailLog struct {
+	Type           string          `json:"type"`
+	Tenant         string          `json:"tenant"`
+	Time           time.Time       `json:"time"`
+	SeverityNumber int             `json:"severity_number"`
+	SeverityText   string          `json:"severity_text,omitempty"`
+	Body           string          `json:"body"`
+	Service        string          `json:"service,omitempty"`
+	TraceID        string          `json:"trace_id,omitempty"`
+	SpanID         string          `json:"span_id,omitempty"`
+	Attributes     json.RawMessage `json:"attributes"`
+	Resource       json.RawMessage `json:"resource"`
+}
+
+type tailPoint struct {
+	Type       string          `json:"type"`
+	Tenant     string          `json:"tenant"`
+	Name       string          `json:"name"`
+	Unit       string          `json:"unit,omitempty"`
+	Time       time.Time       `json:"time"`
+	Value      string          `json:"value"`
+	Service    string          `json:"service,omitempty"`
+	Attributes json.RawMessage `json:"attributes"`
+	Resource   json.RawMessage `json:"resource"`
+}
+
+// tailDropped tells a client how many records it missed by reading slowly.
+type tailDropped struct {
+	Type    string `json:"type"`
+	Records int64  `json:"records"`
+}
+
+func (s tailSpan) eventType() string    { return s.Type }
+func (l tailLog) eventType() string     { return l.Type }
+func (p tailPoint) eventType() string   { return p.Type }
+func (d tailDropped) eventType() string { return d.Type }
+
+// records returns the rows of b that pass the filter.
+func (f *tailFilter) records(b tailBatch) []tailRecord {
+	// Rows of a batch share few resources, so each is decoded once.
+	resources := map[string]map[string]interface{}{}
+	resource := func(raw string) map[string]interface{} {
+		attrs, ok := resources[raw]
+		if !ok {
+			attrs, _ = decodeAttributes(json.RawMessage(raw))
+			resources[raw] = attrs
+		}
+		return attrs
+	}
+	var out []tailRecord
+	for _, row := range b.rows.Traces {
+		res := resource(row.Resource)
+		if !f.matches(res, row.Attributes) {
+			continue
+		}
+		start, _ := parseSpanTime(row.StartTime)
+		end, _ := parseSpanTime(row.EndTime)
+		out = append(out, tailSpan{
+			Type: "span", Tenant: b.tenant,
+			TraceID: row.TraceID, SpanID: row.SpanID, ParentSpanID: row.ParentSpanID,
+			Name: row.Name, Kind: ptrace.SpanKind(row.Kind).String(),
+			Service:   promLabelValue(res["service.name"]),
+			Status:    spanStatus{Code: ptrace.StatusCode(row.StatusCode).String(), Message: row.StatusMessage},
+			StartTime: start, EndTime: end, DurationNanos: end.Sub(start).Nanoseconds(),
+			Attributes: json.RawMessage(row.Attributes), Resource: json.RawMessage(row.Resource),
+		})
+	}
+	for _, row := range b.rows.Logs {
+		res := resource(row.Resource)
+		if row.SeverityNumber < f.minSeverity || !f.matches(res, row.Attributes) {
+			continue
+		}
+		t, _ := parseSpanTime(row.TimeUnixNano)
+		if t.UnixNano() == 0 {
+			t, _ = parseSpanTime(row.ObservedTimeUnixNano)
+		}
+		out = append(out, tailLog{
+			Type: "log", Tenant: b.tenant, Time: t,
+			SeverityNumber: row.SeverityNumber, SeverityText: row.SeverityText, Body: row.Body,
+			Service: promLabelValue(res["service.name"]),
+			TraceID: row.TraceID, SpanID: row.SpanID,
+			Attributes: json.RawMessage(row.Attributes), Resource: json.RawMessage(row.Resource),
+		})
+	}
+	for _, row := range b.rows.Metrics {
+		res := resource(row.Resource)
+		if !f.matches(res, row.Attributes) {
+			continue
+		}
+		t, _ := parseSpanTime(row.Time)
+		out = append(out, tailPoint{
+			Type: "metric", Tenant: b.tenant, Name: row.Name, Unit: row.Unit, Time: t, Value: row.Value,
+			Service:    promLabelValue(res["service.name"]),
+			Attributes: json.RawMessage(row.Attributes), Resource: json.RawMessage(row.Resource),
+		})
+	}
+	return out
+}
+
+// tailWriter sends records to a client over one of the transports.
+type tailWriter interface {
+	send(record tailRecord) error
+	flush() error
+	keepalive() error
+}
+
+// stream sends the client's batches until ctx ends, the live tail closes or
+// a write fails.
+func (c *tailClient) stream(ctx context.Context, out tailWriter) error {
+	ticker := time.NewTicker(tailKeepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-c.closed:
+			return nil
+		case <-ticker.C:
+			if err := out.keepalive(); err != nil {
+				return err
+			}
+		case b := <-c.batches:
+			if n := c.dropped.Swap(0); n > 0 {
+				if err := out.send(tailDropped{Type: "dropped", Records: n}); err != nil {
+					return err
+				}
+			}
+			for _, record := range c.filter.records(b) {
+				if err := out.send(record); err != nil {
+					return err
+				}
+			}
+			if err := out.flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sseWriter writes Server-Sent Events.
+type sseWriter struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func (s sseWriter) send(record tailRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.rc.SetWriteDeadline(time.Now().Add(tailWriteTimeout))
+	_, err = fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", record.eventType(), data)
+	return err
+}
+
+func (s sseWriter) flush() error {
+	return s.rc.Flush()
+}
+
+func (s sseWriter) keepalive() error {
+	s.rc.SetWriteDeadline(time.Now().Add(tailWriteTimeout))
+	if _, err := s.w.Write([]byte(": keepalive\n\n")); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+// wsWriter sends every record as a WebSocket text message.
+type wsWriter struct {
+	ws *websocket.Conn
+}
+
+func (s wsWriter) send(record tailRecord) error {
+	s.ws.SetWriteDeadline(time.Now().Add(tailWriteTimeout))
+	return websocket.JSON.Send(s.ws, record)
+}
+
+func (s wsWriter) flush() error     { return nil }
+func (s wsWriter) keepalive() error { return nil }
+
+// handleTail streams the spans, log records and metric points the caller
+// may see as they are decoded, before they are stored. It speaks
+// Server-Sent Events, or WebSocket when the client asks for an upgrade.
+func (a *queryAPI) handleTail(w http.ResponseWriter, r *http.Request) {
+	tenant, admin, ok := a.getCaller(w, r)
+	if !ok {
+		return
+	}
+	filter, err := parseTailFilter(r.URL.Query())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	client, err := a.tail.Subscribe(tenant, admin, filter)
+	if err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	defer a.tail.Unsubscribe(client)
+	logger := log.WithFields(log.Fields{"tenant": tenant, "admin": admin, "remote_addr": r.RemoteAddr})
+	logger.Info("Live tail started")
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		err = a.tailWebSocket(w, r, client)
+	} else {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		// Send the headers now, so the client sees the stream open before
+		// the first record or keepalive.
+		rc := http.NewResponseController(w)
+		if err = rc.Flush(); err == nil {
+			err = client.stream(r.Context(), sseWriter{w, rc})
+		}
+	}
+	logger = logger.WithField("dropped_records", client.lost.Load())
+	if err != nil {
+		logger = logger.WithError(err)
+	}
+	logger.Info("Live tail ended")
+}
+
+// tailWebSocket upgrades the request and streams to the client until it
+// closes the connection. Messages from the client are ignored.
+func (a *queryAPI) tailWebSocket(w http.ResponseWriter, r *http.Request, client *tailClient) error {
+	var err error
+	websocket.Server{Handshake: func(_ *websocket.Config, r *http.Request) error {
+		if !a.originAllowed(r) {
+			return fmt.Errorf("origin %q is not allowed", r.Header.Get("Origin"))
+		}
+		return nil
+	}, Handler: func(ws *websocket.Conn) {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		go func() {
+			defer cancel()
+			var msg []byte
+			for websocket.Message.Receive(ws, &msg) == nil {
+			}
+		}()
+		err = client.stream(ctx, wsWriter{ws})
+	}}.ServeHTTP(w, r)
+	return err
+}
@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// queuedBatches drains the batches queued for c.
+func queuedBatches(c *tailClient) []tailBatch {
+	var out []tailBatch
+	for {
+		select {
+		case b := <-c.batches:
+			out = append(out, b)
+		default:
+			return out
+		}
+	}
+}
+
+func TestLiveTailPublishIsolatesTenants(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.LiveTailBufferBatches = 8
+	tail := NewLiveTail(cfg)
+	all, _ := parseTailFilter(url.Values{})
+	logsOnly, _ := parseTailFilter(url.Values{"signal": {"logs"}})
+	acme, err := tail.Subscribe("acme", false, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acmeLogs, _ := tail.Subscribe("acme", false, logsOnly)
+	admin, _ := tail.Subscribe("admin", true, all)
+
+	tail.Publish(SignalTraces, "globex", RowBatch{Traces: TracesToRows(jaegerTestTraces(), "globex")})
+	tail.Publish(SignalTraces, "acme", RowBatch{Traces: TracesToRows(jaegerTestTraces(), "acme")})
+	tail.Publish(SignalLogs, "globex", RowBatch{Logs: LogsToRows(lokiTestLogs(time.Unix(1700000000, 0)), "globex")})
+	tail.Publish(SignalLogs, "acme", RowBatch{Logs: LogsToRows(lokiTestLogs(time.Unix(1700000000, 0)), "acme")})
+	tail.Publish(SignalLogs, "acme", RowBatch{})
+
+	for _, c := range []struct {
+		name   string
+		client *tailClient
+		want   []string
+	}{
+		{"acme", acme, []string{"acme", "acme"}},
+		{"acme logs", acmeLogs, []string{"acme"}},
+		{"admin", admin, []string{"globex", "acme", "globex", "acme"}},
+	} {
+		var tenants []string
+		for _, b := range queuedBatches(c.client) {
+			tenants = append(tenants, b.tenant)
+			for _, row := range b.rows.Traces {
+				if !c.client.admin && row.TenantID != c.client.tenant {
+					t.Errorf("%s got a span of %s", c.name, row.TenantID)
+				}
+			}
+		}
+		if strings.Join(tenants, " ") != strings.Join(c.want, " ") {
+			t.Errorf("%s got batches of %q, want %q", c.name, tenants, c.want)
+		}
+	}
+}
+
+func TestLiveTailDropsForSlowClients(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.LiveTailBufferBatches = 1
+	tail := NewLiveTail(cfg)
+	filter, _ := parseTailFilter(url.Values{})
+	c, _ := tail.Subscribe("acme", false, filter)
+	rows := RowBatch{Traces: TracesToRows(jaegerTestTraces(), "acme")}
+	tail.Publish(SignalTraces, "acme", rows)
+	tail.Publish(SignalTraces, "acme", rows)
+	if n := len(queuedBatches(c)); n != 1 {
+		t.Errorf("%d batches queued, want 1", n)
+	}
+	if n := c.dropped.Load(); n != int64(rows.Len()) {
+		t.Errorf("%d records dropped, want %d", n, rows.Len())
+	}
+
+	tail.Unsubscribe(c)
+	tail.Close()
+	if _, err := tail.Subscribe("acme", false, filter); err != ErrLiveTailClosed {
+		t.Errorf("Subscribe after Close: %v, want ErrLiveTailClosed", err)
+	}
+}
+
+func TestParseTailFilter(t *testing.T) {
+	f, err := parseTailFilter(url.Values{"signal": {"logs, traces"}, "severity": {"WARN"}, "service": {"api"}, "attr": {"code=500"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.signals[SignalLogs] || !f.signals[SignalTraces] || f.signals[SignalMetrics] || f.minSeverity != 13 {
+		t.Errorf("parsed %+v", f)
+	}
+	resource := map[string]interface{}{"service.name": "api"}
+	if !f.matches(resource, `{"code": 500}`) || f.matches(resource, `{"code": 200}`) || f.matches(map[string]interface{}{}, `{"code": 500}`) {
+		t.Error("filter does not apply service and attr")
+	}
+	for _, q := range []url.Values{
+		{"signal": {"events"}},
+		{"severity": {"loud"}},
+		{"severity": {"25"}},
+		{"attr": {"code"}},
+	} {
+		if _, err := parseTailFilter(q); err == nil {
+			t.Errorf("parseTailFilter(%v) succeeded, want an error", q)
+		}
+	}
+}
+
+// TestTailStream reads the Server-Sent Events of a tenant while batches of
+// two tenants are published.
+func TestTailStream(t *testing.T) {
+	a := newTestQueryAPI(t, defaultConfig(), RowBatch{})
+	srv := httptest.NewServer(http.HandlerFunc(a.handleTail))
+	defer srv.Close()
+	defer a.tail.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"?signal=traces", nil)
+	req.Header.Set("X-Tenant-ID", "acme")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || ct != "text/event-stream" {
+		t.Fatalf("status %d, content type %q", resp.StatusCode, ct)
+	}
+
+	// The handler subscribes before it sends the headers.
+	a.tail.Publish(SignalTraces, "globex", RowBatch{Traces: TracesToRows(jaegerTestTraces(), "globex")})
+	a.tail.Publish(SignalTraces, "acme", RowBatch{Traces: TracesToRows(jaegerTestTraces(), "acme")})
+	scanner := bufio.NewScanner(resp.Body)
+	spans := 0
+	for spans < 3 && scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var span tailSpan
+		if err := json.Unmarshal([]byte(data), &span); err != nil {
+			t.Fatal(err)
+		}
+		if span.Type != "span" || span.Tenant != "acme" {
+			t.Fatalf("got %s", data)
+		}
+		spans++
+	}
+	if spans != 3 {
+		t.Errorf("%d spans, want 3: %v", spans, scanner.Err())
+	}
+}
@@ -0,0 +1,587 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	ptrace "go.opentelemetry.io/collector/pdata/ptrace"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// tempoPrefix is where the Tempo API is served; Grafana's Tempo data source
+// takes it as part of its URL. The Jaeger API already owns /api/traces.
+const tempoPrefix = "/tempo"
+
+// defaultSpansPerSpanSet is how many matched spans a Tempo search returns
+// per trace when the request has no spss.
+const defaultSpansPerSpanSet = 3
+
+const protobufMediaType = "application/protobuf"
+
+// tempoIntrinsics are the intrinsic fields of the supported TraceQL subset.
+var tempoIntrinsics = []string{"duration", "kind", "name", "status"}
+
+type tempoSearchResponse struct {
+	Traces  []tempoTrace `json:"traces"`
+	Metrics tempoMetrics `json:"metrics"`
+}
+
+type tempoMetrics struct {
+	InspectedTraces int    `json:"inspectedTraces"`
+	InspectedBytes  string `json:"inspectedBytes"`
+}
+
+type tempoTrace struct {
+	TraceID           string         `json:"traceID"`
+	RootServiceName   string         `json:"rootServiceName"`
+	RootTraceName     string         `json:"rootTraceName"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	DurationMs        int64          `json:"durationMs"`
+	SpanSet           *tempoSpanSet  `json:"spanSet,omitempty"`
+	SpanSets          []tempoSpanSet `json:"spanSets"`
+}
+
+type tempoSpanSet struct {
+	Spans   []tempoSpan `json:"spans"`
+	Matched int         `json:"matched"`
+}
+
+type tempoSpan struct {
+	SpanID            string           `json:"spanID"`
+	Name              string           `json:"name"`
+	StartTimeUnixNano string           `json:"startTimeUnixNano"`
+	DurationNanos     string           `json:"durationNanos"`
+	Attributes        []tempoAttribute `json:"attributes,omitempty"`
+}
+
+type tempoAttribute struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+type tempoTagValue struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// jsonTypes maps DuckDB's json_type to the tag value types of Tempo.
+var jsonTypes = map[string]string{
+	"VARCHAR": "string",
+	"BIGINT":  "int",
+	"UBIGINT": "int",
+	"DOUBLE":  "float",
+	"BOOLEAN": "bool",
+}
+
+// handleTempoEcho answers the connection test of Grafana's data source.
+func (a *queryAPI) handleTempoEcho(w http.ResponseWriter, r *http.Request) {
+	if a.cors(w, r, "GET") {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("echo"))
+}
+
+func isTempoV2(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, tempoPrefix+"/api/v2/")
+}
+
+// handleTempoTrace returns a trace as OTLP, in protobuf when the client
+// accepts it and in JSON otherwise. The v1 body is Tempo's Trace message,
+// whose wire format is OTLP's TracesData; v2 wraps it in a response message.
+func (a *queryAPI) handleTempoTrace(w http.ResponseWriter, r *http.Request) {
+	tenant, admin, ok := a.getCaller(w, r)
+	if !ok {
+		return
+	}
+	traceID, err := jaegerTraceID(r.PathValue("traceId"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "trace ID must be up to 32 hex digits")
+		return
+	}
+	ctx, conn, logger, done := a.readRequest(w, r, tenant, admin)
+	if conn == nil {
+		return
+	}
+	defer done()
+	spans, _, err := loadTraceSpans(ctx, conn, []string{traceID}, a.cfg.QueryMaxRows)
+	if err != nil {
+		writeQueryError(ctx, w, r, err, logger)
+		return
+	}
+	if len(spans) == 0 {
+		writeJSONError(w, http.StatusNotFound, "trace not found")
+		return
+	}
+	traces, err := toOTLPTraces(spans)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		logger.WithError(err).Error("converting trace failed")
+		return
+	}
+	if strings.Contains(r.Header.Get("Accept"), protobufMediaType) {
+		body, err := (&ptrace.ProtoMarshaler{}).MarshalTraces(traces)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if isTempoV2(r) {
+			body = protowire.AppendBytes(protowire.AppendTag(nil, 1, protowire.BytesType), body)
+		}
+		w.Header().Set("Content-Type", protobufMediaType)
+		w.Write(body)
+		return
+	}
+	body, err := (&ptrace.JSONMarshaler{}).MarshalTraces(traces)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if isTempoV2(r) {
+		fmt.Fprintf(w, `{"trace":%s}`, body)
+		return
+	}
+	// Tempo names the resource spans of its Trace message "batches".
+	w.Write(bytes.Replace(body, []byte(`"resourceSpans":`), []byte(`"batches":`), 1))
+}
+
+// toOTLPTraces rebuilds OTLP traces from stored spans, grouping them by
+// resource and scope.
+func toOTLPTraces(spans []*traceSpan) (ptrace.Traces, error) {
+	traces := ptrace.NewTraces()
+	resources := map[string]ptrace.ResourceSpans{}
+	scopes := map[string]ptrace.ScopeSpans{}
+	for _, s := range spans {
+		resourceKey := string(s.Resource) + "\x00" + s.SchemaURL
+		rs, ok := resources[resourceKey]
+		if !ok {
+			rs = traces.ResourceSpans().AppendEmpty()
+			rs.SetSchemaUrl(s.SchemaURL)
+			if err := setOTLPAttributes(rs.Resource().Attributes(), s.Resource); err != nil {
+				return traces, fmt.Errorf("span %s: resource: %w", s.SpanID, err)
+			}
+			resources[resourceKey] = rs
+		}
+		scopeKey := resourceKey + "\x00" + string(s.Scope)
+		ss, ok := scopes[scopeKey]
+		if !ok {
+			ss = rs.ScopeSpans().AppendEmpty()
+			if err := setOTLPAttributes(ss.Scope().Attributes(), s.Scope); err != nil {
+				return traces, fmt.Errorf("span %s: scope: %w", s.SpanID, err)
+			}
+			scopes[scopeKey] = ss
+		}
+		span := ss.Spans().AppendEmpty()
+		if err := fillOTLPSpan(span, s); err != nil {
+			return traces, fmt.Errorf("span %s: %w", s.SpanID, err)
+		}
+	}
+	return traces, nil
+}
+
+func fillOTLPSpan(span ptrace.Span, s *traceSpan) error {
+	var traceID pcommon.TraceID
+	var spanID, parentID pcommon.SpanID
+	if err := decodeID(traceID[:], s.TraceID); err != nil {
+		return err
+	}
+	if err := decodeID(spanID[:], s.SpanID); err != nil {
+		return err
+	}
+	if err := decodeID(parentID[:], s.ParentSpanID); err != nil {
+		return err
+	}
+	span.SetTraceID(traceID)
+	span.SetSpanID(spanID)
+	span.SetParentSpanID(parentID)
+	span.SetName(s.Name)
+	span.SetKind(s.kind)
+	span.TraceState().FromRaw(s.TraceState)
+	span.Status().SetCode(s.statusCode)
+	span.Status().SetMessage(s.Status.Message)
+	span.SetStartTimestamp(pcommon.NewTimestampFromTime(s.StartTime))
+	span.SetEndTimestamp(pcommon.NewTimestampFromTime(s.EndTime))
+	span.SetDroppedAttributesCount(uint32(s.DroppedAttributesCount))
+	span.SetDroppedEventsCount(uint32(s.DroppedEventsCount))
+	span.SetDroppedLinksCount(uint32(s.DroppedLinksCount))
+	if err := setOTLPAttributes(span.Attributes(), s.Attributes); err != nil {
+		return fmt.Errorf("attributes: %w", err)
+	}
+	for _, e := range s.Events {
+		event := span.Events().AppendEmpty()
+		event.SetName(e.Name)
+		event.SetTimestamp(pcommon.NewTimestampFromTime(e.Time))
+		event.SetDroppedAttributesCount(uint32(e.DroppedAttributesCount))
+		if err := event.Attributes().FromRaw(otlpRaw(e.Attributes).(map[string]interface{})); err != nil {
+			return fmt.Errorf("event %q: %w", e.Name, err)
+		}
+	}
+	for _, l := range s.Links {
+		link := span.Links().AppendEmpty()
+		var linkTrace pcommon.TraceID
+		var linkSpan pcommon.SpanID
+		if err := decodeID(linkTrace[:], l.TraceID); err != nil {
+			return err
+		}
+		if err := decodeID(linkSpan[:], l.SpanID); err != nil {
+			return err
+		}
+		link.SetTraceID(linkTrace)
+		link.SetSpanID(linkSpan)
+		link.TraceState().FromRaw(l.TraceState)
+		link.SetDroppedAttributesCount(uint32(l.DroppedAttributesCount))
+		if err := link.Attributes().FromRaw(otlpRaw(l.Attributes).(map[string]interface{})); err != nil {
+			return fmt.Errorf("link: %w", err)
+		}
+	}
+	return nil
+}
+
+// decodeID decodes a hex ID into dst; an empty ID leaves dst zero.
+func decodeID(dst []byte, id string) error {
+	if id == "" {
+		return nil
+	}
+	if n, err := hex.Decode(dst, []byte(id)); err != nil || n != len(dst) {
+		return fmt.Errorf("invalid ID %q", id)
+	}
+	return nil
+}
+
+func setOTLPAttributes(dst pcommon.Map, raw json.RawMessage) error {
+	attrs, err := decodeAttributes(raw)
+	if err != nil {
+		return err
+	}
+	return dst.FromRaw(otlpRaw(attrs).(map[string]interface{}))
+}
+
+// otlpRaw converts the json.Number values of decoded attributes to the
+// int64 and float64 pcommon.Map.FromRaw expects.
+func otlpRaw(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			out[key] = otlpRaw(item)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = otlpRaw(item)
+		}
+		return out
+	}
+	return v
+}
+
+// handleTempoSearch runs a TraceQL query given in q. start and end (Unix
+// seconds) and minDuration and maxDuration apply to whole traces; spss
+// bounds the matched spans returned per trace.
+func (a *queryAPI) handleTempoSearch(w http.ResponseWriter, r *http.Request) {
+	tenant, admin, ok := a.getCaller(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	if q.Get("tags") != "" && q.Get("q") == "" {
+		writeJSONError(w, http.StatusBadRequest, "tag search is not supported, use a TraceQL query in q")
+		return
+	}
+	query, err := parseTraceQL(q.Get("q"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	search := &traceSearch{match: query.traces, matchArgs: query.tracesArgs}
+	for _, bound := range []struct{ param, expr string }{
+		{"minDuration", "max(end_ns) - min(start_ns) >= ?"},
+		{"maxDuration", "max(end_ns) - min(start_ns) <= ?"},
+	} {
+		if v := q.Get(bound.param); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("%s: %v", bound.param, err))
+				return
+			}
+			search.having = append(search.having, bound.expr)
+			search.havingArgs = append(search.havingArgs, d.Nanoseconds())
+		}
+	}
+	for _, bound := range []struct{ param, expr string }{
+		{"start", "max(end_ns) >= ?"},
+		{"end", "min(start_ns) <= ?"},
+	} {
+		if v := q.Get(bound.param); v != "" {
+			secs, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, bound.param+" must be Unix seconds")
+				return
+			}
+			search.having = append(search.having, bound.expr)
+			search.havingArgs = append(search.havingArgs, secs*int64(time.Second))
+		}
+	}
+	limit, spss := defaultTraceSearchLimit, defaultSpansPerSpanSet
+	for _, param := range []struct {
+		name string
+		dst  *int
+	}{{"limit", &limit}, {"spss", &spss}} {
+		if v := q.Get(param.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				writeJSONError(w, http.StatusBadRequest, param.name+" must be a positive integer")
+				return
+			}
+			*param.dst = n
+		}
+	}
+	search.page = &queryPage{Size: min(limit, a.cfg.QueryMaxRows)}
+	ctx, conn, logger, done := a.readRequest(w, r, tenant, admin)
+	if conn == nil {
+		return
+	}
+	defer done()
+	summaries, _, err := searchTraces(ctx, conn, search)
+	if err != nil {
+		writeQueryError(ctx, w, r, err, logger)
+		return
+	}
+	spanSets, err := matchedSpans(ctx, conn, query, summaries, spss)
+	if err != nil {
+		writeQueryError(ctx, w, r, err, logger)
+		return
+	}
+	resp := tempoSearchResponse{Traces: make([]tempoTrace, 0, len(summaries)), Metrics: tempoMetrics{InspectedTraces: len(summaries), InspectedBytes: "0"}}
+	for _, s := range summaries {
+		t := tempoTrace{
+			TraceID:           s.TraceID,
+			RootServiceName:   s.RootService,
+			RootTraceName:     s.RootName,
+			StartTimeUnixNano: strconv.FormatInt(s.StartTime.UnixNano(), 10),
+			DurationMs:        s.DurationNanos / int64(time.Millisecond),
+			SpanSets:          []tempoSpanSet{},
+		}
+		if set, ok := spanSets[s.TraceID]; ok {
+			t.SpanSet = set
+			t.SpanSets = append(t.SpanSets, *set)
+		}
+		resp.Traces = append(resp.Traces, t)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// matchedSpans returns, per trace, the first spss spans that matched one of
+// the spansets of query.
+func matchedSpans(ctx context.Context, conn *TenantConn, query *traceQL, traces []traceSummary, spss int) (map[string]*tempoSpanSet, error) {
+	sets := map[string]*tempoSpanSet{}
+	if len(traces) == 0 {
+		return sets, nil
+	}
+	args := make([]interface{}, 0, len(traces)+len(query.spansArgs)+1)
+	for _, t := range traces {
+		args = append(args, t.TraceID)
+	}
+	args = append(append(args, query.spansArgs...), spss)
+	rows, err := conn.QueryContext(ctx, `
+		WITH spans AS (`+spansSQL+`)
+		SELECT trace_id, span_id, name, coalesce(service, ''), start_ns, end_ns - start_ns,
+			count(*) OVER (PARTITION BY trace_id)
+		FROM spans
+		WHERE trace_id IN (?`+strings.Repeat(", ?", len(traces)-1)+`) AND `+query.spans+`
+		QUALIFY row_number() OVER (PARTITION BY trace_id ORDER BY start_ns, span_id) <= ?
+		ORDER BY trace_id, start_ns, span_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var traceID, service string
+		var span tempoSpan
+		var start, duration int64
+		var matched int
+		if err := rows.Scan(&traceID, &span.SpanID, &span.Name, &service, &start, &duration, &matched); err != nil {
+			return nil, err
+		}
+		span.StartTimeUnixNano = strconv.FormatInt(start, 10)
+		span.DurationNanos = strconv.FormatInt(duration, 10)
+		if service != "" {
+			span.Attributes = []tempoAttribute{{Key: "service.name", Value: map[string]string{"stringValue": service}}}
+		}
+		set, ok := sets[traceID]
+		if !ok {
+			set = &tempoSpanSet{Matched: matched}
+			sets[traceID] = set
+		}
+		set.Spans = append(set.Spans, span)
+	}
+	return sets, rows.Err()
+}
+
+// handleTempoTags lists attribute names. v1 returns them in one list; v2
+// groups them by scope and adds the intrinsics, optionally for one scope.
+func (a *queryAPI) handleTempoTags(w http.ResponseWriter, r *http.Request) {
+	tenant, admin, ok := a.getCaller(w, r)
+	if !ok {
+		return
+	}
+	scope := r.URL.Query().Get("scope")
+	if scope != "" && scope != "all" && scope != "span" && scope != "resource" && scope != "intrinsic" {
+		writeJSONError(w, http.StatusBadRequest, "scope must be span, resource, intrinsic or all")
+		return
+	}
+	ctx, conn, logger, done := a.readRequest(w, r, tenant, admin)
+	if conn == nil {
+		return
+	}
+	defer done()
+	keys := func(column string) ([]string, error) {
+		return queryStrings(ctx, conn, fmt.Sprintf(`
+			SELECT DISTINCT unnest(json_keys(%s)) AS key FROM traces ORDER BY key LIMIT ?`, column), a.cfg.QueryMaxRows)
+	}
+	if !isTempoV2(r) {
+		names, err := queryStrings(ctx, conn, `
+			SELECT key FROM (
+				SELECT unnest(json_keys(attributes)) AS key FROM traces
+				UNION SELECT unnest(json_keys(resource)) FROM traces
+			) ORDER BY key LIMIT ?`, a.cfg.QueryMaxRows)
+		if err != nil {
+			writeQueryError(ctx, w, r, err, logger)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"tagNames": names})
+		return
+	}
+	type tagScope struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}
+	scopes := []tagScope{}
+	for _, s := range []struct{ name, column string }{{"resource", "resource"}, {"span", "attributes"}} {
+		if scope != "" && scope != "all" && scope != s.name {
+			continue
+		}
+		tags, err := keys(s.column)
+		if err != nil {
+			writeQueryError(ctx, w, r, err, logger)
+			return
+		}
+		scopes = append(scopes, tagScope{s.name, tags})
+	}
+	if scope == "" || scope == "all" || scope == "intrinsic" {
+		scopes = append(scopes, tagScope{"intrinsic", tempoIntrinsics})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"scopes": scopes})
+}
+
+// handleTempoTagValues lists the values of a tag. v1 takes an attribute name
+// and returns strings; v2 takes a TraceQL field (.key, span.key,
+// resource.key or an intrinsic) and returns typed values.
+func (a *queryAPI) handleTempoTagValues(w http.ResponseWriter, r *http.Request) {
+	tenant, admin, ok := a.getCaller(w, r)
+	if !ok {
+		return
+	}
+	tag := r.PathValue("tag")
+	v2 := isTempoV2(r)
+	var query string
+	var args []interface{}
+	var keywords []string
+	switch field := strings.TrimPrefix(tag, "span:"); {
+	case v2 && field == "name":
+		query = `SELECT DISTINCT name AS v, 'VARCHAR' FROM traces ORDER BY v LIMIT ?`
+	case v2 && field == "status":
+		keywords = []string{"error", "ok", "unset"}
+	case v2 && field == "kind":
+		keywords = []string{"client", "consumer", "internal", "producer", "server", "unspecified"}
+	case v2 && field == "duration":
+		keywords = []string{}
+	case v2 && strings.HasPrefix(tag, "span."), v2 && strings.HasPrefix(tag, "resource."), v2 && strings.HasPrefix(tag, "."), !v2:
+		key := tag
+		columns := []string{"attributes", "resource"}
+		if v2 {
+			scope, name, _ := strings.Cut(tag, ".")
+			key = name
+			switch scope {
+			case "span":
+				columns = columns[:1]
+			case "resource":
+				columns = columns[1:]
+			}
+		}
+		if key == "" || strings.ContainsAny(key, `"\`) {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid tag %q", tag))
+			return
+		}
+		var selects []string
+		for _, column := range columns {
+			selects = append(selects, fmt.Sprintf("SELECT json_extract_string(%[1]s, ?) AS v, json_type(%[1]s, ?) AS t FROM traces", column))
+			args = append(args, attributePath(key), attributePath(key))
+		}
+		query = `SELECT DISTINCT v, t FROM (` + strings.Join(selects, " UNION ALL ") + `) WHERE v IS NOT NULL ORDER BY v LIMIT ?`
+	default:
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("unsupported tag %q", tag))
+		return
+	}
+	values := []tempoTagValue{}
+	for _, k := range keywords {
+		values = append(values, tempoTagValue{Type: "keyword", Value: k})
+	}
+	if query != "" {
+		ctx, conn, logger, done := a.readRequest(w, r, tenant, admin)
+		if conn == nil {
+			return
+		}
+		defer done()
+		var err error
+		if values, err = tagValues(ctx, conn, query, append(args, a.cfg.QueryMaxRows)...); err != nil {
+			writeQueryError(ctx, w, r, err, logger)
+			return
+		}
+	}
+	if v2 {
+		json.NewEncoder(w).Encode(map[string]interface{}{"tagValues": values})
+		return
+	}
+	names := make([]string, len(values))
+	for i, v := range values {
+		names[i] = v.Value
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"tagValues": names})
+}
+
+func tagValues(ctx context.Context, conn *TenantConn, query string, args ...interface{}) ([]tempoTagValue, error) {
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := []tempoTagValue{}
+	for rows.Next() {
+		var value, jsonType string
+		if err := rows.Scan(&value, &jsonType); err != nil {
+			return nil, err
+		}
+		typ, ok := jsonTypes[jsonType]
+		if !ok {
+			typ = "string"
+		}
+		values = append(values, tempoTagValue{Type: typ, Value: value})
+	}
+	return values, rows.Err()
+}
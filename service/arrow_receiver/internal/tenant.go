@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// DefaultTenant owns data sent without any tenant identity.
+const DefaultTenant = "default"
+
+var (
+	ErrUnauthenticated = errors.New("missing or unknown API key")
+	ErrInvalidTenant   = errors.New("invalid tenant id")
+)
+
+var tenantIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+type tenantKey struct{}
+
+// WithTenant returns a copy of ctx carrying the tenant ID.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant stored by WithTenant, or DefaultTenant.
+func TenantFromContext(ctx context.Context) string {
+	if tenant, ok := ctx.Value(tenantKey{}).(string); ok && tenant != "" {
+		return tenant
+	}
+	return DefaultTenant
+}
+
+// TenantResolver maps request credentials to a tenant ID. API keys win over
+// the tenant header; once keys are configured they are mandatory.
+type TenantResolver struct {
+	header string
+
+	mu     sync.RWMutex
+	keys   map[string]string
+	admins map[string]bool
+}
+
+func NewTenantResolver(cfg Config) *TenantResolver {
+	return &TenantResolver{header: cfg.TenantHeader, keys: cfg.TenantKeys, admins: cfg.AdminKeys}
+}
+
+// SetKeys replaces the tenant and admin API keys.
+func (r *TenantResolver) SetKeys(keys map[string]string, admins map[string]bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys, r.admins = keys, admins
+}
+
+// IsAdmin reports whether the HTTP request carries an admin API key.
+func (r *TenantResolver) IsAdmin(req *http.Request) bool {
+	return r.isAdminKey(req.Header.Get("Authorization"))
+}
+
+// IsAdminMetadata reports whether gRPC metadata carries an admin API key.
+func (r *TenantResolver) IsAdminMetadata(md metadata.MD) bool {
+	vals := md.Get("authorization")
+	return len(vals) > 0 && r.isAdminKey(vals[0])
+}
+
+func (r *TenantResolver) isAdminKey(authorization string) bool {
+	key, ok := strings.CutPrefix(authorization, "Bearer ")
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return ok && r.admins[strings.TrimSpace(key)]
+}
+
+// FromMetadata resolves the tenant of an incoming gRPC stream.
+func (r *TenantResolver) FromMetadata(md metadata.MD) (string, error) {
+	first := func(key string) string {
+		if vals := md.Get(key); len(vals) > 0 {
+			return vals[0]
+		}
+		return ""
+	}
+	return r.resolve(first("authorization"), first(r.header))
+}
+
+// FromHTTP resolves the tenant of an HTTP request.
+func (r *TenantResolver) FromHTTP(req *http.Request) (string, error) {
+	return r.resolve(req.Header.Get("Authorization"), req.Header.Get(r.header))
+}
+
+func (r *TenantResolver) resolve(authorization, header string) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.keys) > 0 {
+		key, ok := strings.CutPrefix(authorization, "Bearer ")
+		if !ok {
+			return "", ErrUnauthenticated
+		}
+		tenant, ok := r.keys[strings.TrimSpace(key)]
+		if !ok {
+			return "", ErrUnauthenticated
+		}
+		return tenant, nil
+	}
+	if header == "" {
+		return DefaultTenant, nil
+	}
+	if !tenantIDPattern.MatchString(header) {
+		return "", ErrInvalidTenant
+	}
+	return header, nil
+}
+
+// TenantQuotas enforces a per-tenant token bucket over ingested bytes.
+type TenantQuotas struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewTenantQuotas returns quotas refilling at bytesPerSec up to burst bytes.
+// A zero rate disables the quota.
+func NewTenantQuotas(bytesPerSec, burst int64) *TenantQuotas {
+	if burst < bytesPerSec {
+		burst = bytesPerSec
+	}
+	return &TenantQuotas{
+		rate:    float64(bytesPerSec),
+		burst:   float64(burst),
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+// Allow reports whether the tenant may ingest n more bytes now and, if so,
+// charges them to its bucket. A batch larger than the burst is admitted once
+// the bucket is full and puts the tenant into debt, so oversized batches are
+// slowed down rather than rejected forever.
+func (q *TenantQuotas) Allow(tenant string, n int64) bool {
+	if q.rate <= 0 {
+		return true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	b, ok := q.buckets[tenant]
+	if !ok {
+		b = &tokenBucket{tokens: q.burst, last: now}
+		q.buckets[tenant] = b
+	}
+	b.tokens = min(q.burst, b.tokens+now.Sub(b.last).Seconds()*q.rate)
+	b.last = now
+	if b.tokens <= 0 || (float64(n) > b.tokens && b.tokens < q.burst) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
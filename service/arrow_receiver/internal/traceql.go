@@ -0,0 +1,381 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	ptrace "go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+// traceQL is a TraceQL query translated to SQL over the spans of spansSQL.
+// The supported subset is spansets of span, resource and unscoped attribute
+// comparisons and the name, status, kind and duration intrinsics, joined
+// with && and || inside and between spansets. Pipelines are not supported.
+type traceQL struct {
+	// traces selects the trace_id of the matching traces.
+	traces     string
+	tracesArgs []interface{}
+	// spans is true for the spans that matched one of the spansets.
+	spans     string
+	spansArgs []interface{}
+}
+
+// sqlExpr is a piece of SQL and the arguments of its placeholders.
+type sqlExpr struct {
+	sql  string
+	args []interface{}
+}
+
+// traceQLKinds maps kind values to ptrace.SpanKind.
+var traceQLKinds = map[string]ptrace.SpanKind{
+	"unspecified": ptrace.SpanKindUnspecified,
+	"internal":    ptrace.SpanKindInternal,
+	"server":      ptrace.SpanKindServer,
+	"client":      ptrace.SpanKindClient,
+	"producer":    ptrace.SpanKindProducer,
+	"consumer":    ptrace.SpanKindConsumer,
+}
+
+// traceQLOps maps comparison operators to SQL; =~ and !~ are handled apart.
+var traceQLOps = map[string]string{
+	"=": "=", "!=": "<>", ">": ">", ">=": ">=", "<": "<", "<=": "<=",
+}
+
+type traceQLTokenKind int
+
+const (
+	tqlEOF traceQLTokenKind = iota
+	tqlPunct
+	tqlIdent
+	tqlString
+	tqlNumber
+)
+
+type traceQLToken struct {
+	kind traceQLTokenKind
+	text string
+	pos  int
+}
+
+// lexTraceQL splits a query into tokens. Identifiers include the dots,
+// colons and dashes of attribute names; numbers include duration units.
+func lexTraceQL(q string) ([]traceQLToken, error) {
+	var tokens []traceQLToken
+	for i := 0; i < len(q); {
+		c := q[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '`':
+			j := i + 1
+			for j < len(q) && q[j] != c {
+				if q[j] == '\\' && c == '"' {
+					j++
+				}
+				j++
+			}
+			if j >= len(q) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			text := q[i+1 : j]
+			if c == '"' {
+				unquoted, err := strconv.Unquote(q[i : j+1])
+				if err != nil {
+					return nil, fmt.Errorf("invalid string at %d", i)
+				}
+				text = unquoted
+			}
+			tokens = append(tokens, traceQLToken{tqlString, text, i})
+			i = j + 1
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(q) && (isTraceQLIdentChar(q[j]) && q[j] != ':' && q[j] != '-' && q[j] != '/') {
+				j++
+			}
+			tokens = append(tokens, traceQLToken{tqlNumber, q[i:j], i})
+			i = j
+		case c == '.' || c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i
+			for j < len(q) && isTraceQLIdentChar(q[j]) {
+				j++
+			}
+			tokens = append(tokens, traceQLToken{tqlIdent, q[i:j], i})
+			i = j
+		default:
+			punct := ""
+			for _, p := range []string{"&&", "||", "!=", ">=", "<=", "=~", "!~", "{", "}", "(", ")", "=", ">", "<", "|", "!"} {
+				if strings.HasPrefix(q[i:], p) {
+					punct = p
+					break
+				}
+			}
+			if punct == "" {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+			tokens = append(tokens, traceQLToken{tqlPunct, punct, i})
+			i += len(punct)
+		}
+	}
+	return append(tokens, traceQLToken{kind: tqlEOF, pos: len(q)}), nil
+}
+
+func isTraceQLIdentChar(c byte) bool {
+	return c == '.' || c == '_' || c == ':' || c == '-' || c == '/' ||
+		c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+type traceQLParser struct {
+	tokens []traceQLToken
+	pos    int
+}
+
+// parseTraceQL translates q. An empty query matches every trace.
+func parseTraceQL(q string) (*traceQL, error) {
+	if strings.TrimSpace(q) == "" {
+		q = "{}"
+	}
+	tokens, err := lexTraceQL(q)
+	if err != nil {
+		return nil, fmt.Errorf("traceql: %w", err)
+	}
+	p := &traceQLParser{tokens: tokens}
+	query, err := p.spansetOr()
+	if err == nil && p.peek().kind != tqlEOF {
+		if p.peek().text == "|" {
+			err = fmt.Errorf("pipelines are not supported")
+		} else {
+			err = p.unexpected()
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("traceql: %w", err)
+	}
+	return query, nil
+}
+
+func (p *traceQLParser) peek() traceQLToken { return p.tokens[p.pos] }
+
+func (p *traceQLParser) next() traceQLToken {
+	t := p.tokens[p.pos]
+	if t.kind != tqlEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *traceQLParser) accept(punct string) bool {
+	if t := p.peek(); t.kind == tqlPunct && t.text == punct {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *traceQLParser) expect(punct string) error {
+	if !p.accept(punct) {
+		return p.unexpected()
+	}
+	return nil
+}
+
+func (p *traceQLParser) unexpected() error {
+	t := p.peek()
+	if t.kind == tqlEOF {
+		return fmt.Errorf("unexpected end of query")
+	}
+	return fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+}
+
+// spansetOr and spansetAnd combine spansets: a trace matches A && B when it
+// has spans matching each, and A || B when it has spans matching either.
+func (p *traceQLParser) spansetOr() (*traceQL, error) {
+	left, err := p.spansetAnd()
+	for err == nil && p.accept("||") {
+		var right *traceQL
+		if right, err = p.spansetAnd(); err == nil {
+			left = combineSpansets(left, right, "UNION")
+		}
+	}
+	return left, err
+}
+
+func (p *traceQLParser) spansetAnd() (*traceQL, error) {
+	left, err := p.spanset()
+	for err == nil && p.accept("&&") {
+		var right *traceQL
+		if right, err = p.spanset(); err == nil {
+			left = combineSpansets(left, right, "INTERSECT")
+		}
+	}
+	return left, err
+}
+
+func combineSpansets(left, right *traceQL, op string) *traceQL {
+	return &traceQL{
+		traces:     fmt.Sprintf("SELECT trace_id FROM (%s) %s SELECT trace_id FROM (%s)", left.traces, op, right.traces),
+		tracesArgs: append(append([]interface{}{}, left.tracesArgs...), right.tracesArgs...),
+		spans:      fmt.Sprintf("(%s OR %s)", left.spans, right.spans),
+		spansArgs:  append(append([]interface{}{}, left.spansArgs...), right.spansArgs...),
+	}
+}
+
+func (p *traceQLParser) spanset() (*traceQL, error) {
+	if p.accept("(") {
+		query, err := p.spansetOr()
+		if err != nil {
+			return nil, err
+		}
+		return query, p.expect(")")
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	cond := sqlExpr{sql: "true"}
+	if !p.accept("}") {
+		var err error
+		if cond, err = p.fieldOr(); err != nil {
+			return nil, err
+		}
+		if err := p.expect("}"); err != nil {
+			return nil, err
+		}
+	}
+	return &traceQL{
+		traces:     "SELECT DISTINCT trace_id FROM spans WHERE " + cond.sql,
+		tracesArgs: cond.args,
+		spans:      "(" + cond.sql + ")",
+		spansArgs:  cond.args,
+	}, nil
+}
+
+// fieldOr and fieldAnd combine conditions on a single span.
+func (p *traceQLParser) fieldOr() (sqlExpr, error) {
+	left, err := p.fieldAnd()
+	for err == nil && p.accept("||") {
+		var right sqlExpr
+		if right, err = p.fieldAnd(); err == nil {
+			left = sqlExpr{"(" + left.sql + " OR " + right.sql + ")", append(left.args, right.args...)}
+		}
+	}
+	return left, err
+}
+
+func (p *traceQLParser) fieldAnd() (sqlExpr, error) {
+	left, err := p.fieldTerm()
+	for err == nil && p.accept("&&") {
+		var right sqlExpr
+		if right, err = p.fieldTerm(); err == nil {
+			left = sqlExpr{"(" + left.sql + " AND " + right.sql + ")", append(left.args, right.args...)}
+		}
+	}
+	return left, err
+}
+
+func (p *traceQLParser) fieldTerm() (sqlExpr, error) {
+	if p.accept("(") {
+		cond, err := p.fieldOr()
+		if err != nil {
+			return cond, err
+		}
+		return cond, p.expect(")")
+	}
+	field := p.next()
+	if field.kind != tqlIdent {
+		p.pos--
+		return sqlExpr{}, p.unexpected()
+	}
+	op := p.next()
+	if _, ok := traceQLOps[op.text]; op.kind != tqlPunct || !ok && op.text != "=~" && op.text != "!~" {
+		p.pos--
+		return sqlExpr{}, p.unexpected()
+	}
+	value := p.next()
+	if value.kind == tqlEOF || value.kind == tqlPunct {
+		p.pos--
+		return sqlExpr{}, p.unexpected()
+	}
+	return compareTraceQL(field.text, op.text, value)
+}
+
+// compareTraceQL translates one comparison. A span lacking the attribute
+// matches neither = nor !=, as in Tempo.
+func compareTraceQL(field, op string, value traceQLToken) (sqlExpr, error) {
+	switch strings.TrimPrefix(field, "span:") {
+	case "name":
+		if value.kind != tqlString {
+			return sqlExpr{}, fmt.Errorf("name must be compared to a string")
+		}
+		return compareSQL("name", nil, op, value.text), nil
+	case "status":
+		code, ok := statusCodes[value.text]
+		if value.kind != tqlIdent || !ok || (op != "=" && op != "!=") {
+			return sqlExpr{}, fmt.Errorf("status must be compared with = or != to error, ok or unset")
+		}
+		return compareSQL("status_code", nil, op, int(code)), nil
+	case "kind":
+		kind, ok := traceQLKinds[value.text]
+		if value.kind != tqlIdent || !ok || (op != "=" && op != "!=") {
+			return sqlExpr{}, fmt.Errorf("kind must be compared with = or != to a span kind")
+		}
+		return compareSQL("kind", nil, op, int(kind)), nil
+	case "duration":
+		d, err := time.ParseDuration(value.text)
+		if value.kind != tqlNumber || err != nil || op == "=~" || op == "!~" {
+			return sqlExpr{}, fmt.Errorf("duration must be compared to a duration such as 100ms")
+		}
+		return compareSQL("(end_ns - start_ns)", nil, op, d.Nanoseconds()), nil
+	}
+	var attr sqlExpr
+	switch {
+	case strings.HasPrefix(field, "."):
+		key := attributePath(field[1:])
+		attr = sqlExpr{"coalesce(json_extract_string(attributes, ?), json_extract_string(resource, ?))", []interface{}{key, key}}
+	case strings.HasPrefix(field, "span."):
+		attr = sqlExpr{"json_extract_string(attributes, ?)", []interface{}{attributePath(field[5:])}}
+	case strings.HasPrefix(field, "resource."):
+		attr = sqlExpr{"json_extract_string(resource, ?)", []interface{}{attributePath(field[9:])}}
+	default:
+		return sqlExpr{}, fmt.Errorf("unsupported field %q", field)
+	}
+	switch {
+	case value.kind == tqlString:
+		return compareSQL(attr.sql, attr.args, op, value.text), nil
+	case value.kind == tqlNumber && (op == "=~" || op == "!~"):
+		return sqlExpr{}, fmt.Errorf("regular expressions need a string")
+	case value.kind == tqlNumber:
+		n, err := strconv.ParseFloat(value.text, 64)
+		if err != nil {
+			return sqlExpr{}, fmt.Errorf("invalid number %q", value.text)
+		}
+		return compareSQL("TRY_CAST("+attr.sql+" AS DOUBLE)", attr.args, op, n), nil
+	case value.text == "nil" && (op == "=" || op == "!="):
+		test := " IS NULL"
+		if op == "!=" {
+			test = " IS NOT NULL"
+		}
+		return sqlExpr{attr.sql + test, attr.args}, nil
+	case (value.text == "true" || value.text == "false") && (op == "=" || op == "!="):
+		return compareSQL(attr.sql, attr.args, op, value.text), nil
+	}
+	return sqlExpr{}, fmt.Errorf("unsupported value %q", value.text)
+}
+
+// compareSQL applies op to expr and a placeholder for value.
+func compareSQL(expr string, args []interface{}, op string, value interface{}) sqlExpr {
+	args = append(append([]interface{}{}, args...), value)
+	switch op {
+	case "=~":
+		return sqlExpr{"regexp_full_match(" + expr + ", ?)", args}
+	case "!~":
+		return sqlExpr{"NOT regexp_full_match(" + expr + ", ?)", args}
+	}
+	return sqlExpr{expr + " " + traceQLOps[op] + " ?", args}
+}
+
+// attributePath is the JSON path of an attribute key; the lexer keeps quotes
+// and backslashes out of keys.
+func attributePath(key string) string {
+	return `$."` + key + `"`
+}
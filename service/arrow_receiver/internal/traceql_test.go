@@ -0,0 +1,41 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTraceQLRejectsNonASCII(t *testing.T) {
+	for _, q := range []string{
+		`{ span.café = "x" }`,
+		`{ é }`,
+		`{ name = "x" } && { ☃ }`,
+	} {
+		done := make(chan error, 1)
+		go func() {
+			_, err := parseTraceQL(q)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err == nil || !strings.Contains(err.Error(), "unexpected") {
+				t.Errorf("parseTraceQL(%q) = %v, want an unexpected character error", q, err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("parseTraceQL(%q) did not return", q)
+		}
+	}
+}
+
+func TestParseTraceQLAttributes(t *testing.T) {
+	for _, q := range []string{
+		`{ span.http.status_code = 500 }`,
+		`{ resource.service.name = "api" && duration > 10ms }`,
+		`{ .k8s.pod-name = "a" }`,
+	} {
+		if _, err := parseTraceQL(q); err != nil {
+			t.Errorf("parseTraceQL(%q): %v", q, err)
+		}
+	}
+}
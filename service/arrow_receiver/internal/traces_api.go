@@ -0,0 +1,600 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	ptrace "go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+// spanTimeLayout is the format span timestamps are stored in, that of
+// pcommon.Timestamp.String().
+const spanTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// defaultTraceSearchLimit is the page size of a trace search without limit.
+const defaultTraceSearchLimit = 20
+
+var traceIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// unixNanosSQL converts a stored timestamp column, in the format of
+// pcommon.Timestamp.String(), to Unix nanoseconds.
+// DuckDB casts strings to TIMESTAMP_NS with microsecond precision only, so
+// the fraction is added on its own.
+func unixNanosSQL(col string) string {
+	return fmt.Sprintf(`(epoch_ns(CAST(left(%[1]s, 19) AS TIMESTAMP)) + CAST(rpad(regexp_extract(%[1]s, '^[^.]*\.(\d+)', 1), 9, '0') AS BIGINT))`, col)
+}
+
+func parseSpanTime(s string) (time.Time, error) {
+	t, err := time.Parse(spanTimeLayout, s)
+	return t.UTC(), err
+}
+
+// statusCodes maps the status filter of a search to ptrace.StatusCode.
+var statusCodes = map[string]ptrace.StatusCode{
+	"unset": ptrace.StatusCodeUnset,
+	"ok":    ptrace.StatusCodeOk,
+	"error": ptrace.StatusCodeError,
+}
+
+type spanStatus struct {
+	Code    string `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type spanEvent struct {
+	Name                   string                 `json:"name"`
+	Time                   time.Time              `json:"time"`
+	Attributes             map[string]interface{} `json:"attributes"`
+	DroppedAttributesCount int                    `json:"dropped_attributes_count"`
+}
+
+type spanLink struct {
+	TraceID                string                 `json:"trace_id"`
+	SpanID                 string                 `json:"span_id"`
+	TraceState             string                 `json:"trace_state,omitempty"`
+	Attributes             map[string]interface{} `json:"attributes"`
+	DroppedAttributesCount int                    `json:"dropped_attributes_count"`
+}
+
+// traceSpan is a span of an assembled trace. Depth counts the ancestors
+// found in the trace; spans whose parent is missing are roots.
+type traceSpan struct {
+	TraceID                string          `json:"trace_id"`
+	SpanID                 string          `json:"span_id"`
+	ParentSpanID           string          `json:"parent_span_id,omitempty"`
+	Name                   string          `json:"name"`
+	Kind                   string          `json:"kind"`
+	Service                string          `json:"service,omitempty"`
+	TraceState             string          `json:"trace_state,omitempty"`
+	Status                 spanStatus      `json:"status"`
+	StartTime              time.Time       `json:"start_time"`
+	EndTime                time.Time       `json:"end_time"`
+	DurationNanos          int64           `json:"duration_ns"`
+	Depth                  int             `json:"depth"`
+	Resource               json.RawMessage `json:"resource"`
+	Scope                  json.RawMessage `json:"scope"`
+	SchemaURL              string          `json:"schema_url,omitempty"`
+	Attributes             json.RawMessage `json:"attributes"`
+	Events                 []spanEvent     `json:"events"`
+	Links                  []spanLink      `json:"links"`
+	DroppedAttributesCount int             `json:"dropped_attributes_count"`
+	DroppedEventsCount     int             `json:"dropped_events_count"`
+	DroppedLinksCount      int             `json:"dropped_links_count"`
+	Children               []*traceSpan    `json:"children"`
+
+	kind       ptrace.SpanKind
+	statusCode ptrace.StatusCode
+}
+
+// assembledTrace is the response of /api/v1/traces/{traceId}.
+type assembledTrace struct {
+	TraceID       string    `json:"trace_id"`
+	StartTime     time.Time `json:"start_time"`
+	EndTime       time.Time `json:"end_time"`
+	DurationNanos int64     `json:"duration_ns"`
+	SpanCount     int       `json:"span_count"`
+	ErrorCount    int       `json:"error_count"`
+	Depth         int       `json:"depth"`
+	Services      []string  `json:"services"`
+	// Truncated is set when the trace has more than QueryMaxRows spans.
+	Truncated bool         `json:"truncated,omitempty"`
+	Spans     []*traceSpan `json:"spans"`
+}
+
+// traceSummary is one result of /api/v1/traces.
+type traceSummary struct {
+	TraceID       string    `json:"trace_id"`
+	RootService   string    `json:"root_service"`
+	RootName      string    `json:"root_name"`
+	StartTime     time.Time `json:"start_time"`
+	DurationNanos int64     `json:"duration_ns"`
+	SpanCount     int       `json:"span_count"`
+	ErrorCount    int       `json:"error_count"`
+	Services      []string  `json:"services"`
+}
+
+// readConn waits for a query slot and opens a read-only connection limited
+// to what the caller may see. On failure it writes the response and returns
+// nil; otherwise the returned function closes the connection and frees the
+// slot.
+func (a *queryAPI) readConn(ctx context.Context, w http.ResponseWriter, tenant string, admin bool, logger *log.Entry) (*TenantConn, func()) {
+	if !a.slots.Acquire(ctx) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error": "too many concurrent queries"}`))
+		logger.Warn("query rejected: concurrency limit reached")
+		return nil, nil
+	}
+	var conn *TenantConn
+	var err error
+	if admin {
+		conn, err = OpenAdminConn(ctx, a.db)
+	} else {
+		conn, err = OpenTenantConn(ctx, a.db, tenant)
+	}
+	if err == nil {
+		if err = conn.BeginReadOnly(ctx); err != nil {
+			conn.Close()
+		}
+	}
+	if err != nil {
+		a.slots.Release()
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		logger.WithError(err).Error("opening query connection failed")
+		return nil, nil
+	}
+	return conn, func() {
+		conn.Close()
+		a.slots.Release()
+	}
+}
+
+// readRequest opens a read-only connection for the caller of r under the
+// query timeout. conn is nil when a response was already written; otherwise
+// done releases everything.
+func (a *queryAPI) readRequest(w http.ResponseWriter, r *http.Request, tenant string, admin bool) (ctx context.Context, conn *TenantConn, logger *log.Entry, done func()) {
+	logger = log.WithFields(log.Fields{"tenant": tenant, "admin": admin, "remote_addr": r.RemoteAddr})
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.QueryTimeout)
+	conn, release := a.readConn(ctx, w, tenant, admin, logger)
+	if conn == nil {
+		cancel()
+		return nil, nil, nil, nil
+	}
+	return ctx, conn, logger, func() {
+		release()
+		cancel()
+	}
+}
+
+// getCaller answers preflight requests, rejects methods other than GET and
+// resolves the caller; ok is false when a response was already written.
+func (a *queryAPI) getCaller(w http.ResponseWriter, r *http.Request) (tenant string, admin bool, ok bool) {
+	if a.cors(w, r, "GET") {
+		return "", false, false
+	}
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(`{"error": "GET only"}`))
+		return "", false, false
+	}
+	return a.caller(w, r)
+}
+
+// handleTrace returns the trace with the given ID as a tree of spans.
+func (a *queryAPI) handleTrace(w http.ResponseWriter, r *http.Request) {
+	tenant, admin, ok := a.getCaller(w, r)
+	if !ok {
+		return
+	}
+	traceID := strings.ToLower(r.PathValue("traceId"))
+	if !traceIDPattern.MatchString(traceID) {
+		writeJSONError(w, http.StatusBadRequest, "trace ID must be 32 hex digits")
+		return
+	}
+	ctx, conn, logger, done := a.readRequest(w, r, tenant, admin)
+	if conn == nil {
+		return
+	}
+	defer done()
+	spans, truncated, err := loadTraceSpans(ctx, conn, []string{traceID}, a.cfg.QueryMaxRows)
+	if err != nil {
+		writeQueryError(ctx, w, r, err, logger)
+		return
+	}
+	if len(spans) == 0 {
+		writeJSONError(w, http.StatusNotFound, "trace not found")
+		return
+	}
+	trace := assembleTrace(traceID, spans)
+	trace.Truncated = truncated
+	json.NewEncoder(w).Encode(trace)
+}
+
+// loadTraceSpans reads up to limit spans of the traces in start order and
+// reports whether more were left.
+func loadTraceSpans(ctx context.Context, conn *TenantConn, traceIDs []string, limit int) ([]*traceSpan, bool, error) {
+	if len(traceIDs) == 0 {
+		return nil, false, nil
+	}
+	args := make([]interface{}, 0, len(traceIDs)+1)
+	for _, id := range traceIDs {
+		args = append(args, id)
+	}
+	args = append(args, limit+1)
+	rows, err := conn.QueryContext(ctx, `
+		SELECT trace_id, span_id, parent_span_id, name, kind, trace_state, status_code, status_message,
+			coalesce(json_extract_string(resource, '$."service.name"'), ''),
+			coalesce(CAST(resource AS VARCHAR), '{}'), coalesce(CAST(scope AS VARCHAR), '{}'), schema_url,
+			coalesce(CAST(attributes AS VARCHAR), '{}'), coalesce(CAST(events AS VARCHAR), '[]'), coalesce(CAST(links AS VARCHAR), '[]'),
+			start_time_unix_nano, end_time_unix_nano,
+			dropped_attributes_count, dropped_events_count, dropped_links_count
+		FROM traces
+		WHERE trace_id IN (?`+strings.Repeat(", ?", len(traceIDs)-1)+`)
+		ORDER BY `+unixNanosSQL("start_time_unix_nano")+`, span_id
+		LIMIT ?`, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	var spans []*traceSpan
+	for rows.Next() {
+		if len(spans) == limit {
+			return spans, true, nil
+		}
+		var s traceSpan
+		var kind, statusCode int
+		var resource, scope, attributes, events, links, start, end string
+		err := rows.Scan(&s.TraceID, &s.SpanID, &s.ParentSpanID, &s.Name, &kind, &s.TraceState, &statusCode, &s.Status.Message,
+			&s.Service, &resource, &scope, &s.SchemaURL, &attributes, &events, &links, &start, &end,
+			&s.DroppedAttributesCount, &s.DroppedEventsCount, &s.DroppedLinksCount)
+		if err != nil {
+			return nil, false, err
+		}
+		s.kind, s.statusCode = ptrace.SpanKind(kind), ptrace.StatusCode(statusCode)
+		s.Kind, s.Status.Code = s.kind.String(), s.statusCode.String()
+		s.Resource, s.Scope, s.Attributes = json.RawMessage(resource), json.RawMessage(scope), json.RawMessage(attributes)
+		if s.StartTime, err = parseSpanTime(start); err != nil {
+			return nil, false, fmt.Errorf("span %s: %w", s.SpanID, err)
+		}
+		if s.EndTime, err = parseSpanTime(end); err != nil {
+			return nil, false, fmt.Errorf("span %s: %w", s.SpanID, err)
+		}
+		s.DurationNanos = s.EndTime.Sub(s.StartTime).Nanoseconds()
+		if s.Events, err = decodeSpanEvents(events); err != nil {
+			return nil, false, fmt.Errorf("span %s: %w", s.SpanID, err)
+		}
+		if err := decodeJSONNumbers(links, &s.Links); err != nil {
+			return nil, false, fmt.Errorf("span %s: links: %w", s.SpanID, err)
+		}
+		s.Children = []*traceSpan{}
+		spans = append(spans, &s)
+	}
+	return spans, false, rows.Err()
+}
+
+// decodeSpanEvents reads the events column written by TracesToRows.
+func decodeSpanEvents(raw string) ([]spanEvent, error) {
+	var stored []struct {
+		Name                   string                 `json:"name"`
+		Time                   string                 `json:"time_unix_nano"`
+		Attributes             map[string]interface{} `json:"attributes"`
+		DroppedAttributesCount int                    `json:"dropped_attributes_count"`
+	}
+	if err := decodeJSONNumbers(raw, &stored); err != nil {
+		return nil, fmt.Errorf("events: %w", err)
+	}
+	events := make([]spanEvent, len(stored))
+	for i, e := range stored {
+		t, err := parseSpanTime(e.Time)
+		if err != nil {
+			return nil, fmt.Errorf("event %q: %w", e.Name, err)
+		}
+		events[i] = spanEvent{Name: e.Name, Time: t, Attributes: e.Attributes, DroppedAttributesCount: e.DroppedAttributesCount}
+	}
+	return events, nil
+}
+
+// decodeJSONNumbers decodes raw into v keeping numbers as json.Number, so
+// integer attributes stay exact.
+func decodeJSONNumbers(raw string, v interface{}) error {
+	dec := json.NewDecoder(strings.NewReader(raw))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// assembleTrace nests spans, given in start order, under their parents and
+// sets their depth. Spans whose parent is not in the trace, or that are only
+// reachable through a cycle, become roots.
+func assembleTrace(traceID string, spans []*traceSpan) *assembledTrace {
+	trace := &assembledTrace{TraceID: traceID, SpanCount: len(spans), Spans: []*traceSpan{}}
+	byID := make(map[string]*traceSpan, len(spans))
+	for _, s := range spans {
+		byID[s.SpanID] = s
+	}
+	services := map[string]bool{}
+	for i, s := range spans {
+		if parent, ok := byID[s.ParentSpanID]; ok && parent != s {
+			parent.Children = append(parent.Children, s)
+		} else {
+			trace.Spans = append(trace.Spans, s)
+		}
+		if i == 0 || s.StartTime.Before(trace.StartTime) {
+			trace.StartTime = s.StartTime
+		}
+		if i == 0 || s.EndTime.After(trace.EndTime) {
+			trace.EndTime = s.EndTime
+		}
+		if s.statusCode == ptrace.StatusCodeError {
+			trace.ErrorCount++
+		}
+		if s.Service != "" {
+			services[s.Service] = true
+		}
+	}
+	visited := make(map[*traceSpan]bool, len(spans))
+	var walk func(s *traceSpan, depth int)
+	walk = func(s *traceSpan, depth int) {
+		visited[s] = true
+		s.Depth = depth
+		trace.Depth = max(trace.Depth, depth)
+		for _, child := range s.Children {
+			walk(child, depth+1)
+		}
+	}
+	for _, root := range trace.Spans {
+		walk(root, 0)
+	}
+	for _, s := range spans {
+		if !visited[s] {
+			if parent := byID[s.ParentSpanID]; parent != nil {
+				parent.Children = removeSpan(parent.Children, s)
+			}
+			trace.Spans = append(trace.Spans, s)
+			walk(s, 0)
+		}
+	}
+	trace.DurationNanos = trace.EndTime.Sub(trace.StartTime).Nanoseconds()
+	trace.Services = make([]string, 0, len(services))
+	for service := range services {
+		trace.Services = append(trace.Services, service)
+	}
+	sort.Strings(trace.Services)
+	return trace
+}
+
+func removeSpan(spans []*traceSpan, s *traceSpan) []*traceSpan {
+	for i, other := range spans {
+		if other == s {
+			return append(spans[:i], spans[i+1:]...)
+		}
+	}
+	return spans
+}
+
+// traceSearch is a parsed /api/v1/traces request.
+type traceSearch struct {
+	// conds and args select the spans a trace needs one of to match.
+	conds []string
+	args  []interface{}
+	// match, when set, replaces conds with a query selecting the trace_id
+	// of matching traces from spansSQL.
+	match     string
+	matchArgs []interface{}
+	// having and havingArgs filter traces on aggregates of their spans.
+	having     []string
+	havingArgs []interface{}
+	page       *queryPage
+}
+
+// parseTraceSearch reads the filters of a trace search. Apart from the time
+// window, which applies to span start times, all filters must hold for the
+// same span.
+func parseTraceSearch(q url.Values, maxRows int) (*traceSearch, error) {
+	s := &traceSearch{}
+	if v := q.Get("service"); v != "" {
+		s.filter("service = ?", v)
+	}
+	if v := q.Get("span_name"); v != "" {
+		s.filter("name = ?", v)
+	}
+	if v := q.Get("status"); v != "" {
+		code, ok := statusCodes[strings.ToLower(v)]
+		if !ok {
+			return nil, fmt.Errorf("status must be unset, ok or error")
+		}
+		s.filter("status_code = ?", int(code))
+	}
+	for _, bound := range []struct{ param, op string }{{"min_duration", ">="}, {"max_duration", "<="}} {
+		v := q.Get(bound.param)
+		if v == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", bound.param, err)
+		}
+		s.filter("end_ns - start_ns "+bound.op+" ?", d.Nanoseconds())
+	}
+	for _, bound := range []struct{ param, op string }{{"start", ">="}, {"end", "<"}} {
+		v := q.Get(bound.param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be an RFC 3339 time", bound.param)
+		}
+		s.filter("start_ns "+bound.op+" ?", t.UnixNano())
+	}
+	keys := make([]string, 0, len(q))
+	for key := range q {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		attr, ok := strings.CutPrefix(key, "attr.")
+		if !ok {
+			continue
+		}
+		if err := s.attribute(attr, q.Get(key)); err != nil {
+			return nil, err
+		}
+	}
+	limit := defaultTraceSearchLimit
+	if v := q.Get("limit"); v != "" {
+		if _, err := fmt.Sscan(v, &limit); err != nil || limit <= 0 {
+			return nil, errors.New("limit must be a positive integer")
+		}
+	}
+	// A cursor only applies to the filters it was issued for.
+	filters := url.Values{}
+	for key, vals := range q {
+		if key != "limit" && key != "cursor" {
+			filters[key] = vals
+		}
+	}
+	page, err := parsePage(filters.Encode(), limit, q.Get("cursor"), maxRows)
+	if err != nil {
+		return nil, err
+	}
+	s.page = page
+	return s, nil
+}
+
+func (s *traceSearch) filter(cond string, args ...interface{}) {
+	s.conds = append(s.conds, cond)
+	s.args = append(s.args, args...)
+}
+
+// attribute requires a span attribute to equal value; numbers and booleans
+// compare by their JSON text.
+func (s *traceSearch) attribute(key, value string) error {
+	if key == "" || strings.ContainsAny(key, `"\`) {
+		return fmt.Errorf("invalid attribute name %q", key)
+	}
+	s.filter("json_extract_string(attributes, ?) = ?", attributePath(key), value)
+	return nil
+}
+
+// spansSQL is the traces table with the columns searches filter on.
+var spansSQL = `
+	SELECT trace_id, span_id, parent_span_id, name, kind, status_code, attributes, resource,
+		json_extract_string(resource, '$."service.name"') AS service,
+		` + unixNanosSQL("start_time_unix_nano") + ` AS start_ns,
+		` + unixNanosSQL("end_time_unix_nano") + ` AS end_ns
+	FROM traces`
+
+// query returns the SQL of the search and its arguments. It selects one
+// more trace than the page holds, telling whether another page follows.
+func (s *traceSearch) query() (string, []interface{}) {
+	match, args := s.match, append([]interface{}{}, s.matchArgs...)
+	if match == "" {
+		where := "true"
+		if len(s.conds) > 0 {
+			where = strings.Join(s.conds, " AND ")
+		}
+		match, args = "SELECT DISTINCT trace_id FROM spans WHERE "+where, append([]interface{}{}, s.args...)
+	}
+	having := "true"
+	if len(s.having) > 0 {
+		having = strings.Join(s.having, " AND ")
+	}
+	query := `
+		WITH spans AS (` + spansSQL + `
+		), matched AS (
+			` + match + `
+		)
+		SELECT trace_id,
+			coalesce(arg_min(service, start_ns) FILTER (WHERE parent_span_id = ''), arg_min(service, start_ns), ''),
+			coalesce(arg_min(name, start_ns) FILTER (WHERE parent_span_id = ''), arg_min(name, start_ns)),
+			min(start_ns),
+			max(end_ns) - min(start_ns),
+			count(*),
+			count(*) FILTER (WHERE status_code = ?),
+			coalesce(list_sort(list(DISTINCT service) FILTER (WHERE service IS NOT NULL)), [])
+		FROM spans
+		WHERE trace_id IN (SELECT trace_id FROM matched)
+		GROUP BY trace_id
+		HAVING ` + having + `
+		ORDER BY min(start_ns) DESC, trace_id
+		LIMIT ? OFFSET ?`
+	args = append(args, int(ptrace.StatusCodeError))
+	args = append(args, s.havingArgs...)
+	args = append(args, s.page.Size+1, s.page.Offset)
+	return query, args
+}
+
+// handleTraceSearch lists the traces matching the filters of the request,
+// newest first.
+func (a *queryAPI) handleTraceSearch(w http.ResponseWriter, r *http.Request) {
+	tenant, admin, ok := a.getCaller(w, r)
+	if !ok {
+		return
+	}
+	search, err := parseTraceSearch(r.URL.Query(), a.cfg.QueryMaxRows)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ctx, conn, logger, done := a.readRequest(w, r, tenant, admin)
+	if conn == nil {
+		return
+	}
+	defer done()
+	traces, more, err := searchTraces(ctx, conn, search)
+	if err != nil {
+		writeQueryError(ctx, w, r, err, logger)
+		return
+	}
+	resp := map[string]interface{}{"traces": traces}
+	if more {
+		resp["next_cursor"] = search.page.next(len(traces))
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// searchTraces runs search and reports whether more traces follow the page.
+func searchTraces(ctx context.Context, conn *TenantConn, search *traceSearch) ([]traceSummary, bool, error) {
+	query, args := search.query()
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	traces := []traceSummary{}
+	for rows.Next() {
+		if len(traces) == search.page.Size {
+			return traces, true, nil
+		}
+		var t traceSummary
+		var start int64
+		var services interface{}
+		if err := rows.Scan(&t.TraceID, &t.RootService, &t.RootName, &start, &t.DurationNanos, &t.SpanCount, &t.ErrorCount, &services); err != nil {
+			return nil, false, err
+		}
+		t.StartTime = time.Unix(0, start).UTC()
+		t.Services = stringList(services)
+		traces = append(traces, t)
+	}
+	return traces, false, rows.Err()
+}
+
+// stringList converts a scanned DuckDB list of strings.
+func stringList(v interface{}) []string {
+	list, _ := v.([]interface{})
+	out := make([]string, 0, len(list))
+	for _, item := range list {
+		if s, ok := item.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -0,0 +1,298 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// WAL is a segmented write-ahead log of decoded batches. Entries are fsynced
+// before the batch is acked and a segment is removed once every entry in it
+// has been committed to DuckDB. Batches are stored decoded because raw Arrow
+// batches cannot be decoded without the earlier batches of their stream.
+//
+// Each entry is framed as a 4-byte length, a 4-byte CRC-32 of the payload
+// and the JSON payload, all little-endian.
+type WAL struct {
+	dir          string
+	segmentBytes int64
+	maxBytes     int64
+
+	mu       sync.Mutex
+	current  *walSegment
+	segments map[uint64]*walSegment
+	total    int64
+}
+
+type walSegment struct {
+	id      uint64
+	file    *os.File
+	size    int64
+	pending int
+	// broken is set when a torn record could not be removed; nothing more
+	// is appended to the segment.
+	broken bool
+}
+
+// walEntry is the payload of one WAL record.
+type walEntry struct {
+	Signal Signal   `json:"signal"`
+	Tenant string   `json:"tenant"`
+	Rows   RowBatch `json:"rows"`
+}
+
+const (
+	walHeaderSize = 8
+	walSuffix     = ".wal"
+)
+
+var ErrWALFull = errors.New("write-ahead log full")
+
+// OpenWAL opens the log in dir, creating it if needed. Existing segments are
+// left for Replay.
+func OpenWAL(dir string, segmentBytes, maxBytes int64) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &WAL{
+		dir:          dir,
+		segmentBytes: segmentBytes,
+		maxBytes:     maxBytes,
+		segments:     map[uint64]*walSegment{},
+	}, nil
+}
+
+// Replay feeds every readable entry left by a previous run to apply, oldest
+// first, and deletes the replayed segments. A torn or corrupt tail ends the
+// segment it is found in; the following segments are still read.
+func (w *WAL) Replay(apply func(walEntry) error) (int, error) {
+	ids, err := w.segmentIDs()
+	if err != nil {
+		return 0, err
+	}
+	replayed := 0
+	for _, id := range ids {
+		path := w.segmentPath(id)
+		n, err := replaySegment(path, apply)
+		replayed += n
+		if err != nil {
+			return replayed, fmt.Errorf("replaying %s: %w", path, err)
+		}
+		if err := os.Remove(path); err != nil {
+			return replayed, err
+		}
+	}
+	return replayed, nil
+}
+
+func replaySegment(path string, apply func(walEntry) error) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var offset int64
+	n := 0
+	for {
+		payload, err := readWALRecord(r)
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{"segment": path, "offset": offset}).Warn("Skipping corrupt WAL tail")
+			return n, nil
+		}
+		offset += walHeaderSize + int64(len(payload))
+		var entry walEntry
+		if err := json.Unmarshal(payload, &entry); err != nil {
+			log.WithError(err).WithFields(log.Fields{"segment": path, "offset": offset}).Warn("Skipping undecodable WAL entry")
+			continue
+		}
+		if err := apply(entry); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+func readWALRecord(r io.Reader) ([]byte, error) {
+	var header [walHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("truncated header")
+		}
+		return nil, err
+	}
+	length := binary.LittleEndian.Uint32(header[0:4])
+	sum := binary.LittleEndian.Uint32(header[4:8])
+	if length == 0 || length > 1<<30 {
+		return nil, fmt.Errorf("invalid record length %d", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, errors.New("truncated record")
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		return nil, errors.New("checksum mismatch")
+	}
+	return payload, nil
+}
+
+// Append durably writes the entry and returns the segment holding it, to be
+// passed to Commit once the rows are stored.
+func (w *WAL) Append(entry walEntry) (uint64, error) {
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+	record := make([]byte, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[walHeaderSize:], payload)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.total+int64(len(record)) > w.maxBytes {
+		return 0, ErrWALFull
+	}
+	if w.current == nil {
+		if err := w.nextSegment(0); err != nil {
+			return 0, err
+		}
+	} else if w.current.broken || w.current.size > 0 && w.current.size+int64(len(record)) > w.segmentBytes {
+		if err := w.nextSegment(w.current.id + 1); err != nil {
+			return 0, err
+		}
+	}
+	seg := w.current
+	_, err = seg.file.Write(record)
+	if err == nil {
+		err = seg.file.Sync()
+	}
+	if err != nil {
+		w.discardTail(seg)
+		return 0, err
+	}
+	seg.size += int64(len(record))
+	seg.pending++
+	w.total += int64(len(record))
+	return seg.id, nil
+}
+
+// discardTail removes what a failed Append left after the last whole record
+// of seg, so later records are not written behind a torn one. If that fails
+// the segment is marked broken and the next Append starts a new one. Callers
+// hold w.mu.
+func (w *WAL) discardTail(seg *walSegment) {
+	err := seg.file.Truncate(seg.size)
+	if err == nil {
+		_, err = seg.file.Seek(seg.size, io.SeekStart)
+	}
+	if err != nil {
+		log.WithError(err).WithField("segment", w.segmentPath(seg.id)).Warn("Error discarding a torn WAL record, starting a new segment")
+		seg.broken = true
+	}
+}
+
+// Commit records that an entry of the segment is stored in DuckDB. Fully
+// committed segments are deleted, or truncated if still being written.
+func (w *WAL) Commit(id uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	seg, ok := w.segments[id]
+	if !ok {
+		return
+	}
+	seg.pending--
+	if seg.pending > 0 {
+		return
+	}
+	w.total -= seg.size
+	if seg == w.current {
+		if err := seg.file.Truncate(0); err != nil {
+			log.WithError(err).Warn("Error truncating WAL segment")
+			return
+		}
+		if _, err := seg.file.Seek(0, io.SeekStart); err != nil {
+			log.WithError(err).Warn("Error rewinding WAL segment")
+		}
+		seg.size, seg.broken = 0, false
+		return
+	}
+	w.removeSegment(seg)
+}
+
+// Close closes the open segments. Uncommitted entries stay on disk for the
+// next Replay.
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var errs []error
+	for _, seg := range w.segments {
+		errs = append(errs, seg.file.Close())
+	}
+	w.segments = map[uint64]*walSegment{}
+	w.current = nil
+	return errors.Join(errs...)
+}
+
+// nextSegment opens a new current segment; the previous one is removed if it
+// holds no pending entries. Callers hold w.mu.
+func (w *WAL) nextSegment(id uint64) error {
+	f, err := os.OpenFile(w.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if prev := w.current; prev != nil && prev.pending == 0 {
+		w.removeSegment(prev)
+	}
+	w.current = &walSegment{id: id, file: f}
+	w.segments[id] = w.current
+	return nil
+}
+
+func (w *WAL) removeSegment(seg *walSegment) {
+	delete(w.segments, seg.id)
+	seg.file.Close()
+	if err := os.Remove(w.segmentPath(seg.id)); err != nil {
+		log.WithError(err).Warn("Error removing WAL segment")
+	}
+}
+
+func (w *WAL) segmentPath(id uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%016d%s", id, walSuffix))
+}
+
+func (w *WAL) segmentIDs() ([]uint64, error) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint64
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), walSuffix)
+		if !ok {
+			continue
+		}
+		id, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
@@ -0,0 +1,66 @@
+package internal
+
+import "testing"
+
+// TestWALDiscardsTornRecord checks that records appended after a failed
+// Append are replayed, not hidden behind the torn record it left.
+func TestWALDiscardsTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWAL(dir, 1<<20, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wal.Append(walEntry{Signal: SignalTraces, Tenant: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	// What a write cut short by a full disk leaves behind.
+	if _, err := wal.current.file.Write([]byte{0xff, 0x00, 0x00, 0x00, 0x01}); err != nil {
+		t.Fatal(err)
+	}
+	wal.discardTail(wal.current)
+	if _, err := wal.Append(walEntry{Signal: SignalTraces, Tenant: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err = OpenWAL(dir, 1<<20, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tenants []string
+	if _, err := wal.Replay(func(e walEntry) error {
+		tenants = append(tenants, e.Tenant)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(tenants) != 2 || tenants[0] != "a" || tenants[1] != "b" {
+		t.Errorf("replayed tenants %v, want [a b]", tenants)
+	}
+}
+
+// TestWALCommitRemovesSegments checks that committed segments are removed
+// and the log size is released.
+func TestWALCommitRemovesSegments(t *testing.T) {
+	wal, err := OpenWAL(t.TempDir(), 1, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	var ids []uint64
+	for i := 0; i < 3; i++ {
+		id, err := wal.Append(walEntry{Signal: SignalLogs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		wal.Commit(id)
+	}
+	if wal.total != 0 || len(wal.segments) != 1 {
+		t.Errorf("after committing everything: total %d, %d segments", wal.total, len(wal.segments))
+	}
+}
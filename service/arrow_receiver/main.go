@@ -1,44 +1,229 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 
 	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
 
 	"tonbo/arrow_receiver/internal"
 )
 
 func main() {
-	cfg := internal.LoadConfig()
-	internal.SetupLogger()
+	if len(os.Args) > 1 && os.Args[1] == "validate-config" {
+		os.Exit(validateConfig(os.Args[2:]))
+	}
+	cfg, err := internal.LoadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+		os.Exit(2)
+	}
+	internal.SetupLogger(cfg)
+	if cfg.ConfigFile != "" {
+		log.WithField("file", cfg.ConfigFile).Info("Configuration loaded")
+	}
 
 	db, err := internal.InitDB(cfg.DBPath)
 	if err != nil {
 		log.WithError(err).Fatal("failed to open DuckDB")
 	}
-	defer db.Close()
+	indexed, err := internal.NewLogIndex(cfg).Backfill(context.Background(), db)
+	if err != nil {
+		log.WithError(err).Fatal("failed to build the log search index")
+	}
+	if indexed > 0 {
+		log.WithField("records", indexed).Info("Indexed logs for search")
+	}
+	selfTracing, err := internal.StartSelfTracing(cfg, db)
+	if err != nil {
+		log.WithError(err).Fatal("failed to start self-tracing")
+	}
+
+	var wal *internal.WAL
+	if cfg.WALDir != "" {
+		wal, err = internal.OpenWAL(cfg.WALDir, cfg.WALSegmentBytes, cfg.WALMaxBytes)
+		if err != nil {
+			log.WithError(err).Fatal("failed to open WAL")
+		}
+		replayed, err := internal.ReplayWAL(cfg, db, wal)
+		if err != nil {
+			log.WithError(err).Fatal("failed to replay WAL")
+		}
+		log.WithFields(log.Fields{"dir": cfg.WALDir, "entries": replayed}).Info("WAL replayed")
+	}
+
+	tail := internal.NewLiveTail(cfg)
+	pipeline, err := internal.NewPipeline(cfg, db, wal, tail)
+	if err != nil {
+		log.WithError(err).Fatal("failed to start ingest pipeline")
+	}
+	retention := internal.NewRetention(db, cfg.Retention, cfg.RetentionInterval)
+	retention.Start()
+	tenants := internal.NewTenantResolver(cfg)
+	serverTLS, err := internal.NewServerTLS(cfg)
+	if err != nil {
+		log.WithError(err).Fatal("failed to load TLS certificates")
+	}
+	memory := internal.NewMemoryBudget(cfg.MemoryLimitBytes, cfg.MemoryWait)
+	health := internal.NewHealth(db, pipeline, cfg.HealthCheckInterval)
+	health.Start()
+	slots := internal.NewQuerySlots(cfg.QueryMaxConcurrent)
+	named, err := internal.LoadNamedQueries(cfg.NamedQueriesFile)
+	if err != nil {
+		log.WithError(err).Fatal("failed to load named queries")
+	}
+	var flightSQL *internal.FlightSQLServer
+	if cfg.FlightSQL {
+		flightSQL, err = internal.NewFlightSQLServer(cfg, db, slots, tenants)
+		if err != nil {
+			log.WithError(err).Fatal("failed to start Flight SQL server")
+		}
+	}
+	grpcServer, lis := internal.NewGRPCServer(cfg, pipeline, memory, health, flightSQL, tenants, serverTLS)
+	var flightServer *grpc.Server
+	if flightSQL != nil && cfg.FlightSQLPort != "" {
+		var flightLis net.Listener
+		flightServer, flightLis = internal.NewFlightSQLGRPCServer(cfg, flightSQL, serverTLS)
+		go func() {
+			log.WithField("port", cfg.FlightSQLPort).Info("Flight SQL server listening")
+			if err := flightServer.Serve(flightLis); err != nil {
+				log.WithError(err).Fatal("Flight SQL server failed")
+			}
+		}()
+	}
+
+	// Reload the configuration on SIGHUP
+	reloader := internal.NewReloader(cfg, os.Args[1:], pipeline, tenants, serverTLS, retention, selfTracing)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Info("Received SIGHUP, reloading configuration")
+			reloader.Reload()
+		}
+	}()
+	if cfg.ConfigWatchInterval > 0 {
+		go reloader.Watch(cfg.ConfigWatchInterval)
+	}
 
-	grpcServer, lis := internal.NewGRPCServer(cfg, db)
+	// Start HTTP server for queries
+	httpServer := internal.StartQueryAPIServer(cfg, db, health, slots, named, tail, tenants, serverTLS)
 
-	// Graceful shutdown
+	go func() {
+		log.WithFields(log.Fields{"port": cfg.GRPCPort}).Info("ArrowTracesService gRPC server listening")
+		if err := grpcServer.Serve(lis); err != nil {
+			log.WithError(err).Fatal("failed to serve")
+		}
+	}()
+
+	// Graceful shutdown; a second signal exits at once.
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
 	go func() {
 		<-quit
-		log.Info("Shutting down gRPC server...")
-		grpcServer.GracefulStop()
-		if lis != nil {
-			_ = lis.Close()
+		log.Error("Received a second signal, exiting without flushing")
+		os.Exit(1)
+	}()
+	grpcServers := []*grpc.Server{grpcServer}
+	if flightServer != nil {
+		grpcServers = append(grpcServers, flightServer)
+	}
+	os.Exit(shutdown(cfg, db, pipeline, health, retention, selfTracing, httpServer, grpcServers))
+}
+
+// shutdown stops accepting ingestion and queries, writes the queued batches
+// to DuckDB and checkpoints it within cfg.ShutdownTimeout. It returns the
+// exit code: 0 if every acked batch was stored, 1 if one was not or DuckDB
+// did not close cleanly. Acked batches left in the WAL are replayed on the
+// next start. Failing to write the last self-tracing spans only logs a
+// warning, since they describe the receiver rather than received data.
+func shutdown(cfg internal.Config, db *sql.DB, pipeline *internal.Pipeline, health *internal.Health, retention *internal.Retention, selfTracing *internal.SelfTracing, httpServer *http.Server, grpcServers []*grpc.Server) int {
+	log.WithField("timeout", cfg.ShutdownTimeout.String()).Info("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	health.Shutdown()
+	retention.Shutdown()
+
+	// Streams end once their batches are acked, which lets GracefulStop
+	// return. Queries and live tails finish meanwhile.
+	pipeline.Drain()
+	var stopped sync.WaitGroup
+	for _, server := range grpcServers {
+		stopped.Add(1)
+		go func() {
+			defer stopped.Done()
+			stopGRPC(ctx, server)
+		}()
+	}
+	stopped.Add(1)
+	go func() {
+		defer stopped.Done()
+		if err := httpServer.Shutdown(ctx); err != nil {
+			log.WithError(err).Warn("Closing HTTP connections that did not finish in time")
+			httpServer.Close()
 		}
 	}()
+	stopped.Wait()
 
-	// Start HTTP server for queries
-	go internal.StartQueryAPIServer(db)
+	if err := pipeline.Close(ctx); err != nil {
+		// The writer may still be using the database, so it is not closed.
+		log.WithError(err).Error("Error closing the ingest pipeline, acked batches may not be stored")
+		return 1
+	}
+	if err := selfTracing.Shutdown(ctx); err != nil {
+		log.WithError(err).Warn("Error writing the last self-tracing spans")
+	}
+	if err := internal.CloseDB(ctx, db); err != nil {
+		log.WithError(err).Error("Error closing DuckDB")
+		return 1
+	}
+	log.Info("Shutdown complete")
+	return 0
+}
 
-	log.WithFields(log.Fields{"port": cfg.GRPCPort}).Info("ArrowTracesService gRPC server listening")
-	if err := grpcServer.Serve(lis); err != nil {
-		log.WithError(err).Fatal("failed to serve")
+// stopGRPC stops the server gracefully, or forcibly once ctx ends. It does
+// not wait for forcibly stopped handlers, which wait for their acks.
+func stopGRPC(ctx context.Context, server *grpc.Server) {
+	done := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Warn("Cancelling gRPC streams that did not finish in time")
+		go server.Stop()
+	}
+}
+
+// validateConfig implements "validate-config [file] [flags]": it loads the
+// configuration the receiver would run with and reports whether it is valid.
+func validateConfig(args []string) int {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		args = append([]string{"--config", args[0]}, args[1:]...)
+	}
+	if _, err := internal.LoadConfig(args); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+		}
+		return 1
 	}
-}
\ No newline at end of file
+	fmt.Println("configuration is valid")
+	return 0
+}
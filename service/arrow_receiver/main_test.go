@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	arrowpb "github.com/open-telemetry/otel-arrow/api/experimental/arrow/v1"
+	arrowrecord "github.com/open-telemetry/otel-arrow/pkg/otel/arrow_record"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"tonbo/arrow_receiver/internal"
+)
+
+// testReceiver is the part of main a shutdown test needs.
+type testReceiver struct {
+	cfg        internal.Config
+	db         *sql.DB
+	pipeline   *internal.Pipeline
+	health     *internal.Health
+	retention  *internal.Retention
+	httpServer *http.Server
+	httpDone   chan error
+	grpcServer *grpc.Server
+	grpcAddr   string
+}
+
+func startTestReceiver(t *testing.T, dir string) *testReceiver {
+	t.Helper()
+	cfg, err := internal.LoadConfig([]string{
+		"--grpc-port", "127.0.0.1:0",
+		"--db-path", filepath.Join(dir, "traces.db"),
+		"--wal-dir", filepath.Join(dir, "wal"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ShutdownTimeout = 5 * time.Second
+	r := &testReceiver{cfg: cfg}
+	if r.db, err = internal.InitDB(cfg.DBPath); err != nil {
+		t.Fatal(err)
+	}
+	wal, err := internal.OpenWAL(cfg.WALDir, cfg.WALSegmentBytes, cfg.WALMaxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.pipeline, err = internal.NewPipeline(cfg, r.db, wal, internal.NewLiveTail(cfg)); err != nil {
+		t.Fatal(err)
+	}
+	r.retention = internal.NewRetention(r.db, cfg.Retention, cfg.RetentionInterval)
+	r.health = internal.NewHealth(r.db, r.pipeline, cfg.HealthCheckInterval)
+	memory := internal.NewMemoryBudget(cfg.MemoryLimitBytes, cfg.MemoryWait)
+	var lis net.Listener
+	r.grpcServer, lis = internal.NewGRPCServer(cfg, r.pipeline, memory, r.health, nil, internal.NewTenantResolver(cfg), nil)
+	r.grpcAddr = lis.Addr().String()
+	go r.grpcServer.Serve(lis)
+
+	httpLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.httpServer = &http.Server{Handler: http.NotFoundHandler()}
+	r.httpDone = make(chan error, 1)
+	go func() { r.httpDone <- r.httpServer.Serve(httpLis) }()
+	return r
+}
+
+func (r *testReceiver) shutdown() int {
+	return shutdown(r.cfg, r.db, r.pipeline, r.health, r.retention, nil, r.httpServer, []*grpc.Server{r.grpcServer})
+}
+
+// sendTraces sends one batch of n spans and returns its status.
+func (r *testReceiver) sendTraces(t *testing.T, n int) arrowpb.StatusCode {
+	t.Helper()
+	conn, err := grpc.NewClient(r.grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stream, err := arrowpb.NewArrowTracesServiceClient(conn).ArrowTraces(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	traces := ptrace.NewTraces()
+	spans := traces.ResourceSpans().AppendEmpty().ScopeSpans().AppendEmpty().Spans()
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		span := spans.AppendEmpty()
+		span.SetTraceID(pcommon.TraceID([16]byte{1}))
+		span.SetSpanID(pcommon.SpanID([8]byte{byte(i + 1)}))
+		span.SetName("op")
+		span.SetStartTimestamp(pcommon.NewTimestampFromTime(now))
+		span.SetEndTimestamp(pcommon.NewTimestampFromTime(now.Add(time.Millisecond)))
+	}
+	producer := arrowrecord.NewProducer()
+	defer producer.Close()
+	batch, err := producer.BatchArrowRecordsFromTraces(traces)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(batch); err != nil {
+		t.Fatal(err)
+	}
+	status, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.CloseSend()
+	return status.StatusCode
+}
+
+// walBytes is the size of the segments in the WAL directory.
+func walBytes(t *testing.T, dir string) int64 {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size int64
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		size += info.Size()
+	}
+	return size
+}
+
+// TestShutdownStoresAckedBatches checks that shutdown stops the servers,
+// stores the acked batches and closes DuckDB before reporting success.
+func TestShutdownStoresAckedBatches(t *testing.T) {
+	dir := t.TempDir()
+	r := startTestReceiver(t, dir)
+	if code := r.sendTraces(t, 5); code != arrowpb.StatusCode_OK {
+		t.Fatalf("batch acked with %s", code)
+	}
+	if code := r.shutdown(); code != 0 {
+		t.Fatalf("shutdown exit code %d, want 0", code)
+	}
+	select {
+	case err := <-r.httpDone:
+		if !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("HTTP server ended with %v", err)
+		}
+	default:
+		t.Error("HTTP server still serving after shutdown")
+	}
+	if err := r.db.Ping(); err == nil {
+		t.Error("DuckDB still open after shutdown")
+	}
+
+	db, err := internal.InitDB(r.cfg.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	wal, err := internal.OpenWAL(r.cfg.WALDir, r.cfg.WALSegmentBytes, r.cfg.WALMaxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	if n, err := internal.ReplayWAL(r.cfg, db, wal); err != nil || n != 0 {
+		t.Errorf("replayed %d WAL entries (%v), want none", n, err)
+	}
+	var spans int
+	if err := db.QueryRow("SELECT count(*) FROM traces").Scan(&spans); err != nil {
+		t.Fatal(err)
+	}
+	if spans != 5 {
+		t.Errorf("stored %d spans, want 5", spans)
+	}
+}
+
+// TestShutdownReportsUnstoredBatches checks that shutdown exits 1 when an
+// acked batch could not be inserted before the timeout, and that the batch
+// is kept in the WAL.
+func TestShutdownReportsUnstoredBatches(t *testing.T) {
+	dir := t.TempDir()
+	r := startTestReceiver(t, dir)
+	r.cfg.ShutdownTimeout = 500 * time.Millisecond
+	defer r.db.Close()
+	if _, err := r.db.Exec("ALTER TABLE traces RENAME TO traces_moved"); err != nil {
+		t.Fatal(err)
+	}
+	if code := r.sendTraces(t, 5); code != arrowpb.StatusCode_OK {
+		t.Fatalf("batch acked with %s", code)
+	}
+	if code := r.shutdown(); code != 1 {
+		t.Fatalf("shutdown exit code %d, want 1", code)
+	}
+	if walBytes(t, r.cfg.WALDir) == 0 {
+		t.Error("acked batch not kept in the WAL")
+	}
+}